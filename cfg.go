@@ -12,6 +12,12 @@ const (
 	DataLogLvl  = "data"
 )
 
+const (
+	InterceptConn   ConnAction = iota // intercept the connection (default)
+	PassthroughConn                   // relay the connection to the downstream without interception
+	RejectConn                        // close the connection
+)
+
 type (
 
 	// Cfg establishes methods used by ProxyServer to run and handle
@@ -24,6 +30,12 @@ type (
 	// - ConnInfoReceiver to receive notifications on when connections are started/ended
 	// - LogReceiver to handle LogRecord events
 	// - DataReceiver to handle data captured while dissecting connections
+	// - TimedDataReceiver to also receive the time data was captured
+	// - ConnLimiter to bound the number and rate of accepted connections
+	// - ConnFilter to pass through or reject connections before interception
+	// - LegacyHelloFilter to handle SSLv2 and SSLv3 hellos, which can't be intercepted
+	// - ResponderGetter to converse with victims of connections without a downstream
+	// - UpgraderGetter to intercept connections upgraded to TLS after exchanging cleartext
 	Cfg interface {
 		// GetProxyTLSConfig gets the tls config used by the proxy
 		// upon handshake detection.
@@ -66,9 +78,24 @@ type (
 		RecvConnStart(ConnInfo)
 		// RecvConnEnd receives connection information related to connections
 		// that have ended.
+		//
+		// Connections rejected before being handled are also sent to
+		// RecvConnEnd without a preceding call to RecvConnStart. The
+		// Rejected field indicates why the connection was rejected.
 		RecvConnEnd(ConnInfo)
 	}
 
+	// ConnLimiter allows implementors to bound the connections handled
+	// by ProxyServer.
+	//
+	// Limits are enforced as connections are accepted. Rejected connections
+	// are closed immediately and reported to LogReceiver and ConnInfoReceiver.
+	ConnLimiter interface {
+		// GetConnLimits returns the limits to enforce. It is called for
+		// each accepted connection, allowing limits to change at runtime.
+		GetConnLimits() ConnLimits
+	}
+
 	// Handshaker defines methods used to check the initial data sent by
 	// TCP clients to determine if they wish to speak TLS.
 	Handshaker interface {
@@ -83,6 +110,25 @@ type (
 		GetHandshakeLen() int
 	}
 
+	// ConnFilter allows implementors to decide how each connection is
+	// handled before TLS interception occurs, e.g., to keep interception
+	// within the scope of an engagement.
+	ConnFilter interface {
+		// FilterConn returns the ConnAction to take for the connection.
+		//
+		// hello is the ClientHello sent by the victim, which is nil when
+		// the victim did not initiate a TLS handshake or the ClientHello
+		// could not be parsed.
+		//
+		// PassthroughConn relays data between the victim and downstream
+		// without TLS interception or data capture. Connections without a
+		// downstream are rejected instead.
+		FilterConn(victim Addr, proxy Addr, downstream *Addr, hello *ClientHello) ConnAction
+	}
+
+	// ConnAction indicates how a connection is handled.
+	ConnAction int
+
 	// DataReceiver allows implementors to receive cleartext data
 	// passing through the proxy.
 	DataReceiver interface {
@@ -94,6 +140,17 @@ type (
 		RecvDownstreamData(ConnInfo, []byte)
 	}
 
+	// TimedDataReceiver is a DataReceiver that also receives the time
+	// data passed through the proxy. Data is delivered through a queue,
+	// so it may be received well after it was captured.
+	//
+	// Data is passed to these methods instead of those of DataReceiver.
+	TimedDataReceiver interface {
+		DataReceiver
+		RecvVictimDataAt(cI ConnInfo, captured time.Time, b []byte)
+		RecvDownstreamDataAt(cI ConnInfo, captured time.Time, b []byte)
+	}
+
 	// ProxyListenerAddr contains Addr information for a newly created
 	// ProxyServer.
 	ProxyListenerAddr struct {
@@ -110,14 +167,32 @@ type (
 
 	// ConnInfo adds connection information to LogRecord.
 	ConnInfo struct {
-		Time   time.Time `json:"time"`
-		Victim Addr      `json:"victim,omitempty"` // address of the victim
-		Proxy  Addr      `json:"proxy,omitempty"`  // address of the proxy
+		// ID uniquely identifies the connection within the process.
+		//
+		// Zero indicates that the record is not associated with a
+		// handled connection.
+		ID uint64 `json:"id,omitempty"`
+		// Control is the ID of the connection that announced this one,
+		// e.g., the FTP control connection of a data connection.
+		Control uint64    `json:"control,omitempty"`
+		Time    time.Time `json:"time"`
+		Victim  Addr      `json:"victim,omitempty"` // address of the victim
+		Proxy   Addr      `json:"proxy,omitempty"`  // address of the proxy
 		// Downstream address.
 		//
 		// Unlike Victim and Proxy, null values are supported to enable
 		// capture of initial traffic and then terminating the connection.
 		Downstream *Addr `json:"downstream"`
+		// TLS indicates that the proxy intercepted the connection using TLS.
+		TLS bool `json:"tls,omitempty"`
+		// SNI is the server name sent in the victim's TLS ClientHello.
+		SNI string `json:"sni,omitempty"`
+		// ALPN is the application protocol negotiated with the victim,
+		// e.g., h2, which matches the protocol selected by the downstream.
+		ALPN string `json:"alpn,omitempty"`
+		// Rejected indicates why a connection was rejected, e.g.,
+		// RejectMaxConns.
+		Rejected string `json:"rejected,omitempty"`
 	}
 
 	// Addr provides IP and Port fields for Addr,
@@ -172,6 +247,8 @@ func (cI *ConnInfo) fill(p *proxyConn) {
 	if cI.Time.IsZero() {
 		cI.Time = time.Now()
 	}
+	cI.ID = p.id
+	cI.Control = p.control
 	if p.proxyAddr != nil {
 		cI.Proxy = *p.proxyAddr
 	}
@@ -182,6 +259,12 @@ func (cI *ConnInfo) fill(p *proxyConn) {
 		v := *p.downstreamAddr
 		cI.Downstream = &v
 	}
+	cI.TLS = p.tls
+	if p.hello != nil {
+		cI.SNI = p.hello.ServerName
+	}
+	cI.ALPN = p.alpn
+	cI.Rejected = p.rejected
 	return
 }
 
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	gs "github.com/impostorkeanu/gosplit"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// sseKeepAlive is how often a comment is sent to event stream clients
+// to keep idle connections open.
+const sseKeepAlive = 15 * time.Second
+
+type (
+	// adminServer exposes a JSON api for inspecting and controlling the
+	// running listeners.
+	adminServer struct {
+		ls    *listenerSet
+		sh    *shared
+		token string // bearer token required of clients, if set
+		srv   *http.Server
+		stop  context.CancelFunc // ends event streams so that srv can shut down
+	}
+
+	// adminConn describes an active connection.
+	adminConn struct {
+		Listener     string `json:"listener"`
+		gs.ConnStats `json:",inline"`
+		Age          float64 `json:"age"` // seconds since the connection was accepted
+	}
+
+	// adminVictimMode is the body of PUT /api/victims/{ip}.
+	adminVictimMode struct {
+		Mode string `json:"mode"`
+	}
+
+	// adminError is returned when a request fails.
+	adminError struct {
+		Error string `json:"error"`
+	}
+)
+
+// newAdminServer initializes an adminServer that listens on addr.
+func newAdminServer(addr, token string, ls *listenerSet, sh *shared) *adminServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &adminServer{ls: ls, sh: sh, token: token, stop: cancel}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/conns", a.listConns)
+	mux.HandleFunc("DELETE /api/conns/{id}", a.killConn)
+	mux.HandleFunc("GET /api/victims", a.listVictims)
+	mux.HandleFunc("PUT /api/victims/{ip}", a.setVictim)
+	mux.HandleFunc("DELETE /api/victims/{ip}", a.removeVictim)
+	mux.HandleFunc("GET /api/events", a.streamEvents)
+
+	a.srv = &http.Server{
+		Addr:              addr,
+		Handler:           a.authenticate(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	return a
+}
+
+// start listening, returning once the socket is bound.
+//
+// The api exposes captured data and controls interception, so a token
+// is required unless it listens on a loopback address.
+func (a *adminServer) start() error {
+	if a.token == "" && !isLoopbackAddr(a.srv.Addr) {
+		return fmt.Errorf("an admin token is required to listen on %s, which is not a loopback address", a.srv.Addr)
+	}
+	l, err := net.Listen("tcp", a.srv.Addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", a.srv.Addr, err)
+	}
+	con.printf("Starting admin api on %s", a.srv.Addr)
+	go func() {
+		if err := a.srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			con.errorf("admin api stopped unexpectedly: %v", err)
+		}
+	}()
+	return nil
+}
+
+// shutdown ends event streams and stops the server.
+func (a *adminServer) shutdown(timeout time.Duration) error {
+	a.stop()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return a.srv.Shutdown(ctx)
+}
+
+// isLoopbackAddr determines if addr is a loopback address and port.
+// Addresses binding all interfaces and hostnames other than localhost
+// are not.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	} else if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// authenticate requires the bearer token when one is configured.
+func (a *adminServer) authenticate(next http.Handler) http.Handler {
+	if a.token == "" {
+		return next
+	}
+	want := []byte("Bearer " + a.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			writeJSON(w, http.StatusUnauthorized, adminError{"invalid or missing bearer token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listConns responds with the active connections of all listeners.
+func (a *adminServer) listConns(w http.ResponseWriter, _ *http.Request) {
+	now := time.Now()
+	conns := make([]adminConn, 0)
+	for name, srv := range a.ls.servers() {
+		for _, cs := range srv.Conns() {
+			conns = append(conns, adminConn{
+				Listener:  name,
+				ConnStats: cs,
+				Age:       now.Sub(cs.Time).Seconds(),
+			})
+		}
+	}
+	writeJSON(w, http.StatusOK, conns)
+}
+
+// killConn forcibly closes a connection.
+func (a *adminServer) killConn(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{"invalid connection id"})
+		return
+	}
+	for _, srv := range a.ls.servers() {
+		if srv.KillConn(id) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, adminError{"connection not found"})
+}
+
+// listVictims responds with the mode assigned to each victim.
+func (a *adminServer) listVictims(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, a.sh.overrides.modes())
+}
+
+// setVictim assigns a mode to a victim, which applies to connections
+// accepted afterward.
+func (a *adminServer) setVictim(w http.ResponseWriter, r *http.Request) {
+	ip, err := netip.ParseAddr(r.PathValue("ip"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{"invalid victim ip"})
+		return
+	}
+	var body adminVictimMode
+	if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{"invalid request body"})
+		return
+	}
+	action, err := parseMode(body.Mode)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{err.Error()})
+		return
+	}
+	a.sh.overrides.set(ip, action)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeVictim returns a victim to the mode determined by listener
+// filters.
+func (a *adminServer) removeVictim(w http.ResponseWriter, r *http.Request) {
+	ip, err := netip.ParseAddr(r.PathValue("ip"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{"invalid victim ip"})
+		return
+	}
+	if !a.sh.overrides.remove(ip) {
+		writeJSON(w, http.StatusNotFound, adminError{"victim has no assigned mode"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// streamEvents sends log, connection, and data events as Server-Sent
+// Events until the client disconnects.
+func (a *adminServer) streamEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	events, unsubscribe := a.sh.events.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case e := <-events:
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, e.Data)
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeJSON writes v as the response body.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		con.errorf("error writing admin api response: %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAdminServer_start(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		token   string
+		wantErr bool
+	}{
+		{name: "loopback", addr: "127.0.0.1:0"},
+		{name: "localhost", addr: "localhost:0"},
+		{name: "all interfaces", addr: ":0", wantErr: true},
+		{name: "unspecified ip", addr: "0.0.0.0:0", wantErr: true},
+		{name: "hostname", addr: "gosplit.test:0", wantErr: true},
+		{name: "all interfaces with token", addr: ":0", token: "s3cret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAdminServer(tt.addr, tt.token, newListenerSet(testShared(t)), testShared(t))
+			err := a.start()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("start() error = %v, wantErr %v", err, tt.wantErr)
+			} else if err != nil {
+				if !strings.Contains(err.Error(), "admin token is required") {
+					t.Errorf("start() error = %v, want a missing token error", err)
+				}
+				return
+			}
+			a.shutdown(0)
+		})
+	}
+}
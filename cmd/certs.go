@@ -0,0 +1,160 @@
+package main
+
+import (
+	"container/list"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	gs "github.com/impostorkeanu/gosplit"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// maxCachedCerts bounds the certificates cached by genCertSource, as
+// victims choose the server names they are generated for.
+const maxCachedCerts = 1024
+
+type (
+	// certSource provides the certificate presented to victims.
+	certSource interface {
+		// GetCertificate is suitable for use as tls.Config.GetCertificate.
+		GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	}
+
+	// staticCertSource presents the same certificate to all victims.
+	staticCertSource struct {
+		crt *tls.Certificate
+	}
+
+	// genCertSource generates self-signed certificates for each server
+	// name requested by victims, caching the most recently used for
+	// reuse.
+	genCertSource struct {
+		org       string
+		keys      *gs.RSAPrivKeyGenerator
+		maxCached int
+		m         sync.Mutex
+		cache     map[string]*list.Element // values are *cachedCert
+		lru       *list.List               // most recently used first
+		pending   map[string]*certCall     // certificates being generated
+		hits      atomic.Uint64            // certificates served from cache
+		misses    atomic.Uint64            // certificates generated
+	}
+
+	// cachedCert is an entry of genCertSource's cache.
+	cachedCert struct {
+		key string
+		crt *tls.Certificate
+	}
+
+	// certCall is a certificate being generated, which handshakes
+	// requesting the same name wait for instead of generating their own.
+	certCall struct {
+		done chan struct{} // closed once crt or err is set
+		crt  *tls.Certificate
+		err  error
+	}
+)
+
+// newStaticCertSource loads a PEM certificate and key from disk.
+func newStaticCertSource(crtFile, keyFile string) (*staticCertSource, error) {
+	crt, err := tls.LoadX509KeyPair(crtFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading x509 keypair: %w", err)
+	}
+	return &staticCertSource{crt: &crt}, nil
+}
+
+func (s *staticCertSource) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.crt, nil
+}
+
+// newGenCertSource starts a private key generator producing keys of
+// bitLen bits for generated certificates.
+func newGenCertSource(org string, bitLen int) (*genCertSource, error) {
+	s := &genCertSource{
+		org:       org,
+		keys:      new(gs.RSAPrivKeyGenerator),
+		maxCached: maxCachedCerts,
+		cache:     make(map[string]*list.Element),
+		lru:       list.New(),
+		pending:   make(map[string]*certCall),
+	}
+	if err := s.keys.Start(bitLen); err != nil {
+		return nil, fmt.Errorf("error while starting private key generator: %w", err)
+	}
+	return s, nil
+}
+
+// GetCertificate returns a certificate for the server name sent by the
+// victim, falling back to the local IP address the victim connected to
+// when no server name was sent.
+func (s *genCertSource) GetCertificate(hello *tls.ClientHelloInfo) (crt *tls.Certificate, err error) {
+
+	var (
+		names []string
+		ips   []net.IP
+		key   string
+	)
+	if hello.ServerName != "" {
+		key = hello.ServerName
+		names = []string{hello.ServerName}
+	} else if hello.Conn != nil {
+		if host, _, e := net.SplitHostPort(hello.Conn.LocalAddr().String()); e == nil {
+			if ip := net.ParseIP(host); ip != nil {
+				key = host
+				ips = []net.IP{ip}
+			}
+		}
+	}
+
+	s.m.Lock()
+	if e := s.cache[key]; e != nil {
+		s.lru.MoveToFront(e)
+		s.m.Unlock()
+		s.hits.Add(1)
+		return e.Value.(*cachedCert).crt, nil
+	} else if call := s.pending[key]; call != nil {
+		s.m.Unlock()
+		<-call.done
+		s.hits.Add(1)
+		return call.crt, call.err
+	}
+	call := &certCall{done: make(chan struct{})}
+	s.pending[key] = call
+	s.m.Unlock()
+	s.misses.Add(1)
+
+	// generate without holding the lock so that handshakes requesting
+	// other names aren't delayed
+	call.crt, call.err = s.generate(ips, names)
+	s.m.Lock()
+	delete(s.pending, key)
+	if call.err == nil {
+		s.cache[key] = s.lru.PushFront(&cachedCert{key: key, crt: call.crt})
+		for s.lru.Len() > s.maxCached {
+			delete(s.cache, s.lru.Remove(s.lru.Back()).(*cachedCert).key)
+		}
+	}
+	s.m.Unlock()
+	close(call.done)
+	return call.crt, call.err
+}
+
+// generate a certificate for the IPs and server names.
+func (s *genCertSource) generate(ips []net.IP, names []string) (*tls.Certificate, error) {
+	pK := s.keys.Generate()
+	if pK == nil {
+		return nil, errors.New("private key generator is stopped")
+	} else if pK.Err() != nil {
+		return nil, fmt.Errorf("error while generating private key: %w", pK.Err())
+	}
+	return gs.GenSelfSignedCert(pkix.Name{Organization: []string{s.org}}, ips, names, pK)
+}
+
+// stop the private key generator.
+func (s *genCertSource) stop() {
+	s.keys.Stop()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/tls"
+	"sync"
+	"testing"
+)
+
+func TestGenCertSource_GetCertificate(t *testing.T) {
+	s, err := newGenCertSource("test", 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stop()
+	s.maxCached = 2
+	get := func(name string) *tls.Certificate {
+		crt, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatalf("GetCertificate(%s) error = %v", name, err)
+		} else if crt.Leaf.DNSNames[0] != name {
+			t.Fatalf("GetCertificate(%s) generated a certificate for %v", name, crt.Leaf.DNSNames)
+		}
+		return crt
+	}
+
+	// concurrent handshakes for the same name share one certificate
+	var (
+		wg   sync.WaitGroup
+		crts [8]*tls.Certificate
+	)
+	for i := range crts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			crts[i] = get("a.test")
+		}()
+	}
+	wg.Wait()
+	for _, crt := range crts[1:] {
+		if crt != crts[0] {
+			t.Fatal("concurrent requests for a name generated multiple certificates")
+		}
+	}
+	if got := s.misses.Load(); got != 1 {
+		t.Errorf("misses = %d, want 1", got)
+	}
+
+	// the least recently used certificate is evicted
+	get("b.test")
+	if get("a.test") != crts[0] {
+		t.Error("recently used certificate was not cached")
+	}
+	get("c.test")
+	if s.lru.Len() != 2 || s.cache["b.test"] != nil {
+		t.Errorf("cached %d certificates including b.test = %v, want 2 excluding it", s.lru.Len(), s.cache["b.test"] != nil)
+	}
+	if get("a.test") != crts[0] {
+		t.Error("recently used certificate was evicted")
+	}
+	if got := s.misses.Load(); got != 3 {
+		t.Errorf("misses = %d, want 3", got)
+	}
+}
@@ -5,8 +5,12 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	gs "github.com/impostorkeanu/gosplit"
 	"io"
+	"net/netip"
+	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -17,101 +21,305 @@ const (
 type (
 	// config implements gs.Cfg.
 	config struct {
-		proxyIP          string           // local ip the proxy server will bind to
-		proxyPort        string           // local port the proxy server will bind to
-		downstreamIP     string           // downstream ip the proxy server connects to
-		downstreamPort   string           // downstream port the proxy server connects to
-		dataToLog        bool             // send data events to logWriter AND dataWriter
-		logWriter        io.Writer        // writer for logs
-		dataWriter       io.Writer        // writer for data
-		nssWriter        io.Writer        // key log writer for tls dissection
-		proxyCrt         *tls.Certificate // certificate presented by the proxy server
-		downstreamTlsCfg *tls.Config      // tls config used to connect to the downstream
+		name             string               // name of the listener, included in log records
+		downstream       *gs.Addr             // downstream for victims not matching a route; nil captures initial data
+		routes           []route              // victim-specific downstreams
+		dataToLog        bool                 // send data events to logWriter AND dataWriter
+		logWriter        io.Writer            // writer for logs
+		dataWriter       io.Writer            // writer for data
+		nssWriter        io.Writer            // key log writer for tls dissection
+		certs            certSource           // certificates presented by the proxy server
+		minVersion       uint16               // minimum tls version offered to victims
+		maxVersion       uint16               // maximum tls version offered to victims
+		legacyPolicy     gs.LegacyHelloPolicy // action taken for victims sending sslv2 or sslv3 hellos
+		downstreamTlsCfg *tls.Config          // tls config used to connect to the downstream
+		connLimits       gs.ConnLimits        // limits enforced on accepted connections
+		filter           *connFilter          // decides which connections are intercepted
+		overrides        *victimOverrides     // per-victim actions set through the admin api
+		events           *eventHub            // receives records for the admin api's event stream
+		responder        gs.Responder         // converses with victims when there is no downstream; may be nil
+		creds            *gs.CredExtractor    // extracts credentials from data; may be nil
+		http             *gs.HTTPParser       // reassembles http exchanges from data; may be nil
+		ldap             *gs.LDAPDecoder      // decodes ldap messages from data; may be nil
+		upgrader         gs.Upgrader          // negotiates tls upgrades with downstreams; may be nil
+		outputs          []string             // names of the shared output files opened for the listener
+	}
+
+	// logRecord adds the listener name to gs.LogRecord.
+	logRecord struct {
+		Listener     string `json:"listener,omitempty"`
+		gs.LogRecord `json:",inline"`
+	}
+
+	// connRecord adds the listener name to gs.ConnInfo.
+	connRecord struct {
+		Listener    string `json:"listener,omitempty"`
+		gs.ConnInfo `json:",inline"`
+	}
+
+	// ldapRecord adds the listener name to gs.LDAPMessage.
+	ldapRecord struct {
+		Listener       string `json:"listener,omitempty"`
+		gs.LDAPMessage `json:",inline"`
+	}
+
+	// credRecord adds the listener name to gs.Credential.
+	credRecord struct {
+		Listener      string `json:"listener,omitempty"`
+		gs.Credential `json:",inline"`
+	}
+
+	// webSocketRecord describes a gs.WebSocketMessage. Text messages
+	// are written as text and others are base64 encoded.
+	webSocketRecord struct {
+		Listener    string    `json:"listener,omitempty"`
+		Sender      string    `json:"sender"`
+		Type        string    `json:"type"`
+		Text        string    `json:"text,omitempty"`
+		Data        []byte    `json:"data,omitempty"`
+		Compressed  bool      `json:"compressed,omitempty"`
+		Captured    time.Time `json:"captured"`
+		gs.ConnInfo `json:",inline"`
 	}
 
 	dataLog struct {
-		Level       string `json:"level,omitempty"`
-		Sender      string `json:"sender"`
-		Data        string `json:"data"`
+		Level    string `json:"level,omitempty"`
+		Listener string `json:"listener,omitempty"`
+		Sender   string `json:"sender"`
+		Data     string `json:"data"`
+		// Captured is when the data passed through the proxy, allowing
+		// the timing of conversations to be replayed.
+		Captured    time.Time `json:"captured"`
 		gs.ConnInfo `json:",inline"`
 	}
 )
 
 func (c config) GetProxyTLSConfig(_ gs.Addr, _ gs.Addr, _ *gs.Addr) (*tls.Config, error) {
-	// TODO enhance this method to generate the certificate dynamically
-	//  - generated certificates should be cached for reuse
-	if c.proxyCrt == nil {
-		return nil, errors.New("proxyCrt is nil")
+	if c.certs == nil {
+		return nil, errors.New("certs is nil")
 	}
-	return &tls.Config{InsecureSkipVerify: true, KeyLogWriter: c.nssWriter,
-		Certificates: []tls.Certificate{*c.proxyCrt}}, nil
+	return &tls.Config{KeyLogWriter: c.nssWriter, GetCertificate: c.certs.GetCertificate,
+		MinVersion: c.minVersion, MaxVersion: c.maxVersion}, nil
 }
 
 func (c config) GetDownstreamTLSConfig(_ gs.Addr, _ gs.Addr, _ gs.Addr) (*tls.Config, error) {
 	return c.downstreamTlsCfg, nil
 }
 
-func (c config) GetDownstreamAddr(_ gs.Addr, _ gs.Addr) (*gs.Addr, error) {
-	return &gs.Addr{
-		IP:   c.downstreamIP,
-		Port: c.downstreamPort,
-	}, nil
+// GetDownstreamAddr returns the downstream of the first route matching
+// the victim, falling back to the default downstream.
+func (c config) GetDownstreamAddr(victim gs.Addr, _ gs.Addr) (*gs.Addr, error) {
+	if len(c.routes) > 0 {
+		if ip, err := netip.ParseAddr(victim.IP); err == nil {
+			for _, r := range c.routes {
+				if containsAddr(r.victims, ip.Unmap()) {
+					a := r.downstream
+					return &a, nil
+				}
+			}
+		}
+	}
+	if c.downstream == nil {
+		return nil, nil
+	}
+	a := *c.downstream
+	return &a, nil
+}
+
+// stop releases resources held by the config.
+func (c config) stop() {
+	if g, ok := c.certs.(*genCertSource); ok {
+		g.stop()
+	}
+}
+
+func (c config) GetConnLimits() gs.ConnLimits {
+	return c.connLimits
+}
+
+// FilterConn applies victim overrides before the listener's filter.
+func (c config) FilterConn(victim gs.Addr, proxy gs.Addr, downstream *gs.Addr, hello *gs.ClientHello) gs.ConnAction {
+	if a, ok := c.overrides.get(victim.IP); ok {
+		return a
+	}
+	return c.filter.FilterConn(victim, proxy, downstream, hello)
+}
+
+// FilterLegacyHello returns the listener's policy for legacy hellos.
+func (c config) FilterLegacyHello(_ gs.Addr, _ gs.Addr, _ *gs.Addr, _ *gs.LegacyHello) gs.LegacyHelloPolicy {
+	return c.legacyPolicy
+}
+
+// GetResponder returns the responder configured for the listener, if
+// any.
+func (c config) GetResponder(_ gs.Addr, _ gs.Addr) gs.Responder {
+	return c.responder
+}
+
+// GetUpgrader returns the upgrader configured for the listener, if any.
+func (c config) GetUpgrader(_ gs.Addr, _ gs.Addr, _ gs.Addr) gs.Upgrader {
+	return c.upgrader
+}
+
+func (c config) RecvConnStart(cI gs.ConnInfo) {
+	c.events.publish(connStartEvent, connRecord{Listener: c.name, ConnInfo: cI})
+}
+
+func (c config) RecvConnEnd(cI gs.ConnInfo) {
+	if c.creds != nil {
+		c.creds.RecvConnEnd(cI)
+	}
+	if c.http != nil {
+		c.http.RecvConnEnd(cI)
+	}
+	if c.ldap != nil {
+		c.ldap.RecvConnEnd(cI)
+	}
+	c.events.publish(connEndEvent, connRecord{Listener: c.name, ConnInfo: cI})
 }
 
 func (c config) RecvLog(fields gs.LogRecord) {
 	// marshal the log record and write to logWriter
-	if b, err := json.Marshal(fields); err != nil {
-		println("error marshaling log record: ", err.Error())
+	r := logRecord{Listener: c.name, LogRecord: fields}
+	c.events.publish(logEvent, r)
+	if b, err := json.Marshal(r); err != nil {
+		con.errorf("error marshaling log record: %v", err)
 	} else if _, err = c.logWriter.Write(b); err != nil {
-		println("error writing log record: ", err.Error())
+		con.errorf("error writing log record: %v", err)
 	}
 }
 
 func (c config) RecvVictimData(cI gs.ConnInfo, b []byte) {
+	c.RecvVictimDataAt(cI, time.Now(), b)
+}
+
+func (c config) RecvDownstreamData(cI gs.ConnInfo, b []byte) {
+	c.RecvDownstreamDataAt(cI, time.Now(), b)
+}
+
+func (c config) RecvVictimDataAt(cI gs.ConnInfo, captured time.Time, b []byte) {
+	if c.creds != nil {
+		c.creds.RecvVictimData(cI, b)
+	}
+	if c.http != nil {
+		c.http.RecvVictimDataAt(cI, captured, b)
+	}
+	if c.ldap != nil {
+		c.ldap.RecvVictimDataAt(cI, captured, b)
+	}
 	if c.dataWriter == nil {
 		return
 	}
-	c.writeDataLog(victimDataSender, b, cI)
+	c.writeDataLog(victimDataSender, b, cI, captured)
 }
 
-func (c config) RecvDownstreamData(cI gs.ConnInfo, b []byte) {
+func (c config) RecvDownstreamDataAt(cI gs.ConnInfo, captured time.Time, b []byte) {
+	if c.creds != nil {
+		c.creds.RecvDownstreamData(cI, b)
+	}
+	if c.http != nil {
+		c.http.RecvDownstreamDataAt(cI, captured, b)
+	}
+	if c.ldap != nil {
+		c.ldap.RecvDownstreamDataAt(cI, captured, b)
+	}
 	if c.dataWriter == nil {
 		return
 	}
-	c.writeDataLog(downstreamDataSender, b, cI)
+	c.writeDataLog(downstreamDataSender, b, cI, captured)
 }
 
 // writeDataLog writes data extracted through proxying to dataWriter and
 // optionally the logWriter.
-func (c config) writeDataLog(sender string, b []byte, cI gs.ConnInfo) {
+func (c config) writeDataLog(sender string, b []byte, cI gs.ConnInfo, captured time.Time) {
 
 	// construct the dataLog
 	dL := dataLog{
+		Listener: c.name,
 		Sender:   sender,
 		ConnInfo: cI,
 		Data:     base64.StdEncoding.EncodeToString(b),
+		Captured: captured,
 	}
+	c.events.publish(dataEvent, dL)
 
 	// marshal the dataLog and write to the data writer
 	var err error
 	if b, err = json.Marshal(dL); err != nil {
-		println("error marshaling data log record: ", err.Error())
+		con.errorf("error marshaling data log record: %v", err)
 	} else if _, err = c.dataWriter.Write(b); err != nil {
-		println("error writing data log record: ", err.Error())
+		con.errorf("error writing data log record: %v", err)
 	}
 
 	if c.dataToLog {
 		dL.Level = gs.DataLogLvl
 		if b, err = json.Marshal(dL); err != nil {
-			println("error marshaling data log record: ", err.Error())
+			con.errorf("error marshaling data log record: %v", err)
 		} else if _, err = c.logWriter.Write(b); err != nil {
-			println("error writing data log record: ", err.Error())
+			con.errorf("error writing data log record: %v", err)
+		}
+	}
+}
+
+// credReceiver returns a function that logs credentials extracted by
+// c.creds, writing them to credsW and their hashes to hashesW. Either
+// writer may be nil.
+func (c config) credReceiver(credsW, hashesW io.Writer) func(gs.Credential) {
+	return func(cred gs.Credential) {
+		user := cred.Username
+		if cred.Domain != "" {
+			user = cred.Domain + `\` + user
+		}
+		c.RecvLog(gs.LogRecord{
+			Level:    gs.InfoLogLvl,
+			Msg:      fmt.Sprintf("extracted %s %s credential for %s", cred.Protocol, cred.Type, user),
+			ConnInfo: cred.ConnInfo,
+		})
+		if credsW != nil {
+			if b, err := json.Marshal(credRecord{Listener: c.name, Credential: cred}); err != nil {
+				con.errorf("error marshaling credential record: %v", err)
+			} else if _, err = credsW.Write(b); err != nil {
+				con.errorf("error writing credential record: %v", err)
+			}
+		}
+		if hashesW != nil && cred.Hash != "" {
+			if _, err := io.WriteString(hashesW, cred.Hash); err != nil {
+				con.errorf("error writing credential hash: %v", err)
+			}
 		}
 	}
 }
 
-func (c *config) closeWriters() {
-	closeWriter(c.logWriter)
-	closeWriter(c.dataWriter)
-	closeWriter(c.nssWriter)
+// webSocketReceiver returns a function that writes websocket messages
+// decoded by c.http to w.
+func (c config) webSocketReceiver(w io.Writer) func(gs.WebSocketMessage) {
+	return func(m gs.WebSocketMessage) {
+		r := webSocketRecord{Listener: c.name, Sender: downstreamDataSender, Type: m.Opcode.String(),
+			Compressed: m.Compressed, Captured: m.Time, ConnInfo: m.ConnInfo}
+		if m.Victim {
+			r.Sender = victimDataSender
+		}
+		if m.Opcode == gs.WebSocketText && utf8.Valid(m.Data) {
+			r.Text = string(m.Data)
+		} else {
+			r.Data = m.Data
+		}
+		if b, err := json.Marshal(r); err != nil {
+			con.errorf("error marshaling websocket record: %v", err)
+		} else if _, err = w.Write(b); err != nil {
+			con.errorf("error writing websocket record: %v", err)
+		}
+	}
+}
+
+// ldapReceiver returns a function that writes ldap messages decoded by
+// c.ldap to w.
+func (c config) ldapReceiver(w io.Writer) func(gs.LDAPMessage) {
+	return func(m gs.LDAPMessage) {
+		if b, err := json.Marshal(ldapRecord{Listener: c.name, LDAPMessage: m}); err != nil {
+			con.errorf("error marshaling ldap record: %v", err)
+		} else if _, err = w.Write(b); err != nil {
+			con.errorf("error writing ldap record: %v", err)
+		}
+	}
 }
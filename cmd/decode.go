@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	textDecodeFormat = "text"
+	hexDecodeFormat  = "hex"
+	noneDecodeFormat = "none"
+)
+
+var (
+	decodeCmd = &cobra.Command{
+		Use:   "decode <data-log-file>...",
+		Short: "Decode conversations captured in data logs",
+		Long: "Decode conversations captured in data logs written by the run command.\n\n" +
+			"Conversations are printed as text or hex dumps, and they can be reassembled\n" +
+			"into files for each direction of each connection or written to a pcap.\n" +
+			"Log files written with --data-to-log are also accepted. Supply - to read\n" +
+			"from stdin.",
+		Args: cobra.MinimumNArgs(1),
+		Run:  runDecode,
+		Example: `
+gosplit decode data.json
+
+gosplit decode --format hex --victim 10.0.0.0/24 --since 2024-01-02T15:04:05Z data.json
+
+gosplit decode --conn https-42 data.json
+
+gosplit decode --format none --out-dir streams --pcap data.pcap data.json`,
+	}
+
+	decodeFormat     string   // format of conversations printed to stdout
+	decodeOutDir     string   // directory receiving per-direction stream files
+	decodePcap       string   // pcap file receiving reassembled streams
+	decodeConns      []string // names of connections to decode
+	decodeVictims    []string // victim ips and cidrs to decode
+	decodeDownstream []string // downstream ips and cidrs to decode
+	decodeListeners  []string // listener names to decode
+	decodeSince      string   // decode connections made at or after this time
+	decodeUntil      string   // decode connections made before this time
+)
+
+type (
+	// decodeFilter selects connections to decode.
+	//
+	// Empty fields match all connections.
+	decodeFilter struct {
+		conns      []string // session names
+		victims    []netip.Prefix
+		downstream []netip.Prefix
+		listeners  []string
+		since      time.Time
+		until      time.Time
+	}
+)
+
+func init() {
+	decodeCmd.Flags().StringVar(&decodeFormat, "format", textDecodeFormat,
+		"Format of conversations printed to stdout: text, hex, or none")
+	decodeCmd.Flags().StringVar(&decodeOutDir, "out-dir", "",
+		"Directory to write the data sent by each side of each connection to")
+	decodeCmd.Flags().StringVar(&decodePcap, "pcap", "",
+		"File to write conversations to as a pcap of synthesized TCP packets")
+	addDecodeFilterFlags(decodeCmd)
+}
+
+// addDecodeFilterFlags adds flags that select connections from data logs.
+func addDecodeFilterFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVar(&decodeConns, "conn", nil,
+		"Name of connection to select, as printed by the decode command, e.g., https-42")
+	cmd.Flags().StringSliceVar(&decodeVictims, "victim", nil,
+		"Victim IP or CIDR to select (@file to read from a file)")
+	cmd.Flags().StringSliceVar(&decodeDownstream, "downstream", nil,
+		"Downstream IP or CIDR to select (@file to read from a file)")
+	cmd.Flags().StringSliceVar(&decodeListeners, "listener", nil,
+		"Name of listener to select")
+	cmd.Flags().StringVar(&decodeSince, "since", "",
+		"Select connections made at or after this RFC3339 time")
+	cmd.Flags().StringVar(&decodeUntil, "until", "",
+		"Select connections made before this RFC3339 time")
+}
+
+func runDecode(_ *cobra.Command, args []string) {
+	switch decodeFormat {
+	case textDecodeFormat, hexDecodeFormat, noneDecodeFormat:
+	default:
+		prExit(fmt.Errorf("unknown format: %s", decodeFormat), "error while parsing flags")
+	}
+	f, err := newDecodeFilter()
+	prExit(err, "error while parsing filters")
+
+	var sessions []*session
+	for _, name := range args {
+		s, err := readSessionsFile(name, f)
+		prExit(err, "error while reading data log")
+		sessions = append(sessions, s...)
+	}
+
+	if decodeFormat != noneDecodeFormat {
+		w := bufio.NewWriter(os.Stdout)
+		for _, sess := range sessions {
+			writeConversation(w, sess, decodeFormat == hexDecodeFormat)
+		}
+		prExit(w.Flush(), "error while writing conversations")
+	}
+	if decodeOutDir != "" {
+		prExit(writeStreamFiles(decodeOutDir, sessions), "error while writing stream files")
+	}
+	if decodePcap != "" {
+		prExit(writePcapFile(decodePcap, sessions), "error while writing pcap")
+	}
+}
+
+// newDecodeFilter initializes a decodeFilter from flag values.
+func newDecodeFilter() (f decodeFilter, err error) {
+	if f.victims, err = parsePrefixes(decodeVictims); err != nil {
+		return
+	} else if f.downstream, err = parsePrefixes(decodeDownstream); err != nil {
+		return
+	}
+	f.conns, f.listeners = decodeConns, decodeListeners
+	if decodeSince != "" {
+		if f.since, err = time.Parse(time.RFC3339, decodeSince); err != nil {
+			return f, fmt.Errorf("invalid --since time: %w", err)
+		}
+	}
+	if decodeUntil != "" {
+		if f.until, err = time.Parse(time.RFC3339, decodeUntil); err != nil {
+			return f, fmt.Errorf("invalid --until time: %w", err)
+		}
+	}
+	return
+}
+
+// match determines if a data record belongs to a connection selected
+// by the filter.
+func (f decodeFilter) match(dL *dataLog) bool {
+	if len(f.listeners) > 0 && !slices.Contains(f.listeners, dL.Listener) {
+		return false
+	} else if !f.since.IsZero() && dL.Time.Before(f.since) {
+		return false
+	} else if !f.until.IsZero() && !dL.Time.Before(f.until) {
+		return false
+	} else if len(f.victims) > 0 && !prefixesContain(f.victims, dL.Victim.IP) {
+		return false
+	} else if len(f.downstream) > 0 && (dL.Downstream == nil || !prefixesContain(f.downstream, dL.Downstream.IP)) {
+		return false
+	}
+	return true
+}
+
+// prefixesContain determines if any prefix contains the IP address ip.
+func prefixesContain(prefixes []netip.Prefix, ip string) bool {
+	a, err := netip.ParseAddr(ip)
+	return err == nil && containsAddr(prefixes, a.Unmap())
+}
+
+// readSessionsFile reads the sessions recorded in a data log, with "-"
+// indicating stdin.
+func readSessionsFile(name string, f decodeFilter) ([]*session, error) {
+	if name == "-" {
+		return readSessions(os.Stdin, f)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readSessions(file, f)
+}
+
+// readSessions groups the data records read from r into sessions,
+// ordered by when they were first seen.
+//
+// Unlike sessionStore, all data is retained and chunks are not merged.
+func readSessions(r io.Reader, f decodeFilter) (sessions []*session, err error) {
+	byKey := make(map[string]*session)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		var dL dataLog
+		if err = json.Unmarshal(line, &dL); err != nil {
+			return nil, fmt.Errorf("error parsing record on line %d: %w", n, err)
+		} else if dL.Sender == "" || !f.match(&dL) {
+			// not a data record, e.g., a log record
+			continue
+		}
+		var b []byte
+		if b, err = base64.StdEncoding.DecodeString(dL.Data); err != nil {
+			return nil, fmt.Errorf("error decoding data on line %d: %w", n, err)
+		}
+		key := sessionKey(dL.Listener, dL.ConnInfo)
+		sess := byKey[key]
+		if sess == nil {
+			sess = &session{key: key, info: dL.ConnInfo, listener: dL.Listener, ended: true}
+			byKey[key] = sess
+			sessions = append(sessions, sess)
+		} else if dL.Downstream != nil {
+			sess.info.Downstream = dL.Downstream
+		}
+		c := chunk{victim: dL.Sender == victimDataSender, captured: dL.Captured, data: b}
+		if c.victim {
+			sess.victimBytes += int64(len(b))
+		} else {
+			sess.downstreamBytes += int64(len(b))
+		}
+		sess.chunks = append(sess.chunks, c)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading records: %w", err)
+	}
+	if len(f.conns) > 0 {
+		sessions = slices.DeleteFunc(sessions, func(sess *session) bool {
+			return !slices.Contains(f.conns, sessionName(sess))
+		})
+	}
+	return
+}
+
+// writeConversation writes the data exchanged through a session as text
+// or a hex dump.
+func writeConversation(w io.Writer, sess *session, hexDump bool) {
+	fmt.Fprintf(w, "=== %s %s -> %s", sessionName(sess),
+		addrString(sess.info.Victim.IP, sess.info.Victim.Port), downstreamString(sess))
+	if sess.info.Control != 0 {
+		fmt.Fprintf(w, " control=%d", sess.info.Control)
+	}
+	if sess.info.SNI != "" {
+		fmt.Fprintf(w, " sni=%s", sess.info.SNI)
+	}
+	if sess.info.ALPN != "" {
+		fmt.Fprintf(w, " alpn=%s", sess.info.ALPN)
+	}
+	fmt.Fprintf(w, " time=%s\n", sess.info.Time.Format(time.RFC3339Nano))
+	for _, c := range sess.chunks {
+		if c.victim {
+			fmt.Fprintf(w, ">> victim (%d bytes)\n", len(c.data))
+		} else {
+			fmt.Fprintf(w, "<< downstream (%d bytes)\n", len(c.data))
+		}
+		if hexDump {
+			io.WriteString(w, hex.Dump(c.data))
+		} else if s := printable(c.data); strings.HasSuffix(s, "\n") {
+			io.WriteString(w, s)
+		} else {
+			io.WriteString(w, s+"\n")
+		}
+	}
+	io.WriteString(w, "\n")
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// sessionName returns a name for a session that is safe to use in file
+// names, e.g., "https-42".
+func sessionName(sess *session) string {
+	var name string
+	if sess.info.ID != 0 {
+		name = fmt.Sprintf("%s-%d", sess.listener, sess.info.ID)
+	} else {
+		name = fmt.Sprintf("%s-%s-%s-%s", sess.listener, sess.info.Time.UTC().Format("20060102T150405.000000000"),
+			sess.info.Victim.IP, sess.info.Victim.Port)
+	}
+	return strings.Trim(unsafeFileChars.ReplaceAllString(name, "_"), "_-")
+}
+
+// writeStreamFiles writes the data sent by the victim and downstream of
+// each session to <name>.victim and <name>.downstream files in dir.
+func writeStreamFiles(dir string, sessions []*session) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, sess := range sessions {
+		var victim, downstream []byte
+		for _, c := range sess.chunks {
+			if c.victim {
+				victim = append(victim, c.data...)
+			} else {
+				downstream = append(downstream, c.data...)
+			}
+		}
+		name := filepath.Join(dir, sessionName(sess))
+		err := errors.Join(
+			os.WriteFile(name+"."+victimDataSender, victim, 0600),
+			os.WriteFile(name+"."+downstreamDataSender, downstream, 0600))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	gs "github.com/impostorkeanu/gosplit"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDecodeLog returns a data log containing two connections to https
+// and one to ftp, interleaved with a log record.
+func testDecodeLog(t *testing.T) string {
+	t0 := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	record := func(listener string, id uint64, victim string, at time.Time, sender, data string) dataLog {
+		dL := testDataLog(id, sender, data)
+		dL.Listener, dL.Victim.IP, dL.Time = listener, victim, at
+		dL.Downstream = &gs.Addr{IP: "192.168.1.10", Port: "443"}
+		return dL
+	}
+	var b strings.Builder
+	for _, v := range []any{
+		record("https", 1, "10.0.0.5", t0, victimDataSender, "GET / HTTP/1.1\r\n\r\n"),
+		logRecord{Listener: "https"},
+		record("ftp", 2, "10.0.1.5", t0.Add(time.Minute), victimDataSender, "USER bob\r\n"),
+		record("https", 1, "10.0.0.5", t0, downstreamDataSender, "HTTP/1.1 200 OK\r\n\r\n"),
+		record("https", 3, "10.0.0.6", t0.Add(time.Hour), victimDataSender, "\x00\x01"),
+	} {
+		line, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Write(line)
+		b.WriteString("\n\n")
+	}
+	return b.String()
+}
+
+func TestReadSessions(t *testing.T) {
+	t0 := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name   string
+		filter decodeFilter
+		want   []string // session names
+	}{
+		{name: "all", want: []string{"https-1", "ftp-2", "https-3"}},
+		{name: "listener", filter: decodeFilter{listeners: []string{"https"}}, want: []string{"https-1", "https-3"}},
+		{name: "victim", filter: decodeFilter{victims: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}},
+			want: []string{"https-1", "https-3"}},
+		{name: "downstream", filter: decodeFilter{downstream: []netip.Prefix{netip.MustParsePrefix("172.16.0.0/12")}}},
+		{name: "since and until", filter: decodeFilter{since: t0.Add(time.Minute), until: t0.Add(time.Hour)},
+			want: []string{"ftp-2"}},
+		{name: "conn", filter: decodeFilter{conns: []string{"https-3", "https-9"}}, want: []string{"https-3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessions, err := readSessions(strings.NewReader(testDecodeLog(t)), tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, sess := range sessions {
+				got = append(got, sessionName(sess))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("readSessions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	sessions, err := readSessions(strings.NewReader(testDecodeLog(t)), decodeFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// chunks are not merged and all data is retained
+	if sess := sessions[0]; len(sess.chunks) != 2 || sess.victimBytes != 18 || sess.downstreamBytes != 19 {
+		t.Errorf("https-1 has %d chunks and %d/%d bytes, want 2 chunks and 18/19 bytes",
+			len(sess.chunks), sess.victimBytes, sess.downstreamBytes)
+	}
+
+	for name, in := range map[string]string{
+		"malformed record": "{\n",
+		"malformed data":   `{"sender":"victim","data":"!"}`,
+	} {
+		if _, err = readSessions(strings.NewReader(in), decodeFilter{}); err == nil {
+			t.Errorf("readSessions() accepted a %s", name)
+		}
+	}
+}
+
+func TestSessionName(t *testing.T) {
+	t0 := time.Date(2024, 1, 2, 15, 4, 5, 6, time.UTC)
+	tests := []struct {
+		name string
+		sess session
+		want string
+	}{
+		{name: "id", sess: session{listener: "https", info: gs.ConnInfo{ID: 42}}, want: "https-42"},
+		{name: "legacy record", sess: session{listener: "https",
+			info: gs.ConnInfo{Time: t0, Victim: gs.Addr{IP: "::1", Port: "5000"}}},
+			want: "https-20240102T150405.000000006-_1-5000"},
+		{name: "unsafe listener", sess: session{listener: "../a b", info: gs.ConnInfo{ID: 1}}, want: ".._a_b-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sessionName(&tt.sess); got != tt.want {
+				t.Errorf("sessionName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteConversation(t *testing.T) {
+	sessions, err := readSessions(strings.NewReader(testDecodeLog(t)), decodeFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	writeConversation(&b, sessions[0], false)
+	want := "=== https-1 10.0.0.5:5000 -> 192.168.1.10:443 sni=www.example.com time=2024-01-02T15:04:05Z\n" +
+		">> victim (18 bytes)\nGET / HTTP/1.1\n\n" +
+		"<< downstream (19 bytes)\nHTTP/1.1 200 OK\n\n\n"
+	if b.String() != want {
+		t.Errorf("writeConversation() wrote\n%q\nwant\n%q", b.String(), want)
+	}
+
+	b.Reset()
+	writeConversation(&b, sessions[2], true)
+	if !strings.Contains(b.String(), ">> victim (2 bytes)\n00000000  00 01") {
+		t.Errorf("writeConversation() wrote %q, want a hex dump", b.String())
+	}
+}
+
+func TestWriteStreamFiles(t *testing.T) {
+	sessions, err := readSessions(strings.NewReader(testDecodeLog(t)), decodeFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "streams")
+	if err = writeStreamFiles(dir, sessions); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"https-1.victim":     "GET / HTTP/1.1\r\n\r\n",
+		"https-1.downstream": "HTTP/1.1 200 OK\r\n\r\n",
+		"ftp-2.victim":       "USER bob\r\n",
+		"ftp-2.downstream":   "",
+	} {
+		if b, err := os.ReadFile(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		} else if string(b) != want {
+			t.Errorf("%s = %q, want %q", name, b, want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+const (
+	logEvent       = "log"
+	connStartEvent = "conn_start"
+	connEndEvent   = "conn_end"
+	dataEvent      = "data"
+
+	// eventBufLen is the number of events buffered for each subscriber
+	// before events are dropped.
+	eventBufLen = 256
+)
+
+type (
+	// eventHub fans out events to subscribers, such as the admin API's
+	// event stream.
+	//
+	// Publishing never blocks. Events are dropped for subscribers that
+	// fall behind.
+	eventHub struct {
+		m    sync.Mutex
+		subs map[chan event]struct{}
+	}
+
+	// event is a JSON encoded record published to an eventHub.
+	event struct {
+		Type string
+		Data []byte
+	}
+)
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan event]struct{})}
+}
+
+// subscribe returns a channel receiving published events and a function
+// that must be called to unsubscribe.
+func (h *eventHub) subscribe() (<-chan event, func()) {
+	c := make(chan event, eventBufLen)
+	h.m.Lock()
+	h.subs[c] = struct{}{}
+	h.m.Unlock()
+	return c, func() {
+		h.m.Lock()
+		delete(h.subs, c)
+		h.m.Unlock()
+	}
+}
+
+// publish v as an event of type typ.
+//
+// publish is a no-op when h is nil or there are no subscribers, so
+// records are only marshaled when someone is listening.
+func (h *eventHub) publish(typ string, v any) {
+	if h == nil {
+		return
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		con.errorf("error marshaling event: %v", err)
+		return
+	}
+	e := event{Type: typ, Data: b}
+	for c := range h.subs {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
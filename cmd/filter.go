@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	gs "github.com/impostorkeanu/gosplit"
+	"net/netip"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	passthroughDenyAction = "passthrough"
+	rejectDenyAction      = "reject"
+	interceptMode         = "intercept"
+)
+
+type (
+	// connFilter implements gs.ConnFilter using allow and deny lists
+	// for victim addresses and TLS server names.
+	connFilter struct {
+		allowVictims []netip.Prefix
+		denyVictims  []netip.Prefix
+		allowSNI     []string // glob patterns
+		denySNI      []string // glob patterns
+		denyAction   gs.ConnAction
+	}
+
+	// victimOverrides assigns actions to individual victims, taking
+	// precedence over the filters of all listeners.
+	victimOverrides struct {
+		m       sync.RWMutex
+		actions map[netip.Addr]gs.ConnAction
+	}
+)
+
+// newConnFilter initializes a connFilter from flag values.
+//
+// Values beginning with "@" are treated as files containing one entry
+// per line. Blank lines and lines beginning with "#" are ignored.
+func newConnFilter(allowVictims, denyVictims, allowSNI, denySNI []string, denyAction string) (f *connFilter, err error) {
+	f = new(connFilter)
+	switch denyAction {
+	case passthroughDenyAction:
+		f.denyAction = gs.PassthroughConn
+	case rejectDenyAction:
+		f.denyAction = gs.RejectConn
+	default:
+		return nil, fmt.Errorf("unknown deny action: %s", denyAction)
+	}
+	if f.allowVictims, err = parsePrefixes(allowVictims); err != nil {
+		return nil, err
+	} else if f.denyVictims, err = parsePrefixes(denyVictims); err != nil {
+		return nil, err
+	} else if f.allowSNI, err = parsePatterns(allowSNI); err != nil {
+		return nil, err
+	} else if f.denySNI, err = parsePatterns(denySNI); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// FilterConn denies victims that are absent from a non-empty allow list
+// or present in the deny list.
+//
+// SNI lists apply only to TLS connections. When an SNI allow list is
+// configured, TLS connections that did not send a server name are denied.
+func (f *connFilter) FilterConn(victim gs.Addr, _ gs.Addr, _ *gs.Addr, hello *gs.ClientHello) gs.ConnAction {
+	if f == nil {
+		return gs.InterceptConn
+	}
+
+	if ip, err := netip.ParseAddr(victim.IP); err != nil {
+		return f.denyAction
+	} else if ip = ip.Unmap(); len(f.allowVictims) > 0 && !containsAddr(f.allowVictims, ip) {
+		return f.denyAction
+	} else if containsAddr(f.denyVictims, ip) {
+		return f.denyAction
+	}
+
+	if hello != nil {
+		sni := strings.ToLower(hello.ServerName)
+		if len(f.allowSNI) > 0 && (sni == "" || !matchesPattern(f.allowSNI, sni)) {
+			return f.denyAction
+		} else if sni != "" && matchesPattern(f.denySNI, sni) {
+			return f.denyAction
+		}
+	}
+
+	return gs.InterceptConn
+}
+
+// containsAddr determines if any prefix contains ip.
+func containsAddr(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPattern determines if any glob pattern matches name.
+func matchesPattern(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefixes parses CIDRs and IP addresses into prefixes.
+func parsePrefixes(values []string) (prefixes []netip.Prefix, err error) {
+	values, err = expandListValues(values)
+	if err != nil {
+		return
+	}
+	for _, v := range values {
+		var p netip.Prefix
+		if strings.Contains(v, "/") {
+			p, err = netip.ParsePrefix(v)
+		} else if ip, e := netip.ParseAddr(v); e != nil {
+			err = e
+		} else {
+			p = netip.PrefixFrom(ip, ip.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or cidr (%s): %w", v, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return
+}
+
+// parsePatterns validates and lowercases glob patterns.
+func parsePatterns(values []string) (patterns []string, err error) {
+	values, err = expandListValues(values)
+	if err != nil {
+		return
+	}
+	for _, v := range values {
+		v = strings.ToLower(v)
+		if _, err = path.Match(v, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern (%s): %w", v, err)
+		}
+		patterns = append(patterns, v)
+	}
+	return
+}
+
+// expandListValues replaces values beginning with "@" with the lines of
+// the file they name.
+func expandListValues(values []string) (out []string, err error) {
+	for _, v := range values {
+		if !strings.HasPrefix(v, "@") {
+			out = append(out, v)
+			continue
+		}
+		var f *os.File
+		if f, err = os.Open(v[1:]); err != nil {
+			return nil, fmt.Errorf("failed to open list file: %w", err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				out = append(out, line)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read list file: %w", err)
+		}
+	}
+	return
+}
+
+func newVictimOverrides() *victimOverrides {
+	return &victimOverrides{actions: make(map[netip.Addr]gs.ConnAction)}
+}
+
+// get the action assigned to a victim IP.
+func (o *victimOverrides) get(victim string) (a gs.ConnAction, ok bool) {
+	if o == nil {
+		return
+	}
+	ip, err := netip.ParseAddr(victim)
+	if err != nil {
+		return
+	}
+	o.m.RLock()
+	defer o.m.RUnlock()
+	a, ok = o.actions[ip.Unmap()]
+	return
+}
+
+// set the action for a victim IP.
+func (o *victimOverrides) set(ip netip.Addr, a gs.ConnAction) {
+	o.m.Lock()
+	o.actions[ip.Unmap()] = a
+	o.m.Unlock()
+}
+
+// remove the action for a victim IP, returning false when none was set.
+func (o *victimOverrides) remove(ip netip.Addr) (ok bool) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	if _, ok = o.actions[ip.Unmap()]; ok {
+		delete(o.actions, ip.Unmap())
+	}
+	return
+}
+
+// modes returns the mode name assigned to each victim IP.
+func (o *victimOverrides) modes() map[string]string {
+	o.m.RLock()
+	defer o.m.RUnlock()
+	m := make(map[string]string, len(o.actions))
+	for ip, a := range o.actions {
+		m[ip.String()] = actionMode(a)
+	}
+	return m
+}
+
+// parseMode converts a mode name to a gs.ConnAction.
+func parseMode(mode string) (gs.ConnAction, error) {
+	switch mode {
+	case interceptMode:
+		return gs.InterceptConn, nil
+	case passthroughDenyAction:
+		return gs.PassthroughConn, nil
+	case rejectDenyAction:
+		return gs.RejectConn, nil
+	}
+	return 0, fmt.Errorf("unknown mode: %s", mode)
+}
+
+// actionMode is the inverse of parseMode.
+func actionMode(a gs.ConnAction) string {
+	switch a {
+	case gs.PassthroughConn:
+		return passthroughDenyAction
+	case gs.RejectConn:
+		return rejectDenyAction
+	}
+	return interceptMode
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	gs "github.com/impostorkeanu/gosplit"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNewConnFilter(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "victims.txt")
+	if err := os.WriteFile(list, []byte("# lab\n10.0.0.0/24\n\n  192.168.1.5  \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		allowVictims []string
+		denySNI      []string
+		denyAction   string
+		wantVictims  []netip.Prefix
+		wantSNI      []string
+		wantErr      bool
+	}{
+		{name: "list file", allowVictims: []string{"@" + list, "10.1.2.3/16"}, denySNI: []string{"*.Example.COM"},
+			denyAction: rejectDenyAction,
+			wantVictims: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("192.168.1.5/32"),
+				netip.MustParsePrefix("10.1.0.0/16")},
+			wantSNI: []string{"*.example.com"}},
+		{name: "ipv6", allowVictims: []string{"::1"}, denyAction: passthroughDenyAction,
+			wantVictims: []netip.Prefix{netip.MustParsePrefix("::1/128")}},
+		{name: "invalid cidr", allowVictims: []string{"10.0.0.0/33"}, denyAction: rejectDenyAction, wantErr: true},
+		{name: "invalid address", allowVictims: []string{"victim"}, denyAction: rejectDenyAction, wantErr: true},
+		{name: "invalid pattern", denySNI: []string{"[a-"}, denyAction: rejectDenyAction, wantErr: true},
+		{name: "missing list file", allowVictims: []string{"@" + list + ".missing"}, denyAction: rejectDenyAction,
+			wantErr: true},
+		{name: "unknown deny action", denyAction: "drop", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newConnFilter(tt.allowVictims, nil, nil, tt.denySNI, tt.denyAction)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newConnFilter() error = %v, wantErr %v", err, tt.wantErr)
+			} else if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(f.allowVictims, tt.wantVictims) {
+				t.Errorf("allowVictims = %v, want %v", f.allowVictims, tt.wantVictims)
+			}
+			if !reflect.DeepEqual(f.denySNI, tt.wantSNI) {
+				t.Errorf("denySNI = %v, want %v", f.denySNI, tt.wantSNI)
+			}
+		})
+	}
+}
+
+func TestConnFilter_FilterConn(t *testing.T) {
+	f, err := newConnFilter([]string{"10.0.0.0/24"}, []string{"10.0.0.9"}, []string{"*.corp.test"},
+		[]string{"vault.corp.test"}, rejectDenyAction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		victim string
+		sni    string
+		tls    bool
+		want   gs.ConnAction
+	}{
+		{name: "allowed", victim: "10.0.0.1", want: gs.InterceptConn},
+		{name: "ipv4-mapped", victim: "::ffff:10.0.0.1", want: gs.InterceptConn},
+		{name: "not allowed", victim: "10.0.1.1", want: gs.RejectConn},
+		{name: "denied", victim: "10.0.0.9", want: gs.RejectConn},
+		{name: "invalid victim", victim: "victim", want: gs.RejectConn},
+		{name: "allowed sni", victim: "10.0.0.1", sni: "WWW.corp.test", tls: true, want: gs.InterceptConn},
+		{name: "denied sni", victim: "10.0.0.1", sni: "vault.corp.test", tls: true, want: gs.RejectConn},
+		{name: "sni not allowed", victim: "10.0.0.1", sni: "example.com", tls: true, want: gs.RejectConn},
+		{name: "no sni", victim: "10.0.0.1", tls: true, want: gs.RejectConn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hello *gs.ClientHello
+			if tt.tls {
+				hello = &gs.ClientHello{ServerName: tt.sni}
+			}
+			if got := f.FilterConn(gs.Addr{IP: tt.victim}, gs.Addr{}, nil, hello); got != tt.want {
+				t.Errorf("FilterConn() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	var nilFilter *connFilter
+	if got := nilFilter.FilterConn(gs.Addr{IP: "10.0.1.1"}, gs.Addr{}, nil, nil); got != gs.InterceptConn {
+		t.Errorf("nil FilterConn() = %v, want %v", got, gs.InterceptConn)
+	}
+}
+
+func TestVictimOverrides(t *testing.T) {
+	f, err := newConnFilter(nil, []string{"10.0.0.2"}, nil, nil, rejectDenyAction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := newVictimOverrides()
+	c := config{filter: f, overrides: o}
+	o.set(netip.MustParseAddr("::ffff:10.0.0.1"), gs.PassthroughConn)
+	o.set(netip.MustParseAddr("10.0.0.2"), gs.InterceptConn)
+
+	// overrides take precedence over the filter
+	for victim, want := range map[string]gs.ConnAction{
+		"10.0.0.1": gs.PassthroughConn,
+		"10.0.0.2": gs.InterceptConn,
+		"10.0.0.3": gs.InterceptConn,
+	} {
+		if got := c.FilterConn(gs.Addr{IP: victim}, gs.Addr{}, nil, nil); got != want {
+			t.Errorf("FilterConn(%s) = %v, want %v", victim, got, want)
+		}
+	}
+	if got, want := o.modes(), map[string]string{"10.0.0.1": passthroughDenyAction, "10.0.0.2": interceptMode}; !reflect.DeepEqual(got, want) {
+		t.Errorf("modes() = %v, want %v", got, want)
+	}
+
+	if !o.remove(netip.MustParseAddr("10.0.0.2")) {
+		t.Error("remove() = false for an assigned victim")
+	} else if o.remove(netip.MustParseAddr("10.0.0.2")) {
+		t.Error("remove() = true for an unassigned victim")
+	}
+	if got := c.FilterConn(gs.Addr{IP: "10.0.0.2"}, gs.Addr{}, nil, nil); got != gs.RejectConn {
+		t.Errorf("FilterConn() after remove = %v, want %v", got, gs.RejectConn)
+	}
+
+	for _, mode := range []string{interceptMode, passthroughDenyAction, rejectDenyAction} {
+		if a, err := parseMode(mode); err != nil || actionMode(a) != mode {
+			t.Errorf("parseMode(%s) = %v, %v; does not round trip", mode, a, err)
+		}
+	}
+	if _, err = parseMode("drop"); err == nil {
+		t.Error("parseMode() accepted an unknown mode")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	gs "github.com/impostorkeanu/gosplit"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	harVersion = "1.2"
+	// harTrailer closes the entries array and log. It is overwritten by
+	// each entry so that the file is always a valid HAR document.
+	harTrailer = "\n]}}\n"
+)
+
+type (
+	// harWriter appends HAR 1.2 entries to a file, keeping the file a
+	// valid document after each entry so that it can be loaded while
+	// gosplit runs.
+	harWriter struct {
+		m     sync.Mutex
+		f     *os.File
+		end   int64 // offset of the trailer
+		empty bool  // no entries have been written
+	}
+
+	harLog struct {
+		Log struct {
+			Version string     `json:"version"`
+			Creator harCreator `json:"creator"`
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}
+
+	harCreator struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+
+	harEntry struct {
+		StartedDateTime time.Time   `json:"startedDateTime"`
+		Time            float64     `json:"time"`
+		Request         harRequest  `json:"request"`
+		Response        harResponse `json:"response"`
+		Cache           struct{}    `json:"cache"`
+		Timings         harTimings  `json:"timings"`
+		ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+		Connection      string      `json:"connection,omitempty"`
+		// custom fields identifying the listener and victim
+		Listener string `json:"_listener,omitempty"`
+		Victim   string `json:"_victim,omitempty"`
+	}
+
+	harRequest struct {
+		Method      string       `json:"method"`
+		URL         string       `json:"url"`
+		HTTPVersion string       `json:"httpVersion"`
+		Cookies     []harCookie  `json:"cookies"`
+		Headers     []harNameVal `json:"headers"`
+		QueryString []harNameVal `json:"queryString"`
+		PostData    *harContent  `json:"postData,omitempty"`
+		HeadersSize int          `json:"headersSize"`
+		BodySize    int          `json:"bodySize"`
+	}
+
+	harResponse struct {
+		Status      int          `json:"status"`
+		StatusText  string       `json:"statusText"`
+		HTTPVersion string       `json:"httpVersion"`
+		Cookies     []harCookie  `json:"cookies"`
+		Headers     []harNameVal `json:"headers"`
+		Content     harContent   `json:"content"`
+		RedirectURL string       `json:"redirectURL"`
+		HeadersSize int          `json:"headersSize"`
+		BodySize    int          `json:"bodySize"`
+	}
+
+	harCookie struct {
+		Name     string     `json:"name"`
+		Value    string     `json:"value"`
+		Path     string     `json:"path,omitempty"`
+		Domain   string     `json:"domain,omitempty"`
+		Expires  *time.Time `json:"expires,omitempty"`
+		HTTPOnly bool       `json:"httpOnly,omitempty"`
+		Secure   bool       `json:"secure,omitempty"`
+	}
+
+	harNameVal struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+
+	// harContent is used for both response content and request post
+	// data, which HAR describe using similar fields.
+	harContent struct {
+		Size     *int   `json:"size,omitempty"`
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text,omitempty"`
+		Encoding string `json:"encoding,omitempty"`
+	}
+
+	harTimings struct {
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	}
+)
+
+// openHAR opens a HAR file for writing, continuing the entries of an
+// existing file written by gosplit.
+func openHAR(name string) (w *harWriter, err error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	w = &harWriter{f: f}
+	if info.Size() == 0 {
+		var l harLog
+		l.Log.Version = harVersion
+		l.Log.Creator = harCreator{Name: "gosplit", Version: buildVersion()}
+		l.Log.Entries = []harEntry{}
+		var b []byte
+		if b, err = json.Marshal(l); err != nil {
+			return nil, err
+		}
+		// drop the closing of the empty entries array and log
+		b = bytes.TrimSuffix(b, []byte("]}}"))
+		if _, err = f.Write(append(b, harTrailer...)); err != nil {
+			return nil, err
+		}
+		w.end, w.empty = int64(len(b)), true
+		return w, nil
+	}
+
+	// ensure the file ends with the trailer, and determine if it has
+	// entries from the byte preceding it
+	b := make([]byte, len(harTrailer)+1)
+	if info.Size() < int64(len(b)) {
+		return nil, fmt.Errorf("%s is not a har file written by gosplit", name)
+	} else if _, err = f.ReadAt(b, info.Size()-int64(len(b))); err != nil {
+		return nil, err
+	} else if string(b[1:]) != harTrailer {
+		return nil, fmt.Errorf("%s is not a har file written by gosplit", name)
+	}
+	w.end, w.empty = info.Size()-int64(len(harTrailer)), b[0] == '['
+	return w, nil
+}
+
+// write an entry to the file.
+func (w *harWriter) write(e harEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	sep := ",\n"
+	if w.empty {
+		sep = "\n"
+	}
+	b = append(append([]byte(sep), b...), harTrailer...)
+	if _, err = w.f.WriteAt(b, w.end); err != nil {
+		return err
+	}
+	w.end += int64(len(b) - len(harTrailer))
+	w.empty = false
+	return nil
+}
+
+func (w *harWriter) Close() error {
+	return w.f.Close()
+}
+
+// harReceiver returns a function that writes exchanges reassembled by
+// c.http to w.
+func (c config) harReceiver(w *harWriter) func(gs.HTTPExchange) {
+	return func(x gs.HTTPExchange) {
+		if err := w.write(newHAREntry(c.name, x)); err != nil {
+			con.errorf("error writing har entry: %v", err)
+		}
+	}
+}
+
+// newHAREntry converts an exchange to a HAR entry.
+func newHAREntry(listener string, x gs.HTTPExchange) harEntry {
+	req := x.Request
+	e := harEntry{
+		StartedDateTime: req.Time,
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         req.URL,
+			HTTPVersion: req.Proto,
+			Cookies:     harCookies((&http.Request{Header: req.Header}).Cookies()),
+			Headers:     harHeaders(req.Header),
+			QueryString: []harNameVal{},
+			HeadersSize: -1,
+			BodySize:    req.BodySize,
+		},
+		Response: harResponse{
+			Cookies:     []harCookie{},
+			Headers:     []harNameVal{},
+			Content:     harContent{Size: new(int)},
+			HeadersSize: -1,
+		},
+		Connection: strconv.FormatUint(x.ConnInfo.ID, 10),
+		Listener:   listener,
+		Victim:     x.ConnInfo.Victim.IP,
+	}
+	if x.ConnInfo.Downstream != nil {
+		e.ServerIPAddress = x.ConnInfo.Downstream.IP
+	}
+	if u, err := url.Parse(req.URL); err == nil {
+		q := u.Query()
+		for _, k := range slices.Sorted(maps.Keys(q)) {
+			for _, v := range q[k] {
+				e.Request.QueryString = append(e.Request.QueryString, harNameVal{Name: k, Value: v})
+			}
+		}
+	}
+	if len(req.Body) > 0 {
+		// post data has no size
+		e.Request.PostData = harBody(req.Header, req.Body)
+		e.Request.PostData.Size = nil
+	}
+
+	// requests without responses are left with status 0, which browsers
+	// present as failed
+	if resp := x.Response; resp != nil {
+		e.Response.Status = resp.StatusCode
+		e.Response.StatusText = http.StatusText(resp.StatusCode)
+		if _, text, ok := strings.Cut(resp.Status, " "); ok {
+			e.Response.StatusText = text
+		}
+		e.Response.HTTPVersion = resp.Proto
+		e.Response.Cookies = harCookies((&http.Response{Header: resp.Header}).Cookies())
+		e.Response.Headers = harHeaders(resp.Header)
+		e.Response.Content = *harBody(resp.Header, resp.Body)
+		e.Response.RedirectURL = resp.Header.Get("Location")
+		e.Response.BodySize = resp.BodySize
+		e.Timings.Wait = harMillis(resp.Time.Sub(req.Time))
+		e.Timings.Receive = harMillis(resp.Done.Sub(resp.Time))
+	} else {
+		e.Response.Content.MimeType = "x-unknown"
+	}
+	e.Time = e.Timings.Send + e.Timings.Wait + e.Timings.Receive
+	return e
+}
+
+// harBody describes a request or response body. Bodies that aren't
+// valid UTF-8 are base64 encoded.
+func harBody(h http.Header, body []byte) *harContent {
+	size := len(body)
+	c := &harContent{Size: &size, MimeType: h.Get("Content-Type"), Text: string(body)}
+	if c.MimeType == "" {
+		c.MimeType = "x-unknown"
+	}
+	if !utf8.Valid(body) {
+		c.Text, c.Encoding = base64.StdEncoding.EncodeToString(body), "base64"
+	}
+	return c
+}
+
+func harHeaders(h http.Header) (nvs []harNameVal) {
+	nvs = []harNameVal{}
+	// sorted, as the order headers were sent in is unknown
+	for _, k := range slices.Sorted(maps.Keys(h)) {
+		for _, v := range h[k] {
+			nvs = append(nvs, harNameVal{Name: k, Value: v})
+		}
+	}
+	return
+}
+
+func harCookies(cookies []*http.Cookie) (hcs []harCookie) {
+	hcs = []harCookie{}
+	for _, c := range cookies {
+		hc := harCookie{Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain,
+			HTTPOnly: c.HttpOnly, Secure: c.Secure}
+		if !c.Expires.IsZero() {
+			hc.Expires = &c.Expires
+		}
+		hcs = append(hcs, hc)
+	}
+	return
+}
+
+// harMillis converts d to milliseconds, as HAR timings are expressed.
+func harMillis(d time.Duration) float64 {
+	return max(0, float64(d)/float64(time.Millisecond))
+}
+
+// buildVersion returns the version of the main module, which is
+// "(devel)" when built from a working tree.
+func buildVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
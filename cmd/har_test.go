@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	gs "github.com/impostorkeanu/gosplit"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readHAR parses a HAR file, failing the test when it is invalid.
+func readHAR(t *testing.T, name string) harLog {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var l harLog
+	if err = json.Unmarshal(b, &l); err != nil {
+		t.Fatalf("%s is not valid json: %v\n%s", name, err, b)
+	}
+	return l
+}
+
+func TestOpenHAR(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "http.har")
+	write := func(urls ...string) {
+		w, err := openHAR(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		for _, u := range urls {
+			if err = w.write(harEntry{Request: harRequest{URL: u}}); err != nil {
+				t.Fatal(err)
+			}
+			// the file is a valid document after each entry
+			readHAR(t, name)
+		}
+	}
+
+	// a new file has no entries, and entries written after reopening
+	// it continue those already written
+	write()
+	if l := readHAR(t, name); l.Log.Version != harVersion || l.Log.Creator.Name != "gosplit" || len(l.Log.Entries) != 0 {
+		t.Fatalf("new har file = %+v, want an empty log", l)
+	}
+	write("http://a/")
+	write("http://b/", "http://c/")
+	var urls []string
+	for _, e := range readHAR(t, name).Log.Entries {
+		urls = append(urls, e.Request.URL)
+	}
+	if want := []string{"http://a/", "http://b/", "http://c/"}; !reflect.DeepEqual(urls, want) {
+		t.Errorf("entries = %v, want %v", urls, want)
+	}
+
+	for _, content := range []string{"{}", `{"log":{"entries":[]}}` + "\n"} {
+		other := filepath.Join(dir, "other.har")
+		if err := os.WriteFile(other, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if w, err := openHAR(other); err == nil {
+			w.Close()
+			t.Errorf("openHAR() accepted a file containing %q", content)
+		}
+	}
+}
+
+func TestNewHAREntry(t *testing.T) {
+	t0 := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	x := gs.HTTPExchange{
+		Request: gs.HTTPRequest{
+			Method: http.MethodPost,
+			URL:    "https://www.example.com/login?b=2&a=1&a=0",
+			Proto:  "HTTP/1.1",
+			Header: http.Header{"Cookie": {"session=abc"}, "Content-Type": {"application/x-www-form-urlencoded"}},
+			Body:   []byte("user=bob"), BodySize: 8,
+			Time: t0,
+		},
+		Response: &gs.HTTPResponse{
+			Proto:      "HTTP/1.1",
+			Status:     "302 Moved",
+			StatusCode: http.StatusFound,
+			Header:     http.Header{"Location": {"/home"}, "Set-Cookie": {"session=def; Path=/; HttpOnly"}},
+			Body:       []byte{0xff, 0xfe}, BodySize: 2,
+			Time: t0.Add(20 * time.Millisecond),
+			Done: t0.Add(25 * time.Millisecond),
+		},
+		ConnInfo: gs.ConnInfo{ID: 42, Victim: gs.Addr{IP: "10.0.0.5", Port: "5000"},
+			Downstream: &gs.Addr{IP: "192.168.1.10", Port: "443"}},
+	}
+	e := newHAREntry("https", x)
+
+	if e.Connection != "42" || e.Listener != "https" || e.Victim != "10.0.0.5" || e.ServerIPAddress != "192.168.1.10" {
+		t.Errorf("entry identifies connection %s of %s from %s to %s", e.Connection, e.Listener, e.Victim, e.ServerIPAddress)
+	}
+	if want := []harNameVal{{"a", "1"}, {"a", "0"}, {"b", "2"}}; !reflect.DeepEqual(e.Request.QueryString, want) {
+		t.Errorf("query string = %v, want %v", e.Request.QueryString, want)
+	}
+	if want := []harCookie{{Name: "session", Value: "abc"}}; !reflect.DeepEqual(e.Request.Cookies, want) {
+		t.Errorf("request cookies = %+v, want %+v", e.Request.Cookies, want)
+	}
+	if p := e.Request.PostData; p == nil || p.Text != "user=bob" || p.Size != nil ||
+		p.MimeType != "application/x-www-form-urlencoded" {
+		t.Errorf("post data = %+v, want the request body without a size", p)
+	}
+
+	resp := e.Response
+	if resp.Status != http.StatusFound || resp.StatusText != "Moved" || resp.RedirectURL != "/home" {
+		t.Errorf("response status = %d %q redirecting to %q", resp.Status, resp.StatusText, resp.RedirectURL)
+	}
+	if len(resp.Cookies) != 1 || resp.Cookies[0].Path != "/" || !resp.Cookies[0].HTTPOnly {
+		t.Errorf("response cookies = %+v, want an http only session cookie", resp.Cookies)
+	}
+	if c := resp.Content; c.Encoding != "base64" || c.Text != "//4=" || c.MimeType != "x-unknown" || *c.Size != 2 {
+		t.Errorf("response content = %+v, want a base64 encoded body", c)
+	}
+	if e.Timings.Wait != 20 || e.Timings.Receive != 5 || e.Time != 25 || !e.StartedDateTime.Equal(t0) {
+		t.Errorf("entry started at %s with timings %+v totaling %v, want 20ms waiting and 5ms receiving",
+			e.StartedDateTime, e.Timings, e.Time)
+	}
+
+	// requests without responses are presented as failed
+	x.Response = nil
+	e = newHAREntry("https", x)
+	if e.Response.Status != 0 || e.Response.Content.MimeType != "x-unknown" || e.Time != 0 {
+		t.Errorf("entry without a response = %+v", e.Response)
+	}
+}
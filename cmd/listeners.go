@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	gs "github.com/impostorkeanu/gosplit"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+type (
+	// listenerSet runs a gs.ProxyServer for each configured listener.
+	listenerSet struct {
+		m       sync.Mutex
+		running map[string]*runningListener // keyed by listener name
+		failed  chan string                 // receives names of listeners that stopped unexpectedly
+		sh      *shared
+	}
+
+	// shared holds resources shared by all listeners.
+	shared struct {
+		logWriter io.Writer
+		outs      *outputs         // output files
+		overrides *victimOverrides // per-victim actions set through the admin api
+		events    *eventHub        // nil unless the admin api is enabled
+	}
+
+	// runningListener is a gs.ProxyServer started from a listenerSpec.
+	runningListener struct {
+		spec listenerSpec
+		cfg  config
+		srv  *gs.ProxyServer
+		done chan struct{} // closed when Serve returns
+		err  error         // error returned by Serve
+	}
+)
+
+func newListenerSet(sh *shared) *listenerSet {
+	return &listenerSet{
+		running: make(map[string]*runningListener),
+		failed:  make(chan string, 1),
+		sh:      sh,
+	}
+}
+
+// start a listener described by spec.
+func (s *listenerSet) start(spec listenerSpec, dataToLog bool) (err error) {
+	rL := &runningListener{spec: spec, done: make(chan struct{})}
+	if rL.cfg, err = spec.newConfig(s.sh, dataToLog, nil); err != nil {
+		return fmt.Errorf("error configuring listener %s: %w", spec.Name, err)
+	}
+
+	con.printf("Starting server %s on %s", spec.Name, spec.ListenAddr)
+	var l net.Listener
+	if l, err = net.Listen("tcp", spec.ListenAddr); err != nil {
+		rL.cfg.stop()
+		s.sh.outs.release(rL.cfg.outputs...)
+		return fmt.Errorf("error listening on %s: %w", spec.ListenAddr, err)
+	}
+	rL.srv = gs.NewProxyServer(rL.cfg, l)
+
+	s.m.Lock()
+	s.running[spec.Name] = rL
+	s.m.Unlock()
+
+	go func() {
+		defer close(rL.done)
+		if rL.err = rL.srv.Serve(context.Background()); rL.err != nil {
+			select {
+			case s.failed <- spec.Name:
+			default:
+			}
+		}
+	}()
+
+	return nil
+}
+
+// reload applies the differences between the running listeners and f.
+//
+// Listeners absent from f are drained and stopped in the background,
+// and new listeners are started. Remaining listeners receive a new
+// config that is used for new connections, while active connections
+// continue uninterrupted. Listeners whose address changed are restarted.
+func (s *listenerSet) reload(f *runFile) error {
+
+	want := make(map[string]listenerSpec)
+	for _, spec := range f.Listeners {
+		want[spec.Name] = spec
+	}
+
+	// stop listeners that were removed or need to bind a new address
+	s.m.Lock()
+	var stopping []*runningListener
+	for name, rL := range s.running {
+		if spec, ok := want[name]; !ok || spec.ListenAddr != rL.spec.ListenAddr {
+			delete(s.running, name)
+			stopping = append(stopping, rL)
+		}
+	}
+	s.m.Unlock()
+	for _, rL := range stopping {
+		con.printf("Stopping server %s on %s", rL.spec.Name, rL.spec.ListenAddr)
+		go func() {
+			if err := s.drain(rL, f.ShutdownTimeout); err != nil {
+				con.errorf("error while stopping listener: %v", err)
+			}
+		}()
+		// the address is free once Serve returns
+		<-rL.done
+	}
+
+	var errs []error
+	for _, spec := range f.Listeners {
+		s.m.Lock()
+		rL := s.running[spec.Name]
+		s.m.Unlock()
+		var err error
+		if rL == nil {
+			err = s.start(spec, f.DataToLog)
+		} else {
+			err = s.swap(rL, spec, f.DataToLog, f.ShutdownTimeout)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// swap the config of a running listener for one built from spec.
+//
+// Generated certificates are retained when the certificate source is
+// unchanged, while static certificates are always reloaded from disk.
+func (s *listenerSet) swap(rL *runningListener, spec listenerSpec, dataToLog bool, timeout time.Duration) error {
+	var certs certSource
+	if spec.Cert.Generate && reflect.DeepEqual(spec.Cert, rL.spec.Cert) {
+		certs = rL.cfg.certs
+	}
+	c, err := spec.newConfig(s.sh, dataToLog, certs)
+	if err != nil {
+		return fmt.Errorf("error configuring listener %s: %w", spec.Name, err)
+	}
+	rL.srv.SetCfg(c)
+
+	// active connections may still be handshaking with the old certificate
+	// source or writing to the old config's files, so give them time to
+	// finish before stopping the source and closing files no longer used
+	old := rL.cfg
+	time.AfterFunc(timeout, func() {
+		if old.certs != c.certs {
+			old.stop()
+		}
+		s.sh.outs.release(old.outputs...)
+	})
+	s.m.Lock()
+	rL.spec, rL.cfg = spec, c
+	s.m.Unlock()
+	con.printf("Reloaded server %s on %s", spec.Name, spec.ListenAddr)
+	return nil
+}
+
+// servers returns the proxy server of each running listener, keyed by
+// listener name.
+func (s *listenerSet) servers() map[string]*gs.ProxyServer {
+	s.m.Lock()
+	defer s.m.Unlock()
+	m := make(map[string]*gs.ProxyServer, len(s.running))
+	for name, rL := range s.running {
+		m[name] = rL.srv
+	}
+	return m
+}
+
+// each calls f for every running listener while holding s.m.
+func (s *listenerSet) each(f func(rL *runningListener)) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, rL := range s.running {
+		f(rL)
+	}
+}
+
+// stop a listener, allowing its connections timeout to finish.
+func (s *listenerSet) stop(name string, timeout time.Duration) error {
+	s.m.Lock()
+	rL := s.running[name]
+	delete(s.running, name)
+	s.m.Unlock()
+	if rL == nil {
+		return nil
+	}
+	return s.drain(rL, timeout)
+}
+
+// drain shuts down a listener that has been removed from s.running.
+func (s *listenerSet) drain(rL *runningListener, timeout time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err = rL.srv.Shutdown(ctx); err != nil {
+		err = fmt.Errorf("error shutting down listener %s: %w", rL.spec.Name, err)
+	}
+	<-rL.done
+	rL.cfg.stop()
+	s.sh.outs.release(rL.cfg.outputs...)
+	if rL.err != nil {
+		err = errors.Join(err, fmt.Errorf("listener %s failed: %w", rL.spec.Name, rL.err))
+	}
+	return
+}
+
+// stopAll stops all listeners concurrently.
+func (s *listenerSet) stopAll(timeout time.Duration) error {
+	s.m.Lock()
+	var names []string
+	for n := range s.running {
+		names = append(names, n)
+	}
+	s.m.Unlock()
+
+	var (
+		wg   sync.WaitGroup
+		m    sync.Mutex
+		errs []error
+	)
+	for _, n := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.stop(n, timeout); err != nil {
+				m.Lock()
+				errs = append(errs, err)
+				m.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
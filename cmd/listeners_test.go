@@ -0,0 +1,138 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestListenerSet_reload(t *testing.T) {
+	spec := func(name, listenAddr, downstreamAddr string) listenerSpec {
+		return listenerSpec{Name: name, ListenAddr: listenAddr, DownstreamAddr: downstreamAddr}
+	}
+	load := func(listeners ...listenerSpec) *runFile {
+		f := &runFile{ShutdownTimeout: time.Second, Cert: &certFileCfg{Generate: true, KeyBits: 1024},
+			Listeners: listeners}
+		if err := f.validate(); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	s := newListenerSet(testShared(t))
+	defer s.stopAll(time.Second)
+	running := func() (names []string) {
+		s.each(func(rL *runningListener) { names = append(names, rL.spec.Name) })
+		sort.Strings(names)
+		return
+	}
+
+	if err := s.reload(load(spec("a", "127.0.0.1:0", "127.0.0.1:1"), spec("b", "127.0.0.1:0", ""))); err != nil {
+		t.Fatal("reload() error =", err)
+	}
+	a, b := s.running["a"], s.running["b"]
+
+	// a is reconfigured, b is stopped, and c is started
+	if err := s.reload(load(spec("a", "127.0.0.1:0", "127.0.0.1:2"), spec("c", "127.0.0.1:0", ""))); err != nil {
+		t.Fatal("reload() error =", err)
+	}
+	if got := running(); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("running listeners = %v, want [a c]", got)
+	}
+	select {
+	case <-b.done:
+	case <-time.After(time.Second):
+		t.Error("removed listener is still serving")
+	}
+	if s.running["a"] != a || a.srv != s.servers()["a"] {
+		t.Error("listener was restarted instead of reconfigured")
+	} else if a.cfg.downstream.Port != "2" {
+		t.Errorf("downstream = %+v, want port 2", a.cfg.downstream)
+	}
+	certs := a.cfg.certs
+
+	// generated certificates are retained unless their configuration
+	// changes
+	if err := s.reload(load(spec("a", "127.0.0.1:0", "127.0.0.1:3"), spec("c", "127.0.0.1:0", ""))); err != nil {
+		t.Fatal("reload() error =", err)
+	} else if a.cfg.certs != certs {
+		t.Error("generated certificates were replaced although their configuration was unchanged")
+	}
+	f := load(spec("a", "127.0.0.1:0", "127.0.0.1:3"), spec("c", "127.0.0.1:0", ""))
+	f.Listeners[0].Cert = &certFileCfg{Generate: true, KeyBits: 1024, OrgName: "other"}
+	if err := s.reload(f); err != nil {
+		t.Fatal("reload() error =", err)
+	} else if a.cfg.certs == certs {
+		t.Error("generated certificates were retained although their configuration changed")
+	}
+
+	// listeners are restarted when their address changes
+	if err := s.reload(load(spec("a", "localhost:0", "127.0.0.1:3"), spec("c", "127.0.0.1:0", ""))); err != nil {
+		t.Fatal("reload() error =", err)
+	} else if s.running["a"] == a {
+		t.Error("listener was not restarted after its address changed")
+	}
+
+	// listeners failing to start are reported
+	if err := s.reload(load(spec("a", "localhost:0", "10.0.0.1"))); err == nil {
+		t.Error("reload() accepted an invalid downstream address")
+	}
+}
+
+func TestListenerSet_reloadClosesOutputs(t *testing.T) {
+	dir := t.TempDir()
+	shared, keys, other := filepath.Join(dir, "shared.log"), filepath.Join(dir, "keys.log"),
+		filepath.Join(dir, "other.log")
+	load := func(listeners ...listenerSpec) *runFile {
+		f := &runFile{ShutdownTimeout: 50 * time.Millisecond, Cert: &certFileCfg{Generate: true, KeyBits: 1024},
+			Listeners: listeners}
+		if err := f.validate(); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	s := newListenerSet(testShared(t))
+	defer s.stopAll(time.Second)
+	isOpen := func(name string) bool {
+		s.sh.outs.m.Lock()
+		defer s.sh.outs.m.Unlock()
+		return s.sh.outs.files[name] != nil
+	}
+	waitClosed := func(name string) {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); isOpen(name); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Errorf("%s is still open", filepath.Base(name))
+				return
+			}
+		}
+	}
+
+	if err := s.reload(load(
+		listenerSpec{Name: "a", ListenAddr: "127.0.0.1:0", DataLogFile: shared},
+		listenerSpec{Name: "b", ListenAddr: "127.0.0.1:0", DataLogFile: shared, NSSKeyLogFile: keys},
+	)); err != nil {
+		t.Fatal("reload() error =", err)
+	}
+
+	// files of removed listeners are closed unless another listener
+	// still uses them
+	if err := s.reload(load(listenerSpec{Name: "a", ListenAddr: "127.0.0.1:0", DataLogFile: shared})); err != nil {
+		t.Fatal("reload() error =", err)
+	}
+	waitClosed(keys)
+	if !isOpen(shared) {
+		t.Error("file shared with a running listener was closed")
+	}
+
+	// files replaced by a reconfiguration are closed once the old
+	// config's connections had time to finish
+	if err := s.reload(load(listenerSpec{Name: "a", ListenAddr: "127.0.0.1:0", DataLogFile: other})); err != nil {
+		t.Fatal("reload() error =", err)
+	}
+	waitClosed(shared)
+	if !isOpen(other) {
+		t.Error("file used by the new config is not open")
+	}
+}
@@ -15,13 +15,7 @@ var (
 )
 
 func init() {
-	rootCmd.PersistentFlags().StringVarP(&pemCertFile, "cert-file", "c", "",
-		"File to receive PEM certificate from")
-	rootCmd.PersistentFlags().StringVarP(&pemKeyFile, "key-file", "k", "",
-		"File to read PEM key from")
-	prExit(rootCmd.MarkPersistentFlagRequired("cert-file"), flagRequiredMsg)
-	prExit(rootCmd.MarkPersistentFlagRequired("key-file"), flagRequiredMsg)
-	rootCmd.AddCommand(pemCmd, runCmd)
+	rootCmd.AddCommand(pemCmd, runCmd, watchCmd, decodeCmd, replayCmd)
 }
 
 func main() {
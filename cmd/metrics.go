@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"time"
+)
+
+const metricsNamespace = "gosplit"
+
+var (
+	acceptedDesc = newMetricDesc("connections_accepted_total",
+		"Connections accepted, including those later rejected.")
+	activeDesc = newMetricDesc("connections_active",
+		"Connections currently being handled.")
+	closedDesc = newMetricDesc("connections_closed_total",
+		"Handled connections that have ended.")
+	rejectedDesc = newMetricDesc("connections_rejected_total",
+		"Connections rejected by limits or filters.")
+	interceptedDesc = newMetricDesc("tls_intercepted_total",
+		"Victim TLS handshakes completed with the proxy.")
+	handshakeFailuresDesc = newMetricDesc("tls_handshake_failures_total",
+		"Failed victim TLS handshakes by reason, e.g., the alert sent by the victim.", "reason")
+	dialFailuresDesc = newMetricDesc("downstream_dial_failures_total",
+		"Failed connection attempts to downstreams.")
+	bytesDesc = newMetricDesc("bytes_total",
+		"Bytes relayed by sender (victim or downstream).", "sender")
+	queuedDataDesc = newMetricDesc("data_queue_depth",
+		"Data events waiting to be written to data logs.")
+	certHitsDesc = newMetricDesc("cert_cache_hits_total",
+		"Generated certificates served from cache.")
+	certMissesDesc = newMetricDesc("cert_cache_misses_total",
+		"Certificates generated because none were cached.")
+)
+
+type (
+	// metricsCollector implements prometheus.Collector by reading the
+	// counters of running listeners upon each scrape.
+	metricsCollector struct {
+		ls *listenerSet
+	}
+
+	// metricsServer serves metrics for scraping by Prometheus.
+	metricsServer struct {
+		srv *http.Server
+	}
+)
+
+// newMetricDesc describes a metric labeled by listener name and any
+// additional labels.
+func newMetricDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", name), help,
+		append([]string{"listener"}, labels...), nil)
+}
+
+func (m metricsCollector) Describe(c chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{acceptedDesc, activeDesc, closedDesc, rejectedDesc,
+		interceptedDesc, handshakeFailuresDesc, dialFailuresDesc, bytesDesc, queuedDataDesc,
+		certHitsDesc, certMissesDesc} {
+		c <- d
+	}
+}
+
+func (m metricsCollector) Collect(c chan<- prometheus.Metric) {
+	m.ls.each(func(rL *runningListener) {
+		name := rL.spec.Name
+		counter := func(d *prometheus.Desc, v uint64, labels ...string) {
+			c <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v), append([]string{name}, labels...)...)
+		}
+		gauge := func(d *prometheus.Desc, v int) {
+			c <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(v), name)
+		}
+
+		st := rL.srv.Stats()
+		counter(acceptedDesc, st.Accepted)
+		gauge(activeDesc, st.Active)
+		counter(closedDesc, st.Closed)
+		counter(rejectedDesc, st.Rejected)
+		counter(interceptedDesc, st.Intercepted)
+		for reason, n := range st.HandshakeFailures {
+			counter(handshakeFailuresDesc, n, reason)
+		}
+		counter(dialFailuresDesc, st.DialFailures)
+		counter(bytesDesc, st.VictimBytes, victimDataSender)
+		counter(bytesDesc, st.DownstreamBytes, downstreamDataSender)
+		gauge(queuedDataDesc, st.QueuedData)
+
+		if g, ok := rL.cfg.certs.(*genCertSource); ok {
+			counter(certHitsDesc, g.hits.Load())
+			counter(certMissesDesc, g.misses.Load())
+		}
+	})
+}
+
+// newMetricsServer initializes a metricsServer that listens on addr.
+func newMetricsServer(addr string, ls *listenerSet) *metricsServer {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		metricsCollector{ls: ls},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	return &metricsServer{srv: &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}}
+}
+
+// start listening, returning once the socket is bound.
+func (m *metricsServer) start() error {
+	l, err := net.Listen("tcp", m.srv.Addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", m.srv.Addr, err)
+	}
+	con.printf("Serving metrics on %s/metrics", m.srv.Addr)
+	go func() {
+		if err := m.srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			con.errorf("metrics server stopped unexpectedly: %v", err)
+		}
+	}()
+	return nil
+}
+
+// shutdown stops the server.
+func (m *metricsServer) shutdown(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return m.srv.Shutdown(ctx)
+}
@@ -4,12 +4,67 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"sync"
 )
 
 const (
 	flagRequiredMsg = "error marking flag required"
 )
 
+// console receives status and error messages printed while servers
+// run.
+//
+// Messages go to stdout and stderr unless redirected, e.g., to the
+// status line of the terminal UI while it owns the terminal. It is
+// safe to use from any routine.
+type console struct {
+	m      sync.Mutex
+	stdout io.Writer
+	stderr io.Writer
+	sink   func(string) // receives all messages when set
+}
+
+// con is the console used by the cmd package.
+var con = newConsole(os.Stdout, os.Stderr)
+
+func newConsole(stdout, stderr io.Writer) *console {
+	return &console{stdout: stdout, stderr: stderr}
+}
+
+// printf writes a status message to stdout or the sink.
+func (c *console) printf(format string, a ...any) {
+	c.write(c.stdout, fmt.Sprintf(format, a...))
+}
+
+// errorf writes an error message to stderr or the sink.
+func (c *console) errorf(format string, a ...any) {
+	c.write(c.stderr, fmt.Sprintf(format, a...))
+}
+
+func (c *console) write(w io.Writer, msg string) {
+	msg = strings.TrimRight(msg, "\n")
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.sink != nil {
+		c.sink(msg)
+		return
+	}
+	fmt.Fprintln(w, msg)
+}
+
+// redirect sends messages to sink until restore is called.
+func (c *console) redirect(sink func(string)) (restore func()) {
+	c.m.Lock()
+	c.sink = sink
+	c.m.Unlock()
+	return func() {
+		c.m.Lock()
+		c.sink = nil
+		c.m.Unlock()
+	}
+}
+
 // prExit, when err != nil, prints msg to stderr and exits
 // with a status code of 1
 func prExit(err error, msg string) {
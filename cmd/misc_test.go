@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestConsole_Redirect(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	c := newConsole(&stdout, &stderr)
+	c.printf("Starting server %s", "a")
+	c.errorf("error: %v\n", "b")
+
+	var got []string
+	restore := c.redirect(func(msg string) { got = append(got, msg) })
+	c.printf("Reloading %s", "c")
+	c.errorf("error: %v", "d")
+	restore()
+	c.printf("Stopping server %s", "e")
+
+	if s := stdout.String(); s != "Starting server a\nStopping server e\n" {
+		t.Errorf("stdout = %q", s)
+	}
+	if s := stderr.String(); s != "error: b\n" {
+		t.Errorf("stderr = %q", s)
+	}
+	if len(got) != 2 || got[0] != "Reloading c" || got[1] != "error: d" {
+		t.Errorf("sink received %q, want messages written while redirected", got)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// pcapMaxSegment is the largest TCP payload written to a packet.
+	pcapMaxSegment = 16384
+	// pcapPacketGap separates the timestamps of synthesized packets.
+	//
+	// Data logs record only the time each connection was made, so packets
+	// are spaced evenly to preserve their order.
+	pcapPacketGap = time.Microsecond
+)
+
+type (
+	// pcapWriter synthesizes TCP packets carrying session data.
+	pcapWriter struct {
+		w *pcapgo.Writer
+	}
+
+	// pcapFlow tracks one direction of a synthesized TCP connection.
+	pcapFlow struct {
+		src, dst         net.IP
+		srcPort, dstPort layers.TCPPort
+		seq              uint32
+	}
+)
+
+// writePcapFile writes sessions to a pcap file as TCP connections
+// between each victim and downstream, allowing them to be analyzed with
+// tools like Wireshark.
+//
+// The proxy's address is used for sessions that had no downstream.
+func writePcapFile(name string, sessions []*session) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	p := &pcapWriter{w: pcapgo.NewWriter(f)}
+	if err = p.w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		return fmt.Errorf("error writing pcap header: %w", err)
+	}
+	for _, sess := range sessions {
+		if err = p.writeSession(sess); err != nil {
+			return fmt.Errorf("error writing session %s: %w", sessionName(sess), err)
+		}
+	}
+	return nil
+}
+
+// writeSession writes a handshake, the session's data, and a teardown.
+func (p *pcapWriter) writeSession(sess *session) error {
+	ds := sess.info.Proxy
+	if sess.info.Downstream != nil {
+		ds = *sess.info.Downstream
+	}
+	victim, err := newPcapFlow(sess.info.Victim.IP, sess.info.Victim.Port, ds.IP, ds.Port)
+	if err != nil {
+		return err
+	}
+	downstream := victim.reverse()
+
+	ts := sess.info.Time
+	next := func() time.Time {
+		ts = ts.Add(pcapPacketGap)
+		return ts
+	}
+
+	// three-way handshake
+	if err = p.write(next(), victim, &layers.TCP{SYN: true}, nil); err != nil {
+		return err
+	}
+	victim.seq++
+	if err = p.write(next(), downstream, &layers.TCP{SYN: true, ACK: true, Ack: victim.seq}, nil); err != nil {
+		return err
+	}
+	downstream.seq++
+	if err = p.write(next(), victim, &layers.TCP{ACK: true, Ack: downstream.seq}, nil); err != nil {
+		return err
+	}
+
+	for _, c := range sess.chunks {
+		src, dst := victim, downstream
+		if !c.victim {
+			src, dst = downstream, victim
+		}
+		for data := c.data; len(data) > 0; {
+			seg := data[:min(len(data), pcapMaxSegment)]
+			data = data[len(seg):]
+			if err = p.write(next(), src, &layers.TCP{PSH: true, ACK: true, Ack: dst.seq}, seg); err != nil {
+				return err
+			}
+			src.seq += uint32(len(seg))
+		}
+	}
+
+	// the victim closes the connection
+	if err = p.write(next(), victim, &layers.TCP{FIN: true, ACK: true, Ack: downstream.seq}, nil); err != nil {
+		return err
+	}
+	victim.seq++
+	if err = p.write(next(), downstream, &layers.TCP{FIN: true, ACK: true, Ack: victim.seq}, nil); err != nil {
+		return err
+	}
+	downstream.seq++
+	return p.write(next(), victim, &layers.TCP{ACK: true, Ack: downstream.seq}, nil)
+}
+
+// write a packet sent by src.
+//
+// The packet is IPv4 when both ends of the flow are IPv4 addresses.
+// Otherwise, it's IPv6 and any IPv4 address is written as an
+// IPv4-mapped IPv6 address.
+func (p *pcapWriter) write(ts time.Time, src *pcapFlow, tcp *layers.TCP, payload []byte) error {
+	tcp.SrcPort, tcp.DstPort, tcp.Seq, tcp.Window = src.srcPort, src.dstPort, src.seq, 65535
+
+	var ip gopacket.NetworkLayer
+	var ipLayer gopacket.SerializableLayer
+	if sV4, dV4 := src.src.To4(), src.dst.To4(); sV4 != nil && dV4 != nil {
+		l := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: sV4, DstIP: dV4}
+		ip, ipLayer = l, l
+	} else {
+		l := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: src.src, DstIP: src.dst}
+		ip, ipLayer = l, l
+	}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		return err
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ipLayer, tcp, gopacket.Payload(payload)); err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	return p.w.WritePacket(gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(b), Length: len(b)}, b)
+}
+
+// newPcapFlow initializes the flow from a source to a destination.
+func newPcapFlow(srcIP, srcPort, dstIP, dstPort string) (f *pcapFlow, err error) {
+	f = new(pcapFlow)
+	if f.src = net.ParseIP(srcIP); f.src == nil {
+		return nil, fmt.Errorf("invalid ip address: %s", srcIP)
+	} else if f.dst = net.ParseIP(dstIP); f.dst == nil {
+		return nil, fmt.Errorf("invalid ip address: %s", dstIP)
+	}
+	var port uint64
+	if port, err = strconv.ParseUint(srcPort, 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid port: %s", srcPort)
+	}
+	f.srcPort = layers.TCPPort(port)
+	if port, err = strconv.ParseUint(dstPort, 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid port: %s", dstPort)
+	}
+	f.dstPort = layers.TCPPort(port)
+	return
+}
+
+// reverse returns the flow in the opposite direction.
+func (f *pcapFlow) reverse() *pcapFlow {
+	return &pcapFlow{src: f.dst, dst: f.src, srcPort: f.dstPort, dstPort: f.srcPort}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	gs "github.com/impostorkeanu/gosplit"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritePcapFile(t *testing.T) {
+	t0 := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	big := strings.Repeat("a", pcapMaxSegment+1)
+	sessions := []*session{
+		{listener: "https", info: gs.ConnInfo{ID: 1, Time: t0, Victim: gs.Addr{IP: "10.0.0.5", Port: "5000"},
+			Downstream: &gs.Addr{IP: "192.168.1.10", Port: "443"}},
+			chunks: []chunk{{victim: true, data: []byte("hello")}, {data: []byte(big)}}},
+		// no downstream, so the proxy's address is used
+		{listener: "https", info: gs.ConnInfo{ID: 2, Time: t0, Victim: gs.Addr{IP: "10.0.0.5", Port: "5001"},
+			Proxy: gs.Addr{IP: "::1", Port: "8443"}}},
+	}
+	name := filepath.Join(t.TempDir(), "data.pcap")
+	if err := writePcapFile(name, sessions); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := pcapgo.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		packets    []gopacket.Packet
+		downstream []byte
+		last       time.Time
+	)
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		// each session starts at the time its connection was made
+		if len(packets) != 9 && !ci.Timestamp.After(last) {
+			t.Errorf("packet %d has timestamp %s, want one after %s", len(packets), ci.Timestamp, last)
+		}
+		last = ci.Timestamp
+		p := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+		if p.ErrorLayer() != nil {
+			p = gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.Default)
+		}
+		if p.ErrorLayer() != nil {
+			t.Fatalf("error decoding packet %d: %v", len(packets), p.ErrorLayer().Error())
+		}
+		packets = append(packets, p)
+		if tcp, _ := p.Layer(layers.LayerTypeTCP).(*layers.TCP); tcp != nil && tcp.SrcPort == 443 {
+			downstream = append(downstream, tcp.Payload...)
+		}
+	}
+
+	// handshake, three data segments, and teardown, followed by a
+	// handshake and teardown
+	if len(packets) != 9+6 {
+		t.Fatalf("read %d packets, want 15", len(packets))
+	}
+	if string(downstream) != big {
+		t.Errorf("downstream sent %d bytes, want %d", len(downstream), len(big))
+	}
+
+	ip4, _ := packets[3].Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	tcp, _ := packets[3].Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if ip4 == nil || ip4.SrcIP.String() != "10.0.0.5" || ip4.DstIP.String() != "192.168.1.10" {
+		t.Fatalf("packet 3 = %v, want an ipv4 packet from the victim", packets[3])
+	}
+	if tcp == nil || string(tcp.Payload) != "hello" || tcp.Seq != 1 || tcp.Ack != 1 {
+		t.Errorf("packet 3 = %v, want the victim's data after the handshake", tcp)
+	}
+	// a segment following the first of the downstream's data
+	if tcp, _ = packets[5].Layer(layers.LayerTypeTCP).(*layers.TCP); tcp == nil || tcp.Seq != 1+pcapMaxSegment {
+		t.Errorf("packet 5 = %v, want sequence number %d", tcp, 1+pcapMaxSegment)
+	}
+
+	// mixed address families are written as ipv6
+	ip6, _ := packets[9].Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if ip6 == nil || ip6.SrcIP.String() != "10.0.0.5" || ip6.DstIP.String() != "::1" {
+		t.Errorf("packet 9 = %v, want an ipv6 packet from the victim to the proxy", packets[9])
+	}
+}
+
+func TestNewPcapFlow(t *testing.T) {
+	tests := []struct {
+		name                           string
+		srcIP, srcPort, dstIP, dstPort string
+		wantErr                        bool
+	}{
+		{name: "valid", srcIP: "10.0.0.5", srcPort: "5000", dstIP: "::1", dstPort: "443"},
+		{name: "invalid source ip", srcIP: "victim", srcPort: "5000", dstIP: "::1", dstPort: "443", wantErr: true},
+		{name: "invalid destination ip", srcIP: "10.0.0.5", srcPort: "5000", dstIP: "", dstPort: "443", wantErr: true},
+		{name: "invalid source port", srcIP: "10.0.0.5", srcPort: "65536", dstIP: "::1", dstPort: "443", wantErr: true},
+		{name: "invalid destination port", srcIP: "10.0.0.5", srcPort: "5000", dstIP: "::1", dstPort: "https",
+			wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newPcapFlow(tt.srcIP, tt.srcPort, tt.dstIP, tt.dstPort)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newPcapFlow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if r := f.reverse(); r.srcPort != 443 || r.dstPort != 5000 || !r.src.Equal(f.dst) || !r.dst.Equal(f.src) {
+				t.Errorf("reverse() = %+v, want the flow from %s to %s", r, tt.dstIP, tt.srcIP)
+			}
+		})
+	}
+}
@@ -30,6 +30,12 @@ gosplit pem --cert-file crt.pem --key-file key.pem \
 )
 
 func init() {
+	pemCmd.Flags().StringVarP(&pemCertFile, "cert-file", "c", "",
+		"File to receive PEM certificate")
+	pemCmd.Flags().StringVarP(&pemKeyFile, "key-file", "k", "",
+		"File to receive PEM key")
+	prExit(pemCmd.MarkFlagRequired("cert-file"), flagRequiredMsg)
+	prExit(pemCmd.MarkFlagRequired("key-file"), flagRequiredMsg)
 	pemCmd.Flags().StringVarP(&pemOrgName, "org-name", "n", "GoSplit", "Organization name for the cert")
 	pemCmd.Flags().StringSliceVarP(&pemIps, "ips", "i", []string{"127.0.0.1"}, "IP addresses for the cert")
 	pemCmd.Flags().StringSliceVarP(&pemNames, "names", "s", []string{"gosplit"}, "DNS names for the cert")
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	gs "github.com/impostorkeanu/gosplit"
+	"github.com/spf13/cobra"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	autoReplayTLS = "auto"
+	onReplayTLS   = "on"
+	offReplayTLS  = "off"
+)
+
+var (
+	replayCmd = &cobra.Command{
+		Use:   "replay <data-log-file>",
+		Short: "Replay the victim side of captured connections",
+		Long: "Replay the data sent by victims of connections captured in a data log to\n" +
+			"the original downstream, or another downstream, recording the responses\n" +
+			"as a data log.\n\n" +
+			"Connections are selected with the same flags as the decode command and\n" +
+			"replayed one after another. TLS is used when the connection was\n" +
+			"intercepted using TLS, unless --tls says otherwise.\n\n" +
+			"Unless --preserve-timing is supplied, each chunk of victim data is sent\n" +
+			"once the downstream has responded with as many bytes as it did in the\n" +
+			"capture, or it has been idle for --response-timeout. Replayed records\n" +
+			"retain the listener name and connection ID of the captured connection.",
+		Args: cobra.ExactArgs(1),
+		Run:  runReplay,
+		Example: `
+gosplit replay --conn https-42 data.json
+
+gosplit replay --conn https-42 --downstream-addr 127.0.0.1:8443 --preserve-timing \
+  --data-log-file replayed.json data.json`,
+	}
+
+	replayDownstreamAddr  string        // downstream receiving replayed data
+	replayTLS             string        // auto, on, or off
+	replayServerName      string        // server name sent to the downstream
+	replayVerify          bool          // verify the downstream's certificate
+	replayPreserveTiming  bool          // sleep between chunks as captured
+	replayResponseTimeout time.Duration // idle time before sending the next chunk
+	replayDialTimeout     time.Duration // time allowed to connect to the downstream
+	replayDataLogFile     string        // file receiving replayed data
+)
+
+func init() {
+	replayCmd.Flags().StringVar(&replayDownstreamAddr, "downstream-addr", "",
+		"Downstream to replay to instead of the captured downstream, e.g., 127.0.0.1:443")
+	replayCmd.Flags().StringVar(&replayTLS, "tls", autoReplayTLS,
+		"Whether to connect to the downstream using TLS: auto, on, or off")
+	replayCmd.Flags().StringVar(&replayServerName, "server-name", "",
+		"Server name sent to the downstream instead of the captured SNI")
+	replayCmd.Flags().BoolVar(&replayVerify, "verify", false,
+		"Verify the certificate presented by the downstream")
+	replayCmd.Flags().BoolVar(&replayPreserveTiming, "preserve-timing", false,
+		"Wait between chunks of victim data as long as they were apart when captured")
+	replayCmd.Flags().DurationVar(&replayResponseTimeout, "response-timeout", 2*time.Second,
+		"Time to wait for the downstream to respond before sending more data and closing")
+	replayCmd.Flags().DurationVar(&replayDialTimeout, "dial-timeout", 10*time.Second,
+		"Time allowed to connect to the downstream")
+	replayCmd.Flags().StringVar(&replayDataLogFile, "data-log-file", "",
+		"File to write replayed data to (default stdout)")
+	addDecodeFilterFlags(replayCmd)
+}
+
+func runReplay(_ *cobra.Command, args []string) {
+	switch replayTLS {
+	case autoReplayTLS, onReplayTLS, offReplayTLS:
+	default:
+		prExit(fmt.Errorf("unknown tls mode: %s", replayTLS), "error while parsing flags")
+	}
+	f, err := newDecodeFilter()
+	prExit(err, "error while parsing filters")
+	sessions, err := readSessionsFile(args[0], f)
+	prExit(err, "error while reading data log")
+	if len(sessions) == 0 {
+		prExit(errors.New("no connections matched"), "error while selecting connections")
+	}
+
+	var w io.Writer = os.Stdout
+	if replayDataLogFile != "" {
+		file, err := openFile(replayDataLogFile)
+		prExit(err, "error opening data file for writing")
+		defer file.Close()
+		w = file
+	}
+	w = &newlineWriter{w}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var failed bool
+	for _, sess := range sessions {
+		if ctx.Err() != nil {
+			break
+		}
+		if err = replaySession(ctx, sess, w); err != nil {
+			failed = true
+			fmt.Fprintf(os.Stderr, "error while replaying %s: %s\n", sessionName(sess), err)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// replaySession sends the victim data of sess to its downstream, writing
+// the data sent by both sides to w as data log records.
+func replaySession(ctx context.Context, sess *session, w io.Writer) error {
+	addr := replayDownstreamAddr
+	if addr == "" {
+		if sess.info.Downstream == nil {
+			return errors.New("no downstream was captured; supply --downstream-addr")
+		}
+		addr = net.JoinHostPort(sess.info.Downstream.IP, sess.info.Downstream.Port)
+	}
+	useTLS := replayTLS == onReplayTLS ||
+		(replayTLS == autoReplayTLS && (sess.info.TLS || sess.info.SNI != ""))
+
+	d := net.Dialer{Timeout: replayDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error connecting to downstream: %w", err)
+	}
+	defer conn.Close()
+
+	cI := gs.ConnInfo{ID: sess.info.ID, Time: time.Now(), SNI: sess.info.SNI, TLS: useTLS}
+	if cI.Victim.IP, cI.Victim.Port, err = net.SplitHostPort(conn.LocalAddr().String()); err != nil {
+		return err
+	}
+	cI.Downstream = new(gs.Addr)
+	if cI.Downstream.IP, cI.Downstream.Port, err = net.SplitHostPort(conn.RemoteAddr().String()); err != nil {
+		return err
+	}
+	if useTLS {
+		tCfg := &tls.Config{ServerName: replayServerName, InsecureSkipVerify: !replayVerify}
+		if tCfg.ServerName == "" {
+			tCfg.ServerName = sess.info.SNI
+		}
+		if sess.info.ALPN != "" {
+			// the captured data was exchanged using this protocol
+			tCfg.NextProtos = []string{sess.info.ALPN}
+		}
+		tC := tls.Client(conn, tCfg)
+		if err = tC.HandshakeContext(ctx); err != nil {
+			return fmt.Errorf("downstream tls handshake failed: %w", err)
+		}
+		conn, cI.SNI, cI.ALPN = tC, tCfg.ServerName, tC.ConnectionState().NegotiatedProtocol
+	}
+
+	c := config{name: sess.listener, dataWriter: w, logWriter: io.Discard}
+	var (
+		received atomic.Int64
+		progress = make(chan struct{}, 1)
+		readDone = make(chan struct{})
+	)
+	go func() {
+		defer close(readDone)
+		b := make([]byte, 32*1024)
+		for {
+			n, err := conn.Read(b)
+			if n > 0 {
+				c.writeDataLog(downstreamDataSender, b[:n], cI, time.Now())
+				received.Add(int64(n))
+				select {
+				case progress <- struct{}{}:
+				default:
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// awaitResponse waits until want bytes have been received from the
+	// downstream or it has been idle for replayResponseTimeout.
+	awaitResponse := func(want int64) {
+		timer := time.NewTimer(replayResponseTimeout)
+		defer timer.Stop()
+		for received.Load() < want {
+			select {
+			case <-progress:
+				timer.Reset(replayResponseTimeout)
+			case <-timer.C:
+				return
+			case <-readDone:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+
+	var (
+		sent, expected int64     // victim bytes sent, downstream bytes captured
+		last           time.Time // capture time of the previous victim chunk
+	)
+	for _, ch := range sess.chunks {
+		if !ch.victim {
+			expected += int64(len(ch.data))
+			continue
+		}
+		if replayPreserveTiming && !last.IsZero() && !ch.captured.IsZero() {
+			select {
+			case <-time.After(ch.captured.Sub(last)):
+			case <-ctx.Done():
+			}
+		} else if !replayPreserveTiming {
+			awaitResponse(expected)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		last = ch.captured
+		if _, err = conn.Write(ch.data); err != nil {
+			err = fmt.Errorf("error writing to downstream: %w", err)
+			break
+		}
+		c.writeDataLog(victimDataSender, ch.data, cI, time.Now())
+		sent += int64(len(ch.data))
+	}
+	if err == nil {
+		awaitResponse(expected)
+	}
+	conn.Close()
+	<-readDone
+
+	fmt.Fprintf(os.Stderr, "replayed %s to %s: sent %d bytes, received %d bytes (captured %d)\n",
+		sessionName(sess), addr, sent, received.Load(), expected)
+	return err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	gs "github.com/impostorkeanu/gosplit"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer that is safe for concurrent writes.
+type lockedBuffer struct {
+	m sync.Mutex
+	b bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.b.Write(p)
+}
+
+// startUpperServer starts a server that responds to each read with the
+// data converted to upper case.
+func startUpperServer(t *testing.T, tCfg *tls.Config) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tCfg != nil {
+		l = tls.NewListener(l, tCfg)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b := make([]byte, 1024)
+				for {
+					n, err := conn.Read(b)
+					if err != nil {
+						return
+					}
+					conn.Write(bytes.ToUpper(b[:n]))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestReplaySession(t *testing.T) {
+	certs, err := newGenCertSource("test", 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer certs.stop()
+
+	t0 := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name           string
+		tls            bool
+		preserveTiming bool
+		minDuration    time.Duration
+	}{
+		{name: "plain"},
+		{name: "tls", tls: true},
+		{name: "preserve timing", preserveTiming: true, minDuration: 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tCfg *tls.Config
+			if tt.tls {
+				tCfg = &tls.Config{GetCertificate: certs.GetCertificate}
+			}
+			replayDownstreamAddr = startUpperServer(t, tCfg)
+			replayPreserveTiming, replayResponseTimeout = tt.preserveTiming, 2*time.Second
+			t.Cleanup(func() {
+				replayDownstreamAddr, replayPreserveTiming, replayResponseTimeout = "", false, 2*time.Second
+			})
+
+			sess := &session{listener: "https", info: gs.ConnInfo{ID: 42, TLS: tt.tls}, chunks: []chunk{
+				{victim: true, captured: t0, data: []byte("hello")},
+				{captured: t0, data: []byte("HELLO")},
+				{victim: true, captured: t0.Add(100 * time.Millisecond), data: []byte("bye")},
+				{captured: t0.Add(100 * time.Millisecond), data: []byte("BYE")},
+			}}
+			if tt.tls {
+				sess.info.SNI = "www.example.com"
+			}
+			var w lockedBuffer
+			start := time.Now()
+			if err := replaySession(context.Background(), sess, &newlineWriter{&w}); err != nil {
+				t.Fatal(err)
+			}
+			if d := time.Since(start); d < tt.minDuration {
+				t.Errorf("replaySession() took %s, want at least %s", d, tt.minDuration)
+			}
+
+			// records from each side are written in order, but the
+			// sides may interleave
+			sent := map[string]string{}
+			scanner := bufio.NewScanner(&w.b)
+			for scanner.Scan() {
+				var dL dataLog
+				if err := json.Unmarshal(scanner.Bytes(), &dL); err != nil {
+					t.Fatal(err)
+				}
+				b, _ := base64.StdEncoding.DecodeString(dL.Data)
+				sent[dL.Sender] += string(b)
+				if dL.Listener != "https" || dL.ID != 42 || dL.TLS != tt.tls || dL.SNI != sess.info.SNI {
+					t.Errorf("record %+v does not retain the captured connection's details", dL)
+				}
+				if dL.Captured.Before(start) {
+					t.Errorf("record captured at %s, before the replay started at %s", dL.Captured, start)
+				}
+			}
+			if sent[victimDataSender] != "hellobye" || sent[downstreamDataSender] != "HELLOBYE" {
+				t.Errorf("replay recorded %q, want victim data and its upper case response", sent)
+			}
+		})
+	}
+}
+
+func TestReplaySession_NoDownstream(t *testing.T) {
+	sess := &session{listener: "https", info: gs.ConnInfo{ID: 1},
+		chunks: []chunk{{victim: true, data: []byte("hello")}}}
+	err := replaySession(context.Background(), sess, &lockedBuffer{})
+	if err == nil || !strings.Contains(err.Error(), "--downstream-addr") {
+		t.Errorf("replaySession() error = %v, want one suggesting --downstream-addr", err)
+	}
+}
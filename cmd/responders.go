@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	gs "github.com/impostorkeanu/gosplit"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	smtpResponderProfile = "smtp"
+	ftpResponderProfile  = "ftp"
+	imapResponderProfile = "imap"
+	pop3ResponderProfile = "pop3"
+	httpResponderProfile = "http"
+
+	defaultHTTPRealm = "Restricted"
+)
+
+type (
+	// responderSpec configures the responder that converses with victims
+	// of connections without a downstream.
+	//
+	// Rules are applied before those of the profile, and the remaining
+	// fields override the profile when set.
+	responderSpec struct {
+		// Profile is a built-in responder: smtp, ftp, imap, pop3, or http.
+		Profile     string              `yaml:"profile"`
+		Greeting    string              `yaml:"greeting"`
+		Delimiter   string              `yaml:"delimiter"`
+		Rules       []responderRuleSpec `yaml:"rules"`
+		Default     string              `yaml:"default"`
+		IdleTimeout time.Duration       `yaml:"idle_timeout"`
+		MaxMessages int                 `yaml:"max_messages"`
+		// Realm is sent in the Basic challenges of the http profile.
+		Realm string `yaml:"realm"`
+	}
+
+	// responderRuleSpec mirrors gs.ResponderRule.
+	responderRuleSpec struct {
+		State    string `yaml:"state"`
+		Match    string `yaml:"match"`
+		Response string `yaml:"response"`
+		Next     string `yaml:"next"`
+		Close    bool   `yaml:"close"`
+	}
+)
+
+// enabled determines if the spec configures a responder.
+func (s responderSpec) enabled() bool {
+	return s.Profile != "" || s.Greeting != "" || len(s.Rules) > 0 || s.Default != ""
+}
+
+// responder initializes the gs.ScriptedResponder described by the spec,
+// returning nil when it is not enabled.
+func (s responderSpec) responder() (*gs.ScriptedResponder, error) {
+	if !s.enabled() {
+		return nil, nil
+	}
+	r := &gs.ScriptedResponder{}
+	if s.Profile != "" {
+		var err error
+		if r, err = profileResponder(s.Profile, s.Realm); err != nil {
+			return nil, err
+		}
+	}
+
+	rules := make([]gs.ResponderRule, 0, len(s.Rules)+len(r.Rules))
+	for _, rs := range s.Rules {
+		rule := gs.ResponderRule{State: rs.State, Response: rs.Response, Next: rs.Next, Close: rs.Close}
+		if rs.Match != "" {
+			var err error
+			if rule.Match, err = regexp.Compile(rs.Match); err != nil {
+				return nil, fmt.Errorf("invalid responder rule match (%s): %w", rs.Match, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	r.Rules = append(rules, r.Rules...)
+
+	if s.Greeting != "" {
+		r.Greeting = s.Greeting
+	}
+	if s.Delimiter != "" {
+		r.Delimiter = s.Delimiter
+	}
+	if s.Default != "" {
+		r.Default = s.Default
+	}
+	if s.IdleTimeout != 0 {
+		r.IdleTimeout = s.IdleTimeout
+	}
+	if s.MaxMessages != 0 {
+		r.MaxMessages = s.MaxMessages
+	}
+	return r, nil
+}
+
+// profileResponder returns the built-in responder named by profile.
+//
+// Each profile accepts any credentials and declines attempts to
+// upgrade to TLS, e.g., SMTP's STARTTLS, so that credentials are sent
+// in cleartext.
+func profileResponder(profile, realm string) (*gs.ScriptedResponder, error) {
+	switch strings.ToLower(profile) {
+	case smtpResponderProfile:
+		return &gs.ScriptedResponder{
+			Greeting:  "220 mail ESMTP ready\r\n",
+			Delimiter: "\n",
+			Rules: []gs.ResponderRule{
+				{State: "data", Match: regexp.MustCompile(`^\.\r?\n$`), Response: "250 2.0.0 Ok: queued\r\n"},
+				{State: "data", Next: "data"},
+				{State: "auth-login-user", Response: "334 UGFzc3dvcmQ6\r\n", Next: "auth-login-pass"},
+				{State: "auth-login-pass", Response: "235 2.7.0 Authentication successful\r\n"},
+				{State: "auth-plain", Response: "235 2.7.0 Authentication successful\r\n"},
+				{Match: regexp.MustCompile(`(?i)^EHLO`), Response: "250-mail\r\n250-AUTH LOGIN PLAIN\r\n250 8BITMIME\r\n"},
+				{Match: regexp.MustCompile(`(?i)^HELO`), Response: "250 mail\r\n"},
+				{Match: regexp.MustCompile(`(?i)^AUTH LOGIN \S+`), Response: "334 UGFzc3dvcmQ6\r\n", Next: "auth-login-pass"},
+				{Match: regexp.MustCompile(`(?i)^AUTH LOGIN`), Response: "334 VXNlcm5hbWU6\r\n", Next: "auth-login-user"},
+				{Match: regexp.MustCompile(`(?i)^AUTH PLAIN \S+`), Response: "235 2.7.0 Authentication successful\r\n"},
+				{Match: regexp.MustCompile(`(?i)^AUTH PLAIN`), Response: "334 \r\n", Next: "auth-plain"},
+				{Match: regexp.MustCompile(`(?i)^AUTH`), Response: "504 5.5.4 Unrecognized authentication type\r\n"},
+				{Match: regexp.MustCompile(`(?i)^STARTTLS`), Response: "454 4.7.0 TLS not available\r\n"},
+				{Match: regexp.MustCompile(`(?i)^DATA`), Response: "354 End data with <CR><LF>.<CR><LF>\r\n", Next: "data"},
+				{Match: regexp.MustCompile(`(?i)^QUIT`), Response: "221 2.0.0 Bye\r\n", Close: true},
+			},
+			Default: "250 2.0.0 Ok\r\n",
+		}, nil
+	case ftpResponderProfile:
+		return &gs.ScriptedResponder{
+			Greeting:  "220 FTP server ready\r\n",
+			Delimiter: "\n",
+			Rules: []gs.ResponderRule{
+				{Match: regexp.MustCompile(`(?i)^USER`), Response: "331 Please specify the password\r\n"},
+				{Match: regexp.MustCompile(`(?i)^PASS`), Response: "230 Login successful\r\n"},
+				{Match: regexp.MustCompile(`(?i)^AUTH`), Response: "534 TLS not available\r\n"},
+				{Match: regexp.MustCompile(`(?i)^SYST`), Response: "215 UNIX Type: L8\r\n"},
+				{Match: regexp.MustCompile(`(?i)^PWD`), Response: "257 \"/\" is the current directory\r\n"},
+				{Match: regexp.MustCompile(`(?i)^TYPE`), Response: "200 Switching to binary mode\r\n"},
+				{Match: regexp.MustCompile(`(?i)^QUIT`), Response: "221 Goodbye\r\n", Close: true},
+			},
+			Default: "502 Command not implemented\r\n",
+		}, nil
+	case imapResponderProfile:
+		return &gs.ScriptedResponder{
+			Greeting:  "* OK [CAPABILITY IMAP4rev1 AUTH=LOGIN] IMAP server ready\r\n",
+			Delimiter: "\n",
+			Rules: []gs.ResponderRule{
+				{Match: regexp.MustCompile(`(?i)^(\S+) CAPABILITY`), Response: "* CAPABILITY IMAP4rev1 AUTH=LOGIN\r\n${1} OK CAPABILITY completed\r\n"},
+				{Match: regexp.MustCompile(`(?i)^(\S+) LOGIN `), Response: "${1} OK LOGIN completed\r\n"},
+				{Match: regexp.MustCompile(`(?i)^(\S+) STARTTLS`), Response: "${1} BAD STARTTLS not available\r\n"},
+				{Match: regexp.MustCompile(`(?i)^(\S+) LOGOUT`), Response: "* BYE logging out\r\n${1} OK LOGOUT completed\r\n", Close: true},
+				{Match: regexp.MustCompile(`^(\S+) `), Response: "${1} OK completed\r\n"},
+			},
+		}, nil
+	case pop3ResponderProfile:
+		return &gs.ScriptedResponder{
+			Greeting:  "+OK POP3 server ready\r\n",
+			Delimiter: "\n",
+			Rules: []gs.ResponderRule{
+				{Match: regexp.MustCompile(`(?i)^CAPA`), Response: "+OK\r\nUSER\r\n.\r\n"},
+				{Match: regexp.MustCompile(`(?i)^USER`), Response: "+OK\r\n"},
+				{Match: regexp.MustCompile(`(?i)^PASS`), Response: "+OK logged in\r\n"},
+				{Match: regexp.MustCompile(`(?i)^STAT`), Response: "+OK 0 0\r\n"},
+				{Match: regexp.MustCompile(`(?i)^(LIST|UIDL)`), Response: "+OK\r\n.\r\n"},
+				{Match: regexp.MustCompile(`(?i)^QUIT`), Response: "+OK bye\r\n", Close: true},
+			},
+			Default: "-ERR unknown command\r\n",
+		}, nil
+	case httpResponderProfile:
+		if realm == "" {
+			realm = defaultHTTPRealm
+		}
+		realm = strings.ReplaceAll(realm, `"`, `\"`)
+		return &gs.ScriptedResponder{
+			Delimiter:  "\r\n\r\n",
+			MessageLen: httpMessageLen,
+			Rules: []gs.ResponderRule{
+				{Match: regexp.MustCompile(`(?i)\nAuthorization: `), Response: "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"},
+			},
+			Default: "HTTP/1.1 401 Unauthorized\r\n" +
+				"WWW-Authenticate: Basic realm=\"" + realm + "\"\r\n" +
+				"Content-Length: 0\r\n\r\n",
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown responder profile: %s", profile)
+}
+
+// httpContentLength matches the Content-Length header of a request.
+var httpContentLength = regexp.MustCompile(`(?i)\nContent-Length:[ \t]*(\d+)[ \t]*\r?\n`)
+
+// httpMessageLen returns the length of an HTTP/1.x request given its
+// header, including the body of Content-Length bytes that follows it.
+func httpMessageLen(head []byte) int {
+	m := httpContentLength.FindSubmatch(head)
+	if m == nil {
+		return len(head)
+	}
+	n, err := strconv.Atoi(string(m[1]))
+	if err != nil {
+		// too large to be buffered anyway
+		return math.MaxInt
+	}
+	return len(head) + min(n, math.MaxInt-len(head))
+}
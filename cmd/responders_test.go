@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHTTPMessageLen(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		want int
+	}{
+		{name: "no body", head: "GET / HTTP/1.1\r\nHost: x\r\n\r\n", want: 27},
+		{name: "content length", head: "POST / HTTP/1.1\r\ncontent-length: 11\r\n\r\n", want: 39 + 11},
+		{name: "bare newlines", head: "POST / HTTP/1.1\nContent-Length:\t3 \n\n", want: 36 + 3},
+		{name: "invalid content length", head: "POST / HTTP/1.1\r\nContent-Length: -1\r\n\r\n", want: 39},
+		{name: "huge content length", head: "POST / HTTP/1.1\r\nContent-Length: 99999999999999999999\r\n\r\n",
+			want: math.MaxInt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := httpMessageLen([]byte(tt.head)); got != tt.want {
+				t.Errorf("httpMessageLen() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProfileResponder_HTTP(t *testing.T) {
+	r, err := profileResponder(httpResponderProfile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	victim, server := net.Pipe()
+	defer victim.Close()
+	go func() {
+		defer server.Close()
+		r.Respond(context.Background(), server)
+	}()
+	victim.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the body contains a blank line, which must not be treated as the
+	// end of another request
+	const (
+		body       = "a=1\r\n\r\nb=2"
+		challenge  = "HTTP/1.1 401 Unauthorized\r\nWWW-Authenticate: Basic realm=\"Restricted\"\r\nContent-Length: 0\r\n\r\n"
+		authorized = "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	)
+	for _, e := range [][2]string{
+		{"POST /login HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\n" + body, challenge},
+		{"GET / HTTP/1.1\r\nHost: x\r\nAuthorization: Basic dXNlcjpwYXNz\r\n\r\n", authorized},
+	} {
+		if _, err = victim.Write([]byte(e[0])); err != nil {
+			t.Fatal("failed to write request", err)
+		}
+		b := make([]byte, len(e[1]))
+		if _, err = io.ReadFull(victim, b); err != nil {
+			t.Fatal("failed to read response", err)
+		} else if string(b) != e[1] {
+			t.Errorf("response = %q, want %q", b, e[1])
+		}
+	}
+}
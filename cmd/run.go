@@ -2,13 +2,15 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/impostorkeanu/gosplit"
 	"github.com/spf13/cobra"
 	"io"
-	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var (
@@ -20,17 +22,53 @@ var (
 		Example: `
 gosplit run --listen-addr 192.168.1.2:10000 --downstream-addr 192.168.1.3:10000 \
   --cert-file crt.pem --key-file key.pem \
-  --log-file /tmp/logs.json --nss-key-log-file /tmp/key-log.nss --data-log-file /tmp/data.json`,
+  --log-file /tmp/logs.json --nss-key-log-file /tmp/key-log.nss --data-log-file /tmp/data.json
+
+gosplit run --listen-addr 192.168.1.2:443 --downstream-addr 192.168.1.3:443 \
+  --cert-file crt.pem --key-file key.pem \
+  --allow-victim 192.168.1.0/24 --deny-victim @out-of-scope.txt \
+  --deny-sni '*.microsoft.com' --deny-action passthrough
+
+gosplit run --listen-addr 192.168.1.2:25 --responder smtp \
+  --cert-file crt.pem --key-file key.pem --data-log-file /tmp/data.json
+
+gosplit run --config gosplit.yaml`,
 	}
 
-	listenAddr     string // socket where the proxy will listen
-	downstreamAddr string // socket where the proxy will send traffic to
-	logFile        string // standard log file
-	dataLogFile    string // log file dedicated to extracted data
-	dataToLog      bool   // log data to logFile instead of dataLogFile
-	nssFile        string // file to receive nss keys to decrypt packet captures
+	configFile     string             // yaml file describing listeners
+	watchConfig    bool               // reload configFile when it changes
+	listenAddr     string             // socket where the proxy will listen
+	downstreamAddr string             // socket where the proxy will send traffic to
+	logFile        string             // standard log file
+	dataLogFile    string             // log file dedicated to extracted data
+	dataToLog      bool               // log data to logFile instead of dataLogFile
+	nssFile        string             // file to receive nss keys to decrypt packet captures
+	credsFile      string             // file to receive extracted credentials
+	hashesFile     string             // file to receive hashes of extracted credentials
+	harFile        string             // file to receive http exchanges in har format
+	websocketFile  string             // file to receive websocket messages
+	ldapFile       string             // file to receive ldap messages
+	shutdownTime   time.Duration      // time allowed for connections to drain on shutdown
+	connLimits     gosplit.ConnLimits // limits enforced on accepted connections
+	allowVictims   []string           // victim ips and cidrs to intercept
+	denyVictims    []string           // victim ips and cidrs not to intercept
+	allowSNI       []string           // server name patterns to intercept
+	denySNI        []string           // server name patterns not to intercept
+	denyAction     string             // action taken for denied connections
+	adminAddr      string             // socket where the admin api will listen
+	adminToken     string             // bearer token required by the admin api
+	metricsAddr    string             // socket where prometheus metrics are served
+	tuiMode        bool               // show a terminal ui instead of printing logs
+	responderName  string             // fake server played when there is no downstream
+	startTLSProto  string             // protocol whose tls upgrades are negotiated
+	stripNLA       bool               // remove nla from rdp connection requests
+	legacySSL      string             // action taken for victims sending sslv2 or sslv3 hellos
 )
 
+// configWatchInterval is how often --config is checked for changes
+// when --watch-config is supplied.
+const configWatchInterval = 2 * time.Second
+
 type (
 	teeWriter struct {
 		io.Writer
@@ -41,10 +79,24 @@ type (
 )
 
 func init() {
+	runCmd.PersistentFlags().StringVarP(&configFile, "config", "f", "",
+		"YAML file describing listeners to run (see the README for the format); reloaded upon SIGHUP")
+	runCmd.PersistentFlags().BoolVar(&watchConfig, "watch-config", false,
+		"Reload --config when the file changes")
+	runCmd.PersistentFlags().StringVarP(&pemCertFile, "cert-file", "c", "",
+		"File to read PEM certificate from")
+	runCmd.PersistentFlags().StringVarP(&pemKeyFile, "key-file", "k", "",
+		"File to read PEM key from")
 	runCmd.PersistentFlags().StringVarP(&listenAddr, "listen-addr", "l", "",
 		"Socket the proxy server will listen on, e.g., 192.168.1.86:443")
 	runCmd.PersistentFlags().StringVarP(&downstreamAddr, "downstream-addr", "d", "",
 		"Socket that the proxy will send traffic to, e.g., 192.168.1.250:443")
+	runCmd.PersistentFlags().StringVar(&responderName, "responder", "",
+		"Play a fake server instead of proxying to a downstream: smtp, ftp, imap, pop3, or http")
+	runCmd.PersistentFlags().StringVar(&startTLSProto, "starttls", "",
+		"Intercept connections upgraded to TLS after exchanging cleartext with the downstream: ldap, postgres, mysql, ftp, rdp, xmpp, nntp, sieve, or any")
+	runCmd.PersistentFlags().BoolVar(&stripNLA, "strip-nla", false,
+		"Remove Network Level Authentication from RDP connection requests intercepted using --starttls rdp")
 	runCmd.PersistentFlags().StringVarP(&logFile, "log-file", "x", "gosplit.log",
 		"File to write JSON log messages to")
 	runCmd.PersistentFlags().StringVarP(&dataLogFile, "data-log-file", "o", "",
@@ -53,29 +105,56 @@ func init() {
 		"Results in data being sent to the log file instead of --data-log-file")
 	runCmd.PersistentFlags().StringVarP(&nssFile, "nss-key-log-file", "n", "",
 		"File to receive Network Security Services key log file for Wireshark")
-	prExit(runCmd.MarkPersistentFlagRequired("listen-addr"), flagRequiredMsg)
-	prExit(runCmd.MarkPersistentFlagRequired("downstream-addr"), flagRequiredMsg)
+	runCmd.PersistentFlags().StringVar(&credsFile, "creds-file", "",
+		"File to write credentials extracted from intercepted data to (extraction is disabled when empty)")
+	runCmd.PersistentFlags().StringVar(&hashesFile, "hashes-file", "",
+		"File to write crackable hashes of extracted credentials to in hashcat format, e.g., NetNTLMv2")
+	runCmd.PersistentFlags().StringVar(&harFile, "har-file", "",
+		"File to write intercepted HTTP/1.x and HTTP/2 requests and responses to in HAR 1.2 format")
+	runCmd.PersistentFlags().StringVar(&websocketFile, "websocket-file", "",
+		"File to write messages sent over intercepted WebSockets to")
+	runCmd.PersistentFlags().StringVar(&ldapFile, "ldap-file", "",
+		"File to write decoded LDAP messages to")
+	runCmd.PersistentFlags().DurationVar(&shutdownTime, "shutdown-timeout", 10*time.Second,
+		"Time allowed for active connections to finish after receiving SIGINT or SIGTERM")
+	runCmd.PersistentFlags().IntVar(&connLimits.MaxConns, "max-conns", 0,
+		"Maximum number of concurrent connections (0 for no limit)")
+	runCmd.PersistentFlags().IntVar(&connLimits.MaxVictimConns, "max-victim-conns", 0,
+		"Maximum number of concurrent connections per victim IP (0 for no limit)")
+	runCmd.PersistentFlags().Float64Var(&connLimits.VictimRate, "victim-rate", 0,
+		"New connections per second allowed per victim IP (0 for no limit)")
+	runCmd.PersistentFlags().IntVar(&connLimits.VictimBurst, "victim-burst", 1,
+		"New connections a victim IP can make in a burst beyond --victim-rate")
+	runCmd.PersistentFlags().StringSliceVar(&allowVictims, "allow-victim", nil,
+		"Victim IP or CIDR to intercept; all other victims are denied (@file to read from a file)")
+	runCmd.PersistentFlags().StringSliceVar(&denyVictims, "deny-victim", nil,
+		"Victim IP or CIDR not to intercept (@file to read from a file)")
+	runCmd.PersistentFlags().StringSliceVar(&allowSNI, "allow-sni", nil,
+		"TLS server name glob pattern to intercept; all other TLS connections are denied (@file to read from a file)")
+	runCmd.PersistentFlags().StringSliceVar(&denySNI, "deny-sni", nil,
+		"TLS server name glob pattern not to intercept (@file to read from a file)")
+	runCmd.PersistentFlags().StringVar(&denyAction, "deny-action", passthroughDenyAction,
+		"Action taken for denied connections: passthrough or reject")
+	runCmd.PersistentFlags().StringVar(&legacySSL, "legacy-ssl", passthroughLegacyAction,
+		"Action taken for victims sending SSLv2 or SSLv3 hellos, which can't be intercepted: passthrough, reject, or alert")
+	runCmd.PersistentFlags().StringVar(&adminAddr, "admin-addr", "",
+		"Socket the admin HTTP API will listen on, e.g., 127.0.0.1:8080 (disabled when empty; non-loopback sockets require --admin-token)")
+	runCmd.PersistentFlags().StringVar(&adminToken, "admin-token", "",
+		"Bearer token required by the admin HTTP API")
+	runCmd.PersistentFlags().StringVar(&metricsAddr, "metrics-addr", "",
+		"Socket to serve Prometheus metrics on at /metrics, e.g., 127.0.0.1:9090 (disabled when empty)")
+	runCmd.PersistentFlags().BoolVar(&tuiMode, "tui", false,
+		"Watch sessions in a terminal UI instead of printing log records to stdout")
+	runCmd.PersistentFlags().StringVar(&tuiFilter, "filter", "",
+		"Initial --tui session filter, e.g., 'victim:10.0.0.5 sni:*.example.com content:password'")
 }
 
 func openFile(n string) (*os.File, error) {
 	return os.OpenFile(n, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 }
 
-func dstOpenFile(dst *io.Writer, n string, newline bool) error {
-	if n == "" {
-		return nil
-	}
-	d, err := openFile(n)
-	if newline {
-		*dst = &newlineWriter{d}
-	} else {
-		*dst = d
-	}
-	return err
-}
-
 func (w *teeWriter) Write(p []byte) (n int, err error) {
-	fmt.Println(string(p))
+	con.printf("%s", p)
 	return w.Writer.Write(p)
 }
 
@@ -84,66 +163,228 @@ func (w *newlineWriter) Write(p []byte) (n int, err error) {
 	return w.Writer.Write(p)
 }
 
-func runServer(cmd *cobra.Command, args []string) {
-
-	// initialize the config
-	// - any writers not configured send output to io.Discard
-	// - KeyLogWriter for downstream tls nss is configured later
-	cfg := config{
-		logWriter:        io.Discard,
-		dataWriter:       io.Discard,
-		nssWriter:        io.Discard,
-		dataToLog:        dataToLog,
-		downstreamTlsCfg: &tls.Config{InsecureSkipVerify: true},
+// runFileFromFlags builds a runFile describing the single listener
+// configured through command line flags.
+func runFileFromFlags() (*runFile, error) {
+	if listenAddr == "" || (downstreamAddr == "" && responderName == "") {
+		return nil, errors.New("--listen-addr and --downstream-addr or --responder are required when --config is not supplied")
+	} else if pemCertFile == "" || pemKeyFile == "" {
+		return nil, errors.New("--cert-file and --key-file are required when --config is not supplied")
+	}
+	f := &runFile{
+		LogFile:         logFile,
+		DataLogFile:     dataLogFile,
+		DataToLog:       dataToLog,
+		NSSKeyLogFile:   nssFile,
+		CredsFile:       credsFile,
+		HashesFile:      hashesFile,
+		HARFile:         harFile,
+		WebSocketFile:   websocketFile,
+		LDAPFile:        ldapFile,
+		ShutdownTimeout: shutdownTime,
+		AdminAddr:       adminAddr,
+		AdminToken:      adminToken,
+		MetricsAddr:     metricsAddr,
+		Cert:            &certFileCfg{CertFile: pemCertFile, KeyFile: pemKeyFile},
+		Listeners: []listenerSpec{{
+			ListenAddr:     listenAddr,
+			DownstreamAddr: downstreamAddr,
+			Limits:         limitsSpec(connLimits),
+			Responder:      responderSpec{Profile: responderName},
+			StartTLS:       startTLSSpec{Protocol: startTLSProto, StripNLA: stripNLA},
+			TLS:            tlsSpec{LegacySSL: legacySSL},
+			Filter: filterSpec{
+				AllowVictims: allowVictims,
+				DenyVictims:  denyVictims,
+				AllowSNI:     allowSNI,
+				DenySNI:      denySNI,
+				DenyAction:   denyAction,
+			},
+		}},
 	}
+	return f, f.validate()
+}
 
-	//=================================
-	// PREPARE SERVER TLS AND ADDRESSES
-	//=================================
+// reloadRunFile applies the config file to the running listeners,
+// returning the file that is in effect afterward.
+func reloadRunFile(ls *listenerSet, current *runFile) *runFile {
+	if configFile == "" {
+		con.printf("Ignoring reload request; --config was not supplied")
+		return current
+	}
+	con.printf("Reloading %s", configFile)
+	rf, err := loadRunFile(configFile)
+	if err != nil {
+		con.errorf("error while reloading configuration (keeping current listeners): %v", err)
+		return current
+	}
+	if rf.LogFile != current.LogFile {
+		con.printf("Changes to log_file require a restart and are ignored")
+		rf.LogFile = current.LogFile
+	}
+	if rf.AdminAddr != current.AdminAddr || rf.AdminToken != current.AdminToken || rf.MetricsAddr != current.MetricsAddr {
+		con.printf("Changes to admin_addr, admin_token, and metrics_addr require a restart and are ignored")
+		rf.AdminAddr, rf.AdminToken, rf.MetricsAddr = current.AdminAddr, current.AdminToken, current.MetricsAddr
+	}
+	if err = ls.reload(rf); err != nil {
+		con.errorf("error while reloading configuration: %v", err)
+	}
+	return rf
+}
 
-	t, err := tls.LoadX509KeyPair(pemCertFile, pemKeyFile)
-	prExit(err, "error while loading x509 keypair")
-	cfg.proxyCrt = &t
+// fileModTime returns the modification time of a file, or the zero
+// time if it can't be determined.
+func fileModTime(name string) time.Time {
+	if i, err := os.Stat(name); err == nil {
+		return i.ModTime()
+	}
+	return time.Time{}
+}
 
-	cfg.proxyIP, cfg.proxyPort, err = net.SplitHostPort(listenAddr)
-	prExit(err, "error while parsing --listen-addr")
+func runServer(cmd *cobra.Command, _ []string) {
 
-	cfg.downstreamIP, cfg.downstreamPort, err = net.SplitHostPort(downstreamAddr)
-	prExit(err, "error while parsing --downstream-addr")
+	var (
+		rf  *runFile
+		err error
+	)
+	if configFile != "" {
+		if cmd.Flags().Changed("listen-addr") || cmd.Flags().Changed("downstream-addr") || cmd.Flags().Changed("responder") {
+			prExit(errors.New("listener flags cannot be combined with --config"), "error while parsing flags")
+		}
+		if rf, err = loadRunFile(configFile); err == nil {
+			// admin flags take precedence over the file
+			if cmd.Flags().Changed("admin-addr") {
+				rf.AdminAddr = adminAddr
+			}
+			if cmd.Flags().Changed("admin-token") {
+				rf.AdminToken = adminToken
+			}
+			if cmd.Flags().Changed("metrics-addr") {
+				rf.MetricsAddr = metricsAddr
+			}
+		}
+	} else {
+		rf, err = runFileFromFlags()
+	}
+	prExit(err, "error while preparing configuration")
 
 	//=====================
 	// PREPARE OUTPUT FILES
 	//=====================
 
-	err = dstOpenFile(&cfg.logWriter, logFile, true)
-	prExit(err, "error while opening log file for writing")
+	// any writers not configured send output to io.Discard
+	outs := newOutputs()
+	var logWriter io.Writer = io.Discard
+	if rf.LogFile != "" {
+		f, err := outs.open(rf.LogFile)
+		prExit(err, "error while opening log file for writing")
+		logWriter = &newlineWriter{f}
+	}
 
-	// tee records destined to the log file to stdout
-	cfg.logWriter = &teeWriter{cfg.logWriter}
+	// tee records destined to the log file to stdout, unless the
+	// terminal ui is displaying them
+	if !tuiMode {
+		logWriter = &teeWriter{logWriter}
+	}
 
-	err = dstOpenFile(&cfg.dataWriter, dataLogFile, true)
-	prExit(err, "error while data file for writing")
+	//================
+	// RUN THE SERVERS
+	//================
 
-	err = dstOpenFile(&cfg.nssWriter, nssFile, false)
-	prExit(err, "error while opening nss key file file for writing")
+	sh := &shared{logWriter: logWriter, outs: outs, overrides: newVictimOverrides()}
+	if rf.AdminAddr != "" || tuiMode {
+		sh.events = newEventHub()
+	}
+	ls := newListenerSet(sh)
+	for _, spec := range rf.Listeners {
+		if err = ls.start(spec, rf.DataToLog); err != nil {
+			ls.stopAll(rf.ShutdownTimeout)
+			prExit(err, "error starting the proxy server")
+		}
+	}
 
-	if cfg.nssWriter != io.Discard {
-		// send nss records to log file
-		cfg.downstreamTlsCfg.KeyLogWriter = cfg.nssWriter
+	var admin *adminServer
+	if rf.AdminAddr != "" {
+		admin = newAdminServer(rf.AdminAddr, rf.AdminToken, ls, sh)
+		if err = admin.start(); err != nil {
+			ls.stopAll(rf.ShutdownTimeout)
+			prExit(err, "error starting the admin api")
+		}
 	}
 
-	//===============
-	// RUN THE SERVER
-	//===============
+	var metrics *metricsServer
+	if rf.MetricsAddr != "" {
+		metrics = newMetricsServer(rf.MetricsAddr, ls)
+		if err = metrics.start(); err != nil {
+			ls.stopAll(rf.ShutdownTimeout)
+			prExit(err, "error starting the metrics server")
+		}
+	}
 
-	fmt.Printf("Starting server on %s\n", listenAddr)
-	var l net.Listener
-	l, err = net.Listen("tcp", listenAddr)
-	if err != nil {
-		fmt.Printf("Error listening on %s: %s\n", listenAddr, err)
-		return
+	// drain connections upon receiving a signal so that all events are
+	// written before the process exits
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var tuiDone <-chan error
+	if tuiMode {
+		tuiDone, err = startRunTUI(ctx, ls, sh)
+		if err != nil {
+			ls.stopAll(rf.ShutdownTimeout)
+			prExit(err, "error starting the terminal ui")
+		}
+	}
+
+	// reload the config file upon SIGHUP or, optionally, when it changes
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var (
+		watchC  <-chan time.Time
+		modTime time.Time
+	)
+	if configFile != "" && watchConfig {
+		modTime = fileModTime(configFile)
+		t := time.NewTicker(configWatchInterval)
+		defer t.Stop()
+		watchC = t.C
+	}
+
+ctrl:
+	for {
+		select {
+		case <-ctx.Done():
+			con.printf("Shutting down; waiting for active connections to finish")
+			break ctrl
+		case err = <-tuiDone:
+			prExit(err, "error running the terminal ui")
+			con.printf("Shutting down; waiting for active connections to finish")
+			break ctrl
+		case name := <-ls.failed:
+			con.printf("Listener %s stopped unexpectedly; shutting down", name)
+			break ctrl
+		case <-watchC:
+			if mt := fileModTime(configFile); !mt.Equal(modTime) {
+				modTime = mt
+				rf = reloadRunFile(ls, rf)
+			}
+		case <-hup:
+			rf = reloadRunFile(ls, rf)
+		}
+	}
+
+	err = ls.stopAll(rf.ShutdownTimeout)
+	if admin != nil {
+		if e := admin.shutdown(rf.ShutdownTimeout); e != nil {
+			err = errors.Join(err, fmt.Errorf("error stopping admin api: %w", e))
+		}
+	}
+	if metrics != nil {
+		if e := metrics.shutdown(rf.ShutdownTimeout); e != nil {
+			err = errors.Join(err, fmt.Errorf("error stopping metrics server: %w", e))
+		}
 	}
-	err = gosplit.NewProxyServer(cfg, l).Serve(context.Background())
+	outs.closeAll()
 
 	prExit(err, "error running the proxy server")
 }
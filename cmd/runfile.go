@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	gs "github.com/impostorkeanu/gosplit"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCertOrg     = "GoSplit"
+	defaultCertKeyBits = 2048
+)
+
+type (
+	// runFile is the format of the configuration file accepted by
+	// gosplit run --config.
+	//
+	// Output files and the certificate configured at the top level are
+	// used by listeners that do not configure their own.
+	runFile struct {
+		LogFile         string        `yaml:"log_file"`
+		DataLogFile     string        `yaml:"data_log_file"`
+		DataToLog       bool          `yaml:"data_to_log"`
+		NSSKeyLogFile   string        `yaml:"nss_key_log_file"`
+		CredsFile       string        `yaml:"creds_file"`
+		HashesFile      string        `yaml:"hashes_file"`
+		HARFile         string        `yaml:"har_file"`
+		WebSocketFile   string        `yaml:"websocket_file"`
+		LDAPFile        string        `yaml:"ldap_file"`
+		ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+		// AdminAddr is the socket the admin api listens on. The api is
+		// disabled when empty.
+		AdminAddr string `yaml:"admin_addr"`
+		// AdminToken, when set, must be sent by admin api clients as a
+		// bearer token.
+		AdminToken string `yaml:"admin_token"`
+		// MetricsAddr is the socket Prometheus metrics are served on. The
+		// metrics server is disabled when empty.
+		MetricsAddr string         `yaml:"metrics_addr"`
+		Cert        *certFileCfg   `yaml:"cert"`
+		Listeners   []listenerSpec `yaml:"listeners"`
+	}
+
+	// listenerSpec describes a single proxy listener.
+	listenerSpec struct {
+		// Name identifies the listener in logs. Defaults to ListenAddr.
+		Name       string `yaml:"name"`
+		ListenAddr string `yaml:"listen_addr"`
+		// DownstreamAddr receives traffic from victims that do not
+		// match a route. When empty and no route matches, initial
+		// victim data is captured before the connection is closed.
+		DownstreamAddr string       `yaml:"downstream_addr"`
+		Routes         []routeSpec  `yaml:"routes"`
+		Cert           *certFileCfg `yaml:"cert"`
+		TLS            tlsSpec      `yaml:"tls"`
+		DataLogFile    string       `yaml:"data_log_file"`
+		NSSKeyLogFile  string       `yaml:"nss_key_log_file"`
+		CredsFile      string       `yaml:"creds_file"`
+		HashesFile     string       `yaml:"hashes_file"`
+		HARFile        string       `yaml:"har_file"`
+		WebSocketFile  string       `yaml:"websocket_file"`
+		LDAPFile       string       `yaml:"ldap_file"`
+		Limits         limitsSpec   `yaml:"limits"`
+		Filter         filterSpec   `yaml:"filter"`
+		// Responder converses with victims that have no downstream
+		// instead of capturing only the initial data they send.
+		Responder responderSpec `yaml:"responder"`
+		// StartTLS negotiates upgrades to TLS after victims exchange
+		// cleartext with the downstream, allowing them to be intercepted.
+		StartTLS startTLSSpec `yaml:"starttls"`
+	}
+
+	// routeSpec sends victims matching any of the IPs or CIDRs in
+	// Victims to DownstreamAddr.
+	routeSpec struct {
+		Victims        []string `yaml:"victims"`
+		DownstreamAddr string   `yaml:"downstream_addr"`
+	}
+
+	// certFileCfg selects the certificate source for a listener.
+	//
+	// Either CertFile and KeyFile must be set, or Generate must be true.
+	certFileCfg struct {
+		CertFile string `yaml:"cert_file"`
+		KeyFile  string `yaml:"key_file"`
+		// Generate self-signed certificates for each server name
+		// requested by victims.
+		Generate bool   `yaml:"generate"`
+		OrgName  string `yaml:"org_name"`
+		KeyBits  int    `yaml:"key_bits"`
+	}
+
+	// tlsSpec customizes the TLS configurations of a listener.
+	tlsSpec struct {
+		MinVersion string `yaml:"min_version"` // minimum version offered to victims, e.g., "1.2"
+		MaxVersion string `yaml:"max_version"` // maximum version offered to victims
+		// VerifyDownstream enables verification of downstream certificates.
+		VerifyDownstream bool `yaml:"verify_downstream"`
+		// DownstreamServerName overrides the server name sent to downstreams.
+		DownstreamServerName string `yaml:"downstream_server_name"`
+		// LegacySSL is the action taken for victims sending SSLv2 or
+		// SSLv3 hellos: passthrough (default), reject, or alert.
+		LegacySSL string `yaml:"legacy_ssl"`
+	}
+
+	// limitsSpec mirrors gs.ConnLimits.
+	limitsSpec struct {
+		MaxConns       int     `yaml:"max_conns"`
+		MaxVictimConns int     `yaml:"max_victim_conns"`
+		VictimRate     float64 `yaml:"victim_rate"`
+		VictimBurst    int     `yaml:"victim_burst"`
+	}
+
+	// filterSpec configures a connFilter.
+	filterSpec struct {
+		AllowVictims []string `yaml:"allow_victims"`
+		DenyVictims  []string `yaml:"deny_victims"`
+		AllowSNI     []string `yaml:"allow_sni"`
+		DenySNI      []string `yaml:"deny_sni"`
+		DenyAction   string   `yaml:"deny_action"`
+	}
+
+	// route is a parsed routeSpec.
+	route struct {
+		victims    []netip.Prefix
+		downstream gs.Addr
+	}
+
+	// outputs opens output files once, allowing listeners to share them.
+	// Files are closed once released by every listener that opened them.
+	outputs struct {
+		m     sync.Mutex
+		files map[string]*os.File
+		hars  map[string]*harWriter
+		refs  map[string]int // number of times each name was opened and not released
+	}
+)
+
+// loadRunFile reads and validates a YAML configuration file.
+func loadRunFile(name string) (f *runFile, err error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+	f = new(runFile)
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err = dec.Decode(f); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error parsing config file: %w", err)
+	}
+	return f, f.validate()
+}
+
+// validate the file and apply defaults.
+func (f *runFile) validate() error {
+	if len(f.Listeners) == 0 {
+		return errors.New("at least one listener is required")
+	}
+	if f.ShutdownTimeout == 0 {
+		f.ShutdownTimeout = 10 * time.Second
+	}
+	names := make(map[string]bool)
+	for i := range f.Listeners {
+		l := &f.Listeners[i]
+		if l.ListenAddr == "" {
+			return fmt.Errorf("listener %d: listen_addr is required", i)
+		} else if l.Name == "" {
+			l.Name = l.ListenAddr
+		}
+		if names[l.Name] {
+			return fmt.Errorf("listener %d: duplicate name: %s", i, l.Name)
+		}
+		names[l.Name] = true
+		if l.Cert == nil {
+			l.Cert = f.Cert
+		}
+		if l.Cert == nil {
+			return fmt.Errorf("listener %s: a certificate is required", l.Name)
+		} else if !l.Cert.Generate && (l.Cert.CertFile == "" || l.Cert.KeyFile == "") {
+			return fmt.Errorf("listener %s: cert_file and key_file are required unless generate is true", l.Name)
+		}
+		if l.DataLogFile == "" {
+			l.DataLogFile = f.DataLogFile
+		}
+		if l.NSSKeyLogFile == "" {
+			l.NSSKeyLogFile = f.NSSKeyLogFile
+		}
+		if l.CredsFile == "" {
+			l.CredsFile = f.CredsFile
+		}
+		if l.HashesFile == "" {
+			l.HashesFile = f.HashesFile
+		}
+		if l.HARFile == "" {
+			l.HARFile = f.HARFile
+		}
+		if l.WebSocketFile == "" {
+			l.WebSocketFile = f.WebSocketFile
+		}
+		if l.LDAPFile == "" {
+			l.LDAPFile = f.LDAPFile
+		}
+		if l.Filter.DenyAction == "" {
+			l.Filter.DenyAction = passthroughDenyAction
+		}
+	}
+	return nil
+}
+
+// newConfig initializes the config used to run the listener.
+//
+// certs is used as the certificate source when non-nil, otherwise a
+// source is initialized from the listener's certificate configuration.
+func (l *listenerSpec) newConfig(sh *shared, dataToLog bool, certs certSource) (c config, err error) {
+
+	c = config{
+		name:       l.Name,
+		logWriter:  sh.logWriter,
+		dataWriter: io.Discard,
+		nssWriter:  io.Discard,
+		dataToLog:  dataToLog,
+		connLimits: gs.ConnLimits(l.Limits),
+		overrides:  sh.overrides,
+		events:     sh.events,
+	}
+
+	// files opened for the listener are released when it can't run
+	defer func() {
+		if err != nil {
+			sh.outs.release(c.outputs...)
+		}
+	}()
+	open := func(name string) (f *os.File, err error) {
+		if f, err = sh.outs.open(name); err == nil {
+			c.outputs = append(c.outputs, name)
+		}
+		return
+	}
+
+	//========================
+	// PREPARE ROUTES AND TLS
+	//========================
+
+	if l.DownstreamAddr != "" {
+		var a gs.Addr
+		if a.IP, a.Port, err = net.SplitHostPort(l.DownstreamAddr); err != nil {
+			return c, fmt.Errorf("error parsing downstream address: %w", err)
+		}
+		c.downstream = &a
+	}
+	for _, r := range l.Routes {
+		var rt route
+		if rt.downstream.IP, rt.downstream.Port, err = net.SplitHostPort(r.DownstreamAddr); err != nil {
+			return c, fmt.Errorf("error parsing route downstream address: %w", err)
+		} else if rt.victims, err = parsePrefixes(r.Victims); err != nil {
+			return c, fmt.Errorf("error parsing route victims: %w", err)
+		}
+		c.routes = append(c.routes, rt)
+	}
+
+	if c.certs = certs; c.certs == nil {
+		if c.certs, err = l.Cert.source(); err != nil {
+			return
+		}
+	}
+	if c.minVersion, err = parseTLSVersion(l.TLS.MinVersion); err != nil {
+		return
+	} else if c.maxVersion, err = parseTLSVersion(l.TLS.MaxVersion); err != nil {
+		return
+	} else if c.legacyPolicy, err = parseLegacyPolicy(l.TLS.LegacySSL); err != nil {
+		return
+	}
+	c.downstreamTlsCfg = &tls.Config{
+		InsecureSkipVerify: !l.TLS.VerifyDownstream,
+		ServerName:         l.TLS.DownstreamServerName,
+	}
+
+	if r, e := l.Responder.responder(); e != nil {
+		return c, fmt.Errorf("error preparing responder: %w", e)
+	} else if r != nil {
+		c.responder = r
+	}
+	if u, e := l.StartTLS.upgrader(); e != nil {
+		return c, fmt.Errorf("error preparing starttls: %w", e)
+	} else if u != nil {
+		c.upgrader = u
+	}
+
+	c.filter, err = newConnFilter(l.Filter.AllowVictims, l.Filter.DenyVictims,
+		l.Filter.AllowSNI, l.Filter.DenySNI, l.Filter.DenyAction)
+	if err != nil {
+		return c, fmt.Errorf("error parsing victim and sni filters: %w", err)
+	}
+
+	//=====================
+	// PREPARE OUTPUT FILES
+	//=====================
+
+	if l.DataLogFile != "" {
+		var f *os.File
+		if f, err = open(l.DataLogFile); err != nil {
+			return c, fmt.Errorf("error opening data file for writing: %w", err)
+		}
+		c.dataWriter = &newlineWriter{f}
+	}
+	if l.NSSKeyLogFile != "" {
+		var f *os.File
+		if f, err = open(l.NSSKeyLogFile); err != nil {
+			return c, fmt.Errorf("error opening nss key file for writing: %w", err)
+		}
+		c.nssWriter = f
+		c.downstreamTlsCfg.KeyLogWriter = f
+	}
+	if l.CredsFile != "" || l.HashesFile != "" {
+		var credsW, hashesW io.Writer
+		if l.CredsFile != "" {
+			var f *os.File
+			if f, err = open(l.CredsFile); err != nil {
+				return c, fmt.Errorf("error opening creds file for writing: %w", err)
+			}
+			credsW = &newlineWriter{f}
+		}
+		if l.HashesFile != "" {
+			var f *os.File
+			if f, err = open(l.HashesFile); err != nil {
+				return c, fmt.Errorf("error opening hashes file for writing: %w", err)
+			}
+			hashesW = &newlineWriter{f}
+		}
+		c.creds = gs.NewCredExtractor(c.credReceiver(credsW, hashesW))
+	}
+	if l.HARFile != "" || l.WebSocketFile != "" {
+		var recv func(gs.HTTPExchange)
+		if l.HARFile != "" {
+			var w *harWriter
+			if w, err = sh.outs.har(l.HARFile); err != nil {
+				return c, fmt.Errorf("error opening har file for writing: %w", err)
+			}
+			c.outputs = append(c.outputs, l.HARFile)
+			recv = c.harReceiver(w)
+		}
+		c.http = gs.NewHTTPParser(recv)
+		if l.WebSocketFile != "" {
+			var f *os.File
+			if f, err = open(l.WebSocketFile); err != nil {
+				return c, fmt.Errorf("error opening websocket file for writing: %w", err)
+			}
+			c.http.RecvWebSocket = c.webSocketReceiver(&newlineWriter{f})
+		}
+	}
+	if l.LDAPFile != "" {
+		var f *os.File
+		if f, err = open(l.LDAPFile); err != nil {
+			return c, fmt.Errorf("error opening ldap file for writing: %w", err)
+		}
+		c.ldap = gs.NewLDAPDecoder(c.ldapReceiver(&newlineWriter{f}))
+	}
+
+	return
+}
+
+// source initializes the certificate source described by c.
+func (c *certFileCfg) source() (certSource, error) {
+	if !c.Generate {
+		return newStaticCertSource(c.CertFile, c.KeyFile)
+	}
+	org, bits := c.OrgName, c.KeyBits
+	if org == "" {
+		org = defaultCertOrg
+	}
+	if bits == 0 {
+		bits = defaultCertKeyBits
+	}
+	return newGenCertSource(org, bits)
+}
+
+// parseTLSVersion converts versions like "1.2" to tls.VersionTLS12.
+//
+// Zero is returned for empty strings, allowing crypto/tls to select
+// its default.
+func parseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported tls version: %s", v)
+}
+
+// actions taken for victims sending sslv2 or sslv3 hellos
+const (
+	passthroughLegacyAction = "passthrough"
+	rejectLegacyAction      = "reject"
+	alertLegacyAction       = "alert"
+)
+
+// parseLegacyPolicy converts the action taken for legacy hellos to a
+// gs.LegacyHelloPolicy.
+func parseLegacyPolicy(a string) (gs.LegacyHelloPolicy, error) {
+	switch a {
+	case "", passthroughLegacyAction:
+		return gs.LegacyPassthrough, nil
+	case rejectLegacyAction:
+		return gs.LegacyReject, nil
+	case alertLegacyAction:
+		return gs.LegacyAlert, nil
+	}
+	return 0, fmt.Errorf("unknown legacy ssl action: %s", a)
+}
+
+func newOutputs() *outputs {
+	return &outputs{files: make(map[string]*os.File), hars: make(map[string]*harWriter),
+		refs: make(map[string]int)}
+}
+
+// open a file for appending, returning the previously opened file
+// when name was already opened. Each successful call must be matched
+// by a call to release.
+func (o *outputs) open(name string) (f *os.File, err error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	if f = o.files[name]; f == nil {
+		if f, err = openFile(name); err != nil {
+			return
+		}
+		o.files[name] = f
+	}
+	o.refs[name]++
+	return
+}
+
+// har opens a HAR file, returning the previously opened writer when
+// name was already opened. Each successful call must be matched by a
+// call to release.
+func (o *outputs) har(name string) (w *harWriter, err error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	if w = o.hars[name]; w == nil {
+		if w, err = openHAR(name); err != nil {
+			return
+		}
+		o.hars[name] = w
+	}
+	o.refs[name]++
+	return
+}
+
+// release files opened by open and har, closing those no longer used.
+func (o *outputs) release(names ...string) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	for _, name := range names {
+		if o.refs[name]--; o.refs[name] > 0 {
+			continue
+		}
+		delete(o.refs, name)
+		if f := o.files[name]; f != nil {
+			f.Close()
+			delete(o.files, name)
+		}
+		if w := o.hars[name]; w != nil {
+			w.Close()
+			delete(o.hars, name)
+		}
+	}
+}
+
+// closeAll closes all opened files.
+func (o *outputs) closeAll() {
+	o.m.Lock()
+	defer o.m.Unlock()
+	for _, f := range o.files {
+		f.Close()
+	}
+	for _, w := range o.hars {
+		w.Close()
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/tls"
+	gs "github.com/impostorkeanu/gosplit"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testShared returns resources shared by listeners, closing the files
+// they open when the test ends.
+func testShared(t *testing.T) *shared {
+	sh := &shared{logWriter: io.Discard, outs: newOutputs(), overrides: newVictimOverrides()}
+	t.Cleanup(sh.outs.closeAll)
+	return sh
+}
+
+func TestLoadRunFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+		check   func(t *testing.T, f *runFile)
+	}{
+		{name: "defaults", yaml: `
+data_log_file: data.jsonl
+cert: {generate: true}
+listeners:
+  - listen_addr: 127.0.0.1:443
+  - name: ldap
+    listen_addr: 127.0.0.1:389
+    data_log_file: ldap.jsonl
+    cert: {cert_file: crt.pem, key_file: key.pem}
+`, check: func(t *testing.T, f *runFile) {
+			if f.ShutdownTimeout != 10*time.Second {
+				t.Errorf("ShutdownTimeout = %s, want 10s", f.ShutdownTimeout)
+			}
+			https, ldap := f.Listeners[0], f.Listeners[1]
+			if https.Name != "127.0.0.1:443" || https.DataLogFile != "data.jsonl" || !https.Cert.Generate ||
+				https.Filter.DenyAction != passthroughDenyAction {
+				t.Errorf("listener defaults not applied: %+v", https)
+			}
+			if ldap.DataLogFile != "ldap.jsonl" || ldap.Cert.CertFile != "crt.pem" {
+				t.Errorf("listener settings overridden by defaults: %+v", ldap)
+			}
+		}},
+		{name: "no listeners", yaml: "cert: {generate: true}\n", wantErr: "at least one listener"},
+		{name: "missing listen addr", yaml: "cert: {generate: true}\nlisteners: [{name: a}]\n",
+			wantErr: "listen_addr is required"},
+		{name: "duplicate name", yaml: `
+cert: {generate: true}
+listeners: [{name: a, listen_addr: ":1"}, {name: a, listen_addr: ":2"}]
+`, wantErr: "duplicate name"},
+		{name: "missing cert", yaml: "listeners: [{listen_addr: ':1'}]\n", wantErr: "a certificate is required"},
+		{name: "incomplete cert", yaml: "listeners: [{listen_addr: ':1', cert: {cert_file: crt.pem}}]\n",
+			wantErr: "cert_file and key_file are required"},
+		{name: "unknown field", yaml: "cert: {generate: true}\nlisteners: [{listen_addr: ':1', downstream: x}]\n",
+			wantErr: "error parsing config file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "gosplit.yml")
+			if err := os.WriteFile(name, []byte(tt.yaml), 0600); err != nil {
+				t.Fatal(err)
+			}
+			f, err := loadRunFile(name)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadRunFile() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("loadRunFile() error = %v", err)
+			}
+			tt.check(t, f)
+		})
+	}
+}
+
+func TestListenerSpec_newConfig(t *testing.T) {
+	certs := &staticCertSource{crt: &tls.Certificate{}}
+	tests := []struct {
+		name    string
+		spec    listenerSpec
+		wantErr string
+		check   func(t *testing.T, c config)
+	}{
+		{name: "configured", spec: listenerSpec{
+			Name:           "a",
+			DownstreamAddr: "10.0.0.1:443",
+			Routes:         []routeSpec{{Victims: []string{"10.1.0.0/16"}, DownstreamAddr: "10.0.0.2:443"}},
+			TLS:            tlsSpec{MinVersion: "1.2", LegacySSL: rejectLegacyAction, DownstreamServerName: "a.test"},
+			Limits:         limitsSpec{MaxConns: 5},
+			Filter:         filterSpec{DenyVictims: []string{"10.1.2.3"}, DenyAction: rejectDenyAction},
+			StartTLS:       startTLSSpec{Protocol: ldapStartTLSProtocol},
+			LDAPFile:       "ldap.jsonl",
+		}, check: func(t *testing.T, c config) {
+			if got, _ := c.GetDownstreamAddr(gs.Addr{IP: "10.1.2.4"}, gs.Addr{}); *got != (gs.Addr{IP: "10.0.0.2", Port: "443"}) {
+				t.Errorf("routed downstream = %+v, want 10.0.0.2:443", got)
+			}
+			if got, _ := c.GetDownstreamAddr(gs.Addr{IP: "10.2.0.1"}, gs.Addr{}); *got != (gs.Addr{IP: "10.0.0.1", Port: "443"}) {
+				t.Errorf("default downstream = %+v, want 10.0.0.1:443", got)
+			}
+			if c.minVersion != tls.VersionTLS12 || c.legacyPolicy != gs.LegacyReject ||
+				c.downstreamTlsCfg.ServerName != "a.test" || !c.downstreamTlsCfg.InsecureSkipVerify {
+				t.Errorf("tls settings not applied: %+v", c)
+			}
+			if c.connLimits.MaxConns != 5 || c.filter.denyAction != gs.RejectConn {
+				t.Errorf("limits and filter not applied: %+v, %+v", c.connLimits, c.filter)
+			}
+			if !reflect.DeepEqual(c.upgrader, gs.LDAPStartTLS{}) || c.ldap == nil || c.certs != certs {
+				t.Errorf("starttls, ldap decoder, or certs not configured: %+v", c)
+			}
+		}},
+		{name: "no downstream", spec: listenerSpec{Name: "a"}, check: func(t *testing.T, c config) {
+			if got, _ := c.GetDownstreamAddr(gs.Addr{IP: "10.0.0.1"}, gs.Addr{}); got != nil {
+				t.Errorf("downstream = %+v, want nil", got)
+			}
+		}},
+		{name: "invalid downstream", spec: listenerSpec{DownstreamAddr: "10.0.0.1"}, wantErr: "downstream address"},
+		{name: "invalid route", spec: listenerSpec{Routes: []routeSpec{{Victims: []string{"x"}, DownstreamAddr: ":1"}}},
+			wantErr: "route victims"},
+		{name: "invalid tls version", spec: listenerSpec{TLS: tlsSpec{MaxVersion: "1.4"}}, wantErr: "tls version"},
+		{name: "invalid legacy action", spec: listenerSpec{TLS: tlsSpec{LegacySSL: "drop"}}, wantErr: "legacy ssl"},
+		{name: "invalid starttls", spec: listenerSpec{StartTLS: startTLSSpec{Protocol: "smtp"}}, wantErr: "starttls"},
+		{name: "invalid filter", spec: listenerSpec{Filter: filterSpec{DenyAction: "drop"}}, wantErr: "filters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := tt.spec
+			if spec.Filter.DenyAction == "" {
+				spec.Filter.DenyAction = passthroughDenyAction
+			}
+			if spec.LDAPFile != "" {
+				spec.LDAPFile = filepath.Join(t.TempDir(), spec.LDAPFile)
+			}
+			c, err := spec.newConfig(testShared(t), false, certs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("newConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("newConfig() error = %v", err)
+			}
+			tt.check(t, c)
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	gs "github.com/impostorkeanu/gosplit"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxSessions is the number of sessions retained by a sessionStore.
+	// The oldest ended sessions are discarded first.
+	maxSessions = 5000
+	// maxSessionData is the number of bytes of data retained for each
+	// session. Byte counters continue to increase beyond it.
+	maxSessionData = 1 << 20
+)
+
+type (
+	// session is a connection observed through data log records or
+	// events, along with the cleartext data it carried.
+	session struct {
+		key             string
+		info            gs.ConnInfo
+		listener        string
+		ended           bool
+		victimBytes     int64
+		downstreamBytes int64
+		chunks          []chunk
+		dataLen         int // bytes retained in chunks
+	}
+
+	// chunk is data sent by one side of a session.
+	chunk struct {
+		victim   bool      // sent by the victim
+		captured time.Time // zero for records written before capture times were logged
+		data     []byte
+	}
+
+	// sessionStore aggregates records into sessions.
+	sessionStore struct {
+		m       sync.Mutex
+		byKey   map[string]*session
+		order   []*session // ordered by time first seen
+		version uint64     // incremented upon each change
+	}
+
+	// sessionFilter selects sessions by victim, SNI, and content.
+	//
+	// Empty fields match all sessions.
+	sessionFilter struct {
+		victim  string // substring of the victim address
+		sni     string // glob pattern matching the server name
+		content string // substring of data sent by either side
+	}
+)
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{byKey: make(map[string]*session)}
+}
+
+// sessionKey identifies the session of a record.
+//
+// Records written before connections were assigned IDs are keyed by
+// connection time and victim address.
+func sessionKey(listener string, cI gs.ConnInfo) string {
+	if cI.ID != 0 {
+		return fmt.Sprintf("%s/%d", listener, cI.ID)
+	}
+	return fmt.Sprintf("%s/%s/%s:%s", listener, cI.Time.Format(time.RFC3339Nano), cI.Victim.IP, cI.Victim.Port)
+}
+
+// get the session for a record, creating it when necessary.
+//
+// Note: s.m must be held by the caller.
+func (s *sessionStore) get(listener string, cI gs.ConnInfo) *session {
+	key := sessionKey(listener, cI)
+	if sess := s.byKey[key]; sess != nil {
+		// later records carry details learned during the connection
+		if cI.Downstream != nil {
+			sess.info.Downstream = cI.Downstream
+		}
+		if cI.SNI != "" {
+			sess.info.SNI = cI.SNI
+		}
+		if cI.ALPN != "" {
+			sess.info.ALPN = cI.ALPN
+		}
+		sess.info.TLS = sess.info.TLS || cI.TLS
+		if cI.Rejected != "" {
+			sess.info.Rejected = cI.Rejected
+		}
+		return sess
+	}
+	sess := &session{key: key, info: cI, listener: listener}
+	s.byKey[key] = sess
+	s.order = append(s.order, sess)
+	s.prune()
+	return sess
+}
+
+// prune discards the oldest sessions, preferring those that have ended.
+//
+// Note: s.m must be held by the caller.
+func (s *sessionStore) prune() {
+	for len(s.order) > maxSessions {
+		i := slices.IndexFunc(s.order, func(sess *session) bool { return sess.ended })
+		if i < 0 {
+			i = 0
+		}
+		delete(s.byKey, s.order[i].key)
+		s.order = slices.Delete(s.order, i, i+1)
+	}
+}
+
+// addData appends data sent by one side of a session.
+func (s *sessionStore) addData(dL dataLog) error {
+	b, err := base64.StdEncoding.DecodeString(dL.Data)
+	if err != nil {
+		return fmt.Errorf("error decoding data: %w", err)
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	sess := s.get(dL.Listener, dL.ConnInfo)
+	victim := dL.Sender == victimDataSender
+	if victim {
+		sess.victimBytes += int64(len(b))
+	} else {
+		sess.downstreamBytes += int64(len(b))
+	}
+	if n := min(len(b), maxSessionData-sess.dataLen); n > 0 {
+		// consecutive data from the same side is merged
+		if last := len(sess.chunks) - 1; last >= 0 && sess.chunks[last].victim == victim {
+			sess.chunks[last].data = append(sess.chunks[last].data, b[:n]...)
+		} else {
+			sess.chunks = append(sess.chunks, chunk{victim: victim, captured: dL.Captured, data: b[:n]})
+		}
+		sess.dataLen += n
+	}
+	s.version++
+	return nil
+}
+
+// startConn records the start of a connection.
+func (s *sessionStore) startConn(r connRecord) {
+	s.m.Lock()
+	s.get(r.Listener, r.ConnInfo)
+	s.version++
+	s.m.Unlock()
+}
+
+// endConn records the end of a connection.
+func (s *sessionStore) endConn(r connRecord) {
+	s.m.Lock()
+	s.get(r.Listener, r.ConnInfo).ended = true
+	s.version++
+	s.m.Unlock()
+}
+
+// setCounters updates the byte counters of an active connection with
+// those reported by its gs.ProxyServer, which include data that was not
+// captured, e.g., from connections passed through.
+func (s *sessionStore) setCounters(listener string, cs gs.ConnStats) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if sess := s.byKey[sessionKey(listener, cs.ConnInfo)]; sess != nil &&
+		(sess.victimBytes != cs.VictimBytes || sess.downstreamBytes != cs.DownstreamBytes) {
+		sess.victimBytes = max(sess.victimBytes, cs.VictimBytes)
+		sess.downstreamBytes = max(sess.downstreamBytes, cs.DownstreamBytes)
+		s.version++
+	}
+}
+
+// addEvent applies an event published to an eventHub.
+func (s *sessionStore) addEvent(e event) (err error) {
+	switch e.Type {
+	case connStartEvent, connEndEvent:
+		var r connRecord
+		if err = json.Unmarshal(e.Data, &r); err != nil {
+			return
+		}
+		if e.Type == connStartEvent {
+			s.startConn(r)
+		} else {
+			s.endConn(r)
+		}
+	case dataEvent:
+		var dL dataLog
+		if err = json.Unmarshal(e.Data, &dL); err != nil {
+			return
+		}
+		err = s.addData(dL)
+	}
+	return
+}
+
+// addLine applies a line read from a data log or log file.
+//
+// Lines that aren't data records, e.g., log records, are ignored.
+func (s *sessionStore) addLine(line []byte) error {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil
+	}
+	var dL dataLog
+	if err := json.Unmarshal(line, &dL); err != nil {
+		return fmt.Errorf("error parsing record: %w", err)
+	} else if dL.Sender == "" {
+		return nil
+	}
+	return s.addData(dL)
+}
+
+// snapshot returns copies of the sessions matching f, along with the
+// store's version.
+//
+// Chunks are shared with the store, which only appends to them.
+func (s *sessionStore) snapshot(f sessionFilter) (sessions []session, version uint64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, sess := range s.order {
+		if f.match(sess) {
+			c := *sess
+			c.chunks = slices.Clip(slices.Clone(sess.chunks))
+			sessions = append(sessions, c)
+		}
+	}
+	return sessions, s.version
+}
+
+// parseSessionFilter parses space separated terms of the form
+// victim:<substring>, sni:<glob>, and content:<substring>. Terms without
+// a prefix are treated as content.
+func parseSessionFilter(s string) (f sessionFilter, err error) {
+	for _, term := range strings.Fields(s) {
+		k, v, ok := strings.Cut(term, ":")
+		if !ok {
+			k, v = "content", term
+		}
+		switch k {
+		case "victim":
+			f.victim = v
+		case "sni":
+			if _, err = path.Match(v, ""); err != nil {
+				return f, fmt.Errorf("invalid sni pattern (%s): %w", v, err)
+			}
+			f.sni = strings.ToLower(v)
+		case "content":
+			f.content = v
+		default:
+			// e.g., content containing a colon
+			f.content = term
+		}
+	}
+	return
+}
+
+// String returns the filter in the format accepted by parseSessionFilter.
+func (f sessionFilter) String() string {
+	var terms []string
+	if f.victim != "" {
+		terms = append(terms, "victim:"+f.victim)
+	}
+	if f.sni != "" {
+		terms = append(terms, "sni:"+f.sni)
+	}
+	if f.content != "" {
+		terms = append(terms, "content:"+f.content)
+	}
+	return strings.Join(terms, " ")
+}
+
+// match determines if a session satisfies the filter.
+func (f sessionFilter) match(sess *session) bool {
+	if f.victim != "" && !strings.Contains(sess.info.Victim.IP+":"+sess.info.Victim.Port, f.victim) {
+		return false
+	}
+	if f.sni != "" {
+		if ok, _ := path.Match(f.sni, strings.ToLower(sess.info.SNI)); !ok {
+			return false
+		}
+	}
+	if f.content != "" {
+		for _, c := range sess.chunks {
+			if bytes.Contains(c.data, []byte(f.content)) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	gs "github.com/impostorkeanu/gosplit"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSessionFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    sessionFilter
+		wantErr bool
+	}{
+		{name: "empty", in: "  "},
+		{name: "all terms", in: "victim:10.0.0.5 sni:*.Example.COM content:password",
+			want: sessionFilter{victim: "10.0.0.5", sni: "*.example.com", content: "password"}},
+		{name: "bare term is content", in: "password", want: sessionFilter{content: "password"}},
+		{name: "unknown prefix is content", in: "Authorization:Basic", want: sessionFilter{content: "Authorization:Basic"}},
+		{name: "later terms win", in: "victim:a victim:b", want: sessionFilter{victim: "b"}},
+		{name: "invalid sni pattern", in: "sni:[a-", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parseSessionFilter(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSessionFilter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if f != tt.want {
+				t.Errorf("parseSessionFilter() = %+v, want %+v", f, tt.want)
+			}
+			// String output must parse to the same filter
+			if rt, err := parseSessionFilter(f.String()); err != nil || rt != f {
+				t.Errorf("parseSessionFilter(%q) = %+v, %v, want %+v", f.String(), rt, err, f)
+			}
+		})
+	}
+}
+
+// testDataLog returns a data record sent through connection id.
+func testDataLog(id uint64, sender, data string) dataLog {
+	return dataLog{
+		Listener: "l",
+		Sender:   sender,
+		Data:     base64.StdEncoding.EncodeToString([]byte(data)),
+		ConnInfo: gs.ConnInfo{ID: id, Victim: gs.Addr{IP: "10.0.0.5", Port: "5000"}, SNI: "www.example.com"},
+	}
+}
+
+func TestSessionStore_AddData(t *testing.T) {
+	s := newSessionStore()
+	for _, dL := range []dataLog{
+		testDataLog(1, victimDataSender, "USER "),
+		testDataLog(1, victimDataSender, "bob"),
+		testDataLog(1, downstreamDataSender, "331 ok"),
+		testDataLog(2, victimDataSender, "other"),
+	} {
+		if err := s.addData(dL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.addData(dataLog{Listener: "l", Sender: victimDataSender, Data: "!"}); err == nil {
+		t.Error("addData() accepted data that isn't base64")
+	}
+
+	sessions, version := s.snapshot(sessionFilter{})
+	if len(sessions) != 2 || version != 4 {
+		t.Fatalf("snapshot() returned %d sessions at version %d, want 2 at version 4", len(sessions), version)
+	}
+	sess := sessions[0]
+	if sess.victimBytes != 8 || sess.downstreamBytes != 6 {
+		t.Errorf("byte counters = %d/%d, want 8/6", sess.victimBytes, sess.downstreamBytes)
+	}
+	// consecutive data from the same side is merged
+	if len(sess.chunks) != 2 || string(sess.chunks[0].data) != "USER bob" || string(sess.chunks[1].data) != "331 ok" {
+		t.Errorf("chunks = %+v, want merged victim data followed by downstream data", sess.chunks)
+	}
+}
+
+func TestSessionStore_MaxSessionData(t *testing.T) {
+	s := newSessionStore()
+	big := strings.Repeat("a", maxSessionData)
+	for range 2 {
+		if err := s.addData(testDataLog(1, victimDataSender, big)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sessions, _ := s.snapshot(sessionFilter{})
+	if sess := sessions[0]; sess.dataLen != maxSessionData || sess.victimBytes != 2*maxSessionData {
+		t.Errorf("retained %d of %d bytes, want %d of %d", sess.dataLen, sess.victimBytes, maxSessionData, 2*maxSessionData)
+	}
+}
+
+func TestSessionStore_Prune(t *testing.T) {
+	s := newSessionStore()
+	cI := func(id uint64) gs.ConnInfo { return gs.ConnInfo{ID: id} }
+	for i := range maxSessions {
+		s.startConn(connRecord{Listener: "l", ConnInfo: cI(uint64(i + 1))})
+	}
+	// ended sessions are discarded before older active ones
+	s.endConn(connRecord{Listener: "l", ConnInfo: cI(10)})
+	s.startConn(connRecord{Listener: "l", ConnInfo: cI(maxSessions + 1)})
+	s.startConn(connRecord{Listener: "l", ConnInfo: cI(maxSessions + 2)})
+
+	if len(s.order) != maxSessions || len(s.byKey) != maxSessions {
+		t.Fatalf("store holds %d/%d sessions, want %d", len(s.order), len(s.byKey), maxSessions)
+	}
+	for _, id := range []uint64{1, 10} {
+		if s.byKey[sessionKey("l", cI(id))] != nil {
+			t.Errorf("session %d was retained", id)
+		}
+	}
+	for _, id := range []uint64{2, maxSessions + 2} {
+		if s.byKey[sessionKey("l", cI(id))] == nil {
+			t.Errorf("session %d was discarded", id)
+		}
+	}
+}
+
+func TestSessionStore_AddEvent(t *testing.T) {
+	s := newSessionStore()
+	r := connRecord{Listener: "l", ConnInfo: gs.ConnInfo{ID: 1, Victim: gs.Addr{IP: "10.0.0.5", Port: "5000"}}}
+	mustEvent := func(typ string, v any) event {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event{Type: typ, Data: b}
+	}
+	for _, e := range []event{
+		mustEvent(connStartEvent, r),
+		mustEvent(dataEvent, testDataLog(1, victimDataSender, "hello")),
+		mustEvent(logEvent, logRecord{Listener: "l"}),
+		mustEvent(connEndEvent, r),
+	} {
+		if err := s.addEvent(e); err != nil {
+			t.Fatalf("addEvent(%s) error = %v", e.Type, err)
+		}
+	}
+	if err := s.addEvent(event{Type: dataEvent, Data: []byte("{")}); err == nil {
+		t.Error("addEvent() accepted a malformed event")
+	}
+
+	sessions, _ := s.snapshot(sessionFilter{})
+	if len(sessions) != 1 {
+		t.Fatalf("snapshot() returned %d sessions, want 1", len(sessions))
+	}
+	if sess := sessions[0]; !sess.ended || sess.info.SNI != "www.example.com" || string(sess.chunks[0].data) != "hello" {
+		t.Errorf("session = %+v, want an ended session with details learned from its data", sess)
+	}
+}
+
+func TestSessionStore_AddLine(t *testing.T) {
+	s := newSessionStore()
+	dL := testDataLog(1, victimDataSender, "hello")
+	dL.Captured = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	b, err := json.Marshal(dL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"", `{"level":"info","msg":"not data"}`, string(b) + "\n"} {
+		if err = s.addLine([]byte(line)); err != nil {
+			t.Fatalf("addLine(%q) error = %v", line, err)
+		}
+	}
+	if err = s.addLine([]byte("not json")); err == nil {
+		t.Error("addLine() accepted a line that isn't json")
+	}
+	sessions, _ := s.snapshot(sessionFilter{})
+	if len(sessions) != 1 || !sessions[0].chunks[0].captured.Equal(dL.Captured) {
+		t.Errorf("snapshot() = %+v, want one session captured at %s", sessions, dL.Captured)
+	}
+}
+
+func TestSessionStore_Snapshot(t *testing.T) {
+	s := newSessionStore()
+	for i, v := range []struct{ victim, sni, data string }{
+		{"10.0.0.5", "www.example.com", "password=hunter2"},
+		{"10.0.0.6", "api.example.com", "GET /"},
+		{"10.0.0.7", "www.example.org", "password"},
+	} {
+		dL := testDataLog(uint64(i+1), victimDataSender, v.data)
+		dL.Victim.IP, dL.SNI = v.victim, v.sni
+		if err := s.addData(dL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		filter string
+		want   []string // victim IPs
+	}{
+		{filter: "", want: []string{"10.0.0.5", "10.0.0.6", "10.0.0.7"}},
+		{filter: "victim:10.0.0.6", want: []string{"10.0.0.6"}},
+		{filter: "sni:*.EXAMPLE.com", want: []string{"10.0.0.5", "10.0.0.6"}},
+		{filter: "password", want: []string{"10.0.0.5", "10.0.0.7"}},
+		{filter: "sni:*.example.com password", want: []string{"10.0.0.5"}},
+		{filter: "victim:10.0.0.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			f, err := parseSessionFilter(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sessions, _ := s.snapshot(f)
+			var got []string
+			for _, sess := range sessions {
+				got = append(got, sess.info.Victim.IP)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("snapshot(%q) = %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
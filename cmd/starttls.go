@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	gs "github.com/impostorkeanu/gosplit"
+	"regexp"
+	"strings"
+)
+
+const (
+	ldapStartTLSProtocol     = "ldap"
+	postgresStartTLSProtocol = "postgres"
+	mysqlStartTLSProtocol    = "mysql"
+	ftpStartTLSProtocol      = "ftp"
+	rdpStartTLSProtocol      = "rdp"
+	xmppStartTLSProtocol     = "xmpp"
+	nntpStartTLSProtocol     = "nntp"
+	sieveStartTLSProtocol    = "sieve"
+	anyStartTLSProtocol      = "any"
+)
+
+// startTLSSpec configures the negotiation of upgrades to TLS that
+// victims request after exchanging cleartext with the downstream.
+//
+// Trigger, Accept, and ServerFirst describe text protocols that are
+// negotiated using gs.PatternStartTLS, overriding those of the profile
+// named by Protocol when set.
+type startTLSSpec struct {
+	// Protocol whose upgrades are negotiated: ldap, postgres, mysql,
+	// ftp, rdp, the text protocols xmpp, nntp, or sieve, or any to
+	// intercept handshakes found anywhere in the victim's data.
+	Protocol string `yaml:"protocol"`
+	// StripNLA removes Network Level Authentication from the
+	// connection requests of rdp victims.
+	StripNLA bool `yaml:"strip_nla"`
+	// Trigger matches the victim's request to upgrade, e.g., STARTTLS.
+	Trigger string `yaml:"trigger"`
+	// Accept matches the downstream's reply accepting the upgrade.
+	Accept string `yaml:"accept"`
+	// ServerFirst indicates that the downstream speaks first.
+	ServerFirst *bool `yaml:"server_first"`
+}
+
+// upgrader returns the gs.Upgrader described by the spec, or nil when
+// no protocol is configured.
+func (s startTLSSpec) upgrader() (gs.Upgrader, error) {
+	var p gs.PatternStartTLS
+	switch strings.ToLower(s.Protocol) {
+	case "":
+		if s.Trigger == "" && s.Accept == "" {
+			return nil, nil
+		}
+	case ldapStartTLSProtocol:
+		return gs.LDAPStartTLS{}, nil
+	case postgresStartTLSProtocol:
+		return gs.PostgresStartTLS{}, nil
+	case mysqlStartTLSProtocol:
+		return gs.MySQLStartTLS{}, nil
+	case ftpStartTLSProtocol:
+		return gs.FTPStartTLS{}, nil
+	case rdpStartTLSProtocol:
+		return gs.RDPStartTLS{StripNLA: s.StripNLA}, nil
+	case anyStartTLSProtocol:
+		return gs.MidStreamTLS{}, nil
+	case xmppStartTLSProtocol:
+		p = gs.PatternStartTLS{
+			Trigger: regexp.MustCompile(`<starttls\s+xmlns=['"]urn:ietf:params:xml:ns:xmpp-tls['"]`),
+			Accept:  regexp.MustCompile(`<proceed\s+xmlns=['"]urn:ietf:params:xml:ns:xmpp-tls['"]`),
+		}
+	case nntpStartTLSProtocol:
+		p = gs.PatternStartTLS{
+			Trigger:     regexp.MustCompile(`(?mi)^STARTTLS\r?\n`),
+			Accept:      regexp.MustCompile(`(?m)^382`),
+			ServerFirst: true,
+		}
+	case sieveStartTLSProtocol:
+		p = gs.PatternStartTLS{
+			Trigger:     regexp.MustCompile(`(?mi)^STARTTLS\r?\n`),
+			Accept:      regexp.MustCompile(`(?mi)^OK`),
+			ServerFirst: true,
+		}
+	default:
+		return nil, fmt.Errorf("unknown starttls protocol: %s", s.Protocol)
+	}
+
+	var err error
+	if s.Trigger != "" {
+		if p.Trigger, err = regexp.Compile(s.Trigger); err != nil {
+			return nil, fmt.Errorf("invalid starttls trigger (%s): %w", s.Trigger, err)
+		}
+	}
+	if s.Accept != "" {
+		if p.Accept, err = regexp.Compile(s.Accept); err != nil {
+			return nil, fmt.Errorf("invalid starttls accept (%s): %w", s.Accept, err)
+		}
+	}
+	if s.ServerFirst != nil {
+		p.ServerFirst = *s.ServerFirst
+	}
+	if p.Trigger == nil || p.Accept == nil {
+		return nil, errors.New("starttls trigger and accept patterns are required")
+	}
+	return p, nil
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// tuiRefresh is how often the terminal UI is redrawn.
+const tuiRefresh = 250 * time.Millisecond
+
+var (
+	titleStyle      = tcell.StyleDefault.Reverse(true)
+	headerStyle     = tcell.StyleDefault.Bold(true).Underline(true)
+	selectedStyle   = tcell.StyleDefault.Background(tcell.ColorNavy).Foreground(tcell.ColorWhite)
+	endedStyle      = tcell.StyleDefault.Foreground(tcell.ColorGray)
+	victimStyle     = tcell.StyleDefault.Foreground(tcell.ColorRed)
+	downstreamStyle = tcell.StyleDefault.Foreground(tcell.ColorBlue)
+	statusStyle     = tcell.StyleDefault.Foreground(tcell.ColorYellow)
+)
+
+type (
+	// tui is a full-screen view of sessions in a sessionStore.
+	//
+	// The upper pane lists sessions, while the lower pane shows the
+	// data exchanged through the selected session as text or hex.
+	tui struct {
+		screen tcell.Screen
+		store  *sessionStore
+		title  string
+		poll   func() // called before each redraw, if set
+		live   bool   // sessions are known to end, i.e., the store receives events
+
+		filter      sessionFilter
+		hex         bool   // show data as a hex dump
+		selected    string // key of the selected session
+		follow      bool   // select new sessions as they arrive
+		listTop     int    // index of the first session shown
+		detailTop   int    // index of the first detail line shown
+		focusDetail bool   // arrow keys scroll the detail pane
+		editing     bool   // the filter prompt is active
+		input       []rune // filter being edited
+
+		statusM sync.Mutex
+		status  string // message shown in the footer
+	}
+
+	// tuiLine is a line of styled text.
+	tuiLine struct {
+		style tcell.Style
+		text  string
+	}
+)
+
+func newTUI(screen tcell.Screen, store *sessionStore, title string, filter sessionFilter) *tui {
+	return &tui{screen: screen, store: store, title: title, filter: filter, follow: true}
+}
+
+// setStatus shows msg in the footer. It is safe to call from any routine.
+func (t *tui) setStatus(msg string) {
+	t.statusM.Lock()
+	t.status = msg
+	t.statusM.Unlock()
+}
+
+// run the UI until the user quits or ctx is done.
+func (t *tui) run(ctx context.Context) error {
+	if err := t.screen.Init(); err != nil {
+		return fmt.Errorf("error initializing terminal: %w", err)
+	}
+	defer t.screen.Fini()
+
+	events := make(chan tcell.Event)
+	quit := make(chan struct{})
+	defer close(quit)
+	go t.screen.ChannelEvents(events, quit)
+
+	ticker := time.NewTicker(tuiRefresh)
+	defer ticker.Stop()
+
+	t.draw()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case ev := <-events:
+			switch ev := ev.(type) {
+			case *tcell.EventResize:
+				t.screen.Sync()
+			case *tcell.EventKey:
+				if !t.handleKey(ev) {
+					return nil
+				}
+			}
+		}
+		t.draw()
+	}
+}
+
+// handleKey updates the UI state, returning false when the user quits.
+func (t *tui) handleKey(ev *tcell.EventKey) bool {
+	if t.editing {
+		switch ev.Key() {
+		case tcell.KeyEnter:
+			f, err := parseSessionFilter(string(t.input))
+			if err != nil {
+				t.setStatus(err.Error())
+				return true
+			}
+			t.filter, t.editing, t.listTop = f, false, 0
+			t.setStatus("")
+		case tcell.KeyEscape:
+			t.editing = false
+		case tcell.KeyBackspace, tcell.KeyBackspace2:
+			if len(t.input) > 0 {
+				t.input = t.input[:len(t.input)-1]
+			}
+		case tcell.KeyRune:
+			t.input = append(t.input, ev.Rune())
+		}
+		return true
+	}
+
+	_, h := t.screen.Size()
+	page := max(h/2-3, 1)
+	switch ev.Key() {
+	case tcell.KeyCtrlC:
+		return false
+	case tcell.KeyUp:
+		t.move(-1)
+	case tcell.KeyDown:
+		t.move(1)
+	case tcell.KeyPgUp:
+		t.move(-page)
+	case tcell.KeyPgDn:
+		t.move(page)
+	case tcell.KeyTab:
+		t.focusDetail = !t.focusDetail
+	case tcell.KeyRune:
+		switch ev.Rune() {
+		case 'q':
+			return false
+		case 'k':
+			t.move(-1)
+		case 'j':
+			t.move(1)
+		case 'x':
+			t.hex, t.detailTop = !t.hex, 0
+		case '/':
+			t.editing, t.input = true, []rune(t.filter.String())
+		case 'f':
+			t.follow = !t.follow
+		}
+	}
+	return true
+}
+
+// move the selection, or scroll the detail pane when it has focus.
+func (t *tui) move(n int) {
+	if t.focusDetail {
+		t.detailTop = max(t.detailTop+n, 0)
+		return
+	}
+	sessions, _ := t.store.snapshot(t.filter)
+	i := t.selectedIndex(sessions) + n
+	if i = min(max(i, 0), len(sessions)-1); i >= 0 {
+		t.selected, t.detailTop = sessions[i].key, 0
+		t.follow = i == len(sessions)-1
+	}
+}
+
+// selectedIndex returns the index of the selected session, updating the
+// selection when following new sessions or when the selected session
+// is no longer listed.
+func (t *tui) selectedIndex(sessions []session) int {
+	if len(sessions) == 0 {
+		return -1
+	}
+	if !t.follow {
+		for i := range sessions {
+			if sessions[i].key == t.selected {
+				return i
+			}
+		}
+	}
+	i := len(sessions) - 1
+	if t.selected != sessions[i].key {
+		t.selected, t.detailTop = sessions[i].key, 0
+	}
+	return i
+}
+
+func (t *tui) draw() {
+	if t.poll != nil {
+		t.poll()
+	}
+	s := t.screen
+	s.Clear()
+	w, h := s.Size()
+	sessions, _ := t.store.snapshot(t.filter)
+	sel := t.selectedIndex(sessions)
+
+	// title
+	title := fmt.Sprintf(" %s | %d sessions", t.title, len(sessions))
+	if t.live {
+		active := 0
+		for _, sess := range sessions {
+			if !sess.ended {
+				active++
+			}
+		}
+		title += fmt.Sprintf(" (%d active)", active)
+	}
+	if f := t.filter.String(); f != "" {
+		title += " | filter: " + f
+	}
+	if t.follow {
+		title += " | following"
+	}
+	drawText(s, 0, 0, w, titleStyle, pad(title, w))
+
+	// session list
+	listH := max((h-3)/2, 2)
+	timeHeader := "STARTED"
+	if t.live {
+		timeHeader = "AGE"
+	}
+	drawText(s, 0, 1, w, headerStyle, pad(sessionRow("ID", "LISTENER", "VICTIM", "DOWNSTREAM", "SNI", "SENT", "RECV", timeHeader), w))
+	rows := listH - 1
+	if sel >= 0 {
+		if sel < t.listTop {
+			t.listTop = sel
+		} else if sel >= t.listTop+rows {
+			t.listTop = sel - rows + 1
+		}
+	}
+	t.listTop = min(t.listTop, max(len(sessions)-rows, 0))
+	for i := 0; i < rows && t.listTop+i < len(sessions); i++ {
+		sess := &sessions[t.listTop+i]
+		style := tcell.StyleDefault
+		if t.listTop+i == sel {
+			style = selectedStyle
+		} else if sess.ended {
+			style = endedStyle
+		}
+		drawText(s, 0, 2+i, w, style, pad(sessionSummary(sess, t.live), w))
+	}
+
+	// detail pane
+	y := 1 + listH
+	var lines []tuiLine
+	detailTitle := " no session selected"
+	if sel >= 0 {
+		sess := &sessions[sel]
+		detailTitle = fmt.Sprintf(" %s -> %s", addrString(sess.info.Victim.IP, sess.info.Victim.Port), downstreamString(sess))
+		if sess.info.Rejected != "" {
+			detailTitle += " | rejected: " + sess.info.Rejected
+		}
+		lines = t.detailLines(sess, w)
+	}
+	mode := "text"
+	if t.hex {
+		mode = "hex"
+	}
+	focus := ""
+	if t.focusDetail {
+		focus = " | scrolling"
+	}
+	drawText(s, 0, y, w, titleStyle, pad(fmt.Sprintf("%s | %s%s", detailTitle, mode, focus), w))
+	detailH := h - y - 2
+	t.detailTop = min(t.detailTop, max(len(lines)-detailH, 0))
+	for i := 0; i < detailH && t.detailTop+i < len(lines); i++ {
+		l := lines[t.detailTop+i]
+		drawText(s, 0, y+1+i, w, l.style, l.text)
+	}
+
+	// footer
+	if t.editing {
+		prompt := "filter (victim:<ip> sni:<glob> content:<text>): " + string(t.input)
+		drawText(s, 0, h-1, w, tcell.StyleDefault, prompt)
+		s.ShowCursor(min(runewidth.StringWidth(prompt), w-1), h-1)
+	} else {
+		s.HideCursor()
+		t.statusM.Lock()
+		status := t.status
+		t.statusM.Unlock()
+		if status != "" {
+			drawText(s, 0, h-1, w, statusStyle, status)
+		} else {
+			drawText(s, 0, h-1, w, tcell.StyleDefault,
+				"q quit | up/down select | tab scroll data | x text/hex | / filter | f follow")
+		}
+	}
+	s.Show()
+}
+
+// detailLines renders the data exchanged through a session.
+func (t *tui) detailLines(sess *session, w int) (lines []tuiLine) {
+	for _, c := range sess.chunks {
+		style, label := downstreamStyle, "<< downstream"
+		if c.victim {
+			style, label = victimStyle, ">> victim"
+		}
+		lines = append(lines, tuiLine{style.Bold(true), fmt.Sprintf("%s (%d bytes)", label, len(c.data))})
+		if t.hex {
+			for _, l := range strings.Split(strings.TrimSuffix(hex.Dump(c.data), "\n"), "\n") {
+				lines = append(lines, tuiLine{style, l})
+			}
+			continue
+		}
+		for _, l := range strings.Split(strings.TrimSuffix(printable(c.data), "\n"), "\n") {
+			for _, wrapped := range wrap(l, w) {
+				lines = append(lines, tuiLine{style, wrapped})
+			}
+		}
+	}
+	return
+}
+
+// sessionSummary formats a session as a row of the session list.
+//
+// The age of live sessions is shown, while the start time is shown for
+// sessions read from data logs, since it's unknown when they ended.
+func sessionSummary(sess *session, live bool) string {
+	id := "-"
+	if sess.info.ID != 0 {
+		id = fmt.Sprint(sess.info.ID)
+	}
+	age := sess.info.Time.Local().Format(time.DateTime)
+	if sess.ended {
+		age = "closed"
+	} else if live {
+		age = time.Since(sess.info.Time).Truncate(time.Second).String()
+	}
+	return sessionRow(id, sess.listener, addrString(sess.info.Victim.IP, sess.info.Victim.Port),
+		downstreamString(sess), sess.info.SNI, byteCount(sess.victimBytes), byteCount(sess.downstreamBytes), age)
+}
+
+func sessionRow(id, listener, victim, downstream, sni, sent, recv, age string) string {
+	return fmt.Sprintf("%-6s %-16s %-21s %-21s %-28s %9s %9s %s",
+		truncate(id, 6), truncate(listener, 16), truncate(victim, 21), truncate(downstream, 21),
+		truncate(sni, 28), sent, recv, age)
+}
+
+func downstreamString(sess *session) string {
+	if sess.info.Downstream == nil {
+		return "(none)"
+	}
+	return addrString(sess.info.Downstream.IP, sess.info.Downstream.Port)
+}
+
+func addrString(ip, port string) string {
+	if strings.Contains(ip, ":") {
+		return "[" + ip + "]:" + port
+	}
+	return ip + ":" + port
+}
+
+// byteCount formats n using binary units.
+func byteCount(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// printable replaces characters that can't be displayed with '.',
+// preserving newlines.
+func printable(b []byte) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || (unicode.IsPrint(r) && r != unicode.ReplacementChar) {
+			return r
+		} else if r == '\t' {
+			return ' '
+		}
+		return '.'
+	}, strings.ReplaceAll(string(b), "\r\n", "\n"))
+}
+
+// wrap splits s into lines no wider than w columns.
+func wrap(s string, w int) (lines []string) {
+	if w <= 0 || runewidth.StringWidth(s) <= w {
+		return []string{s}
+	}
+	var b strings.Builder
+	width := 0
+	for _, r := range s {
+		if rw := runewidth.RuneWidth(r); width+rw > w {
+			lines = append(lines, b.String())
+			b.Reset()
+			width = 0
+		}
+		b.WriteRune(r)
+		width += runewidth.RuneWidth(r)
+	}
+	return append(lines, b.String())
+}
+
+func truncate(s string, n int) string {
+	if runewidth.StringWidth(s) <= n {
+		return s
+	}
+	return runewidth.Truncate(s, n, "~")
+}
+
+func pad(s string, w int) string {
+	return runewidth.FillRight(s, w)
+}
+
+// drawText draws text at x, y, clipping it at w columns.
+func drawText(s tcell.Screen, x, y, w int, style tcell.Style, text string) {
+	for _, r := range text {
+		rw := runewidth.RuneWidth(r)
+		if x+rw > w {
+			return
+		}
+		s.SetContent(x, y, r, nil, style)
+		x += rw
+	}
+}
+
+// startRunTUI shows sessions handled by the listeners of the run command
+// in a terminal UI until the user quits or ctx is done.
+//
+// The returned channel receives the result of the UI once it exits.
+func startRunTUI(ctx context.Context, ls *listenerSet, sh *shared) (<-chan error, error) {
+	f, err := parseSessionFilter(tuiFilter)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing filter: %w", err)
+	}
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		return nil, fmt.Errorf("error initializing terminal: %w", err)
+	}
+
+	store := newSessionStore()
+	t := newTUI(screen, store, "gosplit run", f)
+	t.live = true
+	events, unsubscribe := sh.events.subscribe()
+	go func() {
+		for e := range events {
+			if err := store.addEvent(e); err != nil {
+				t.setStatus(fmt.Sprintf("error applying %s event: %s", e.Type, err))
+			}
+		}
+	}()
+	// byte counters include traffic that isn't captured, e.g., from
+	// connections passed through
+	t.poll = func() {
+		for name, srv := range ls.servers() {
+			for _, cs := range srv.Conns() {
+				store.setCounters(name, cs)
+			}
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		// messages printed while the UI owns the terminal would draw
+		// over it, so show them in the footer instead
+		restore := con.redirect(t.setStatus)
+		err := t.run(ctx)
+		restore()
+		unsubscribe()
+		done <- err
+	}()
+	return done, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gdamore/tcell/v2"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// watchPollInterval is how often the watched file is checked for new
+// records after reaching its end.
+const watchPollInterval = 500 * time.Millisecond
+
+var (
+	watchCmd = &cobra.Command{
+		Use:   "watch <data-log-file>",
+		Short: "Watch intercepted sessions in a data log",
+		Long: "Watch intercepted sessions in a data log written by the run command.\n\n" +
+			"The file is followed as it grows, and log files written with --data-to-log\n" +
+			"are also accepted.",
+		Args: cobra.ExactArgs(1),
+		Run:  runWatch,
+		Example: `
+gosplit watch data.json
+
+gosplit watch --filter 'sni:*.example.com content:password' data.json`,
+	}
+
+	tuiFilter string // initial session filter
+)
+
+func init() {
+	watchCmd.Flags().StringVar(&tuiFilter, "filter", "",
+		"Initial session filter, e.g., 'victim:10.0.0.5 sni:*.example.com content:password'")
+}
+
+func runWatch(_ *cobra.Command, args []string) {
+	f, err := parseSessionFilter(tuiFilter)
+	prExit(err, "error while parsing filter")
+	file, err := os.Open(args[0])
+	prExit(err, "error while opening data log")
+	defer file.Close()
+
+	screen, err := tcell.NewScreen()
+	prExit(err, "error while initializing terminal")
+
+	store := newSessionStore()
+	t := newTUI(screen, store, "gosplit watch "+args[0], f)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		if err := followRecords(ctx, file, store, t.setStatus); err != nil {
+			t.setStatus(err.Error())
+		}
+	}()
+	prExit(t.run(ctx), "error while running terminal ui")
+}
+
+// followRecords adds records read from r to store until ctx is done,
+// waiting for more records to be written after reaching the end of r.
+//
+// Reading restarts from the beginning when r is an *os.File that has
+// been truncated.
+//
+// status receives messages describing records that were skipped.
+func followRecords(ctx context.Context, r io.ReadSeeker, store *sessionStore, status func(string)) error {
+	var (
+		br      = bufio.NewReader(r)
+		partial []byte // incomplete line preceding EOF
+		offset  int64  // bytes consumed from r
+		invalid int    // lines that failed to parse
+	)
+	for {
+		line, err := br.ReadBytes('\n')
+		offset += int64(len(line))
+		if errors.Is(err, io.EOF) {
+			partial = append(partial, line...)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(watchPollInterval):
+			}
+			if f, ok := r.(*os.File); ok {
+				if i, e := f.Stat(); e == nil && i.Size() < offset {
+					// truncated; start over
+					if _, err = r.Seek(0, io.SeekStart); err != nil {
+						return fmt.Errorf("error rewinding truncated file: %w", err)
+					}
+					br.Reset(r)
+					partial, offset = nil, 0
+				}
+			}
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error reading records: %w", err)
+		}
+		if len(partial) > 0 {
+			line, partial = append(partial, line...), nil
+		}
+		if err = store.addLine(line); err != nil {
+			invalid++
+			status(fmt.Sprintf("skipped %d invalid records; last error: %s", invalid, err))
+		}
+	}
+}
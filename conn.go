@@ -2,24 +2,53 @@ package gosplit
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// dataQueueLen is the number of data events that can be queued for
+// a connection before relaying blocks.
+const dataQueueLen = 64
+
 type (
 	// proxyConn maps the proxy server's connection to the downstream connection.
 	proxyConn struct {
+		id             uint64 // unique identifier for the connection
+		control        uint64 // id of the connection that linked this one, if any
+		start          time.Time
 		net.Conn                // server connection to victim
+		victimConn     net.Conn // underlying victim connection, closed to force handle to return
 		downstream     net.Conn // client connection to downstream target
 		proxyAddr      *Addr
 		victimAddr     *Addr
 		downstreamAddr *Addr
-		cfg            cfg          // provides getters for configuration data
-		s              *ProxyServer // allows handle to decrement the connection counter
+		cfg            cfg             // provides getters for configuration data
+		s              *ProxyServer    // allows handle to decrement the connection counter
+		ctx            context.Context // done when the server is shutting down
+		dq             *dataQueue      // delivers data to cfg when it implements DataReceiver; set before tracking
+		limitIP        string          // victim ip passed to ProxyServer.releaseLimit
+		hello          *ClientHello    // ClientHello sent by the victim, if any
+		tls            bool            // the victim completed a tls handshake with the proxy
+		alpn           string          // protocol negotiated with the victim using alpn
+		rejected       string          // reason the connection was rejected, if any
+		closeOnce      sync.Once
+		info           atomic.Pointer[ConnInfo] // snapshot of ConnInfo for ProxyServer.Conns
+		sessions       *controlSessions         // tls sessions with the downstream, shared with linked connections
+		counters       connCounters
+	}
+
+	// connCounters tracks the number of bytes relayed for a connection.
+	connCounters struct {
+		victim     atomic.Int64 // bytes sent by the victim
+		downstream atomic.Int64 // bytes sent by the downstream
 	}
 
 	// peekConn allows peeking at the first few bytes to determine
@@ -29,13 +58,34 @@ type (
 		buf *bufio.Reader
 	}
 
-	// downstreamConn determines if cfg implements DataReceiver and passes
-	// data to methods when it does, allowing implementors to receive
-	// cleartext data passing through the proxy.
+	// downstreamConn passes data to a dataQueue when cfg implements
+	// DataReceiver, allowing implementors to receive cleartext data
+	// passing through the proxy.
 	downstreamConn struct {
 		net.Conn
-		cfg      cfg
+		dq       *dataQueue // nil when cfg does not implement DataReceiver
+		connInfo ConnInfo
+		counters *connCounters
+	}
+
+	// dataQueue delivers data events to a DataReceiver in the order
+	// they were captured.
+	//
+	// Use newDataQueue to initialize a queue and close to wait for
+	// all queued events to be delivered.
+	dataQueue struct {
+		recv  DataReceiver
+		timed TimedDataReceiver // recv, when it implements TimedDataReceiver
+		c     chan dataEvent
+		done  chan struct{}
+	}
+
+	// dataEvent is a chunk of data captured from a connection.
+	dataEvent struct {
+		victim   bool // data was sent by the victim
 		connInfo ConnInfo
+		captured time.Time
+		data     []byte
 	}
 )
 
@@ -43,10 +93,10 @@ type (
 //
 // Note: This is the victim side of the intercepted connection.
 func (c *downstreamConn) Write(b []byte) (n int, err error) {
-	if dh, ok := c.cfg.Cfg.(DataReceiver); ok {
-		go dh.RecvVictimData(c.connInfo, b)
-	}
-	return c.Conn.Write(b)
+	c.dq.push(c.connInfo, true, b)
+	n, err = c.Conn.Write(b)
+	c.counters.victim.Add(int64(n))
+	return
 }
 
 // Read from the connection.
@@ -54,16 +104,78 @@ func (c *downstreamConn) Write(b []byte) (n int, err error) {
 // Note: This is the downstream side of the intercepted connection.
 func (c *downstreamConn) Read(b []byte) (n int, err error) {
 	n, err = c.Conn.Read(b)
-	if dh, ok := c.cfg.Cfg.(DataReceiver); ok {
-		go dh.RecvDownstreamData(c.connInfo, b[0:n])
-	}
+	c.dq.push(c.connInfo, false, b[:n])
+	c.counters.downstream.Add(int64(n))
 	return
 }
 
+func newDataQueue(recv DataReceiver) *dataQueue {
+	q := &dataQueue{
+		recv: recv,
+		c:    make(chan dataEvent, dataQueueLen),
+		done: make(chan struct{}),
+	}
+	q.timed, _ = recv.(TimedDataReceiver)
+	go q.run()
+	return q
+}
+
+// push a copy of b to the queue, stamped with the time it was
+// captured, blocking when the queue is full.
+//
+// push is a no-op when q is nil or b is empty, and it must not be
+// called after close.
+func (q *dataQueue) push(cI ConnInfo, victim bool, b []byte) {
+	if q == nil || len(b) == 0 {
+		return
+	}
+	q.c <- dataEvent{victim: victim, connInfo: cI, captured: time.Now(), data: append([]byte(nil), b...)}
+}
+
+// len returns the number of queued events.
+func (q *dataQueue) len() int {
+	if q == nil {
+		return 0
+	}
+	return len(q.c)
+}
+
+// close the queue and block until all queued events are delivered.
+func (q *dataQueue) close() {
+	if q == nil {
+		return
+	}
+	close(q.c)
+	<-q.done
+}
+
+// run delivers events to the DataReceiver until the queue is closed.
+func (q *dataQueue) run() {
+	defer close(q.done)
+	for e := range q.c {
+		switch {
+		case q.timed != nil && e.victim:
+			q.timed.RecvVictimDataAt(e.connInfo, e.captured, e.data)
+		case q.timed != nil:
+			q.timed.RecvDownstreamDataAt(e.connInfo, e.captured, e.data)
+		case e.victim:
+			q.recv.RecvVictimData(e.connInfo, e.data)
+		default:
+			q.recv.RecvDownstreamData(e.connInfo, e.data)
+		}
+	}
+}
+
 func (c *peekConn) Peek(n int) ([]byte, error) {
 	return c.buf.Peek(n)
 }
 
+// Buffered returns the number of bytes that can be peeked at without
+// reading from the connection.
+func (c *peekConn) Buffered() int {
+	return c.buf.Buffered()
+}
+
 func (c *peekConn) Read(b []byte) (n int, err error) {
 	return c.buf.Read(b)
 }
@@ -72,25 +184,44 @@ func (c *proxyConn) log(lvl, msg string) {
 	c.cfg.log(c, lvl, msg)
 }
 
+// Close the victim and downstream connections.
+//
+// Close is safe to call multiple times and from multiple routines. Only
+// the first call closes the connections; subsequent calls are no-ops.
 func (c *proxyConn) Close() (err error) {
-	if _, ok := c.Conn.(io.Closer); ok {
-		err = c.Conn.Close()
-		if err != nil {
-			err = fmt.Errorf("failed to close proxy connection: %w", err)
+	c.closeOnce.Do(func() {
+		if e := c.Conn.Close(); e != nil {
+			err = fmt.Errorf("failed to close proxy connection: %w", e)
 		}
-	}
-	if _, ok := c.downstream.(io.Closer); ok {
-		e := c.downstream.Close()
-		if e != nil {
-			err = fmt.Errorf("; failed to close downstream conn (%w)", e)
+		if c.downstream != nil {
+			if e := c.downstream.Close(); e != nil {
+				err = errors.Join(err, fmt.Errorf("failed to close downstream conn: %w", e))
+			}
 		}
-	}
-	c.cfg.connEnd(c)
+	})
 	return
 }
 
+// kill forces the connection closed by closing the underlying victim
+// connection, which causes handle to return.
+//
+// Unlike Close, kill is safe to call while handle is running.
+func (c *proxyConn) kill() {
+	c.victimConn.Close()
+}
+
+// closeWrite shuts down the writing side of the victim connection.
+func (c *proxyConn) closeWrite() {
+	if tC, ok := c.Conn.(*tls.Conn); ok {
+		tC.CloseWrite()
+	}
+	if cw, ok := c.victimConn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
 func (c *proxyConn) close() {
-	if err := c.Close(); err != nil {
+	if err := c.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 		c.log(ErrorLogLvl, fmt.Sprintf("failed to close connection: %s", err))
 	}
 }
@@ -103,15 +234,22 @@ func (c *proxyConn) close() {
 //
 // - SSL is not currently supported
 //   - See https://github.com/golang/go/issues/32716
+//
 // - The client is presumed to send data over the connection first
 //   - This will surely break any protocol expecting the server to
 //     send first, e.g., FTP Active Mode.
+//   - Responders may speak first when the victim does not initiate
+//     a TLS handshake within responderPeekTimeout.
+//
 // - It assumes that the initial client connection is a TLS handshake
-//   - Proxying for SMTP servers relying upon STARTTLS will fail
+//   - Connections upgraded to TLS later, e.g., using STARTTLS, are
+//     relayed without interception unless an Upgrader negotiates
+//     the upgrade
 func (c *proxyConn) handle() {
 
-	defer c.Close()
-	cTime := time.Now()
+	defer c.s.untrackConn(c)
+	defer c.close()
+	cTime := c.start
 
 	//==================================
 	// GET VICTIM & DOWNSTREAM ADDRESSES
@@ -121,17 +259,36 @@ func (c *proxyConn) handle() {
 	var vA Addr
 	if vA, err = getVictimAddr(c.Conn); err != nil {
 		c.log(ErrorLogLvl, err.Error())
+		c.dq.close()
 		return
 	}
 	c.victimAddr = &vA
+	c.publish()
 	c.cfg.connStart(c)
+	defer c.end()
 
 	// reminder: nil is a valid value!
-	if c.downstreamAddr, err = c.cfg.GetDownstreamAddr(*c.victimAddr, *c.proxyAddr); err != nil {
+	if c.control != 0 {
+		// linked connections are relayed to the downstream announced
+		// over the connection that linked them
+	} else if c.downstreamAddr, err = c.cfg.GetDownstreamAddr(*c.victimAddr, *c.proxyAddr); err != nil {
 		// error getting the downstream
 		c.log(ErrorLogLvl, fmt.Sprintf("failure getting downstream addr: %s", err))
 		return
 	}
+	c.publish()
+
+	// respond to victims of connections without a downstream when
+	// supported by the cfg
+	var responder Responder
+	if rg, ok := c.cfg.Cfg.(ResponderGetter); ok && c.downstreamAddr == nil {
+		responder = rg.GetResponder(*c.victimAddr, *c.proxyAddr)
+	}
+	// negotiate upgrades to tls when supported by the cfg
+	var upgrader Upgrader
+	if ug, ok := c.cfg.Cfg.(UpgraderGetter); ok && c.downstreamAddr != nil && c.control == 0 {
+		upgrader = ug.GetUpgrader(*c.victimAddr, *c.proxyAddr, *c.downstreamAddr)
+	}
 
 	//================
 	// FINGERPRINT TLS
@@ -148,19 +305,117 @@ func (c *proxyConn) handle() {
 		checkHs = isHandshake
 	}
 
-	c.Conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // TODO deadline configurable
+	var (
+		isTLS  bool
+		legacy *LegacyHello // the victim sent a hello that can't be intercepted
+	)
+	if responder != nil {
+		// victims may be waiting for the responder to speak first
+		c.Conn.SetReadDeadline(time.Now().Add(responderPeekTimeout))
+	} else if upgrader != nil || c.control != 0 {
+		// victims may be waiting for the downstream to speak first
+		c.Conn.SetReadDeadline(time.Now().Add(upgradePeekTimeout))
+	} else {
+		c.Conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // TODO deadline configurable
+	}
+	var nErr net.Error
 	if peek, err := c.Conn.(*peekConn).Peek(hsLen); err != nil {
-		c.log(ErrorLogLvl, "failure checking incoming proxy connection for tls")
-		return
-	} else if checkHs(peek) {
+		if responder == nil && upgrader == nil && c.control == 0 || !errors.As(err, &nErr) || !nErr.Timeout() {
+			c.log(ErrorLogLvl, "failure checking incoming proxy connection for tls")
+			return
+		}
+	} else if isTLS = checkHs(peek); isTLS {
+		if c.hello, err = c.peekHello(); err != nil {
+			c.log(DebugLogLvl, fmt.Sprintf("failed to parse client hello: %s", err))
+		}
+		// the tls package doesn't support ssl
+		if legacy = c.hello.legacy(); legacy != nil {
+			isTLS = false
+		}
+		c.publish()
+	} else {
+		legacy = c.peekSSLv2Hello(peek)
+	}
+
+	//=================
+	// FILTER THE VICTIM
+	//=================
+
+	var passthrough bool
+	if f, ok := c.cfg.Cfg.(ConnFilter); ok {
+		switch f.FilterConn(vA, *c.proxyAddr, c.downstreamAddr, c.hello) {
+		case RejectConn:
+			c.s.updateStats(func(st *ServerStats) { st.Rejected++ })
+			c.rejected = RejectFilter
+			c.log(InfoLogLvl, "connection rejected by filter")
+			return
+		case PassthroughConn:
+			if c.downstreamAddr == nil {
+				c.s.updateStats(func(st *ServerStats) { st.Rejected++ })
+				c.rejected = RejectFilter
+				c.log(InfoLogLvl, "connection rejected by filter (passthrough requires a downstream)")
+				return
+			}
+			c.log(DebugLogLvl, "passing connection through without interception")
+			passthrough = true
+		}
+	}
+
+	if legacy != nil && !passthrough {
+		c.log(InfoLogLvl, fmt.Sprintf("victim sent %s", legacy))
+		policy := LegacyPassthrough
+		if f, ok := c.cfg.Cfg.(LegacyHelloFilter); ok {
+			policy = f.FilterLegacyHello(vA, *c.proxyAddr, c.downstreamAddr, legacy)
+		}
+		switch {
+		case policy == LegacyPassthrough && c.downstreamAddr == nil:
+			// capture the hello and what follows like any other data
+			// sent without a downstream
+			c.log(InfoLogLvl, "capturing legacy connection as cleartext (passthrough requires a downstream)")
+		case policy == LegacyPassthrough:
+			c.log(DebugLogLvl, "passing legacy connection through without interception")
+			passthrough = true
+		case policy == LegacyAlert:
+			c.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if _, err := c.Conn.Write(legacy.alert()); err != nil {
+				c.log(DebugLogLvl, fmt.Sprintf("failed to send alert to legacy victim: %s", err))
+			}
+			fallthrough
+		default:
+			c.s.updateStats(func(st *ServerStats) { st.Rejected++ })
+			c.rejected = RejectLegacySSL
+			c.log(InfoLogLvl, "legacy connection rejected")
+			return
+		}
+	}
+
+	//=========================
+	// CONNECT TO THE DOWNSTREAM
+	//=========================
+
+	// connect before the victim's tls handshake so that the protocol
+	// selected by the downstream can be offered to the victim
+	var dialErr error
+	if c.downstreamAddr != nil && responder == nil && c.ctx.Err() == nil {
+		c.downstream, dialErr = c.dialDownstream()
+	}
+
+	if isTLS && !passthrough {
 		c.log(DebugLogLvl, "upgrading proxy connection to tls")
-		var tlsCfg *tls.Config
-		tlsCfg, err = c.cfg.GetProxyTLSConfig(*c.victimAddr, *c.proxyAddr, c.downstreamAddr)
-		if err != nil {
-			c.log(ErrorLogLvl, "failure getting proxy tls config")
+		// offer the victim only the protocol chosen by the downstream,
+		// e.g., h2, so that both legs speak the same protocol
+		var proto string
+		mirror := c.hello != nil && len(c.hello.ALPN) > 0 && c.downstream != nil
+		if mirror {
+			if proto, err = c.mirrorALPN(); err != nil {
+				c.log(ErrorLogLvl, err.Error())
+				return
+			}
+		}
+		if err = c.handshakeVictim(mirror, proto); err != nil {
+			c.log(ErrorLogLvl, err.Error())
 			return
 		}
-		c.Conn = tls.Server(c.Conn, tlsCfg)
 	}
 	c.Conn.SetReadDeadline(time.Time{}) // reset read deadline
 
@@ -168,39 +423,61 @@ func (c *proxyConn) handle() {
 	// ESTABLISH CONNECTION WITH DOWNSTREAM FOR PROXYING
 	//==================================================
 
-	// connect to the downstream
+	if c.ctx.Err() != nil {
+		c.log(DebugLogLvl, "proxy server is shutting down; abandoning connection")
+		return
+	} else if responder != nil {
+		c.respond(cTime, responder)
+		return
+	}
+
+	_, mirrored := c.downstream.(*tls.Conn)
 	if c.downstreamAddr == nil {
 		// nil downstream; assume victim sends first and capture data, then
 		// terminate the connection
 		c.dsDeadRead(cTime, vA)
 		return
-	} else if dC, err := net.Dial("tcp4", net.JoinHostPort(c.downstreamAddr.IP, c.downstreamAddr.Port)); err != nil {
+	} else if dialErr != nil {
 		c.dsDeadRead(cTime, vA)
-		c.log(ErrorLogLvl, "error connecting to downstream")
+		c.log(ErrorLogLvl, dialErr.Error())
 		return
+	} else if passthrough || mirrored {
+		// relayed as is, or already upgraded to tls
 	} else if _, ok := c.Conn.(*tls.Conn); ok {
-		// upgrade to tls
 		c.log(DebugLogLvl, "upgrading downstream connection to tls")
-		var tlsCfg *tls.Config
-		tlsCfg, err = c.cfg.GetDownstreamTLSConfig(*c.victimAddr, *c.proxyAddr, *c.downstreamAddr)
-		if err != nil {
-			c.log(ErrorLogLvl, "failure getting downstream tls config")
+		// the downstream mustn't select a protocol the victim didn't
+		// negotiate
+		var alpn []string
+		if c.alpn != "" {
+			alpn = []string{c.alpn}
+		}
+		var tC *tls.Conn
+		if tC, err = c.handshakeDownstream(c.downstream, alpn); err != nil {
+			c.log(ErrorLogLvl, err.Error())
+			return
+		}
+		c.downstream = tC
+	} else if upgrader != nil {
+		if !c.upgrade(cTime, upgrader) {
 			return
 		}
-		c.downstream = tls.Client(dC, tlsCfg)
-	} else {
-		c.downstream = dC
 	}
 
-	c.downstream = &downstreamConn{
-		Conn: c.downstream,
-		cfg:  c.cfg,
-		connInfo: ConnInfo{
-			Time:       cTime,
-			Victim:     vA,
-			Proxy:      *c.proxyAddr,
-			Downstream: c.downstreamAddr,
-		},
+	// wrap the downstream to count bytes and, unless the connection is
+	// passed through, capture data
+	cI := ConnInfo{Time: cTime}
+	cI.fill(c)
+	dC := &downstreamConn{Conn: c.downstream, connInfo: cI, counters: &c.counters}
+	if !passthrough {
+		dC.dq = c.dq
+	}
+	c.downstream = dC
+
+	// data sent by the downstream is captured before Upgraders that
+	// take part in the relay see it
+	var dsReader io.Reader = c.downstream
+	if rw, ok := upgrader.(RelayWrapper); ok && !passthrough {
+		dsReader = rw.WrapDownstream(cI, c, c.downstream)
 	}
 
 	c.log(DebugLogLvl, "new connection established")
@@ -210,11 +487,16 @@ func (c *proxyConn) handle() {
 	//=================================
 
 	// put one side of the connection in routine
+	relayDone := make(chan struct{})
 	go func() {
-		if _, err := io.Copy(c, c.downstream); err != nil && !errors.Is(err, net.ErrClosed) {
+		defer close(relayDone)
+		if _, err := io.Copy(c, dsReader); err != nil && !errors.Is(err, net.ErrClosed) {
 			c.log(ErrorLogLvl, fmt.Sprintf("error copying data between connections (proxy to downstream): %s", err))
 		}
 		c.log(DebugLogLvl, "finished relaying data (proxy to downstream)")
+		// let the victim know that the downstream finished sending, e.g.,
+		// the end of an FTP download
+		c.closeWrite()
 	}()
 
 	// block until one side of the connection dies
@@ -222,25 +504,162 @@ func (c *proxyConn) handle() {
 		c.log(ErrorLogLvl, fmt.Sprintf("error copying data between connections (downstream to proxy): %s", err))
 	}
 	c.log(DebugLogLvl, "finished relaying data (downstream to proxy)")
+
+	// close both sides to unblock the relay routine, then wait for it
+	// so that no data events are queued after the connection ends
+	c.close()
+	<-relayDone
+}
+
+// dialDownstream connects to the downstream, counting failures in the
+// server's stats.
+func (c *proxyConn) dialDownstream() (net.Conn, error) {
+	var dialer net.Dialer
+	dC, err := dialer.DialContext(c.ctx, "tcp4", net.JoinHostPort(c.downstreamAddr.IP, c.downstreamAddr.Port))
+	if err != nil {
+		c.s.updateStats(func(st *ServerStats) { st.DialFailures++ })
+		return nil, fmt.Errorf("error connecting to downstream: %w", err)
+	}
+	return dC, nil
+}
+
+// mirrorALPN completes a TLS handshake with the downstream offering the
+// protocols offered by the victim, returning the protocol selected by
+// the downstream.
+func (c *proxyConn) mirrorALPN() (string, error) {
+	tC, err := c.handshakeDownstream(c.downstream, c.hello.ALPN)
+	if err != nil {
+		return "", fmt.Errorf("%w while mirroring alpn", err)
+	}
+	c.downstream = tC
+	proto := tC.ConnectionState().NegotiatedProtocol
+	c.log(DebugLogLvl, fmt.Sprintf("downstream selected alpn protocol: %q", proto))
+	return proto, nil
+}
+
+// handshakeDownstream upgrades dC to TLS, offering the alpn protocols.
+func (c *proxyConn) handshakeDownstream(dC net.Conn, alpn []string) (*tls.Conn, error) {
+	tlsCfg, err := c.cfg.GetDownstreamTLSConfig(*c.victimAddr, *c.proxyAddr, *c.downstreamAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failure getting downstream tls config: %w", err)
+	}
+	tlsCfg = tlsCfg.Clone()
+	tlsCfg.NextProtos = alpn
+	if tlsCfg.ClientSessionCache == nil {
+		// linked connections resume the session of their control
+		// connection
+		tlsCfg.ClientSessionCache = c.sessions
+		if c.control != 0 {
+			tlsCfg.ClientSessionCache = linkedSessions{c.sessions}
+		}
+	}
+	tC := tls.Client(dC, tlsCfg)
+	if err = tC.HandshakeContext(c.ctx); err != nil {
+		return nil, fmt.Errorf("downstream tls handshake failed: %w", err)
+	}
+	return tC, nil
+}
+
+// handshakeVictim terminates the victim's TLS handshake. When mirror is
+// set, proto is the only alpn protocol offered to the victim, and none
+// are offered when it is empty.
+func (c *proxyConn) handshakeVictim(mirror bool, proto string) error {
+	tlsCfg, err := c.cfg.GetProxyTLSConfig(*c.victimAddr, *c.proxyAddr, c.downstreamAddr)
+	if err != nil {
+		return fmt.Errorf("failure getting proxy tls config: %w", err)
+	}
+	if mirror {
+		tlsCfg = tlsCfg.Clone()
+		tlsCfg.NextProtos = nil
+		if proto != "" {
+			tlsCfg.NextProtos = []string{proto}
+		}
+	}
+	tC := tls.Server(c.Conn, tlsCfg)
+	if err = tC.HandshakeContext(c.ctx); c.ctx.Err() == nil {
+		// handshakes abandoned during shutdown aren't failures
+		c.s.recordHandshake(err)
+	}
+	if err != nil {
+		return fmt.Errorf("victim tls handshake failed: %w", err)
+	}
+	c.Conn, c.tls = tC, true
+	c.alpn = tC.ConnectionState().NegotiatedProtocol
+	c.publish()
+	return nil
+}
+
+// publish a snapshot of the connection's ConnInfo for ProxyServer.Conns.
+func (c *proxyConn) publish() {
+	cI := ConnInfo{Time: c.start}
+	cI.fill(c)
+	c.info.Store(&cI)
+}
+
+// peekHello peeks at the first TLS record sent by the victim and parses
+// the ClientHello it contains.
+func (c *proxyConn) peekHello() (*ClientHello, error) {
+	pC := c.Conn.(*peekConn)
+	hdr, err := pC.Peek(tlsRecordHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	rLen := int(binary.BigEndian.Uint16(hdr[3:5]))
+	if rLen > maxTLSRecordLen {
+		return nil, fmt.Errorf("tls record length exceeds maximum (%d)", rLen)
+	}
+	b, err := pC.Peek(tlsRecordHeaderLen + rLen)
+	if err != nil {
+		return nil, err
+	}
+	return ParseClientHello(b)
+}
+
+// initDataQueue creates the queue delivering data to the cfg when it
+// implements DataReceiver. It must be called before the connection is
+// tracked, as ProxyServer.Stats reads the queue.
+func (c *proxyConn) initDataQueue() {
+	if dr, ok := c.cfg.Cfg.(DataReceiver); ok {
+		c.dq = newDataQueue(dr)
+	}
+}
+
+// end closes the connection, blocks until all queued data events have
+// been delivered, and notifies the cfg that the connection has ended.
+func (c *proxyConn) end() {
+	c.close()
+	c.dq.close()
+	c.cfg.connEnd(c)
+}
+
+// respond hands the victim connection to a Responder, capturing the
+// data they exchange.
+func (c *proxyConn) respond(connTime time.Time, r Responder) {
+	cI := ConnInfo{Time: connTime}
+	cI.fill(c)
+	rC := &responderConn{Conn: c.Conn, dq: c.dq, connInfo: cI, counters: &c.counters}
+	c.log(DebugLogLvl, "responding to victim")
+	if err := r.Respond(c.ctx, rC); err != nil && !errors.Is(err, net.ErrClosed) {
+		c.log(ErrorLogLvl, fmt.Sprintf("responder failed: %s", err))
+	}
+	c.log(DebugLogLvl, "finished responding to victim")
 }
 
 // dsDeadRead is called when the downstream connecting to the downstream fails,
 // allowing us to capture any data sent by the victim before altogether terminating
 // the connection.
 func (c *proxyConn) dsDeadRead(connTime time.Time, vA Addr) {
-	if dh, ok := c.cfg.Cfg.(DataReceiver); ok {
+	if c.dq != nil {
 		data := make([]byte, 4028)                                                  // TODO size configurable
 		if e := c.Conn.SetReadDeadline(time.Now().Add(5 * time.Second)); e != nil { // TODO deadline configurable
 			c.log(ErrorLogLvl, fmt.Sprintf("failed to set read deadline for victim connection: %s", e))
 		} else if n, err := c.Conn.Read(data); err != nil {
 			c.log(ErrorLogLvl, fmt.Sprintf("failed to read data from victim connection: %s", err))
 		} else {
-			dh.RecvVictimData(ConnInfo{
-				Time:       connTime,
-				Victim:     vA,
-				Proxy:      *c.proxyAddr,
-				Downstream: nil,
-			}, data[:n])
+			cI := ConnInfo{Time: connTime}
+			cI.fill(c)
+			cI.Downstream = nil
+			c.dq.push(cI, true, data[:n])
 		}
 	}
 }
@@ -0,0 +1,65 @@
+package gosplit
+
+import "container/list"
+
+type (
+	// connTable is the state of connections tracked by a receiver, keyed
+	// by ConnInfo.ID. Once it holds max connections the oldest is
+	// discarded as another is added.
+	//
+	// connTable isn't safe for concurrent use. Use newConnTable to
+	// initialize.
+	connTable[T any] struct {
+		max   int
+		conns map[uint64]*list.Element
+		order list.List // connTableEntry values ordered by creation
+	}
+
+	connTableEntry[T any] struct {
+		id    uint64
+		state T
+	}
+)
+
+// newConnTable initializes a connTable tracking at most max connections.
+func newConnTable[T any](max int) *connTable[T] {
+	return &connTable[T]{max: max, conns: make(map[uint64]*list.Element)}
+}
+
+// get returns the state of the connection.
+func (t *connTable[T]) get(id uint64) (state T, ok bool) {
+	if e := t.conns[id]; e != nil {
+		return e.Value.(connTableEntry[T]).state, true
+	}
+	return
+}
+
+// add the state of a connection that isn't tracked, returning the state
+// of the oldest connection when it was discarded to make room.
+func (t *connTable[T]) add(id uint64, state T) (evicted T, ok bool) {
+	t.conns[id] = t.order.PushBack(connTableEntry[T]{id: id, state: state})
+	if len(t.conns) > t.max {
+		e := t.order.Front()
+		evicted = e.Value.(connTableEntry[T]).state
+		t.order.Remove(e)
+		delete(t.conns, e.Value.(connTableEntry[T]).id)
+		ok = true
+	}
+	return
+}
+
+// remove the connection, returning its state.
+func (t *connTable[T]) remove(id uint64) (state T, ok bool) {
+	e := t.conns[id]
+	if e == nil {
+		return
+	}
+	delete(t.conns, id)
+	t.order.Remove(e)
+	return e.Value.(connTableEntry[T]).state, true
+}
+
+// len returns the number of connections tracked.
+func (t *connTable[T]) len() int {
+	return len(t.conns)
+}
@@ -0,0 +1,51 @@
+package gosplit
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConnTable(t *testing.T) {
+	tests := []struct {
+		name        string
+		max         int
+		add         []uint64
+		remove      []uint64
+		wantEvicted []int
+		wantIDs     []uint64
+	}{
+		{name: "under max", max: 2, add: []uint64{1, 2}, wantIDs: []uint64{1, 2}},
+		{name: "oldest evicted", max: 2, add: []uint64{1, 2, 3, 4}, wantEvicted: []int{1, 2},
+			wantIDs: []uint64{3, 4}},
+		{name: "removal makes room", max: 3, add: []uint64{1, 2, 3, 4}, remove: []uint64{2, 5},
+			wantIDs: []uint64{1, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ct := newConnTable[int](tt.max)
+			var evicted []int
+			for i, id := range tt.add {
+				if i == len(tt.add)-1 {
+					// removals happen before the last connection is added
+					for _, id := range tt.remove {
+						ct.remove(id)
+					}
+				}
+				if s, ok := ct.add(id, int(id)); ok {
+					evicted = append(evicted, s)
+				}
+			}
+			if !reflect.DeepEqual(evicted, tt.wantEvicted) {
+				t.Errorf("evicted %v, want %v", evicted, tt.wantEvicted)
+			}
+			if ct.len() != len(tt.wantIDs) {
+				t.Errorf("len() = %d, want %d", ct.len(), len(tt.wantIDs))
+			}
+			for _, id := range tt.wantIDs {
+				if s, ok := ct.get(id); !ok || s != int(id) {
+					t.Errorf("get(%d) = %d, %v, want %d, true", id, s, ok, id)
+				}
+			}
+		})
+	}
+}
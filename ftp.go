@@ -0,0 +1,190 @@
+package gosplit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxFTPLine bounds the command and reply lines read while negotiating
+// TLS.
+const maxFTPLine = 4096
+
+var (
+	// ftpPASVAddr matches the address announced by a PASV reply.
+	ftpPASVAddr = regexp.MustCompile(`(\d+),(\d+),(\d+),(\d+),(\d+),(\d+)`)
+	// ftpEPSVPort matches the port announced by an EPSV reply, which is
+	// enclosed by a repeated delimiter, e.g., (|||6446|).
+	ftpEPSVPort = regexp.MustCompile(`\(([!-~])([!-~])([!-~])(\d+)([!-~])\)`)
+)
+
+type (
+	// FTPStartTLS is an Upgrader for FTP control connections, which are
+	// upgraded to TLS using AUTH TLS before logging in.
+	//
+	// FTPStartTLS also implements RelayWrapper, rewriting the replies to
+	// PASV and EPSV commands so that victims open data connections to
+	// listeners opened by the proxy, which intercepts them and relays
+	// them to the downstream. This includes control connections that
+	// begin with a TLS handshake (implicit FTPS) or aren't upgraded.
+	// Data connections opened by the downstream in active mode are not
+	// intercepted.
+	FTPStartTLS struct{}
+
+	// ftpPassiveRewriter rewrites the passive mode replies sent by a
+	// downstream.
+	ftpPassiveRewriter struct {
+		r   *bufio.Reader
+		ip  string // of the downstream
+		l   ConnLinker
+		buf []byte // rewritten data yet to be read
+		err error  // returned once buf is drained
+	}
+)
+
+// Upgrade implements Upgrader.
+func (FTPStartTLS) Upgrade(_ context.Context, victim, downstream net.Conn) (bool, error) {
+	code, err := relayFTPReply(downstream, victim)
+	if err != nil {
+		return false, fmt.Errorf("error relaying ftp greeting: %w", err)
+	} else if code != "220" {
+		return false, nil
+	}
+	for {
+		cmd, err := readFTPLine(victim)
+		if err != nil {
+			return false, fmt.Errorf("error reading ftp command: %w", err)
+		} else if _, err = downstream.Write([]byte(cmd)); err != nil {
+			return false, fmt.Errorf("error relaying ftp command: %w", err)
+		}
+		verb, _, _ := strings.Cut(strings.TrimSpace(cmd), " ")
+		verb = strings.ToUpper(verb)
+		if verb == "USER" {
+			// logging in without upgrading
+			return false, nil
+		}
+		if code, err = relayFTPReply(downstream, victim); err != nil {
+			return false, fmt.Errorf("error relaying ftp reply: %w", err)
+		} else if verb == "AUTH" && code == "234" {
+			return true, nil
+		}
+	}
+}
+
+// WrapDownstream implements RelayWrapper.
+func (FTPStartTLS) WrapDownstream(cI ConnInfo, l ConnLinker, r io.Reader) io.Reader {
+	w := &ftpPassiveRewriter{r: bufio.NewReaderSize(r, maxFTPLine), l: l}
+	if cI.Downstream != nil {
+		w.ip = cI.Downstream.IP
+	}
+	return w
+}
+
+// Read from the downstream, rewriting complete reply lines.
+func (w *ftpPassiveRewriter) Read(b []byte) (int, error) {
+	if len(w.buf) == 0 {
+		if w.err != nil {
+			return 0, w.err
+		}
+		line, err := w.r.ReadSlice('\n')
+		if err == nil {
+			w.buf = w.rewrite(line)
+		} else {
+			w.buf = append([]byte(nil), line...)
+			if !errors.Is(err, bufio.ErrBufferFull) {
+				w.err = err
+			}
+		}
+		if len(w.buf) == 0 {
+			return 0, w.err
+		}
+	}
+	n := copy(b, w.buf)
+	w.buf = w.buf[n:]
+	return n, nil
+}
+
+// rewrite a reply line announcing a passive mode data connection to
+// announce a listener linked to the control connection instead.
+//
+// Data connections are relayed to the downstream's address, as
+// announced addresses are often unreachable, e.g., private addresses of
+// servers behind NAT.
+func (w *ftpPassiveRewriter) rewrite(line []byte) []byte {
+	s := string(line)
+	switch {
+	case strings.HasPrefix(s, "227 "):
+		m := ftpPASVAddr.FindStringSubmatchIndex(s)
+		if m == nil {
+			break
+		}
+		hi, _ := strconv.Atoi(s[m[10]:m[11]])
+		lo, _ := strconv.Atoi(s[m[12]:m[13]])
+		a, err := w.l.Link(Addr{IP: w.ip, Port: strconv.Itoa(hi<<8 | lo)})
+		if err != nil {
+			break
+		}
+		port, _ := strconv.Atoi(a.Port)
+		return []byte(fmt.Sprintf("%s%s,%d,%d%s", s[:m[0]], strings.ReplaceAll(a.IP, ".", ","),
+			port>>8, port&0xff, s[m[1]:]))
+	case strings.HasPrefix(s, "229 "):
+		m := ftpEPSVPort.FindStringSubmatchIndex(s)
+		if m == nil {
+			break
+		}
+		d := s[m[2]:m[3]]
+		if s[m[4]:m[5]] != d || s[m[6]:m[7]] != d || s[m[10]:m[11]] != d {
+			break
+		}
+		a, err := w.l.Link(Addr{IP: w.ip, Port: s[m[8]:m[9]]})
+		if err != nil {
+			break
+		}
+		return []byte(s[:m[8]] + a.Port + s[m[9]:])
+	}
+	return append([]byte(nil), line...)
+}
+
+// readFTPLine reads a line from r without reading beyond its end.
+func readFTPLine(r io.Reader) (string, error) {
+	var b []byte
+	c := make([]byte, 1)
+	for len(b) < maxFTPLine {
+		if _, err := io.ReadFull(r, c); err != nil {
+			return "", err
+		}
+		if b = append(b, c[0]); c[0] == '\n' {
+			return string(b), nil
+		}
+	}
+	return "", errors.New("ftp line exceeds maximum length")
+}
+
+// relayFTPReply relays a reply, which may span multiple lines, from src
+// to dst, returning its code.
+func relayFTPReply(src io.Reader, dst io.Writer) (string, error) {
+	var code string
+	for {
+		line, err := readFTPLine(src)
+		if err != nil {
+			return "", err
+		} else if _, err = dst.Write([]byte(line)); err != nil {
+			return "", err
+		}
+		if len(line) < 4 {
+			continue
+		} else if code == "" {
+			code = line[:3]
+		}
+		// the last line repeats the code followed by a space
+		if line[:3] == code && line[3] == ' ' {
+			return code, nil
+		}
+	}
+}
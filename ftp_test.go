@@ -0,0 +1,269 @@
+package gosplit
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// linkerFunc implements ConnLinker.
+type linkerFunc func(Addr) (Addr, error)
+
+func (f linkerFunc) Link(downstream Addr) (Addr, error) {
+	return f(downstream)
+}
+
+func TestRelayFTPReply(t *testing.T) {
+	tests := []struct {
+		name     string
+		b        string
+		want     string
+		wantLine string // relayed
+		wantErr  bool
+	}{
+		{name: "single line", b: "220 ready\r\nnext", want: "220", wantLine: "220 ready\r\n"},
+		{name: "multiple lines", b: "211-features\r\n AUTH TLS\r\n211 end\r\n", want: "211",
+			wantLine: "211-features\r\n AUTH TLS\r\n211 end\r\n"},
+		{name: "other code ending in space", b: "230-a\r\n220 b\r\n230 c\r\n", want: "230",
+			wantLine: "230-a\r\n220 b\r\n230 c\r\n"},
+		{name: "unterminated", b: "220-ready\r\n", wantErr: true},
+		{name: "line too long", b: strings.Repeat("a", maxFTPLine+1), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var relayed strings.Builder
+			r := strings.NewReader(tt.b)
+			got, err := relayFTPReply(r, &relayed)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("relayFTPReply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got != tt.want || relayed.String() != tt.wantLine {
+				t.Errorf("relayFTPReply() = %q relaying %q, want %q relaying %q", got, relayed.String(), tt.want,
+					tt.wantLine)
+			}
+			if r.Len() != len(tt.b)-len(tt.wantLine) {
+				t.Error("relayFTPReply() read beyond the reply")
+			}
+		})
+	}
+}
+
+func TestFTPPassiveRewriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		b        string
+		linkErr  error
+		want     string
+		wantLink string // downstream address linked
+	}{
+		{name: "pasv", b: "227 Entering Passive Mode (10,0,0,5,4,1).\r\n",
+			want: "227 Entering Passive Mode (127,0,0,1,31,144).\r\n", wantLink: "192.0.2.1:1025"},
+		{name: "epsv", b: "229 Entering Extended Passive Mode (|||6446|)\r\n",
+			want: "229 Entering Extended Passive Mode (|||8080|)\r\n", wantLink: "192.0.2.1:6446"},
+		{name: "epsv mismatched delimiters", b: "229 Entering Extended Passive Mode (|!|6446|)\r\n",
+			want: "229 Entering Extended Passive Mode (|!|6446|)\r\n"},
+		{name: "link failed", b: "227 Entering Passive Mode (10,0,0,5,4,1).\r\n", linkErr: io.ErrClosedPipe,
+			want: "227 Entering Passive Mode (10,0,0,5,4,1).\r\n", wantLink: "192.0.2.1:1025"},
+		{name: "other replies", b: "220 ready\r\n150 opening (1,2,3,4,5,6)\r\npartial",
+			want: "220 ready\r\n150 opening (1,2,3,4,5,6)\r\npartial"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var linked string
+			l := linkerFunc(func(ds Addr) (Addr, error) {
+				linked = ds.String()
+				return Addr{IP: "127.0.0.1", Port: "8080"}, tt.linkErr
+			})
+			r := FTPStartTLS{}.WrapDownstream(ConnInfo{Downstream: &Addr{IP: "192.0.2.1", Port: "21"}}, l,
+				strings.NewReader(tt.b))
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal("failed to read rewritten replies", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("rewritten replies = %q, want %q", got, tt.want)
+			}
+			if linked != tt.wantLink {
+				t.Errorf("linked %q, want %q", linked, tt.wantLink)
+			}
+		})
+	}
+}
+
+// TestFTPStartTLS_DataConnections tests that passive mode data
+// connections are intercepted, linked to their control connection, and
+// resume its tls session.
+func TestFTPStartTLS_DataConnections(t *testing.T) {
+	crt := upgradeTestCert(t)
+	tests := []struct {
+		name string
+		tls  bool // the victim upgrades the control and data connections
+	}{
+		{name: "auth tls", tls: true},
+		{name: "cleartext"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsCfg := &tls.Config{Certificates: []tls.Certificate{*crt}}
+			pasv, uploaded := make(chan string, 1), make(chan string, 1)
+			// dataListener accepts a data connection from the proxy,
+			// passing it to handle
+			dataListener := func(handle func(net.Conn)) int {
+				l, err := net.Listen("tcp4", "127.0.0.1:0")
+				if err != nil {
+					t.Error("failed to start data listener", err)
+					return 0
+				}
+				go func() {
+					defer l.Close()
+					c, err := l.Accept()
+					if err != nil {
+						return
+					}
+					defer c.Close()
+					if tt.tls {
+						tC := tls.Server(c, dsCfg)
+						if err := tC.Handshake(); err != nil || !tC.ConnectionState().DidResume {
+							t.Errorf("data connection handshake error = %v, resumed %v, want resumed",
+								err, tC.ConnectionState().DidResume)
+						}
+						c = tC
+					}
+					handle(c)
+				}()
+				return l.Addr().(*net.TCPAddr).Port
+			}
+			c, rec := startUpgradeProxy(t, crt, FTPStartTLS{}, func(c net.Conn) {
+				c.Write([]byte("220-welcome\r\n220 ready\r\n"))
+				cmds := []string{"USER a\r\n", "PASV\r\n", "EPSV\r\n", "QUIT\r\n"}
+				if tt.tls {
+					cmds = append([]string{"AUTH TLS\r\n"}, cmds...)
+				}
+				for _, want := range cmds {
+					if cmd, err := readFTPLine(c); err != nil || cmd != want {
+						t.Errorf("downstream received %q, %v, want %q", cmd, err, want)
+						return
+					}
+					switch want {
+					case "AUTH TLS\r\n":
+						c.Write([]byte("234 proceed\r\n"))
+						c = tls.Server(c, dsCfg)
+					case "USER a\r\n":
+						c.Write([]byte("230 logged in\r\n"))
+					case "PASV\r\n":
+						port := dataListener(func(c net.Conn) { c.Write([]byte("file contents")) })
+						reply := fmt.Sprintf("227 Entering Passive Mode (127,0,0,1,%d,%d).\r\n", port>>8, port&0xff)
+						pasv <- reply
+						c.Write([]byte(reply))
+					case "EPSV\r\n":
+						port := dataListener(func(c net.Conn) {
+							b, _ := io.ReadAll(c)
+							uploaded <- string(b)
+						})
+						c.Write([]byte(fmt.Sprintf("229 Entering Extended Passive Mode (|||%d|)\r\n", port)))
+					case "QUIT\r\n":
+						c.Write([]byte("221 bye\r\n"))
+					}
+				}
+			})
+
+			// dial a data connection announced by the proxy
+			dial := func(port string) net.Conn {
+				dC, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", port))
+				if err != nil {
+					t.Fatal("failed to open data connection", err)
+				}
+				t.Cleanup(func() { dC.Close() })
+				dC.SetDeadline(time.Now().Add(5 * time.Second))
+				if tt.tls {
+					dC = upgradeTestHandshake(t, dC)
+				}
+				return dC
+			}
+			cmd := func(cmd string) string {
+				if _, err := c.Write([]byte(cmd)); err != nil {
+					t.Fatal("failed to write to proxy", err)
+				}
+				reply, err := readFTPLine(c)
+				if err != nil {
+					t.Fatal("failed to read from proxy", err)
+				}
+				return reply
+			}
+
+			if _, err := relayFTPReply(c, io.Discard); err != nil {
+				t.Fatal("failed to read greeting", err)
+			}
+			if tt.tls {
+				if reply := cmd("AUTH TLS\r\n"); reply != "234 proceed\r\n" {
+					t.Fatalf("AUTH TLS reply = %q", reply)
+				}
+				c = upgradeTestHandshake(t, c)
+			}
+			cmd("USER a\r\n")
+
+			m := ftpPASVAddr.FindStringSubmatch(cmd("PASV\r\n"))
+			if m == nil || strings.Join(m[1:5], ".") != "127.0.0.1" {
+				t.Fatalf("PASV reply announced %v, want a proxy address", m)
+			}
+			hi, _ := strconv.Atoi(m[5])
+			lo, _ := strconv.Atoi(m[6])
+			dC := dial(strconv.Itoa(hi<<8 | lo))
+			if b, err := io.ReadAll(dC); err != nil || string(b) != "file contents" {
+				t.Errorf("downloaded %q, %v, want file contents", b, err)
+			}
+			dC.Close()
+
+			m = ftpEPSVPort.FindStringSubmatch(cmd("EPSV\r\n"))
+			if m == nil {
+				t.Fatal("EPSV reply did not announce a port")
+			}
+			dC = dial(m[4])
+			dC.Write([]byte("upload"))
+			dC.Close()
+			if got := <-uploaded; got != "upload" {
+				t.Errorf("downstream received upload %q", got)
+			}
+			cmd("QUIT\r\n")
+			c.Close()
+
+			victim, downstream := capturedData(rec, 3)
+			// replies are captured as sent by the downstream
+			for _, want := range []string{<-pasv, "file contents"} {
+				if !strings.Contains(downstream, want) {
+					t.Errorf("downstream data %q does not contain %q", downstream, want)
+				}
+			}
+			if !strings.Contains(victim, "upload") {
+				t.Errorf("victim data %q does not contain upload", victim)
+			}
+			rec.m.Lock()
+			defer rec.m.Unlock()
+			if len(rec.ended) != 3 {
+				t.Fatalf("%d connections ended, want 3", len(rec.ended))
+			}
+			var control uint64
+			for _, cI := range rec.ended {
+				if cI.Control == 0 {
+					control = cI.ID
+				}
+			}
+			for _, cI := range rec.ended {
+				if cI.ID != control && cI.Control != control {
+					t.Errorf("data connection %d linked to %d, want %d", cI.ID, cI.Control, control)
+				}
+				if cI.TLS != tt.tls {
+					t.Errorf("connection %d tls = %v, want %v", cI.ID, cI.TLS, tt.tls)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package gosplit
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	tlsRecordHeaderLen = 5           // length of a TLS record header
+	maxTLSRecordLen    = 16384 + 256 // maximum length of a TLS record payload, plus allowance for expansion
+	tlsHandshakeType   = 0x16        // content type of TLS handshake records
+	clientHelloType    = 0x01        // handshake message type of ClientHello
+
+	extServerName        uint16 = 0  // server_name extension
+	extALPN              uint16 = 16 // application_layer_protocol_negotiation extension
+	extSupportedVersions uint16 = 43 // supported_versions extension
+)
+
+var errShortHello = errors.New("truncated client hello")
+
+type (
+	// ClientHello contains fields parsed from a victim's TLS ClientHello.
+	ClientHello struct {
+		// Version is the legacy version field of the ClientHello.
+		Version uint16 `json:"version"`
+		// ServerName is the value of the server_name (SNI) extension.
+		ServerName string `json:"server_name,omitempty"`
+		// ALPN contains the protocols offered in the application layer
+		// protocol negotiation extension.
+		ALPN []string `json:"alpn,omitempty"`
+		// CipherSuites offered by the victim.
+		CipherSuites []uint16 `json:"cipher_suites,omitempty"`
+		// SupportedVersions contains the versions offered in the
+		// supported_versions extension.
+		SupportedVersions []uint16 `json:"supported_versions,omitempty"`
+	}
+
+	// helloReader consumes length-prefixed fields from a ClientHello.
+	helloReader []byte
+)
+
+// ParseClientHello parses a TLS record containing a ClientHello, as
+// sent by a victim when initiating a TLS handshake.
+//
+// Only the first record is parsed, so an error is returned when the
+// ClientHello is fragmented across multiple records.
+func ParseClientHello(b []byte) (h *ClientHello, err error) {
+
+	if len(b) < tlsRecordHeaderLen {
+		return nil, errShortHello
+	} else if b[0] != tlsHandshakeType {
+		return nil, errors.New("not a tls handshake record")
+	}
+	rLen := int(binary.BigEndian.Uint16(b[3:5]))
+	if len(b) < tlsRecordHeaderLen+rLen {
+		return nil, errShortHello
+	}
+	r := helloReader(b[tlsRecordHeaderLen : tlsRecordHeaderLen+rLen])
+
+	var (
+		msgType uint8
+		msgLen  uint32
+		msg     helloReader
+		suites  helloReader
+		exts    helloReader
+		ok      bool
+	)
+
+	if msgType, ok = r.uint8(); !ok || msgType != clientHelloType {
+		return nil, errors.New("not a client hello")
+	} else if msgLen, ok = r.uint24(); !ok {
+		return nil, errShortHello
+	} else if msg, ok = r.bytes(int(msgLen)); !ok {
+		return nil, errShortHello
+	}
+
+	h = new(ClientHello)
+	if h.Version, ok = msg.uint16(); !ok {
+		return nil, errShortHello
+	} else if _, ok = msg.bytes(32); !ok { // random
+		return nil, errShortHello
+	} else if _, ok = msg.prefixed8(); !ok { // session id
+		return nil, errShortHello
+	} else if suites, ok = msg.prefixed16(); !ok {
+		return nil, errShortHello
+	} else if _, ok = msg.prefixed8(); !ok { // compression methods
+		return nil, errShortHello
+	}
+
+	for len(suites) > 0 {
+		var suite uint16
+		if suite, ok = suites.uint16(); !ok {
+			return nil, errors.New("malformed cipher suites")
+		}
+		h.CipherSuites = append(h.CipherSuites, suite)
+	}
+
+	// extensions are optional
+	if len(msg) == 0 {
+		return h, nil
+	} else if exts, ok = msg.prefixed16(); !ok {
+		return nil, errors.New("malformed extensions")
+	}
+
+	for len(exts) > 0 {
+		var (
+			extType uint16
+			extData helloReader
+		)
+		if extType, ok = exts.uint16(); !ok {
+			return nil, errors.New("malformed extension")
+		} else if extData, ok = exts.prefixed16(); !ok {
+			return nil, errors.New("malformed extension")
+		}
+
+		switch extType {
+		case extServerName:
+			list, ok := extData.prefixed16()
+			for ok && len(list) > 0 {
+				var (
+					nameType uint8
+					name     helloReader
+				)
+				if nameType, ok = list.uint8(); !ok {
+					break
+				} else if name, ok = list.prefixed16(); ok && nameType == 0 {
+					h.ServerName = string(name)
+				}
+			}
+		case extALPN:
+			list, ok := extData.prefixed16()
+			for ok && len(list) > 0 {
+				var proto helloReader
+				if proto, ok = list.prefixed8(); ok {
+					h.ALPN = append(h.ALPN, string(proto))
+				}
+			}
+		case extSupportedVersions:
+			list, ok := extData.prefixed8()
+			for ok && len(list) > 0 {
+				var v uint16
+				if v, ok = list.uint16(); ok {
+					h.SupportedVersions = append(h.SupportedVersions, v)
+				}
+			}
+		}
+	}
+
+	return h, nil
+}
+
+func (r *helloReader) bytes(n int) (b helloReader, ok bool) {
+	if len(*r) < n {
+		return nil, false
+	}
+	b, *r = (*r)[:n], (*r)[n:]
+	return b, true
+}
+
+func (r *helloReader) uint8() (uint8, bool) {
+	b, ok := r.bytes(1)
+	if !ok {
+		return 0, false
+	}
+	return b[0], true
+}
+
+func (r *helloReader) uint16() (uint16, bool) {
+	b, ok := r.bytes(2)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(b), true
+}
+
+func (r *helloReader) uint24() (uint32, bool) {
+	b, ok := r.bytes(3)
+	if !ok {
+		return 0, false
+	}
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2]), true
+}
+
+// prefixed8 reads a field prefixed by an 8-bit length.
+func (r *helloReader) prefixed8() (helloReader, bool) {
+	n, ok := r.uint8()
+	if !ok {
+		return nil, false
+	}
+	return r.bytes(int(n))
+}
+
+// prefixed16 reads a field prefixed by a 16-bit length.
+func (r *helloReader) prefixed16() (helloReader, bool) {
+	n, ok := r.uint16()
+	if !ok {
+		return nil, false
+	}
+	return r.bytes(int(n))
+}
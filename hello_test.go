@@ -0,0 +1,73 @@
+package gosplit
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// captureClientHello returns the first TLS record sent by a client
+// using cfg.
+func captureClientHello(t *testing.T, cfg *tls.Config) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, cfg).Handshake()
+		client.Close()
+	}()
+	hdr := make([]byte, tlsRecordHeaderLen)
+	if _, err := io.ReadFull(server, hdr); err != nil {
+		t.Fatal("failed to read record header", err)
+	}
+	b := make([]byte, int(hdr[3])<<8|int(hdr[4]))
+	if _, err := io.ReadFull(server, b); err != nil {
+		t.Fatal("failed to read record", err)
+	}
+	return append(hdr, b...)
+}
+
+func TestParseClientHello(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       *tls.Config
+		truncate  int // bytes to remove from the end of the record
+		wantSNI   string
+		wantALPN  []string
+		wantErr   bool
+		wantTLS13 bool
+	}{
+		{name: "sni and alpn", cfg: &tls.Config{ServerName: "gosplit.test", NextProtos: []string{"h2", "http/1.1"}},
+			wantSNI: "gosplit.test", wantALPN: []string{"h2", "http/1.1"}, wantTLS13: true},
+		{name: "no sni", cfg: &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}},
+		{name: "truncated", cfg: &tls.Config{ServerName: "gosplit.test"}, truncate: 10, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := captureClientHello(t, tt.cfg)
+			got, err := ParseClientHello(b[:len(b)-tt.truncate])
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseClientHello() error = %v, wantErr %v", err, tt.wantErr)
+			} else if err != nil {
+				return
+			}
+			if got.ServerName != tt.wantSNI {
+				t.Errorf("ParseClientHello() ServerName = %q, want %q", got.ServerName, tt.wantSNI)
+			}
+			if !reflect.DeepEqual(got.ALPN, tt.wantALPN) {
+				t.Errorf("ParseClientHello() ALPN = %v, want %v", got.ALPN, tt.wantALPN)
+			}
+			if len(got.CipherSuites) == 0 {
+				t.Error("ParseClientHello() CipherSuites is empty")
+			}
+			var tls13 bool
+			for _, v := range got.SupportedVersions {
+				tls13 = tls13 || v == tls.VersionTLS13
+			}
+			if tls13 != tt.wantTLS13 {
+				t.Errorf("ParseClientHello() TLS 1.3 offered = %v, want %v", tls13, tt.wantTLS13)
+			}
+		})
+	}
+}
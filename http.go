@@ -0,0 +1,627 @@
+package gosplit
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"github.com/andybalholm/brotli"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxHTTPBuffer is the number of bytes buffered for each side of a
+	// connection while waiting for a complete message, and the largest
+	// decoded body retained. Parsing of the connection stops once the
+	// buffer is exceeded.
+	maxHTTPBuffer = 16 << 20
+	// maxHTTPBufferTotal is the number of bytes buffered across all
+	// connections tracked by an HTTPParser. Parsing of a connection stops
+	// when its data would exceed the budget.
+	maxHTTPBufferTotal = 256 << 20
+	// maxHTTPStreams is the number of connections tracked by an
+	// HTTPParser. The oldest are discarded first.
+	maxHTTPStreams = 10000
+	// maxHTTPRequestLine is the number of bytes buffered while waiting
+	// for the request line that identifies a connection as HTTP.
+	maxHTTPRequestLine = 8192
+)
+
+type (
+	// HTTPExchange is an HTTP request sent by a victim and the response
+	// sent by the downstream.
+	HTTPExchange struct {
+		Request HTTPRequest `json:"request"`
+		// Response is nil when the connection ended, or could no longer
+		// be parsed, before the response was received.
+		Response *HTTPResponse `json:"response,omitempty"`
+		ConnInfo `json:"conn_info"`
+	}
+
+	// HTTPRequest is a reassembled HTTP/1.x or HTTP/2 request.
+	HTTPRequest struct {
+		Method string `json:"method"`
+		// URL is absolute. The https scheme is used when the connection
+		// was intercepted using TLS.
+		URL    string      `json:"url"`
+		Proto  string      `json:"proto"`
+		Header http.Header `json:"header"`
+		// Body after removing chunked transfer encoding or HTTP/2
+		// framing and decoding gzip, deflate, and br content encodings.
+		Body []byte `json:"body,omitempty"`
+		// BodySize is the number of body bytes sent, before decoding
+		// the content encoding.
+		BodySize int `json:"body_size"`
+		// Time the first byte of the request was captured.
+		Time time.Time `json:"time"`
+	}
+
+	// HTTPResponse is a reassembled HTTP/1.x or HTTP/2 response.
+	HTTPResponse struct {
+		Proto string `json:"proto"`
+		// Status is the status code and reason phrase, e.g., "200 OK".
+		Status     string      `json:"status"`
+		StatusCode int         `json:"status_code"`
+		Header     http.Header `json:"header"`
+		// Body is decoded as described by HTTPRequest.Body.
+		Body     []byte `json:"body,omitempty"`
+		BodySize int    `json:"body_size"`
+		// Time the first byte of the response was captured.
+		Time time.Time `json:"time"`
+		// Done is the time the last byte of the response was captured.
+		Done time.Time `json:"done"`
+	}
+
+	// HTTPParser is a TimedDataReceiver that reassembles the HTTP requests
+	// and responses exchanged over connections, passing each
+	// HTTPExchange to a function. Pipelined HTTP/1.x requests and
+	// multiplexed HTTP/2 streams are supported.
+	//
+	// Connections are identified as HTTP by the first data sent by the
+	// victim: an HTTP/1.x request line or the HTTP/2 connection preface.
+	// Messages sent over connections upgraded to a WebSocket are passed
+	// to RecvWebSocket. Parsing stops after a connection is upgraded to
+	// other protocols or a CONNECT request succeeds.
+	//
+	// RecvConnEnd must be called for each connection to complete
+	// responses delimited by the end of the connection and release its
+	// state.
+	HTTPParser struct {
+		// RecvWebSocket, when set, receives the messages sent over
+		// WebSockets. It must be set before data is received and may be
+		// called concurrently for different connections.
+		RecvWebSocket func(WebSocketMessage)
+
+		recv     func(HTTPExchange)
+		budget   int64        // bytes that may be held by all connections
+		buffered atomic.Int64 // bytes held by all connections
+		m        sync.Mutex   // guards streams
+		streams  *connTable[*httpConn]
+	}
+
+	// httpConn is the state of a connection observed by an HTTPParser.
+	//
+	// Bodies of exchanges are decoded once they are emitted, outside of
+	// any lock.
+	httpConn struct {
+		m          sync.Mutex
+		held       int // bytes counted against the parser's budget
+		cI         ConnInfo
+		at         time.Time // capture time of the data being parsed
+		started    bool      // the victim sent a request line
+		stopped    bool      // parsing stopped
+		victim     httpBuffer
+		downstream httpBuffer
+		pending    []*HTTPExchange    // requests awaiting responses
+		h2         *http2Conn         // set when the victim sent the http/2 preface
+		ws         *webSocketConn     // set when the connection was upgraded to a websocket
+		msgs       []WebSocketMessage // websocket messages awaiting delivery
+	}
+
+	// httpBuffer is the unparsed data sent by one side of a connection.
+	//
+	// Messages are parsed again only once the data they lacked may have
+	// been received, so that large bodies aren't parsed for every read.
+	httpBuffer struct {
+		b    []byte
+		time time.Time // time the first byte of b was captured
+		last time.Time // time the last byte of b was captured
+		// headerLen is the length of the header of the last message
+		// parsed, set before its body is read
+		headerLen int
+		need      int  // b must grow to need bytes before it is parsed
+		blankLine bool // b must receive a blank line before it is parsed
+	}
+)
+
+// NewHTTPParser initializes an HTTPParser that passes exchanges to recv,
+// which may be nil when only RecvWebSocket is of interest. recv may be
+// called concurrently for different connections.
+func NewHTTPParser(recv func(HTTPExchange)) *HTTPParser {
+	return &HTTPParser{recv: recv, budget: maxHTTPBufferTotal, streams: newConnTable[*httpConn](maxHTTPStreams)}
+}
+
+// RecvVictimData parses data as though it was captured upon receipt.
+func (p *HTTPParser) RecvVictimData(cI ConnInfo, b []byte) {
+	p.RecvVictimDataAt(cI, time.Now(), b)
+}
+
+// RecvDownstreamData parses data as though it was captured upon receipt.
+func (p *HTTPParser) RecvDownstreamData(cI ConnInfo, b []byte) {
+	p.RecvDownstreamDataAt(cI, time.Now(), b)
+}
+
+func (p *HTTPParser) RecvVictimDataAt(cI ConnInfo, captured time.Time, b []byte) {
+	p.add(cI, true, captured, b)
+}
+
+func (p *HTTPParser) RecvDownstreamDataAt(cI ConnInfo, captured time.Time, b []byte) {
+	p.add(cI, false, captured, b)
+}
+
+// add data sent by the victim or downstream to the state of its
+// connection, emitting the exchanges and messages it completes.
+func (p *HTTPParser) add(cI ConnInfo, victim bool, at time.Time, b []byte) {
+	s := p.stream(cI)
+	s.m.Lock()
+	var ex []HTTPExchange
+	if victim {
+		ex = s.addVictim(at, b)
+	} else {
+		ex = s.addDownstream(at, b)
+	}
+	ex = append(ex, p.account(s)...)
+	msgs := s.takeMessages()
+	s.m.Unlock()
+	p.emit(ex, msgs)
+}
+
+// account updates the bytes held by s against the parser's budget,
+// stopping s when the budget is exceeded.
+//
+// Note: s.m must be held by the caller.
+func (p *HTTPParser) account(s *httpConn) (ex []HTTPExchange) {
+	n := s.buffered()
+	total := p.buffered.Add(int64(n - s.held))
+	s.held = n
+	if n > 0 && total > p.budget {
+		ex = s.stop()
+		p.buffered.Add(int64(-n))
+		s.held = 0
+	}
+	return
+}
+
+// RecvConnStart implements ConnInfoReceiver.
+func (p *HTTPParser) RecvConnStart(ConnInfo) {}
+
+// RecvConnEnd completes the exchanges of the connection and releases
+// its state.
+func (p *HTTPParser) RecvConnEnd(cI ConnInfo) {
+	p.m.Lock()
+	s, ok := p.streams.remove(cI.ID)
+	p.m.Unlock()
+	if !ok {
+		return
+	}
+	s.m.Lock()
+	ex, msgs := s.end(), s.takeMessages()
+	p.account(s)
+	s.m.Unlock()
+	p.emit(ex, msgs)
+}
+
+// emit exchanges and websocket messages, the former first as messages
+// follow the exchange that upgraded their connection.
+func (p *HTTPParser) emit(ex []HTTPExchange, msgs []WebSocketMessage) {
+	for _, e := range ex {
+		if p.recv != nil {
+			p.recv(e.decode())
+		}
+	}
+	for _, m := range msgs {
+		if p.RecvWebSocket != nil {
+			p.RecvWebSocket(m)
+		}
+	}
+}
+
+// stream returns the state of the connection, creating it when needed.
+func (p *HTTPParser) stream(cI ConnInfo) *httpConn {
+	p.m.Lock()
+	if s, ok := p.streams.get(cI.ID); ok {
+		p.m.Unlock()
+		return s
+	}
+	s := &httpConn{cI: cI}
+	evicted, ok := p.streams.add(cI.ID, s)
+	p.m.Unlock()
+
+	if ok {
+		// release the bytes held by the discarded connection
+		evicted.m.Lock()
+		evicted.stop()
+		p.account(evicted)
+		evicted.m.Unlock()
+	}
+	return s
+}
+
+// addVictim parses requests sent by the victim.
+func (s *httpConn) addVictim(at time.Time, b []byte) (ex []HTTPExchange) {
+	s.at = at
+	if s.stopped {
+		return
+	} else if s.h2 != nil {
+		return s.addHTTP2(true, b)
+	} else if s.ws != nil {
+		return s.addWebSocket(true, b)
+	} else if len(s.victim.b)+len(b) > maxHTTPBuffer {
+		return s.stop()
+	}
+	s.victim.add(s.at, b)
+
+	if !s.started {
+		line := s.victim.b[:min(len(s.victim.b), maxHTTPRequestLine)]
+		if len(line) < len(http2Preface) && strings.HasPrefix(http2Preface, string(line)) {
+			// possibly an incomplete http/2 connection preface
+			return
+		} else if bytes.HasPrefix(line, []byte(http2Preface)) {
+			return s.startHTTP2()
+		} else if httpRequestLine.Match(line) {
+			s.started = true
+		} else if bytes.IndexByte(line, '\n') >= 0 || len(line) == maxHTTPRequestLine {
+			return s.stop()
+		} else {
+			return
+		}
+	}
+
+	for s.victim.ready() {
+		r := bytes.NewReader(s.victim.b)
+		br := bufio.NewReader(r)
+		req, err := http.ReadRequest(br)
+		var body []byte
+		if err == nil {
+			s.victim.headerLen = s.victim.read(r, br)
+			body, err = io.ReadAll(req.Body)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			s.victim.wait(req)
+			break
+		} else if err != nil {
+			return s.stop()
+		}
+		start := s.victim.consume(s.victim.read(r, br))
+		s.pending = append(s.pending, &HTTPExchange{
+			Request: HTTPRequest{
+				Method:   req.Method,
+				URL:      s.requestURL(req),
+				Proto:    req.Proto,
+				Header:   req.Header,
+				Body:     body,
+				BodySize: len(body),
+				Time:     start,
+			},
+			ConnInfo: s.cI,
+		})
+	}
+
+	// responses may have been received before the requests
+	// were complete
+	return s.parseResponses(false)
+}
+
+// addDownstream parses responses sent by the downstream.
+func (s *httpConn) addDownstream(at time.Time, b []byte) (ex []HTTPExchange) {
+	s.at = at
+	if s.stopped {
+		return
+	} else if s.h2 != nil {
+		return s.addHTTP2(false, b)
+	} else if s.ws != nil {
+		return s.addWebSocket(false, b)
+	} else if len(s.downstream.b)+len(b) > maxHTTPBuffer {
+		return s.stop()
+	}
+	s.downstream.add(s.at, b)
+	return s.parseResponses(false)
+}
+
+// parseResponses parses the responses to pending requests. final
+// indicates that the connection has ended, completing responses
+// delimited by the end of the connection.
+func (s *httpConn) parseResponses(final bool) (ex []HTTPExchange) {
+	for len(s.pending) > 0 && (s.downstream.ready() || final && len(s.downstream.b) > 0) {
+		x := s.pending[0]
+		r := bytes.NewReader(s.downstream.b)
+		br := bufio.NewReader(r)
+		resp, err := http.ReadResponse(br, &http.Request{Method: x.Request.Method})
+		var body []byte
+		if err == nil {
+			s.downstream.headerLen = s.downstream.read(r, br)
+			if !final && resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 && resp.Body != http.NoBody {
+				// the body is delimited by the end of the connection
+				s.downstream.need = math.MaxInt
+				return
+			}
+			body, err = io.ReadAll(resp.Body)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			if final {
+				break
+			}
+			s.downstream.wait(resp)
+			return
+		} else if err != nil {
+			return append(ex, s.stop()...)
+		}
+		start := s.downstream.consume(s.downstream.read(r, br))
+		if resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			// informational responses precede the final response
+			continue
+		}
+
+		x.Response = &HTTPResponse{
+			Proto:      resp.Proto,
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Body:       body,
+			BodySize:   len(body),
+			Time:       start,
+			Done:       s.downstream.time,
+		}
+		s.pending = s.pending[1:]
+		ex = append(ex, *x)
+
+		if isWebSocketUpgrade(x.Response) {
+			return append(ex, s.startWebSocket(x.Response.Header)...)
+		} else if resp.StatusCode == http.StatusSwitchingProtocols ||
+			(x.Request.Method == http.MethodConnect && resp.StatusCode/100 == 2) {
+			// the remaining data is not http/1.x
+			return append(ex, s.stop()...)
+		}
+	}
+	return
+}
+
+// startHTTP2 parses the connection as HTTP/2 after the victim sent the
+// connection preface.
+func (s *httpConn) startHTTP2() (ex []HTTPExchange) {
+	s.started, s.h2 = true, newHTTP2Conn(s.cI)
+	victim, downstream := s.victim.b[len(http2Preface):], s.downstream.b
+	s.victim, s.downstream = httpBuffer{}, httpBuffer{}
+	if ex = s.addHTTP2(false, downstream); s.stopped {
+		return
+	}
+	return append(ex, s.addHTTP2(true, victim)...)
+}
+
+// startWebSocket parses the remainder of the connection as a WebSocket
+// after the downstream accepted the upgrade.
+func (s *httpConn) startWebSocket(h http.Header) (ex []HTTPExchange) {
+	// requests pipelined after the upgrade request were never answered
+	victim, downstream := s.victim.b, s.downstream.b
+	ex = append(ex, s.stop()...)
+	s.stopped, s.ws = false, newWebSocketConn(s.cI, h)
+	if ex = append(ex, s.addWebSocket(false, downstream)...); s.stopped {
+		return
+	}
+	return append(ex, s.addWebSocket(true, victim)...)
+}
+
+// addWebSocket parses WebSocket frames sent by the victim or downstream.
+func (s *httpConn) addWebSocket(victim bool, b []byte) []HTTPExchange {
+	msgs, err := s.ws.add(victim, s.at, b)
+	s.msgs = append(s.msgs, msgs...)
+	if err != nil {
+		return s.stop()
+	}
+	return nil
+}
+
+// takeMessages returns the websocket messages awaiting delivery.
+func (s *httpConn) takeMessages() (msgs []WebSocketMessage) {
+	msgs, s.msgs = s.msgs, nil
+	return
+}
+
+// addHTTP2 parses HTTP/2 frames sent by the victim or downstream.
+func (s *httpConn) addHTTP2(victim bool, b []byte) []HTTPExchange {
+	ex, err := s.h2.add(victim, s.at, b)
+	if err != nil {
+		ex = append(ex, s.stop()...)
+	}
+	return ex
+}
+
+// end completes the exchanges of the connection.
+func (s *httpConn) end() (ex []HTTPExchange) {
+	if !s.stopped {
+		ex = s.parseResponses(true)
+	}
+	return append(ex, s.stop()...)
+}
+
+// stop parsing the connection, returning requests that will not
+// receive responses.
+func (s *httpConn) stop() (ex []HTTPExchange) {
+	for _, x := range s.pending {
+		ex = append(ex, *x)
+	}
+	if s.h2 != nil {
+		ex = append(ex, s.h2.end()...)
+	}
+	s.stopped, s.pending, s.h2, s.ws = true, nil, nil, nil
+	s.victim, s.downstream = httpBuffer{}, httpBuffer{}
+	return
+}
+
+// buffered returns the number of bytes held by the connection's state.
+func (s *httpConn) buffered() (n int) {
+	n = len(s.victim.b) + len(s.downstream.b)
+	for _, x := range s.pending {
+		n += len(x.Request.Body)
+	}
+	if s.h2 != nil {
+		n += s.h2.buffered()
+	}
+	if s.ws != nil {
+		n += s.ws.buffered()
+	}
+	return
+}
+
+// decode returns the exchange with the bodies of its messages decoded
+// according to their Content-Encoding headers.
+func (x HTTPExchange) decode() HTTPExchange {
+	x.Request.Body = decodeHTTPBody(x.Request.Header, x.Request.Body)
+	if x.Response != nil {
+		resp := *x.Response
+		resp.Body = decodeHTTPBody(resp.Header, resp.Body)
+		x.Response = &resp
+	}
+	return x
+}
+
+// requestURL returns the absolute URL of req.
+func (s *httpConn) requestURL(req *http.Request) string {
+	if req.URL.IsAbs() {
+		// sent to a proxy
+		return req.URL.String()
+	}
+	u := *req.URL
+	u.Scheme, u.Host = "http", req.Host
+	if s.cI.TLS {
+		u.Scheme = "https"
+	}
+	if u.Host == "" && s.cI.SNI != "" {
+		u.Host = s.cI.SNI
+	} else if u.Host == "" && s.cI.Downstream != nil {
+		u.Host = net.JoinHostPort(s.cI.Downstream.IP, s.cI.Downstream.Port)
+	}
+	if req.Method == http.MethodConnect {
+		// the request target is the authority
+		return u.Host
+	}
+	return u.String()
+}
+
+// add data captured at the given time to the buffer.
+func (h *httpBuffer) add(at time.Time, b []byte) {
+	if len(h.b) == 0 {
+		h.time = at
+	}
+	h.last = at
+	// the blank line may span the previous and new data
+	start := max(0, len(h.b)-3)
+	h.b = append(h.b, b...)
+	if h.blankLine && httpHeaderComplete(h.b[start:]) {
+		h.blankLine = false
+	}
+}
+
+// ready determines if the buffer may contain a complete message.
+func (h *httpBuffer) ready() bool {
+	return len(h.b) > 0 && len(h.b) >= h.need && !h.blankLine && httpHeaderComplete(h.b)
+}
+
+// read returns the number of bytes of the buffer read through r, which
+// br reads from.
+func (h *httpBuffer) read(r *bytes.Reader, br *bufio.Reader) int {
+	return len(h.b) - r.Len() - br.Buffered()
+}
+
+// wait records what an incomplete message lacks. msg is the
+// *http.Request or *http.Response parsed from its header, which may be
+// nil.
+func (h *httpBuffer) wait(msg any) {
+	var (
+		contentLen       int64
+		transferEncoding []string
+	)
+	switch m := msg.(type) {
+	case *http.Request:
+		if m != nil {
+			contentLen, transferEncoding = m.ContentLength, m.TransferEncoding
+		}
+	case *http.Response:
+		if m != nil {
+			contentLen, transferEncoding = m.ContentLength, m.TransferEncoding
+		}
+	}
+	switch {
+	case !httpHeaderComplete(h.b) || len(transferEncoding) > 0:
+		// chunked bodies end with a blank line, after the last chunk or
+		// its trailer
+		h.blankLine = true
+	case contentLen > 0:
+		h.need = h.headerLen + int(contentLen)
+	}
+}
+
+// consume n bytes of parsed data, returning the time the first byte was
+// captured.
+func (h *httpBuffer) consume(n int) time.Time {
+	start := h.time
+	// the remaining data arrived with the last data added
+	h.b, h.time, h.need, h.blankLine = h.b[n:], h.last, 0, false
+	return start
+}
+
+// httpHeaderComplete determines if b contains the blank line that ends
+// the header of a message, since partial header lines can't be
+// distinguished from malformed ones once read.
+func httpHeaderComplete(b []byte) bool {
+	return bytes.Contains(b, []byte("\n\r\n")) || bytes.Contains(b, []byte("\n\n"))
+}
+
+// decodeHTTPBody decodes body according to the Content-Encoding header,
+// returning body unmodified when it cannot be decoded.
+func decodeHTTPBody(h http.Header, body []byte) []byte {
+	if len(body) == 0 {
+		return body
+	}
+	decoded := body
+	codings := strings.Split(h.Get("Content-Encoding"), ",")
+	// codings are listed in the order they were applied
+	for i := len(codings) - 1; i >= 0; i-- {
+		var (
+			r   io.Reader
+			err error
+		)
+		switch strings.ToLower(strings.TrimSpace(codings[i])) {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(bytes.NewReader(decoded))
+		case "deflate":
+			// deflate is meant to be zlib wrapped, but raw streams
+			// are common
+			if r, err = zlib.NewReader(bytes.NewReader(decoded)); err != nil {
+				r, err = flate.NewReader(bytes.NewReader(decoded)), nil
+			}
+		case "br":
+			r = brotli.NewReader(bytes.NewReader(decoded))
+		default:
+			return body
+		}
+		if err == nil {
+			decoded, err = io.ReadAll(io.LimitReader(r, maxHTTPBuffer))
+		}
+		if err != nil {
+			return body
+		}
+	}
+	return decoded
+}
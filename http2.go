@@ -0,0 +1,319 @@
+package gosplit
+
+import (
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/http2/hpack"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// http2Preface is sent by clients before their first frame.
+	http2Preface        = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	http2FrameHeaderLen = 9
+	// http2HeaderTableSize is the initial size of hpack dynamic tables.
+	http2HeaderTableSize = 4096
+
+	http2FrameData         = 0x0
+	http2FrameHeaders      = 0x1
+	http2FrameRSTStream    = 0x3
+	http2FrameSettings     = 0x4
+	http2FramePushPromise  = 0x5
+	http2FrameContinuation = 0x9
+
+	http2FlagEndStream  = 0x1
+	http2FlagAck        = 0x1
+	http2FlagEndHeaders = 0x4
+	http2FlagPadded     = 0x8
+	http2FlagPriority   = 0x20
+
+	http2SettingHeaderTableSize = 0x1
+)
+
+var errHTTP2Frame = errors.New("malformed http/2 frame")
+
+type (
+	// http2Conn is the HTTP/2 state of a connection observed by an
+	// HTTPParser.
+	http2Conn struct {
+		cI         ConnInfo
+		at         time.Time // capture time of the data being added
+		victim     http2Side
+		downstream http2Side
+		streams    map[uint32]*http2Stream
+	}
+
+	// http2Side is the state of the frames sent by one side of an
+	// HTTP/2 connection.
+	http2Side struct {
+		b   []byte // unparsed frames
+		dec *hpack.Decoder
+		// header block continued by CONTINUATION frames
+		block       []byte
+		blockStream uint32 // stream the header block applies to
+		blockEnd    bool   // the HEADERS frame ended its stream
+		blockPush   bool   // the block is a PUSH_PROMISE
+	}
+
+	// http2Stream is an exchange in progress.
+	http2Stream struct {
+		x        HTTPExchange
+		reqBody  []byte
+		respBody []byte
+	}
+)
+
+func newHTTP2Conn(cI ConnInfo) *http2Conn {
+	return &http2Conn{
+		cI:         cI,
+		victim:     http2Side{dec: hpack.NewDecoder(http2HeaderTableSize, nil)},
+		downstream: http2Side{dec: hpack.NewDecoder(http2HeaderTableSize, nil)},
+		streams:    make(map[uint32]*http2Stream),
+	}
+}
+
+// add data sent by the victim, after the connection preface, or the
+// downstream, returning the exchanges it completes.
+func (c *http2Conn) add(victim bool, at time.Time, b []byte) (ex []HTTPExchange, err error) {
+	c.at = at
+	side := &c.downstream
+	if victim {
+		side = &c.victim
+	}
+	side.b = append(side.b, b...)
+	for len(side.b) >= http2FrameHeaderLen {
+		l := int(side.b[0])<<16 | int(side.b[1])<<8 | int(side.b[2])
+		if len(side.b) < http2FrameHeaderLen+l {
+			break
+		}
+		typ, flags := side.b[3], side.b[4]
+		stream := binary.BigEndian.Uint32(side.b[5:9]) & 0x7fffffff
+		payload := side.b[http2FrameHeaderLen : http2FrameHeaderLen+l]
+		side.b = side.b[http2FrameHeaderLen+l:]
+		if ex, err = c.frame(ex, victim, typ, flags, stream, payload); err != nil {
+			return
+		}
+	}
+	if len(side.b) > maxHTTPBuffer {
+		err = errors.New("http/2 frame exceeds buffer")
+	}
+	return
+}
+
+// frame handles a frame sent by the victim or downstream.
+func (c *http2Conn) frame(ex []HTTPExchange, victim bool, typ, flags byte, stream uint32, p []byte) ([]HTTPExchange, error) {
+	side := &c.downstream
+	if victim {
+		side = &c.victim
+	}
+	if side.block != nil && typ != http2FrameContinuation {
+		return ex, errHTTP2Frame
+	}
+
+	var err error
+	switch typ {
+	case http2FrameData:
+		if p, err = http2Unpad(flags, p); err != nil {
+			return ex, err
+		}
+		if s := c.streams[stream]; s != nil && victim {
+			s.reqBody = append(s.reqBody, p...)
+		} else if s != nil {
+			s.respBody = append(s.respBody, p...)
+		}
+		if flags&http2FlagEndStream != 0 {
+			ex = c.endStream(ex, victim, stream)
+		}
+	case http2FrameHeaders:
+		if p, err = http2Unpad(flags, p); err != nil {
+			return ex, err
+		} else if flags&http2FlagPriority != 0 {
+			if len(p) < 5 {
+				return ex, errHTTP2Frame
+			}
+			p = p[5:]
+		}
+		side.block = append([]byte{}, p...)
+		side.blockStream, side.blockEnd, side.blockPush = stream, flags&http2FlagEndStream != 0, false
+	case http2FramePushPromise:
+		if p, err = http2Unpad(flags, p); err != nil {
+			return ex, err
+		} else if len(p) < 4 {
+			return ex, errHTTP2Frame
+		}
+		// the promised stream carries the response to the pushed request
+		side.block = append([]byte{}, p[4:]...)
+		side.blockStream = binary.BigEndian.Uint32(p) & 0x7fffffff
+		side.blockEnd, side.blockPush = false, true
+	case http2FrameContinuation:
+		if side.block == nil {
+			return ex, errHTTP2Frame
+		}
+		side.block = append(side.block, p...)
+	case http2FrameRSTStream:
+		if s := c.streams[stream]; s != nil {
+			delete(c.streams, stream)
+			ex = append(ex, s.exchange(c.at))
+		}
+		return ex, nil
+	case http2FrameSettings:
+		if flags&http2FlagAck != 0 {
+			return ex, nil
+		}
+		// the table size limits the encoder of the other side
+		peer := &c.victim
+		if victim {
+			peer = &c.downstream
+		}
+		for ; len(p) >= 6; p = p[6:] {
+			if binary.BigEndian.Uint16(p) == http2SettingHeaderTableSize {
+				peer.dec.SetAllowedMaxDynamicTableSize(binary.BigEndian.Uint32(p[2:]))
+			}
+		}
+		return ex, nil
+	default:
+		return ex, nil
+	}
+
+	if (typ == http2FrameHeaders || typ == http2FramePushPromise || typ == http2FrameContinuation) &&
+		flags&http2FlagEndHeaders != 0 {
+		// header blocks must be decoded to keep the hpack state of the
+		// connection, even when they are trailers
+		fields, err := side.dec.DecodeFull(side.block)
+		side.block = nil
+		if err != nil {
+			return ex, err
+		}
+		ex = c.headers(ex, victim, side.blockStream, side.blockEnd, side.blockPush, fields)
+	}
+	return ex, nil
+}
+
+// headers handles a decoded header block.
+func (c *http2Conn) headers(ex []HTTPExchange, victim bool, stream uint32, end, push bool, fields []hpack.HeaderField) []HTTPExchange {
+	s := c.streams[stream]
+	switch {
+	case (victim || push) && s == nil:
+		s = &http2Stream{}
+		s.x.ConnInfo = c.cI
+		s.x.Request = HTTPRequest{Proto: "HTTP/2.0", Header: make(http.Header), Time: c.at}
+		var scheme, authority, path string
+		for _, f := range fields {
+			switch f.Name {
+			case ":method":
+				s.x.Request.Method = f.Value
+			case ":scheme":
+				scheme = f.Value
+			case ":authority":
+				authority = f.Value
+			case ":path":
+				path = f.Value
+			default:
+				s.x.Request.Header.Add(f.Name, f.Value)
+			}
+		}
+		s.x.Request.URL = c.requestURL(s.x.Request.Method, scheme, authority, path)
+		c.streams[stream] = s
+	case !victim && s != nil && s.x.Response == nil:
+		resp := &HTTPResponse{Proto: "HTTP/2.0", Header: make(http.Header), Time: c.at}
+		for _, f := range fields {
+			if f.Name == ":status" {
+				resp.StatusCode, _ = strconv.Atoi(f.Value)
+				resp.Status = strings.TrimSpace(f.Value + " " + http.StatusText(resp.StatusCode))
+			} else if !strings.HasPrefix(f.Name, ":") {
+				resp.Header.Add(f.Name, f.Value)
+			}
+		}
+		if resp.StatusCode >= 100 && resp.StatusCode < 200 {
+			// informational responses precede the final response
+			break
+		}
+		s.x.Response = resp
+	}
+	// headers of existing streams are trailers, which are ignored
+	if end {
+		ex = c.endStream(ex, victim, stream)
+	}
+	return ex
+}
+
+// endStream handles the end of a stream by the victim or downstream,
+// returning the exchange once the downstream has ended it.
+func (c *http2Conn) endStream(ex []HTTPExchange, victim bool, stream uint32) []HTTPExchange {
+	if s := c.streams[stream]; s != nil && !victim && s.x.Response != nil {
+		s.x.Response.Done = c.at
+		delete(c.streams, stream)
+		ex = append(ex, s.exchange(c.at))
+	}
+	return ex
+}
+
+// buffered returns the number of bytes held by the connection's state.
+func (c *http2Conn) buffered() (n int) {
+	n = len(c.victim.b) + len(c.victim.block) + len(c.downstream.b) + len(c.downstream.block)
+	for _, s := range c.streams {
+		n += len(s.reqBody) + len(s.respBody)
+	}
+	return
+}
+
+// end returns the exchanges of streams that did not end, ordered by
+// stream identifier.
+func (c *http2Conn) end() (ex []HTTPExchange) {
+	for _, id := range slices.Sorted(maps.Keys(c.streams)) {
+		ex = append(ex, c.streams[id].exchange(c.at))
+	}
+	clear(c.streams)
+	return
+}
+
+// requestURL returns the absolute URL described by the pseudo-header
+// fields of a request.
+func (c *http2Conn) requestURL(method, scheme, authority, path string) string {
+	if authority == "" {
+		authority = c.cI.SNI
+	}
+	if method == http.MethodConnect {
+		return authority
+	} else if scheme == "" {
+		scheme = "http"
+		if c.cI.TLS {
+			scheme = "https"
+		}
+	}
+	return scheme + "://" + authority + path
+}
+
+// exchange returns the exchange with its bodies, which are decoded once
+// emitted. Responses that didn't end are completed at last, the capture
+// time of the last data added to the connection.
+func (s *http2Stream) exchange(last time.Time) HTTPExchange {
+	x := s.x
+	x.Request.Body = s.reqBody
+	x.Request.BodySize = len(s.reqBody)
+	if x.Response != nil {
+		resp := *x.Response
+		resp.Body = s.respBody
+		resp.BodySize = len(s.respBody)
+		if resp.Done.IsZero() {
+			resp.Done = last
+		}
+		x.Response = &resp
+	}
+	return x
+}
+
+// http2Unpad removes the padding of a frame with the PADDED flag.
+func http2Unpad(flags byte, p []byte) ([]byte, error) {
+	if flags&http2FlagPadded == 0 {
+		return p, nil
+	} else if len(p) < 1 || int(p[0]) >= len(p) {
+		return nil, errHTTP2Frame
+	}
+	return p[1 : len(p)-int(p[0])], nil
+}
@@ -0,0 +1,297 @@
+package gosplit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"github.com/andybalholm/brotli"
+	"golang.org/x/net/http2/hpack"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func compressTest(t *testing.T, coding, s string) string {
+	var (
+		buf bytes.Buffer
+		w   io.WriteCloser
+	)
+	switch coding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	}
+	if _, err := io.WriteString(w, s); err != nil {
+		t.Fatal(err)
+	} else if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestHTTPParser(t *testing.T) {
+	gz := compressTest(t, "gzip", "hello gzip")
+	br := compressTest(t, "br", "hello br")
+	deflated := compressTest(t, "deflate", "a=1&b=2")
+
+	type (
+		chunk struct {
+			victim bool
+			data   string
+		}
+		// exchange is the subset of HTTPExchange fields compared
+		exchange struct {
+			method, url, reqBody string
+			reqBodySize          int
+			status               int
+			respBody             string
+		}
+	)
+	tests := []struct {
+		name   string
+		tls    bool
+		chunks []chunk
+		want   []exchange
+	}{
+		{name: "get", chunks: []chunk{
+			{true, "GET /a?b=c HTTP/1.1\r\nHost: a.test\r\n\r\n"},
+			{false, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nhi"},
+		}, want: []exchange{
+			{method: "GET", url: "http://a.test/a?b=c", status: 200, respBody: "hi"},
+		}},
+		{name: "pipelined and split", tls: true, chunks: []chunk{
+			{true, "GET /1 HTTP/1.1\r\nHost: a.test\r\n\r\nGET /2 HTTP/1.1\r\nHo"},
+			{false, "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n1HTTP/1.1 404 Not Found\r\nContent-"},
+			{true, "st: a.test\r\n\r\n"},
+			{false, "Length: 1\r\n\r\n2"},
+		}, want: []exchange{
+			{method: "GET", url: "https://a.test/1", status: 200, respBody: "1"},
+			{method: "GET", url: "https://a.test/2", status: 404, respBody: "2"},
+		}},
+		{name: "chunked and compressed", chunks: []chunk{
+			{true, "POST /p HTTP/1.1\r\nHost: a.test\r\nContent-Encoding: deflate\r\nContent-Length: " +
+				strconv.Itoa(len(deflated)) + "\r\n\r\n" + deflated},
+			{false, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nContent-Encoding: gzip\r\n\r\n" +
+				"5\r\n" + gz[:5] + "\r\n"},
+			{false, strconv.FormatInt(int64(len(gz)-5), 16) + "\r\n" + gz[5:] + "\r\n0\r\n\r\n"},
+			{true, "GET /br HTTP/1.1\r\nHost: a.test\r\n\r\n"},
+			{false, "HTTP/1.1 200 OK\r\nContent-Encoding: br\r\nContent-Length: " + strconv.Itoa(len(br)) + "\r\n\r\n" + br},
+		}, want: []exchange{
+			{method: "POST", url: "http://a.test/p", reqBody: "a=1&b=2", reqBodySize: len(deflated),
+				status: 200, respBody: "hello gzip"},
+			{method: "GET", url: "http://a.test/br", status: 200, respBody: "hello br"},
+		}},
+		{name: "informational, head, and close delimited", chunks: []chunk{
+			{true, "PUT /u HTTP/1.1\r\nHost: a.test\r\nExpect: 100-continue\r\nContent-Length: 1\r\n\r\n"},
+			{false, "HTTP/1.1 100 Continue\r\n\r\n"},
+			{true, "x"},
+			{false, "HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n"},
+			{true, "HEAD / HTTP/1.1\r\nHost: a.test\r\n\r\nGET /c HTTP/1.0\r\nHost: a.test\r\n\r\n"},
+			{false, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nHTTP/1.0 200 OK\r\n\r\nuntil"},
+			{false, " the end"},
+		}, want: []exchange{
+			{method: "PUT", url: "http://a.test/u", reqBody: "x", reqBodySize: 1, status: 201},
+			{method: "HEAD", url: "http://a.test/", status: 200},
+			{method: "GET", url: "http://a.test/c", status: 200, respBody: "until the end"},
+		}},
+		{name: "upgrade stops parsing", chunks: []chunk{
+			{true, "GET /ws HTTP/1.1\r\nHost: a.test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"},
+			{false, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n\x81\x02hi"},
+			{true, "GET / HTTP/1.1\r\nHost: a.test\r\n\r\n"},
+		}, want: []exchange{
+			{method: "GET", url: "http://a.test/ws", status: 101},
+		}},
+		{name: "unanswered request", chunks: []chunk{
+			{true, "GET / HTTP/1.1\r\nHost: a.test\r\n\r\n"},
+		}, want: []exchange{
+			{method: "GET", url: "http://a.test/"},
+		}},
+		{name: "not http", chunks: []chunk{
+			{true, "EHLO mail\r\n"},
+			{false, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []exchange
+			p := NewHTTPParser(func(x HTTPExchange) {
+				e := exchange{method: x.Request.Method, url: x.Request.URL, reqBody: string(x.Request.Body),
+					reqBodySize: x.Request.BodySize}
+				if x.Response != nil {
+					e.status, e.respBody = x.Response.StatusCode, string(x.Response.Body)
+				}
+				got = append(got, e)
+			})
+			cI := ConnInfo{ID: 1, TLS: tt.tls}
+			for _, c := range tt.chunks {
+				if c.victim {
+					p.RecvVictimData(cI, []byte(c.data))
+				} else {
+					p.RecvDownstreamData(cI, []byte(c.data))
+				}
+			}
+			p.RecvConnEnd(cI)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsed %+v, want %+v", got, tt.want)
+			}
+			if p.streams.len() != 0 {
+				t.Error("RecvConnEnd() did not release the connection")
+			}
+		})
+	}
+}
+
+func TestHTTPParser_CaptureTimes(t *testing.T) {
+	var got []HTTPExchange
+	p := NewHTTPParser(func(x HTTPExchange) { got = append(got, x) })
+	t0 := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	at := func(i int) time.Time { return t0.Add(time.Duration(i) * time.Second) }
+	cI := ConnInfo{ID: 1}
+	p.RecvVictimDataAt(cI, at(0), []byte("GET /a HTTP/1.1\r\nHost: x\r\n\r\nGET /b HTTP/1.1\r\nHo"))
+	p.RecvVictimDataAt(cI, at(1), []byte("st: x\r\n\r\n"))
+	p.RecvDownstreamDataAt(cI, at(2), []byte("HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nab"))
+	p.RecvDownstreamDataAt(cI, at(3), []byte("cdHTTP/1.1 204 No Content\r\n\r\n"))
+	p.RecvConnEnd(cI)
+
+	if len(got) != 2 || got[0].Response == nil || got[1].Response == nil {
+		t.Fatalf("parsed %+v, want two exchanges", got)
+	}
+	// each message starts when its first byte was captured, even when
+	// it arrived with the previous message
+	want := [][3]time.Time{{at(0), at(2), at(3)}, {at(0), at(3), at(3)}}
+	for i, x := range got {
+		if times := [3]time.Time{x.Request.Time, x.Response.Time, x.Response.Done}; times != want[i] {
+			t.Errorf("exchange %d has request, response, and done times %v, want %v", i, times, want[i])
+		}
+	}
+}
+
+func TestHTTPParser_Budget(t *testing.T) {
+	var got []HTTPExchange
+	p := NewHTTPParser(func(x HTTPExchange) { got = append(got, x) })
+	p.budget = 100
+	head := "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\n"
+	one, two := ConnInfo{ID: 1}, ConnInfo{ID: 2}
+
+	// both incomplete requests fit within the budget
+	p.RecvVictimData(one, []byte(head))
+	p.RecvVictimData(two, []byte("GET / HTTP/1.1\r\n"))
+	if n := p.buffered.Load(); n != int64(len(head)+16) {
+		t.Fatalf("buffered = %d, want %d", n, len(head)+16)
+	}
+	// the second connection exceeds it and stops being parsed
+	p.RecvVictimData(two, []byte("Host: x\r\nX-Pad: "+strings.Repeat("a", 50)))
+	if n := p.buffered.Load(); n != int64(len(head)) {
+		t.Fatalf("buffered = %d after exceeding the budget, want %d", n, len(head))
+	}
+	p.RecvVictimData(two, []byte("\r\n\r\n"))
+	p.RecvVictimData(one, []byte("0123456789"))
+	p.RecvConnEnd(one)
+	p.RecvConnEnd(two)
+	if len(got) != 1 || string(got[0].Request.Body) != "0123456789" {
+		t.Errorf("parsed %+v, want the request of the first connection", got)
+	}
+	if n := p.buffered.Load(); n != 0 {
+		t.Errorf("buffered = %d after connections ended, want 0", n)
+	}
+}
+
+// http2TestFrame encodes a frame.
+func http2TestFrame(typ, flags byte, stream uint32, payload []byte) string {
+	b := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typ, flags}
+	b = binary.BigEndian.AppendUint32(b, stream)
+	return string(append(b, payload...))
+}
+
+// http2TestHeaders encodes header fields, alternating names and values.
+func http2TestHeaders(enc *hpack.Encoder, buf *bytes.Buffer, fields ...string) []byte {
+	buf.Reset()
+	for i := 0; i < len(fields); i += 2 {
+		enc.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+func TestHTTPParser_HTTP2(t *testing.T) {
+	var victimBuf, downstreamBuf bytes.Buffer
+	victimEnc, downstreamEnc := hpack.NewEncoder(&victimBuf), hpack.NewEncoder(&downstreamBuf)
+	gz := compressTest(t, "gzip", "hello h2")
+
+	get1 := http2TestHeaders(victimEnc, &victimBuf, ":method", "GET", ":scheme", "https",
+		":authority", "a.test", ":path", "/1", "cookie", "a=b")
+	// indexed fields from the dynamic table
+	get3 := http2TestHeaders(victimEnc, &victimBuf, ":method", "POST", ":scheme", "https",
+		":authority", "a.test", ":path", "/3", "cookie", "a=b")
+	get5 := http2TestHeaders(victimEnc, &victimBuf, ":method", "GET", ":scheme", "https",
+		":authority", "a.test", ":path", "/5")
+	continue3 := http2TestHeaders(downstreamEnc, &downstreamBuf, ":status", "100")
+	resp3 := http2TestHeaders(downstreamEnc, &downstreamBuf, ":status", "201", "content-type", "text/plain")
+	resp1 := http2TestHeaders(downstreamEnc, &downstreamBuf, ":status", "200", "content-encoding", "gzip")
+	trailers := http2TestHeaders(downstreamEnc, &downstreamBuf, "grpc-status", "0")
+
+	chunks := []struct {
+		victim bool
+		data   string
+	}{
+		{true, http2Preface[:10]},
+		{true, http2Preface[10:] + http2TestFrame(http2FrameSettings, 0, 0, nil)},
+		{false, http2TestFrame(http2FrameSettings, 0, 0, nil) + http2TestFrame(http2FrameSettings, http2FlagAck, 0, nil)},
+		{true, http2TestFrame(http2FrameHeaders, http2FlagEndStream|http2FlagEndHeaders, 1, get1)},
+		// header block split across a CONTINUATION frame, and a padded body
+		{true, http2TestFrame(http2FrameHeaders, 0, 3, get3[:4]) +
+			http2TestFrame(http2FrameContinuation, http2FlagEndHeaders, 3, get3[4:]) +
+			http2TestFrame(http2FrameData, http2FlagEndStream|http2FlagPadded, 3, []byte("\x02up\x00\x00"))},
+		{true, http2TestFrame(http2FrameHeaders, http2FlagEndStream|http2FlagEndHeaders, 5, get5)},
+		{false, http2TestFrame(http2FrameHeaders, http2FlagEndHeaders, 3, continue3) +
+			http2TestFrame(http2FrameHeaders, http2FlagEndHeaders, 3, resp3)},
+		{false, http2TestFrame(http2FrameHeaders, http2FlagEndHeaders, 1, resp1) +
+			http2TestFrame(http2FrameData, 0, 1, []byte(gz[:4]))[:12]},
+		{false, http2TestFrame(http2FrameData, 0, 1, []byte(gz[:4]))[12:] +
+			http2TestFrame(http2FrameData, 0, 1, []byte(gz[4:])) +
+			http2TestFrame(http2FrameHeaders, http2FlagEndStream|http2FlagEndHeaders, 1, trailers)},
+		{false, http2TestFrame(http2FrameData, http2FlagEndStream, 3, []byte("created"))},
+		{true, http2TestFrame(http2FrameRSTStream, 0, 5, []byte{0, 0, 0, 8})},
+	}
+
+	type exchange struct {
+		method, url, proto, reqBody, cookie string
+		status                              int
+		respBody                            string
+	}
+	var got []exchange
+	p := NewHTTPParser(func(x HTTPExchange) {
+		e := exchange{method: x.Request.Method, url: x.Request.URL, proto: x.Request.Proto,
+			reqBody: string(x.Request.Body), cookie: x.Request.Header.Get("Cookie")}
+		if x.Response != nil {
+			e.status, e.respBody = x.Response.StatusCode, string(x.Response.Body)
+		}
+		got = append(got, e)
+	})
+	cI := ConnInfo{ID: 1, TLS: true}
+	for _, c := range chunks {
+		if c.victim {
+			p.RecvVictimData(cI, []byte(c.data))
+		} else {
+			p.RecvDownstreamData(cI, []byte(c.data))
+		}
+	}
+	p.RecvConnEnd(cI)
+
+	want := []exchange{
+		{method: "GET", url: "https://a.test/1", proto: "HTTP/2.0", cookie: "a=b", status: 200, respBody: "hello h2"},
+		{method: "POST", url: "https://a.test/3", proto: "HTTP/2.0", cookie: "a=b", reqBody: "up", status: 201,
+			respBody: "created"},
+		// reset before a response was received
+		{method: "GET", url: "https://a.test/5", proto: "HTTP/2.0"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsed %+v, want %+v", got, want)
+	}
+}
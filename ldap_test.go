@@ -0,0 +1,180 @@
+package gosplit
+
+import (
+	"crypto/tls"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// ldapTestMsg encodes an LDAPMessage.
+func ldapTestMsg(id byte, op []byte) []byte {
+	return berTestTLV(berSequence, berTestTLV(berInteger, []byte{id}), op)
+}
+
+// ldapTestResult encodes an LDAPResult with the tag of a response.
+func ldapTestResult(tag, code byte, diag string, extra ...[]byte) []byte {
+	return berTestTLV(tag, append([][]byte{berTestTLV(berEnumerated, []byte{code}),
+		berTestTLV(berOctetString, nil), berTestTLV(berOctetString, []byte(diag))}, extra...)...)
+}
+
+func ldapTestStr(tag byte, s string) []byte {
+	return berTestTLV(tag, []byte(s))
+}
+
+func TestLDAPDecoder(t *testing.T) {
+	startTLS := ldapTestMsg(1, berTestTLV(ldapExtendedRequest, ldapTestStr(ldapExtendedRequestName, ldapStartTLSOID)))
+	bind := ldapTestMsg(2, berTestTLV(ldapBindRequest, berTestTLV(berInteger, []byte{3}),
+		ldapTestStr(berOctetString, "cn=admin,dc=a,dc=test"), ldapTestStr(ldapSimpleAuth, "s3cret")))
+	search := ldapTestMsg(3, berTestTLV(ldapSearchRequest,
+		ldapTestStr(berOctetString, "dc=a,dc=test"),
+		berTestTLV(berEnumerated, []byte{2}), berTestTLV(berEnumerated, []byte{0}),
+		berTestTLV(berInteger, []byte{0}), berTestTLV(berInteger, []byte{0}), berTestTLV(0x01, []byte{0}),
+		berTestTLV(ldapFilterAnd,
+			berTestTLV(ldapFilterEquality, ldapTestStr(berOctetString, "objectClass"),
+				ldapTestStr(berOctetString, "user")),
+			berTestTLV(ldapFilterSubstrings, ldapTestStr(berOctetString, "cn"), berTestTLV(berSequence,
+				ldapTestStr(ldapSubstringInitial, "ad"), ldapTestStr(ldapSubstringAny, "m(n)"))),
+			berTestTLV(ldapFilterNot, ldapTestStr(ldapFilterPresent, "mail"))),
+		berTestTLV(berSequence, ldapTestStr(berOctetString, "cn"), ldapTestStr(berOctetString, "objectSid"))))
+	entry := ldapTestMsg(3, berTestTLV(ldapSearchResultEntry, ldapTestStr(berOctetString, "cn=admin,dc=a,dc=test"),
+		berTestTLV(berSequence,
+			berTestTLV(berSequence, ldapTestStr(berOctetString, "cn"),
+				berTestTLV(0x31, ldapTestStr(berOctetString, "admin"))),
+			berTestTLV(berSequence, ldapTestStr(berOctetString, "objectSid"),
+				berTestTLV(0x31, berTestTLV(berOctetString, []byte{1, 0xff}))))))
+	modify := ldapTestMsg(4, berTestTLV(ldapModifyRequest, ldapTestStr(berOctetString, "cn=admin,dc=a,dc=test"),
+		berTestTLV(berSequence, berTestTLV(berSequence, berTestTLV(berEnumerated, []byte{2}),
+			berTestTLV(berSequence, ldapTestStr(berOctetString, "description"),
+				berTestTLV(0x31, ldapTestStr(berOctetString, "x")))))))
+
+	type chunk struct {
+		victim bool
+		data   string
+	}
+	tests := []struct {
+		name   string
+		chunks []chunk
+		want   []LDAPMessage
+	}{
+		{name: "starttls and bind", chunks: []chunk{
+			{true, string(startTLS)},
+			{false, string(ldapTestMsg(1, ldapTestResult(ldapExtendedResponse, 0, "",
+				ldapTestStr(ldapExtendedResponseName, ldapStartTLSOID))))},
+			// split messages
+			{true, string(bind[:7])},
+			{true, string(bind[7:])},
+			{false, string(ldapTestMsg(2, ldapTestResult(ldapBindResponse, 49, "bad password")))},
+			{true, string(ldapTestMsg(3, berTestTLV(0x42)))},
+		}, want: []LDAPMessage{
+			{Victim: true, MessageID: 1, Operation: "ExtendedRequest", Fields: map[string]string{"name": ldapStartTLSOID}},
+			{MessageID: 1, Operation: "ExtendedResponse",
+				Fields: map[string]string{"result": "success", "name": ldapStartTLSOID}},
+			{Victim: true, MessageID: 2, Operation: "BindRequest", DN: "cn=admin,dc=a,dc=test",
+				Fields: map[string]string{"version": "3", "password": "s3cret"}},
+			{MessageID: 2, Operation: "BindResponse",
+				Fields: map[string]string{"result": "invalidCredentials", "diagnostic": "bad password"}},
+			{Victim: true, MessageID: 3, Operation: "UnbindRequest"},
+		}},
+		{name: "search and modify", chunks: []chunk{
+			{true, string(search)},
+			{false, string(entry) + string(ldapTestMsg(3, ldapTestResult(ldapSearchResultDone, 0, "")))},
+			{true, string(modify)},
+		}, want: []LDAPMessage{
+			{Victim: true, MessageID: 3, Operation: "SearchRequest", DN: "dc=a,dc=test", Fields: map[string]string{
+				"scope": "wholeSubtree", "filter": `(&(objectClass=user)(cn=ad*m\28n\29*)(!(mail=*)))`,
+				"attributes": "cn,objectSid"}},
+			{MessageID: 3, Operation: "SearchResultEntry", DN: "cn=admin,dc=a,dc=test",
+				Attributes: map[string][]string{"cn": {"admin"}, "objectSid": {"Af8="}}},
+			{MessageID: 3, Operation: "SearchResultDone", Fields: map[string]string{"result": "success"}},
+			{Victim: true, MessageID: 4, Operation: "ModifyRequest", DN: "cn=admin,dc=a,dc=test",
+				Attributes: map[string][]string{"replace description": {"x"}}},
+		}},
+		{name: "not ldap", chunks: []chunk{
+			{true, "GET / HTTP/1.1\r\n\r\n"},
+			{true, string(bind)},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []LDAPMessage
+			d := NewLDAPDecoder(func(m LDAPMessage) {
+				m.Time, m.ConnInfo = time.Time{}, ConnInfo{}
+				got = append(got, m)
+			})
+			cI := ConnInfo{ID: 1}
+			for _, c := range tt.chunks {
+				if c.victim {
+					d.RecvVictimData(cI, []byte(c.data))
+				} else {
+					d.RecvDownstreamData(cI, []byte(c.data))
+				}
+			}
+			d.RecvConnEnd(cI)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded %+v, want %+v", got, tt.want)
+			}
+			if d.streams.len() != 0 {
+				t.Error("RecvConnEnd() did not release the connection")
+			}
+		})
+	}
+}
+
+func TestLDAPStartTLS(t *testing.T) {
+	crt := upgradeTestCert(t)
+	startTLS := ldapTestMsg(1, berTestTLV(ldapExtendedRequest, ldapTestStr(ldapExtendedRequestName, ldapStartTLSOID)))
+	bind := ldapTestMsg(2, berTestTLV(ldapBindRequest, berTestTLV(berInteger, []byte{3}),
+		ldapTestStr(berOctetString, "cn=admin"), ldapTestStr(ldapSimpleAuth, "s3cret")))
+	bindResp := ldapTestMsg(2, ldapTestResult(ldapBindResponse, 0, ""))
+
+	tests := []struct {
+		name   string
+		result byte // of the starttls response
+	}{
+		{name: "accepted"},
+		{name: "refused", result: 52},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := ldapTestMsg(1, ldapTestResult(ldapExtendedResponse, tt.result, ""))
+			dsCfg := &tls.Config{Certificates: []tls.Certificate{*crt}}
+			c, rec := startUpgradeProxy(t, crt, LDAPStartTLS{}, func(c net.Conn) {
+				if msg, err := readLDAPMessage(c); err != nil || string(msg) != string(startTLS) {
+					t.Errorf("downstream received %q, %v, want starttls request", msg, err)
+					return
+				}
+				c.Write(resp)
+				if tt.result == 0 {
+					c = tls.Server(c, dsCfg)
+				}
+				if msg, err := readLDAPMessage(c); err != nil || string(msg) != string(bind) {
+					t.Errorf("downstream received %q, %v, want bind request", msg, err)
+					return
+				}
+				c.Write(bindResp)
+			})
+
+			if got := roundTrip(t, c, string(startTLS), len(resp)); got != string(resp) {
+				t.Fatalf("starttls response = %q, want %q", got, resp)
+			}
+			if tt.result == 0 {
+				c = upgradeTestHandshake(t, c)
+			}
+			if got := roundTrip(t, c, string(bind), len(bindResp)); got != string(bindResp) {
+				t.Errorf("bind response = %q, want %q", got, bindResp)
+			}
+			c.Close()
+
+			// cleartext is captured before and after the upgrade
+			victim, downstream := capturedData(rec, 1)
+			if want := string(startTLS) + string(bind); victim != want {
+				t.Errorf("victim data = %q, want %q", victim, want)
+			}
+			if want := string(resp) + string(bindResp); downstream != want {
+				t.Errorf("downstream data = %q, want %q", downstream, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package gosplit
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	LegacyPassthrough LegacyHelloPolicy = iota // relay the connection to the downstream without interception (default)
+	LegacyReject                               // close the connection
+	LegacyAlert                                // send an alert indicating that the version is unsupported, then close the connection
+)
+
+const (
+	sslv2HeaderLen       = 2 // length of an SSLv2 record header without padding
+	sslv2ClientHelloType = 0x01
+	// sslv2HelloLen is the length of the fixed fields of an SSLv2
+	// CLIENT-HELLO: message type, version, and the lengths of the cipher
+	// specs, session id, and challenge.
+	sslv2HelloLen = 9
+	// versionSSL20 is the version offered by SSLv2 only clients.
+	versionSSL20 = 0x0002
+)
+
+var errShortSSLv2Hello = errors.New("truncated sslv2 client hello")
+
+// sslv2CipherNames are the names of SSLv2 cipher kinds, which are
+// offered alongside TLS cipher suites in SSLv2 hellos.
+var sslv2CipherNames = map[uint32]string{
+	0x010080: "SSL_CK_RC4_128_WITH_MD5",
+	0x020080: "SSL_CK_RC4_128_EXPORT40_WITH_MD5",
+	0x030080: "SSL_CK_RC2_128_CBC_WITH_MD5",
+	0x040080: "SSL_CK_RC2_128_CBC_EXPORT40_WITH_MD5",
+	0x050080: "SSL_CK_IDEA_128_CBC_WITH_MD5",
+	0x060040: "SSL_CK_DES_64_CBC_WITH_MD5",
+	0x0700c0: "SSL_CK_DES_192_EDE3_CBC_WITH_MD5",
+}
+
+type (
+	// LegacyHelloPolicy indicates how connections beginning with an
+	// SSLv2 or SSLv3 ClientHello are handled.
+	LegacyHelloPolicy int
+
+	// LegacyHelloFilter allows implementors to decide how connections
+	// beginning with an SSLv2 or SSLv3 ClientHello are handled. Such
+	// connections can't be intercepted because the tls package doesn't
+	// support SSL.
+	LegacyHelloFilter interface {
+		// FilterLegacyHello returns the LegacyHelloPolicy to apply to the
+		// connection.
+		//
+		// LegacyPassthrough relays data between the victim and downstream
+		// without data capture. Data sent over connections without a
+		// downstream is captured as cleartext instead.
+		//
+		// LegacyAlert allows victims that also support later versions to
+		// retry with a ClientHello that can be intercepted.
+		FilterLegacyHello(victim Addr, proxy Addr, downstream *Addr, hello *LegacyHello) LegacyHelloPolicy
+	}
+
+	// LegacyHello contains fields parsed from a victim's SSLv2 or SSLv3
+	// ClientHello.
+	LegacyHello struct {
+		// SSLv2 indicates that the ClientHello used the SSLv2 record
+		// format, which clients may use to offer later versions too.
+		SSLv2 bool `json:"sslv2,omitempty"`
+		// Version is the highest version offered, e.g., 0x0002 for SSLv2
+		// and tls.VersionSSL30 for SSLv3.
+		Version uint16 `json:"version"`
+		// CipherSuites offered by the victim. The cipher kinds of SSLv2
+		// are three bytes long, while TLS cipher suites offered in SSLv2
+		// hellos are prefixed with a zero byte.
+		CipherSuites []uint32 `json:"cipher_suites,omitempty"`
+	}
+)
+
+// ParseSSLv2Hello parses an SSLv2 record containing a CLIENT-HELLO, as
+// sent by legacy clients, including those offering later versions
+// using the SSLv2 record format.
+func ParseSSLv2Hello(b []byte) (*LegacyHello, error) {
+	if len(b) < sslv2HeaderLen {
+		return nil, errShortSSLv2Hello
+	} else if b[0]&0x80 == 0 {
+		return nil, errors.New("not an sslv2 record")
+	}
+	rLen := int(b[0]&0x7f)<<8 | int(b[1])
+	if len(b) < sslv2HeaderLen+rLen {
+		return nil, errShortSSLv2Hello
+	}
+	msg := b[sslv2HeaderLen : sslv2HeaderLen+rLen]
+	if len(msg) < sslv2HelloLen {
+		return nil, errShortSSLv2Hello
+	} else if msg[0] != sslv2ClientHelloType {
+		return nil, errors.New("not an sslv2 client hello")
+	}
+
+	h := &LegacyHello{SSLv2: true, Version: binary.BigEndian.Uint16(msg[1:])}
+	specsLen := int(binary.BigEndian.Uint16(msg[3:]))
+	if specsLen%3 != 0 {
+		return nil, errors.New("malformed cipher specs")
+	} else if len(msg) < sslv2HelloLen+specsLen {
+		return nil, errShortSSLv2Hello
+	}
+	for specs := msg[sslv2HelloLen : sslv2HelloLen+specsLen]; len(specs) > 0; specs = specs[3:] {
+		h.CipherSuites = append(h.CipherSuites, uint32(specs[0])<<16|uint32(specs[1])<<8|uint32(specs[2]))
+	}
+	return h, nil
+}
+
+// isSSLv2Hello determines if b begins with the header of an SSLv2
+// record containing a CLIENT-HELLO offering SSLv2 or later.
+//
+// Note: b must be at least five bytes long.
+func isSSLv2Hello(b []byte) bool {
+	return b[0]&0x80 != 0 && b[2] == sslv2ClientHelloType &&
+		(b[3] == 0 && b[4] == versionSSL20 || b[3] == 3 && b[4] <= 3)
+}
+
+// legacy returns the LegacyHello of a ClientHello offering nothing
+// later than SSLv3, or nil when the hello can be intercepted.
+func (h *ClientHello) legacy() *LegacyHello {
+	if h == nil || h.Version > tls.VersionSSL30 {
+		return nil
+	}
+	for _, v := range h.SupportedVersions {
+		if v > tls.VersionSSL30 {
+			return nil
+		}
+	}
+	l := &LegacyHello{Version: h.Version}
+	for _, s := range h.CipherSuites {
+		l.CipherSuites = append(l.CipherSuites, uint32(s))
+	}
+	return l
+}
+
+// String describes the hello for logging.
+func (h *LegacyHello) String() string {
+	format, version := "ssl", tls.VersionName(h.Version)
+	if h.SSLv2 {
+		format = "sslv2"
+	}
+	if h.Version == versionSSL20 {
+		version = "SSL 2.0"
+	}
+	names := make([]string, len(h.CipherSuites))
+	for i, s := range h.CipherSuites {
+		if name, ok := sslv2CipherNames[s]; ok {
+			names[i] = name
+		} else if s <= 0xffff {
+			names[i] = tls.CipherSuiteName(uint16(s))
+		} else {
+			names[i] = fmt.Sprintf("0x%06X", s)
+		}
+	}
+	return fmt.Sprintf("%s client hello offering %s with cipher suites: %s", format, version, strings.Join(names, ", "))
+}
+
+// alert returns the message that informs the victim that the version it
+// offered is unsupported: an SSLv2 NO-CIPHER-ERROR for SSLv2 only
+// clients and a protocol_version alert otherwise.
+func (h *LegacyHello) alert() []byte {
+	if h.Version == versionSSL20 {
+		return []byte{0x80, 0x03, 0x00, 0x00, 0x01}
+	}
+	return []byte{0x15, 0x03, byte(min(h.Version, tls.VersionTLS10)), 0x00, 0x02, 0x02, 0x46}
+}
+
+// peekSSLv2Hello returns the LegacyHello of a connection beginning with
+// an SSLv2 ClientHello, or nil when it doesn't. peek is the beginning of
+// the connection.
+func (c *proxyConn) peekSSLv2Hello(peek []byte) *LegacyHello {
+	pC := c.Conn.(*peekConn)
+	if len(peek) < 3 || peek[0]&0x80 == 0 || peek[2] != sslv2ClientHelloType {
+		return nil
+	} else if hdr, err := pC.Peek(sslv2HeaderLen + 3); err != nil || !isSSLv2Hello(hdr) {
+		return nil
+	} else if b, err := pC.Peek(sslv2HeaderLen + (int(hdr[0]&0x7f)<<8 | int(hdr[1]))); err != nil {
+		return &LegacyHello{SSLv2: true, Version: binary.BigEndian.Uint16(hdr[3:])}
+	} else if h, err := ParseSSLv2Hello(b); err != nil {
+		c.log(DebugLogLvl, fmt.Sprintf("failed to parse sslv2 client hello: %s", err))
+		return &LegacyHello{SSLv2: true, Version: binary.BigEndian.Uint16(hdr[3:])}
+	} else {
+		return h
+	}
+}
@@ -0,0 +1,145 @@
+package gosplit
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// legacyCfg applies policy to legacy hellos.
+type legacyCfg struct {
+	tlsCfg
+	policy       LegacyHelloPolicy
+	noDownstream bool
+}
+
+func (c legacyCfg) GetDownstreamAddr(victim Addr, proxy Addr) (*Addr, error) {
+	if c.noDownstream {
+		return nil, nil
+	}
+	return c.tlsCfg.GetDownstreamAddr(victim, proxy)
+}
+
+func (c legacyCfg) FilterLegacyHello(_ Addr, _ Addr, _ *Addr, _ *LegacyHello) LegacyHelloPolicy {
+	return c.policy
+}
+
+// sslv2TestHello encodes an SSLv2 CLIENT-HELLO offering version.
+func sslv2TestHello(version uint16, specs ...uint32) []byte {
+	msg := []byte{sslv2ClientHelloType, byte(version >> 8), byte(version), 0, byte(len(specs) * 3), 0, 0, 0, 16}
+	for _, s := range specs {
+		msg = append(msg, byte(s>>16), byte(s>>8), byte(s))
+	}
+	msg = append(msg, make([]byte, 16)...) // challenge
+	return append([]byte{0x80 | byte(len(msg)>>8), byte(len(msg))}, msg...)
+}
+
+// sslv3TestHello encodes an SSLv3 ClientHello without extensions.
+func sslv3TestHello(suites ...uint16) []byte {
+	body := append([]byte{3, 0}, make([]byte, 33)...) // random and session id
+	body = binary.BigEndian.AppendUint16(body, uint16(len(suites)*2))
+	for _, s := range suites {
+		body = binary.BigEndian.AppendUint16(body, s)
+	}
+	body = append(body, 1, 0) // compression methods
+	msg := append([]byte{clientHelloType, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+	return append([]byte{tlsHandshakeType, 3, 0, byte(len(msg) >> 8), byte(len(msg))}, msg...)
+}
+
+func TestParseSSLv2Hello(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		want    *LegacyHello
+		wantErr bool
+	}{
+		{name: "sslv2", b: sslv2TestHello(versionSSL20, 0x010080, 0x0700c0),
+			want: &LegacyHello{SSLv2: true, Version: versionSSL20, CipherSuites: []uint32{0x010080, 0x0700c0}}},
+		{name: "tls in sslv2 record", b: sslv2TestHello(tls.VersionTLS10, 0x00002f, 0x010080),
+			want: &LegacyHello{SSLv2: true, Version: tls.VersionTLS10, CipherSuites: []uint32{0x00002f, 0x010080}}},
+		{name: "truncated", b: sslv2TestHello(versionSSL20, 0x010080)[:10], wantErr: true},
+		{name: "tls record", b: sslv3TestHello(0x002f), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSSLv2Hello(tt.b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSSLv2Hello() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSSLv2Hello() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyServer_LegacyHello(t *testing.T) {
+	crt := upgradeTestCert(t)
+	sslv2 := sslv2TestHello(versionSSL20, 0x010080)
+	sslv3 := sslv3TestHello(0x000a)
+
+	tests := []struct {
+		name         string
+		policy       LegacyHelloPolicy
+		noDownstream bool
+		hello        []byte
+		want         string // received by the victim
+		wantCaptured string // victim data captured
+	}{
+		{name: "sslv2 passthrough", policy: LegacyPassthrough, hello: sslv2, want: string(sslv2)},
+		{name: "sslv3 passthrough", policy: LegacyPassthrough, hello: sslv3, want: string(sslv3)},
+		{name: "sslv3 passthrough without downstream", policy: LegacyPassthrough, noDownstream: true, hello: sslv3,
+			wantCaptured: string(sslv3)},
+		{name: "sslv3 reject", policy: LegacyReject, hello: sslv3},
+		{name: "sslv2 alert", policy: LegacyAlert, hello: sslv2, want: "\x80\x03\x00\x00\x01"},
+		{name: "sslv3 alert", policy: LegacyAlert, hello: sslv3, want: "\x15\x03\x00\x00\x02\x02\x46"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recordingCfg{downstream: startEchoServer(t)}
+			l, err := net.Listen("tcp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal("failed to start listener for server", err)
+			}
+			s := NewProxyServer(legacyCfg{tlsCfg: tlsCfg{recordingCfg: rec, crt: crt}, policy: tt.policy,
+				noDownstream: tt.noDownstream}, l)
+			go s.Serve(context.Background())
+			defer s.Shutdown(context.Background())
+
+			c, err := net.Dial("tcp4", l.Addr().String())
+			if err != nil {
+				t.Fatal("failed to connect to proxy", err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err = c.Write(tt.hello); err != nil {
+				t.Fatal("failed to write to proxy", err)
+			}
+			got := make([]byte, len(tt.want))
+			if _, err = io.ReadFull(c, got); err != nil {
+				t.Fatal("failed to read from proxy", err)
+			} else if string(got) != tt.want {
+				t.Errorf("victim received %q, want %q", got, tt.want)
+			}
+			c.Close()
+
+			if victim, _ := capturedData(rec, 1); victim != tt.wantCaptured {
+				t.Errorf("victim data = %q, want %q", victim, tt.wantCaptured)
+			}
+			rec.m.Lock()
+			defer rec.m.Unlock()
+			wantRejected := RejectLegacySSL
+			if tt.policy == LegacyPassthrough {
+				wantRejected = ""
+			}
+			if len(rec.ended) != 1 || rec.ended[0].Rejected != wantRejected {
+				t.Errorf("ended connections = %+v, want one rejected for %q", rec.ended, wantRejected)
+			}
+		})
+	}
+}
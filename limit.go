@@ -0,0 +1,134 @@
+package gosplit
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	RejectMaxConns       = "max_conns"        // ConnLimits.MaxConns was reached
+	RejectMaxVictimConns = "max_victim_conns" // ConnLimits.MaxVictimConns was reached for the victim
+	RejectVictimRate     = "victim_rate"      // victim exceeded ConnLimits.VictimRate
+	RejectFilter         = "filter"           // ConnFilter returned RejectConn
+	RejectLegacySSL      = "legacy_ssl"       // victim sent an SSLv2 or SSLv3 hello that wasn't passed through
+
+	// limitSweepInterval is how often idle victims are pruned from
+	// connLimiter.
+	limitSweepInterval = time.Minute
+)
+
+type (
+	// ConnLimits defines limits enforced by ProxyServer when accepting
+	// connections. Zero values disable the corresponding limit.
+	ConnLimits struct {
+		// MaxConns is the maximum number of concurrent connections
+		// handled by the server.
+		MaxConns int
+		// MaxVictimConns is the maximum number of concurrent connections
+		// handled for a single victim IP.
+		MaxVictimConns int
+		// VictimRate is the number of new connections per second allowed
+		// for a single victim IP.
+		VictimRate float64
+		// VictimBurst is the number of new connections a victim IP can
+		// make in excess of VictimRate. Values less than 1 are treated
+		// as 1.
+		VictimBurst int
+	}
+
+	// connLimiter tracks active connections and connection rates
+	// to enforce ConnLimits.
+	connLimiter struct {
+		m         sync.Mutex
+		active    int                     // total active connections
+		victims   map[string]*victimLimit // state for each victim ip
+		lastSweep time.Time
+	}
+
+	// victimLimit tracks the state of a single victim ip.
+	victimLimit struct {
+		active int       // active connections for the victim
+		tokens float64   // token bucket used to enforce VictimRate
+		last   time.Time // last time tokens were refilled
+	}
+)
+
+// acquire attempts to reserve a connection slot for the victim ip.
+//
+// An empty string is returned when the connection is allowed, otherwise
+// one of the Reject constants is returned. release must be called for
+// each allowed connection once it ends.
+func (l *connLimiter) acquire(ip string, lim ConnLimits) (reason string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := time.Now()
+	if l.victims == nil {
+		l.victims = make(map[string]*victimLimit)
+		l.lastSweep = now
+	} else if now.Sub(l.lastSweep) >= limitSweepInterval {
+		l.sweep(now)
+	}
+
+	v, ok := l.victims[ip]
+	if !ok {
+		v = &victimLimit{tokens: float64(lim.burst()), last: now}
+		l.victims[ip] = v
+	}
+
+	// refill the victim's token bucket
+	if lim.VictimRate > 0 {
+		v.tokens += now.Sub(v.last).Seconds() * lim.VictimRate
+		if b := float64(lim.burst()); v.tokens > b {
+			v.tokens = b
+		}
+	}
+	v.last = now
+
+	switch {
+	case lim.MaxConns > 0 && l.active >= lim.MaxConns:
+		return RejectMaxConns
+	case lim.MaxVictimConns > 0 && v.active >= lim.MaxVictimConns:
+		return RejectMaxVictimConns
+	case lim.VictimRate > 0 && v.tokens < 1:
+		return RejectVictimRate
+	}
+
+	if lim.VictimRate > 0 {
+		v.tokens--
+	}
+	v.active++
+	l.active++
+	return
+}
+
+// release a connection slot reserved by acquire.
+func (l *connLimiter) release(ip string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.active--
+	if v, ok := l.victims[ip]; ok {
+		v.active--
+	}
+}
+
+// sweep removes victims without active connections that have not
+// connected recently, preventing unbounded growth of l.victims.
+//
+// Note: l.m must be held by the caller.
+func (l *connLimiter) sweep(now time.Time) {
+	for ip, v := range l.victims {
+		if v.active == 0 && now.Sub(v.last) >= limitSweepInterval {
+			delete(l.victims, ip)
+		}
+	}
+	l.lastSweep = now
+}
+
+// burst returns the effective size of the token bucket.
+func (c ConnLimits) burst() int {
+	if c.VictimBurst < 1 {
+		return 1
+	}
+	return c.VictimBurst
+}
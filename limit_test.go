@@ -0,0 +1,114 @@
+package gosplit
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimiter_acquire(t *testing.T) {
+	type attempt struct {
+		ip      string
+		release bool   // release the slot after acquiring it
+		want    string // expected rejection reason
+	}
+	tests := []struct {
+		name     string
+		limits   ConnLimits
+		attempts []attempt
+	}{
+		{name: "no limits", limits: ConnLimits{}, attempts: []attempt{
+			{ip: "10.0.0.1"}, {ip: "10.0.0.1"}, {ip: "10.0.0.1"},
+		}},
+		{name: "max conns", limits: ConnLimits{MaxConns: 2}, attempts: []attempt{
+			{ip: "10.0.0.1"}, {ip: "10.0.0.2"}, {ip: "10.0.0.3", want: RejectMaxConns},
+		}},
+		{name: "max conns released", limits: ConnLimits{MaxConns: 1}, attempts: []attempt{
+			{ip: "10.0.0.1", release: true}, {ip: "10.0.0.2"}, {ip: "10.0.0.3", want: RejectMaxConns},
+		}},
+		{name: "max victim conns", limits: ConnLimits{MaxVictimConns: 1}, attempts: []attempt{
+			{ip: "10.0.0.1"}, {ip: "10.0.0.1", want: RejectMaxVictimConns}, {ip: "10.0.0.2"},
+		}},
+		{name: "victim rate", limits: ConnLimits{VictimRate: 0.001, VictimBurst: 2}, attempts: []attempt{
+			{ip: "10.0.0.1", release: true}, {ip: "10.0.0.1", release: true},
+			{ip: "10.0.0.1", want: RejectVictimRate}, {ip: "10.0.0.2"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var l connLimiter
+			for i, a := range tt.attempts {
+				got := l.acquire(a.ip, tt.limits)
+				if got != a.want {
+					t.Errorf("acquire() attempt %d = %q, want %q", i, got, a.want)
+				}
+				if got == "" && a.release {
+					l.release(a.ip)
+				}
+			}
+		})
+	}
+}
+
+// limitCfg enforces limits while recording rejected connections.
+type limitCfg struct {
+	*recordingCfg
+	limits ConnLimits
+	logs   []LogRecord
+}
+
+func (c *limitCfg) GetConnLimits() ConnLimits {
+	return c.limits
+}
+
+func (c *limitCfg) RecvLog(r LogRecord) {
+	c.m.Lock()
+	if r.Rejected != "" {
+		c.logs = append(c.logs, r)
+	}
+	c.m.Unlock()
+}
+
+func TestProxyServer_ConnLimits(t *testing.T) {
+	cfg := &limitCfg{recordingCfg: &recordingCfg{downstream: startEchoServer(t)}, limits: ConnLimits{MaxConns: 1}}
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to start listener for server", err)
+	}
+	s := NewProxyServer(cfg, l)
+	go s.Serve(context.Background())
+	defer s.Shutdown(context.Background())
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp4", l.Addr().String())
+		if err != nil {
+			t.Fatal("failed to connect to proxy", err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		return c
+	}
+	held := dial()
+	defer held.Close()
+	if got := roundTrip(t, held, "abc", 3); got != "abc" {
+		t.Fatalf("response = %q, want abc", got)
+	}
+
+	rejected := dial()
+	defer rejected.Close()
+	if _, err = rejected.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection exceeding max conns was not closed")
+	}
+
+	cfg.m.Lock()
+	defer cfg.m.Unlock()
+	if len(cfg.ended) != 1 || cfg.ended[0].Rejected != RejectMaxConns {
+		t.Errorf("ended connections = %+v, want one rejected for %q", cfg.ended, RejectMaxConns)
+	}
+	if len(cfg.logs) != 1 || cfg.logs[0].Rejected != RejectMaxConns {
+		t.Errorf("rejection logs = %+v, want one for %q", cfg.logs, RejectMaxConns)
+	}
+	if st := s.Stats(); st.Rejected != 1 {
+		t.Errorf("Stats().Rejected = %d, want 1", st.Rejected)
+	}
+}
@@ -0,0 +1,135 @@
+package gosplit
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// linkTimeout is how long listeners opened by ConnLinker.Link wait for
+// the victim to connect.
+const linkTimeout = 30 * time.Second
+
+// ConnLinker opens listeners for connections related to an intercepted
+// connection, e.g., FTP data connections.
+type ConnLinker interface {
+	// Link listens on the IP address of the proxy that the victim
+	// connected to, returning the address of the listener, which should
+	// be announced to the victim in place of downstream.
+	//
+	// The first connection from the victim's IP address accepted by the
+	// listener within thirty seconds is intercepted and relayed to
+	// downstream like any other connection, with ConnInfo.Control set to
+	// the ID of the connection that linked it. The listener is then
+	// closed. Connections from other hosts are closed upon receipt.
+	//
+	// Linked connections resume the TLS session of the connection that
+	// linked them with its downstream, as some servers require, e.g.,
+	// vsftpd's require_ssl_reuse, unless the config returned by
+	// GetDownstreamTLSConfig has a ClientSessionCache.
+	Link(downstream Addr) (Addr, error)
+}
+
+type (
+	// controlSessions is a tls.ClientSessionCache holding the last
+	// session established with the downstream of a connection, which is
+	// offered regardless of the server's address so that connections it
+	// links may resume it.
+	controlSessions struct {
+		m       sync.Mutex
+		session *tls.ClientSessionState
+	}
+
+	// linkedSessions offers the session of a control connection without
+	// replacing it with sessions of the linked connection.
+	linkedSessions struct {
+		*controlSessions
+	}
+)
+
+// Link implements ConnLinker.
+func (c *proxyConn) Link(downstream Addr) (Addr, error) {
+	ip, _, err := net.SplitHostPort(c.victimConn.LocalAddr().String())
+	if err != nil {
+		return Addr{}, fmt.Errorf("failed to parse proxy address: %w", err)
+	}
+	l, err := net.Listen("tcp4", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		return Addr{}, fmt.Errorf("failed to listen for linked connection: %w", err)
+	}
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(linkTimeout))
+	stop := context.AfterFunc(c.ctx, func() { l.Close() })
+	ip, port, _ := net.SplitHostPort(l.Addr().String())
+	c.log(DebugLogLvl, fmt.Sprintf("listening on %s:%s for connection to %s", ip, port, downstream))
+
+	go func() {
+		defer stop()
+		defer l.Close()
+		for {
+			vC, err := l.Accept()
+			if err != nil {
+				c.log(DebugLogLvl, fmt.Sprintf("no linked connection accepted on %s:%s: %s", ip, port, err))
+				return
+			}
+			if vA, err := getVictimAddr(vC); err != nil || vA.IP != c.victimAddr.IP {
+				// only the victim may open linked connections
+				c.log(InfoLogLvl, fmt.Sprintf("dropped connection from %s to %s:%s", vC.RemoteAddr(), ip, port))
+				vC.Close()
+				continue
+			}
+			l.Close()
+			c.s.serveLinked(vC, c, downstream)
+			return
+		}
+	}()
+	return Addr{IP: ip, Port: port}, nil
+}
+
+// serveLinked handles a connection accepted by a listener opened by
+// control's Link method.
+func (s *ProxyServer) serveLinked(c net.Conn, control *proxyConn, downstream Addr) {
+	s.updateStats(func(st *ServerStats) { st.Accepted++ })
+	ip, port, _ := net.SplitHostPort(c.LocalAddr().String())
+	pC := &proxyConn{
+		id:             lastConnID.Add(1),
+		control:        control.id,
+		start:          time.Now(),
+		Conn:           &peekConn{Conn: c, buf: bufio.NewReaderSize(c, tlsRecordHeaderLen+maxTLSRecordLen)},
+		victimConn:     c,
+		proxyAddr:      &Addr{IP: ip, Port: port},
+		downstreamAddr: &downstream,
+		sessions:       control.sessions,
+		cfg:            control.cfg,
+		s:              s}
+	pC.initDataQueue()
+	pC.publish()
+
+	if !s.trackConn(pC) {
+		// shutdown started after the connection was accepted
+		pC.dq.close()
+		c.Close()
+		return
+	}
+	pC.handle()
+}
+
+// Get returns the last session, regardless of sessionKey.
+func (c *controlSessions) Get(string) (*tls.ClientSessionState, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.session, c.session != nil
+}
+
+// Put replaces the last session, regardless of sessionKey.
+func (c *controlSessions) Put(_ string, cs *tls.ClientSessionState) {
+	c.m.Lock()
+	c.session = cs
+	c.m.Unlock()
+}
+
+// Put does nothing, leaving the control connection's session in place.
+func (linkedSessions) Put(string, *tls.ClientSessionState) {}
@@ -0,0 +1,61 @@
+package gosplit
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyConn_Link_ForeignHost(t *testing.T) {
+	data := startTestServer(t, func(c net.Conn) { c.Write([]byte("file contents")) })
+	c, _ := startUpgradeProxy(t, upgradeTestCert(t), FTPStartTLS{}, func(c net.Conn) {
+		c.Write([]byte("220 ready\r\n"))
+		for _, reply := range []string{"230 logged in\r\n",
+			fmt.Sprintf("229 Entering Extended Passive Mode (|||%s|)\r\n", data.Port)} {
+			if _, err := readFTPLine(c); err != nil {
+				return
+			}
+			c.Write([]byte(reply))
+		}
+		io.Copy(io.Discard, c)
+	})
+
+	if _, err := relayFTPReply(c, io.Discard); err != nil {
+		t.Fatal("failed to read greeting", err)
+	}
+	roundTrip(t, c, "USER a\r\n", len("230 logged in\r\n"))
+	if _, err := c.Write([]byte("EPSV\r\n")); err != nil {
+		t.Fatal("failed to write to proxy", err)
+	}
+	reply, err := readFTPLine(c)
+	m := ftpEPSVPort.FindStringSubmatch(reply)
+	if err != nil || m == nil {
+		t.Fatalf("EPSV reply = %q, %v, want a linked port", reply, err)
+	}
+	linked := net.JoinHostPort("127.0.0.1", m[4])
+
+	// connections from other hosts are dropped without closing the
+	// listener
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}
+	fC, err := d.Dial("tcp4", linked)
+	if err != nil {
+		t.Skip("unable to connect from a second loopback address", err)
+	}
+	defer fC.Close()
+	fC.SetDeadline(time.Now().Add(5 * time.Second))
+	if b, err := io.ReadAll(fC); err != nil || len(b) != 0 {
+		t.Errorf("foreign host received %q, %v, want connection closed", b, err)
+	}
+
+	dC, err := net.Dial("tcp4", linked)
+	if err != nil {
+		t.Fatal("failed to open data connection", err)
+	}
+	defer dC.Close()
+	dC.SetDeadline(time.Now().Add(5 * time.Second))
+	if b, err := io.ReadAll(dC); err != nil || string(b) != "file contents" {
+		t.Errorf("victim received %q, %v, want file contents", b, err)
+	}
+}
@@ -0,0 +1,160 @@
+package gosplit
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// midStreamHeaderLen is the length of a TLS record header followed
+	// by the type and length of the handshake message it contains.
+	midStreamHeaderLen = tlsRecordHeaderLen + 4
+	// midStreamHoldTimeout is how long the beginning of what may be a
+	// TLS record is held back from the downstream while waiting for the
+	// rest of its header.
+	midStreamHoldTimeout = time.Second
+)
+
+type (
+	// MidStreamTLS is an Upgrader for protocols that upgrade to TLS
+	// after an arbitrary cleartext exchange, e.g., in-house protocols
+	// with a proprietary preamble. Cleartext is relayed in both
+	// directions until a TLS record containing a ClientHello appears at
+	// any offset of the victim's data, after which the handshakes are
+	// intercepted.
+	//
+	// Cleartext resembling the beginning of a TLS record is delayed by
+	// up to a second while the rest of the record header is awaited.
+	MidStreamTLS struct{}
+
+	// peeker is implemented by the connections passed to Upgraders.
+	peeker interface {
+		Peek(n int) ([]byte, error)
+		Buffered() int
+	}
+)
+
+// Upgrade implements Upgrader.
+func (u MidStreamTLS) Upgrade(_ context.Context, victim, downstream net.Conn) (bool, error) {
+	vP, ok := victim.(peeker)
+	if !ok {
+		return false, errors.New("victim connection does not support peeking")
+	}
+
+	var (
+		m       sync.Mutex
+		stopped bool
+	)
+	// setDeadline sets the victim's read deadline, returning false once
+	// the watch has been stopped
+	setDeadline := func(t time.Time) bool {
+		m.Lock()
+		defer m.Unlock()
+		if !stopped {
+			victim.SetReadDeadline(t)
+		}
+		return !stopped
+	}
+	stop := func() {
+		m.Lock()
+		stopped = true
+		victim.SetReadDeadline(time.Now())
+		m.Unlock()
+	}
+
+	watched, relayed := make(chan error, 1), make(chan error, 1)
+	go func() {
+		watched <- u.watch(vP, victim, downstream, setDeadline)
+	}()
+	go func() {
+		_, err := io.Copy(victim, downstream)
+		relayed <- err
+	}()
+
+	var wErr, rErr error
+	select {
+	case wErr = <-watched:
+		// the downstream's reply to the hello must not be read
+		downstream.SetReadDeadline(time.Now())
+		rErr = <-relayed
+	case rErr = <-relayed:
+		stop()
+		wErr = <-watched
+		if rErr == nil {
+			// the downstream closed the connection
+			return false, nil
+		}
+	}
+	switch {
+	case rErr != nil && !errors.Is(rErr, os.ErrDeadlineExceeded):
+		return false, fmt.Errorf("error relaying downstream data: %w", rErr)
+	case wErr == nil:
+		return true, nil
+	case errors.Is(wErr, io.EOF) || errors.Is(wErr, os.ErrDeadlineExceeded):
+		return false, nil
+	}
+	return false, wErr
+}
+
+// watch relays data from the victim to the downstream until a
+// ClientHello is found, leaving it unread. An error is returned when
+// the victim's data ends without one.
+func (u MidStreamTLS) watch(vP peeker, victim, downstream net.Conn, setDeadline func(time.Time) bool) error {
+	var held int // bytes of a candidate record awaiting the rest of its header
+	for {
+		if _, err := vP.Peek(held + 1); err != nil {
+			if held == 0 || !errors.Is(err, os.ErrDeadlineExceeded) || !setDeadline(time.Time{}) {
+				return err
+			}
+			// no more data arrived, so the candidate is cleartext
+			if _, err = io.CopyN(downstream, victim, int64(held)); err != nil {
+				return fmt.Errorf("error relaying victim data: %w", err)
+			}
+			held = 0
+			continue
+		} else if held > 0 && !setDeadline(time.Time{}) {
+			return os.ErrDeadlineExceeded
+		}
+
+		b, _ := vP.Peek(vP.Buffered())
+		i, found := findClientHello(b)
+		if _, err := io.CopyN(downstream, victim, int64(i)); err != nil {
+			return fmt.Errorf("error relaying victim data: %w", err)
+		} else if found {
+			return nil
+		}
+		if held = len(b) - i; held > 0 && !setDeadline(time.Now().Add(midStreamHoldTimeout)) {
+			return os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// findClientHello returns the offset of the first TLS record in b that
+// begins with a ClientHello and true, or the offset of a candidate whose
+// header is incomplete and false. len(b) is returned when there are
+// neither.
+func findClientHello(b []byte) (int, bool) {
+	for i := range b {
+		h := b[i:]
+		switch {
+		case h[0] != tlsHandshakeType,
+			len(h) > 1 && h[1] != 3,
+			len(h) > 2 && h[2] > 4,
+			len(h) > 4 && (binary.BigEndian.Uint16(h[3:]) == 0 || binary.BigEndian.Uint16(h[3:]) > maxTLSRecordLen),
+			len(h) > 5 && h[5] != clientHelloType,
+			len(h) > 6 && h[6] != 0: // hellos are far shorter than 64KiB
+			continue
+		case len(h) < midStreamHeaderLen:
+			return i, false
+		}
+		return i, true
+	}
+	return len(b), false
+}
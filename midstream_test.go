@@ -0,0 +1,27 @@
+package gosplit
+
+import "testing"
+
+func TestFindClientHello(t *testing.T) {
+	hdr := "\x16\x03\x01\x00\x40\x01\x00\x00\x3c"
+	tests := []struct {
+		name  string
+		b     string
+		want  int
+		found bool
+	}{
+		{name: "at start", b: hdr, want: 0, found: true},
+		{name: "after cleartext", b: "a\x16b" + hdr, want: 3, found: true},
+		{name: "incomplete header", b: "ab" + hdr[:4], want: 2},
+		{name: "server hello", b: "\x16\x03\x03\x00\x40\x02\x00\x00\x3c", want: 9},
+		{name: "empty record", b: "\x16\x03\x01\x00\x00\x01\x00\x00\x3c", want: 9},
+		{name: "cleartext", b: "hello", want: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, found := findClientHello([]byte(tt.b)); got != tt.want || found != tt.found {
+				t.Errorf("findClientHello() = %d, %v, want %d, %v", got, found, tt.want, tt.found)
+			}
+		})
+	}
+}
@@ -17,6 +17,11 @@ import (
 	"time"
 )
 
+const (
+	minAcceptDelay = 5 * time.Millisecond // initial backoff after a temporary accept error
+	maxAcceptDelay = time.Second          // maximum backoff after temporary accept errors
+)
+
 type (
 	// RSAPrivKey wraps rsa.PrivateKey, giving us a type to carry
 	// configuration values and errors through StartRSAPrivKeyGenerator.
@@ -244,8 +249,8 @@ func checkRSABitLen(bitLen int) (err error) {
 }
 
 func isHandshake(buf []byte) bool {
-	// TODO SSL is no longer supported by the tls package
-	//  may need to see about implementing it manually
+	// only tls-format records match; legacy.go detects sslv2 and sslv3
+	// hellos
 	// https://tls12.xargs.org/#client-hello/annotated
 	if len(buf) >= 2 && buf[0] == 0x16 && buf[1] == 0x03 {
 		return true
@@ -253,6 +258,24 @@ func isHandshake(buf []byte) bool {
 	return false
 }
 
+// isTemporaryErr determines if err is a temporary error returned by
+// net.Listener.Accept, indicating that accepting should be retried.
+func isTemporaryErr(err error) bool {
+	var tE interface{ Temporary() bool }
+	return errors.As(err, &tE) && tE.Temporary()
+}
+
+// nextAcceptDelay doubles the delay used to back off after temporary
+// accept errors, bounded by minAcceptDelay and maxAcceptDelay.
+func nextAcceptDelay(d time.Duration) time.Duration {
+	if d == 0 {
+		return minAcceptDelay
+	} else if d *= 2; d > maxAcceptDelay {
+		return maxAcceptDelay
+	}
+	return d
+}
+
 func getVictimAddr(c net.Conn) (vA Addr, err error) {
 	if vA.IP, vA.Port, err = net.SplitHostPort(c.RemoteAddr().String()); err != nil {
 		err = fmt.Errorf("error parsing victim address information: %w", err)
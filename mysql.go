@@ -0,0 +1,87 @@
+package gosplit
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	mysqlHeaderLen = 4 // payload length and sequence id
+	// mysqlClientSSL is the capability flag advertised by servers that
+	// support TLS and set by clients requesting it.
+	mysqlClientSSL = 0x800
+	// mysqlSSLRequestLen is the length of the SSLRequest payload, which
+	// is the beginning of a HandshakeResponse.
+	mysqlSSLRequestLen = 32
+	// mysqlMaxPacket bounds the handshake packets read while
+	// negotiating TLS.
+	mysqlMaxPacket = 64 << 10
+)
+
+// MySQLStartTLS is an Upgrader for MySQL connections, which negotiate TLS
+// when the client responds to the server's handshake with an
+// SSLRequest.
+type MySQLStartTLS struct{}
+
+// Upgrade implements Upgrader.
+func (MySQLStartTLS) Upgrade(_ context.Context, victim, downstream net.Conn) (bool, error) {
+	greeting, err := readMySQLPacket(downstream)
+	if err != nil {
+		return false, fmt.Errorf("error reading mysql handshake: %w", err)
+	} else if _, err = victim.Write(greeting); err != nil {
+		return false, fmt.Errorf("error relaying mysql handshake: %w", err)
+	}
+	if caps, ok := mysqlServerCapabilities(greeting[mysqlHeaderLen:]); !ok || caps&mysqlClientSSL == 0 {
+		// an error or a server that doesn't support tls
+		return false, nil
+	}
+
+	resp, err := readMySQLPacket(victim)
+	if err != nil {
+		return false, fmt.Errorf("error reading mysql handshake response: %w", err)
+	} else if _, err = downstream.Write(resp); err != nil {
+		return false, fmt.Errorf("error relaying mysql handshake response: %w", err)
+	}
+	payload := resp[mysqlHeaderLen:]
+	return len(payload) == mysqlSSLRequestLen && binary.LittleEndian.Uint32(payload)&mysqlClientSSL != 0, nil
+}
+
+// readMySQLPacket reads a packet, including its header, from r without
+// reading beyond its end.
+func readMySQLPacket(r io.Reader) ([]byte, error) {
+	hdr := make([]byte, mysqlHeaderLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	l := int(hdr[0]) | int(hdr[1])<<8 | int(hdr[2])<<16
+	if l > mysqlMaxPacket {
+		return nil, errors.New("mysql packet exceeds maximum length")
+	}
+	b := make([]byte, mysqlHeaderLen+l)
+	copy(b, hdr)
+	_, err := io.ReadFull(r, b[mysqlHeaderLen:])
+	return b, err
+}
+
+// mysqlServerCapabilities returns the lower capability flags of a
+// protocol version 10 initial handshake.
+func mysqlServerCapabilities(b []byte) (uint32, bool) {
+	// protocol version and null terminated server version
+	if len(b) < 1 || b[0] != 10 {
+		return 0, false
+	}
+	i := 1
+	for i < len(b) && b[i] != 0 {
+		i++
+	}
+	// connection id, 8 bytes of auth data, and filler
+	i += 1 + 4 + 8 + 1
+	if len(b) < i+2 {
+		return 0, false
+	}
+	return uint32(binary.LittleEndian.Uint16(b[i:])), true
+}
@@ -0,0 +1,70 @@
+package gosplit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// mysqlTestPacket encodes a packet.
+func mysqlTestPacket(seq byte, payload string) string {
+	l := len(payload)
+	return string([]byte{byte(l), byte(l >> 8), byte(l >> 16), seq}) + payload
+}
+
+func TestReadMySQLPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       string
+		want    string
+		wantErr bool
+	}{
+		{name: "packet", b: mysqlTestPacket(1, "abc") + "next", want: mysqlTestPacket(1, "abc")},
+		{name: "empty payload", b: mysqlTestPacket(3, ""), want: mysqlTestPacket(3, "")},
+		{name: "truncated", b: mysqlTestPacket(1, "abc")[:6], wantErr: true},
+		{name: "too long", b: "\xff\xff\xff\x00", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := strings.NewReader(tt.b)
+			got, err := readMySQLPacket(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readMySQLPacket() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != tt.want {
+				t.Errorf("readMySQLPacket() = %q, want %q", got, tt.want)
+			}
+			if !tt.wantErr && r.Len() != len(tt.b)-len(tt.want) {
+				t.Errorf("readMySQLPacket() read beyond the packet")
+			}
+		})
+	}
+}
+
+func TestMySQLServerCapabilities(t *testing.T) {
+	greeting := func(version string, caps uint16) []byte {
+		b := append([]byte("\x0a"+version+"\x00"), 1, 0, 0, 0)
+		b = append(b, "abcdefgh\x00"...)
+		return binary.LittleEndian.AppendUint16(b, caps)
+	}
+	tests := []struct {
+		name string
+		b    []byte
+		want uint32
+		ok   bool
+	}{
+		{name: "ssl", b: greeting("8.0.36", 0xffff), want: 0xffff, ok: true},
+		{name: "no ssl", b: greeting("5.7", 0xffff&^mysqlClientSSL), want: 0xffff &^ mysqlClientSSL, ok: true},
+		{name: "truncated", b: greeting("8.0.36", 0xffff)[:16]},
+		{name: "protocol version 9", b: bytes.Replace(greeting("8.0.36", 0xffff), []byte{10}, []byte{9}, 1)},
+		{name: "empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, ok := mysqlServerCapabilities(tt.b); got != tt.want || ok != tt.ok {
+				t.Errorf("mysqlServerCapabilities() = %#x, %v, want %#x, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package gosplit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	ntlmChallengeMsg    = 2
+	ntlmAuthenticateMsg = 3
+
+	// ntlmNegotiateUnicode indicates that strings are UTF-16LE encoded.
+	ntlmNegotiateUnicode = 0x00000001
+	// ntlmChallengeLen is the length of the fixed fields of a
+	// CHALLENGE_MESSAGE through the server challenge.
+	ntlmChallengeLen = 32
+	// ntlmAuthenticateLen is the length of the fixed fields of an
+	// AUTHENTICATE_MESSAGE through the negotiate flags.
+	ntlmAuthenticateLen = 64
+	// ntlmV1ResponseLen is the length of NetNTLMv1 responses.
+	ntlmV1ResponseLen = 24
+	// ntlmV2ProofLen is the length of the NTProofStr that begins
+	// NetNTLMv2 responses.
+	ntlmV2ProofLen = 16
+)
+
+var (
+	ntlmSignature    = []byte("NTLMSSP\x00")
+	ntlmB64Signature = []byte("TlRMTVNTUA") // base64 of ntlmSignature, as sent in headers and SASL
+)
+
+// ntlmAuthenticate is a parsed NTLMSSP AUTHENTICATE_MESSAGE.
+type ntlmAuthenticate struct {
+	lmResponse  []byte
+	ntResponse  []byte
+	domain      string
+	user        string
+	workstation string
+}
+
+// scanNTLM extracts NTLMSSP messages from b, which are sent raw by
+// binary protocols, e.g., SMB, and base64 encoded by text protocols,
+// e.g., HTTP.
+//
+// Challenges are retained so that they can be reported along with the
+// responses that follow them.
+func (s *credStream) scanNTLM(creds []Credential, b []byte) []Credential {
+	for _, msg := range findNTLM(b) {
+		if len(msg) < 12 {
+			continue
+		}
+		switch binary.LittleEndian.Uint32(msg[8:12]) {
+		case ntlmChallengeMsg:
+			if len(msg) >= ntlmChallengeLen {
+				s.challenge = append([]byte(nil), msg[24:32]...)
+			}
+		case ntlmAuthenticateMsg:
+			if a, err := parseNTLMAuthenticate(msg); err == nil && a.user != "" && len(a.ntResponse) > 0 {
+				creds = s.add(creds, s.ntlmCred(a))
+			}
+		}
+	}
+	return creds
+}
+
+// ntlmCred describes the response sent by the victim.
+//
+// Hash is set only when the server challenge preceded the response on
+// the same connection, since it is required to crack the response.
+func (s *credStream) ntlmCred(a *ntlmAuthenticate) Credential {
+	c := Credential{Protocol: CredNTLM, Type: "netntlmv2", Username: a.user, Domain: a.domain,
+		Extra: map[string]string{
+			"workstation": a.workstation,
+			"lm_response": hex.EncodeToString(a.lmResponse),
+			"nt_response": hex.EncodeToString(a.ntResponse),
+		}}
+	if len(a.ntResponse) == ntlmV1ResponseLen {
+		c.Type = "netntlmv1"
+	}
+	if s.challenge != nil {
+		c.Extra["server_challenge"] = hex.EncodeToString(s.challenge)
+		c.Hash = ntlmHashcat(a, s.challenge)
+	}
+	return c
+}
+
+// ntlmHashcat formats a response for hashcat, i.e., mode 5500 for
+// NetNTLMv1 and mode 5600 for NetNTLMv2.
+//
+// v1: user::domain:lm_response:nt_response:server_challenge
+// v2: user::domain:server_challenge:nt_proof:blob
+func ntlmHashcat(a *ntlmAuthenticate, challenge []byte) string {
+	if len(a.ntResponse) == ntlmV1ResponseLen {
+		return fmt.Sprintf("%s::%s:%x:%x:%x", a.user, a.domain, a.lmResponse, a.ntResponse, challenge)
+	} else if len(a.ntResponse) <= ntlmV2ProofLen {
+		return ""
+	}
+	return fmt.Sprintf("%s::%s:%x:%x:%x", a.user, a.domain, challenge,
+		a.ntResponse[:ntlmV2ProofLen], a.ntResponse[ntlmV2ProofLen:])
+}
+
+// findNTLM returns the NTLMSSP messages found in b, beginning with their
+// signatures. Messages may include trailing data.
+func findNTLM(b []byte) (msgs [][]byte) {
+	for i := 0; ; {
+		j := bytes.Index(b[i:], ntlmSignature)
+		if j < 0 {
+			break
+		}
+		msgs, i = append(msgs, b[i+j:]), i+j+len(ntlmSignature)
+	}
+	for i := 0; ; {
+		j := bytes.Index(b[i:], ntlmB64Signature)
+		if j < 0 {
+			break
+		}
+		i += j
+		end := i
+		for end < len(b) && isBase64Char(b[end]) {
+			end++
+		}
+		enc := strings.TrimRight(string(b[i:end]), "=")
+		if msg, err := base64.RawStdEncoding.DecodeString(enc); err == nil {
+			msgs = append(msgs, msg)
+		}
+		i = end
+	}
+	return
+}
+
+func isBase64Char(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '+' || c == '/' || c == '='
+}
+
+// parseNTLMAuthenticate parses an AUTHENTICATE_MESSAGE.
+func parseNTLMAuthenticate(b []byte) (*ntlmAuthenticate, error) {
+	if len(b) < ntlmAuthenticateLen || !bytes.HasPrefix(b, ntlmSignature) ||
+		binary.LittleEndian.Uint32(b[8:12]) != ntlmAuthenticateMsg {
+		return nil, errors.New("not an ntlm authenticate message")
+	}
+	// field returns the payload referenced by the fields at offset
+	var err error
+	field := func(offset int) []byte {
+		l := int(binary.LittleEndian.Uint16(b[offset:]))
+		o := int(binary.LittleEndian.Uint32(b[offset+4:]))
+		if o+l > len(b) || o < 0 {
+			err = errors.New("ntlm field exceeds message length")
+			return nil
+		}
+		return b[o : o+l]
+	}
+	unicode := binary.LittleEndian.Uint32(b[60:64])&ntlmNegotiateUnicode != 0
+	str := func(offset int) string {
+		v := field(offset)
+		if !unicode {
+			return string(v)
+		}
+		u := make([]uint16, len(v)/2)
+		for i := range u {
+			u[i] = binary.LittleEndian.Uint16(v[i*2:])
+		}
+		return string(utf16.Decode(u))
+	}
+	a := &ntlmAuthenticate{
+		lmResponse:  field(12),
+		ntResponse:  field(20),
+		domain:      str(28),
+		user:        str(36),
+		workstation: str(44),
+	}
+	return a, err
+}
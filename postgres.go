@@ -0,0 +1,65 @@
+package gosplit
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	// postgresRequestLen is the length of the SSLRequest and
+	// GSSENCRequest messages, which begin with their length.
+	postgresRequestLen = 8
+	// request codes, which take the place of the protocol version of
+	// a StartupMessage
+	postgresSSLRequest    = 80877103
+	postgresGSSENCRequest = 80877104
+)
+
+// PostgresStartTLS is an Upgrader for PostgreSQL connections that negotiate
+// TLS using an SSLRequest before the StartupMessage.
+//
+// Connections that begin with a TLS handshake, as clients configured
+// for direct negotiation do, are intercepted without an Upgrader.
+// Connections encrypted using GSSAPI are relayed as is.
+type PostgresStartTLS struct{}
+
+// Upgrade implements Upgrader.
+func (PostgresStartTLS) Upgrade(_ context.Context, victim, downstream net.Conn) (bool, error) {
+	for {
+		// requests are shorter than any StartupMessage, so reading one
+		// never reads beyond the start of the connection
+		b := make([]byte, postgresRequestLen)
+		if _, err := io.ReadFull(victim, b); err != nil {
+			return false, fmt.Errorf("error reading postgres request: %w", err)
+		} else if _, err = downstream.Write(b); err != nil {
+			return false, fmt.Errorf("error relaying postgres request: %w", err)
+		}
+		code := binary.BigEndian.Uint32(b[4:])
+		if binary.BigEndian.Uint32(b) != postgresRequestLen ||
+			code != postgresSSLRequest && code != postgresGSSENCRequest {
+			// the StartupMessage of a cleartext connection
+			return false, nil
+		}
+
+		// the downstream accepts with S or G, and declines with N
+		resp := make([]byte, 1)
+		if _, err := io.ReadFull(downstream, resp); err != nil {
+			return false, fmt.Errorf("error reading postgres response: %w", err)
+		} else if _, err = victim.Write(resp); err != nil {
+			return false, fmt.Errorf("error relaying postgres response: %w", err)
+		}
+		switch {
+		case code == postgresSSLRequest && resp[0] == 'S':
+			return true, nil
+		case resp[0] != 'N':
+			// gssapi encryption, or an error message sent by servers
+			// that don't support the request
+			return false, nil
+		}
+		// declined requests are followed by another request or the
+		// StartupMessage
+	}
+}
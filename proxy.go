@@ -2,10 +2,13 @@ package gosplit
 
 import (
 	"bufio"
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"net"
+	"slices"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -20,19 +23,50 @@ type (
 	//
 	// ConnCount can be used to determine the number of connections active
 	// with the server.
+	//
+	// Shutdown can be used to stop the server while allowing active
+	// connections to drain.
+	//
+	// SetCfg can be used to replace the Cfg used for new connections.
+	//
+	// Conns and KillConn can be used to inspect and close individual
+	// connections, while Stats returns counters suitable for metrics.
 	ProxyServer struct {
 		l         net.Listener
-		cfg       Cfg
+		cfg       Cfg // guarded by mu
 		connCount atomic.Int32
+
+		mu         sync.Mutex
+		conns      map[*proxyConn]struct{} // connections currently being handled
+		handlers   sync.WaitGroup          // tracks routines running proxyConn.handle
+		inShutdown bool                    // set once Shutdown is called
+		drainCtx   context.Context         // done when active connections should finish
+		drain      context.CancelFunc      // cancels drainCtx
+		limiter    connLimiter             // enforces limits when cfg implements ConnLimiter
+		stats      ServerStats             // cumulative counters returned by Stats
 	}
 
-	// proxyListener provides configuration information to Listener.
+	// proxyListener wraps the Listener passed to NewProxyServer.
 	proxyListener struct {
 		net.Listener
-		cfg cfg
+	}
+
+	// ConnStats describes an active connection, as returned by
+	// ProxyServer.Conns.
+	ConnStats struct {
+		ConnInfo
+		// VictimBytes is the number of bytes the victim has sent to
+		// the downstream.
+		VictimBytes int64 `json:"victim_bytes"`
+		// DownstreamBytes is the number of bytes the downstream has sent
+		// to the victim.
+		DownstreamBytes int64 `json:"downstream_bytes"`
 	}
 )
 
+// lastConnID is the ID most recently assigned to a connection.
+var lastConnID atomic.Uint64
+
 // ConnCount returns the total number of active connections to the
 // server.
 func (s *ProxyServer) ConnCount() int {
@@ -44,8 +78,32 @@ func NewProxyServer(cfg Cfg, l net.Listener) *ProxyServer {
 	return &ProxyServer{cfg: cfg, l: l}
 }
 
+// SetCfg replaces the Cfg used by the server.
+//
+// Connections accepted after SetCfg returns use the new Cfg, while
+// active connections continue using the Cfg they were accepted with.
+// This allows certificates, routes, and other settings to be changed
+// without dropping connections.
+func (s *ProxyServer) SetCfg(c Cfg) {
+	s.mu.Lock()
+	s.cfg = c
+	s.mu.Unlock()
+}
+
+// getCfg returns the Cfg used for new connections.
+func (s *ProxyServer) getCfg() Cfg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
 // Serve a TCP server capable of handling TLS connections.
 //
+// Temporary errors returned while accepting connections, e.g., EMFILE,
+// are logged and retried with exponential backoff. Serve returns nil when
+// ctx is done or the listener is closed, and returns an error only when
+// the listener fails fatally.
+//
 // The method obtains the IP and port the server binds to in
 // on of two ways:
 //
@@ -60,17 +118,19 @@ func (s *ProxyServer) Serve(ctx context.Context) (err error) {
 		s.log(ErrorLogLvl, "failed to parse ip and port from l", Addr{}, nil)
 	}
 
-	l := &proxyListener{Listener: s.l, cfg: cfg{Cfg: s.cfg}}
+	l := &proxyListener{Listener: s.l}
 	pA := Addr{IP: pIP, Port: pPort}
 
 	s.log(InfoLogLvl, "starting proxy server", pA, nil)
 
 	context.AfterFunc(ctx, func() {
-		if e := l.Close(); e != nil {
+		if e := l.Close(); e != nil && !errors.Is(e, net.ErrClosed) {
 			s.log(ErrorLogLvl, "error closing proxy server l", pA, nil)
 		}
 	})
 
+	var tempDelay time.Duration // time to wait before retrying after a temporary accept error
+
 ctrl:
 	for {
 		select {
@@ -83,40 +143,237 @@ ctrl:
 				err = nil
 				s.log(InfoLogLvl, "proxy server listener closed", pA, nil)
 				break ctrl
-			} else if e != nil {
-				e = fmt.Errorf("error accepting connection: %v", e)
-				var vA *Addr
-				if v, vE := getVictimAddr(c); vE != nil {
-					e = fmt.Errorf("error getting victim address: %v (while handling: %v)", vE, e)
-				} else {
-					vA = &v
+			} else if isTemporaryErr(e) {
+				// back off and retry, e.g., when the process has temporarily
+				// run out of file descriptors (EMFILE)
+				tempDelay = nextAcceptDelay(tempDelay)
+				s.log(ErrorLogLvl, fmt.Sprintf("temporary error accepting connection (retrying in %v): %v", tempDelay, e), pA, nil)
+				t := time.NewTimer(tempDelay)
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					break ctrl
+				case <-t.C:
 				}
-				s.log(ErrorLogLvl, err.Error(), pA, vA)
+				continue
+			} else if e != nil {
+				err = fmt.Errorf("error accepting connection: %w", e)
+				s.log(ErrorLogLvl, err.Error(), pA, nil)
 				break ctrl
 			}
+			tempDelay = 0
+			s.updateStats(func(st *ServerStats) { st.Accepted++ })
+
+			var limitIP string
+			if limitIP, e = s.limit(c, pA); e != nil {
+				c.Close()
+				continue
+			}
+
+			pC := &proxyConn{
+				id:         lastConnID.Add(1),
+				start:      time.Now(),
+				Conn:       &peekConn{Conn: c, buf: bufio.NewReaderSize(c, tlsRecordHeaderLen+maxTLSRecordLen)},
+				victimConn: c,
+				proxyAddr:  &pA,
+				sessions:   new(controlSessions),
+				cfg:        cfg{Cfg: s.getCfg()},
+				s:          s,
+				limitIP:    limitIP}
+			pC.initDataQueue()
+			pC.publish()
 
-			c = &proxyConn{
-				Conn:      &peekConn{Conn: c, buf: bufio.NewReader(c)},
-				proxyAddr: &pA,
-				cfg:       l.cfg,
-				s:         s}
+			if !s.trackConn(pC) {
+				// shutdown started after the connection was accepted
+				s.releaseLimit(limitIP)
+				pC.dq.close()
+				c.Close()
+				continue
+			}
 
-			go c.(*proxyConn).handle()
+			go pC.handle()
 		}
 	}
 
 	if l != nil {
-		if err := l.Close(); err != nil {
+		if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 			s.log(ErrorLogLvl, "error closing proxy server listener", pA, nil)
 		}
 	}
 
-	l.cfg.log(nil, InfoLogLvl, "proxy server stopped")
+	s.log(InfoLogLvl, "proxy server stopped", pA, nil)
+	return
+}
+
+// Conns returns statistics for each active connection, ordered by ID.
+func (s *ProxyServer) Conns() (stats []ConnStats) {
+	s.mu.Lock()
+	for c := range s.conns {
+		stats = append(stats, ConnStats{
+			ConnInfo:        *c.info.Load(),
+			VictimBytes:     c.counters.victim.Load(),
+			DownstreamBytes: c.counters.downstream.Load(),
+		})
+	}
+	s.mu.Unlock()
+	slices.SortFunc(stats, func(a, b ConnStats) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
 	return
 }
 
+// KillConn forcibly closes the active connection identified by id,
+// returning false when no such connection exists.
+//
+// The connection ends as though the victim closed it, so the usual
+// ConnInfoReceiver.RecvConnEnd call is still made.
+func (s *ProxyServer) KillConn(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		if c.id == id {
+			c.kill()
+			return true
+		}
+	}
+	return false
+}
+
+// Shutdown gracefully stops the server.
+//
+// The listener is closed so that no new connections are accepted and
+// active connections are signaled to finish. Connections that have yet to
+// begin relaying data are abandoned, while those relaying data are allowed
+// to end naturally.
+//
+// Shutdown blocks until all connections have ended, guaranteeing that
+// every ConnInfoReceiver.RecvConnEnd call and queued DataReceiver event
+// has been delivered before returning. When ctx is done before then, the
+// remaining connections are forcibly closed and ctx.Err is returned once
+// their events have been delivered.
+func (s *ProxyServer) Shutdown(ctx context.Context) (err error) {
+	s.mu.Lock()
+	s.inShutdown = true
+	s.drainContext()
+	s.drain()
+	s.mu.Unlock()
+
+	if e := s.l.Close(); e != nil && !errors.Is(e, net.ErrClosed) {
+		err = fmt.Errorf("error closing proxy server listener: %w", e)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// deadline reached; force the remaining connections closed
+		// and wait for their events to be delivered
+		s.mu.Lock()
+		for c := range s.conns {
+			c.kill()
+		}
+		s.mu.Unlock()
+		<-done
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+
+	return
+}
+
+// drainContext returns the context that connections watch to determine
+// if they should finish, initializing it when necessary.
+//
+// Note: s.mu must be held by the caller.
+func (s *ProxyServer) drainContext() context.Context {
+	if s.drainCtx == nil {
+		s.drainCtx, s.drain = context.WithCancel(context.Background())
+	}
+	return s.drainCtx
+}
+
+// trackConn registers c as an active connection, returning false when
+// the server is shutting down and c should not be handled.
+func (s *ProxyServer) trackConn(c *proxyConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inShutdown {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*proxyConn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	c.ctx = s.drainContext()
+	s.handlers.Add(1)
+	return true
+}
+
+// untrackConn removes c from the active connections after its handler
+// has finished.
+func (s *ProxyServer) untrackConn(c *proxyConn) {
+	s.releaseLimit(c.limitIP)
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.stats.Closed++
+	s.stats.VictimBytes += uint64(c.counters.victim.Load())
+	s.stats.DownstreamBytes += uint64(c.counters.downstream.Load())
+	s.mu.Unlock()
+	s.handlers.Done()
+}
+
+// limit enforces ConnLimits on a newly accepted connection when the cfg
+// implements ConnLimiter.
+//
+// A non-nil error is returned when the connection is rejected, after the
+// rejection has been reported. Otherwise, ip is the victim IP that must
+// be passed to releaseLimit once the connection ends. ip is empty when
+// no limits are enforced.
+func (s *ProxyServer) limit(c net.Conn, pA Addr) (ip string, err error) {
+	cl, ok := s.getCfg().(ConnLimiter)
+	if !ok {
+		return
+	}
+	vA, err := getVictimAddr(c)
+	if err != nil {
+		// handle reports the error
+		return "", nil
+	}
+	if reason := s.limiter.acquire(vA.IP, cl.GetConnLimits()); reason != "" {
+		err = fmt.Errorf("connection rejected: %s", reason)
+		s.reject(pA, vA, reason)
+		return
+	}
+	return vA.IP, nil
+}
+
+// releaseLimit releases a connection slot acquired by limit.
+func (s *ProxyServer) releaseLimit(ip string) {
+	if ip != "" {
+		s.limiter.release(ip)
+	}
+}
+
+// reject reports a connection that was rejected before being handled.
+func (s *ProxyServer) reject(pA, vA Addr, reason string) {
+	s.updateStats(func(st *ServerStats) { st.Rejected++ })
+	cI := ConnInfo{Time: time.Now(), Victim: vA, Proxy: pA, Rejected: reason}
+	if lr, ok := s.getCfg().(LogReceiver); ok {
+		lr.RecvLog(LogRecord{Level: InfoLogLvl, Msg: "rejected connection", ConnInfo: cI})
+	}
+	if cir, ok := s.getCfg().(ConnInfoReceiver); ok {
+		cir.RecvConnEnd(cI)
+	}
+}
+
 func (s *ProxyServer) log(lvl, msg string, pA Addr, vA *Addr) {
-	if lr, ok := s.cfg.(LogReceiver); ok {
+	if lr, ok := s.getCfg().(LogReceiver); ok {
 		cI := ConnInfo{
 			Time:  time.Now(),
 			Proxy: pA,
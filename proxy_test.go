@@ -5,8 +5,14 @@ import (
 	"crypto/tls"
 	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
+	"io"
 	"net"
+	"os"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 var (
@@ -102,10 +108,491 @@ func TestProxyServer_Serve(t *testing.T) {
 				return
 			}
 			t.Logf("started listener on %s", s.l.Addr().String())
-			if err := s.Serve(tt.args.ctx); (err != nil) != tt.wantErr {
+			errC := make(chan error)
+			go func() { errC <- s.Serve(tt.args.ctx) }()
+			if err := s.Shutdown(context.Background()); err != nil {
+				t.Errorf("Shutdown() error = %v", err)
+			}
+			if err := <-errC; (err != nil) != tt.wantErr {
 				t.Errorf("Serve() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 	cancel()
 }
+
+// recordingCfg proxies cleartext connections to a downstream while
+// recording the events it receives.
+type recordingCfg struct {
+	downstream Addr
+	m          sync.Mutex
+	ends       int
+	ended      []ConnInfo
+	victimData []byte
+	dsData     []byte
+}
+
+func (c *recordingCfg) GetProxyTLSConfig(_ Addr, _ Addr, _ *Addr) (*tls.Config, error) {
+	return nil, errors.New("tls not supported")
+}
+
+func (c *recordingCfg) GetDownstreamTLSConfig(_ Addr, _ Addr, _ Addr) (*tls.Config, error) {
+	return nil, errors.New("tls not supported")
+}
+
+func (c *recordingCfg) GetDownstreamAddr(_ Addr, _ Addr) (*Addr, error) {
+	return &c.downstream, nil
+}
+
+func (c *recordingCfg) RecvConnStart(_ ConnInfo) {}
+
+func (c *recordingCfg) RecvConnEnd(cI ConnInfo) {
+	c.m.Lock()
+	c.ends++
+	c.ended = append(c.ended, cI)
+	c.m.Unlock()
+}
+
+func (c *recordingCfg) RecvVictimData(_ ConnInfo, b []byte) {
+	time.Sleep(10 * time.Millisecond) // slow receivers must still be drained
+	c.m.Lock()
+	c.victimData = append(c.victimData, b...)
+	c.m.Unlock()
+}
+
+func (c *recordingCfg) RecvDownstreamData(_ ConnInfo, b []byte) {
+	time.Sleep(10 * time.Millisecond)
+	c.m.Lock()
+	c.dsData = append(c.dsData, b...)
+	c.m.Unlock()
+}
+
+// startEchoServer starts a TCP server that echoes data back to clients
+// until the test ends.
+func startEchoServer(t *testing.T) Addr {
+	return startTestServer(t, func(c net.Conn) { io.Copy(c, c) })
+}
+
+// startTestServer starts a TCP server that passes each connection to
+// handle until the test ends.
+func startTestServer(t *testing.T, handle func(net.Conn)) Addr {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to start test listener", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				handle(c)
+			}()
+		}
+	}()
+	ip, port, _ := net.SplitHostPort(l.Addr().String())
+	return Addr{IP: ip, Port: port}
+}
+
+// roundTrip writes msg to c and reads n bytes in response.
+func roundTrip(t *testing.T, c net.Conn, msg string, n int) string {
+	buf := make([]byte, n)
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal("failed to write to proxy", err)
+	} else if _, err = io.ReadFull(c, buf); err != nil {
+		t.Fatal("failed to read from proxy", err)
+	}
+	return string(buf)
+}
+
+func TestProxyServer_Shutdown(t *testing.T) {
+	tests := []struct {
+		name        string
+		closeClient bool          // close the client after shutdown starts
+		timeout     time.Duration // time allowed for connections to drain
+		wantErr     error
+	}{
+		{name: "drained", closeClient: true, timeout: 5 * time.Second, wantErr: nil},
+		{name: "forced", closeClient: false, timeout: 100 * time.Millisecond, wantErr: context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &recordingCfg{downstream: startEchoServer(t)}
+			l, err := net.Listen("tcp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal("failed to start listener for server", err)
+			}
+			s := NewProxyServer(cfg, l)
+			errC := make(chan error)
+			go func() { errC <- s.Serve(context.Background()) }()
+
+			// relay data through the proxy
+			c, err := net.Dial("tcp4", l.Addr().String())
+			if err != nil {
+				t.Fatal("failed to connect to proxy", err)
+			}
+			defer c.Close()
+			msg := []byte("hello")
+			roundTrip(t, c, string(msg), len(msg))
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			if tt.closeClient {
+				time.AfterFunc(50*time.Millisecond, func() { c.Close() })
+			}
+			if err = s.Shutdown(ctx); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Shutdown() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			// events must be delivered by the time Shutdown returns
+			cfg.m.Lock()
+			defer cfg.m.Unlock()
+			if cfg.ends != 1 {
+				t.Errorf("Shutdown() RecvConnEnd calls = %d, want 1", cfg.ends)
+			}
+			if string(cfg.victimData) != string(msg) {
+				t.Errorf("Shutdown() victim data = %q, want %q", cfg.victimData, msg)
+			}
+			if string(cfg.dsData) != string(msg) {
+				t.Errorf("Shutdown() downstream data = %q, want %q", cfg.dsData, msg)
+			}
+			if s.ConnCount() != 0 {
+				t.Errorf("Shutdown() ConnCount = %d, want 0", s.ConnCount())
+			}
+			if err = <-errC; err != nil {
+				t.Errorf("Serve() error = %v", err)
+			}
+		})
+	}
+}
+
+// errListener returns queued errors from Accept before failing with
+// its final error.
+type errListener struct {
+	net.Listener
+	errs  []error
+	final error
+}
+
+func (l *errListener) Accept() (net.Conn, error) {
+	if len(l.errs) > 0 {
+		e := l.errs[0]
+		l.errs = l.errs[1:]
+		return nil, e
+	}
+	return nil, l.final
+}
+
+// logCounter counts the LogRecord events it receives by level.
+type logCounter struct {
+	Config
+	m      sync.Mutex
+	counts map[string]int
+}
+
+func (c *logCounter) RecvLog(r LogRecord) {
+	c.m.Lock()
+	c.counts[r.Level]++
+	c.m.Unlock()
+}
+
+func TestProxyServer_Serve_AcceptErrors(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	fatal := errors.New("fatal listener error")
+	tests := []struct {
+		name       string
+		errs       []error
+		final      error
+		wantErr    bool
+		wantErrors int // number of error log records
+	}{
+		{name: "temporary errors then closed", errs: []error{emfile, emfile, emfile}, final: net.ErrClosed, wantErr: false, wantErrors: 3},
+		{name: "fatal error", final: fatal, wantErr: true, wantErrors: 1},
+		{name: "temporary then fatal error", errs: []error{emfile}, final: fatal, wantErr: true, wantErrors: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal("failed to start listener for server", err)
+			}
+			defer inner.Close()
+			cfg := &logCounter{counts: make(map[string]int)}
+			l := &errListener{Listener: inner, errs: tt.errs, final: tt.final}
+			err = NewProxyServer(cfg, l).Serve(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Serve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if cfg.counts[ErrorLogLvl] != tt.wantErrors {
+				t.Errorf("Serve() error records = %d, want %d", cfg.counts[ErrorLogLvl], tt.wantErrors)
+			}
+		})
+	}
+}
+
+func TestProxyServer_SetCfg(t *testing.T) {
+	oldCfg := &recordingCfg{downstream: startEchoServer(t)}
+	newCfg := &recordingCfg{downstream: startTestServer(t, func(c net.Conn) {
+		io.ReadFull(c, make([]byte, 3))
+		c.Write([]byte("new"))
+	})}
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to start listener for server", err)
+	}
+	s := NewProxyServer(oldCfg, l)
+	go s.Serve(context.Background())
+	defer s.Shutdown(context.Background())
+
+	oldC, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal("failed to connect to proxy", err)
+	}
+	defer oldC.Close()
+	if got := roundTrip(t, oldC, "aaa", 3); got != "aaa" {
+		t.Errorf("roundTrip() before SetCfg = %q, want %q", got, "aaa")
+	}
+
+	s.SetCfg(newCfg)
+
+	// new connections use the new cfg
+	newC, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal("failed to connect to proxy", err)
+	}
+	defer newC.Close()
+	if got := roundTrip(t, newC, "bbb", 3); got != "new" {
+		t.Errorf("roundTrip() after SetCfg = %q, want %q", got, "new")
+	}
+
+	// active connections continue using the old cfg
+	if got := roundTrip(t, oldC, "ccc", 3); got != "ccc" {
+		t.Errorf("roundTrip() on active connection = %q, want %q", got, "ccc")
+	}
+}
+
+func TestProxyServer_KillConn(t *testing.T) {
+	cfg := &recordingCfg{downstream: startEchoServer(t)}
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to start listener for server", err)
+	}
+	s := NewProxyServer(cfg, l)
+	go s.Serve(context.Background())
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal("failed to connect to proxy", err)
+	}
+	defer c.Close()
+	roundTrip(t, c, "aaa", 3)
+
+	// counters are updated after relayed writes return, so allow them
+	// a moment to settle
+	var conns []ConnStats
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if conns = s.Conns(); len(conns) == 1 && conns[0].VictimBytes == 3 {
+			break
+		}
+	}
+	if len(conns) != 1 {
+		t.Fatalf("Conns() returned %d connections, want 1", len(conns))
+	}
+	if cs := conns[0]; cs.ID == 0 || cs.Downstream == nil || cs.VictimBytes != 3 || cs.DownstreamBytes != 3 {
+		t.Errorf("Conns()[0] = %+v, want non-zero ID, downstream, and 3 bytes each way", cs)
+	}
+
+	if s.KillConn(conns[0].ID + 1) {
+		t.Error("KillConn() = true for unknown id")
+	}
+	if !s.KillConn(conns[0].ID) {
+		t.Fatal("KillConn() = false for active connection")
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("connection remained open after KillConn")
+	}
+}
+
+func TestProxyServer_ALPN(t *testing.T) {
+	crt, err := GenSelfSignedCert(pkix.Name{Organization: []string{"Test Org"}},
+		[]net.IP{net.ParseIP("127.0.0.1")}, []string{"localhost"}, nil)
+	if err != nil {
+		t.Fatal("failed to generate certificate", err)
+	}
+
+	tests := []struct {
+		name       string
+		offered    []string // by the victim
+		downstream []string // supported by the downstream
+		want       string
+	}{
+		{name: "h2", offered: []string{"h2", "http/1.1"}, downstream: []string{"h2", "http/1.1"}, want: "h2"},
+		{name: "downstream without h2", offered: []string{"h2", "http/1.1"}, downstream: []string{"http/1.1"},
+			want: "http/1.1"},
+		{name: "downstream without alpn", offered: []string{"h2", "http/1.1"}},
+		{name: "victim without alpn", downstream: []string{"h2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsCfg := &tls.Config{Certificates: []tls.Certificate{*crt}, NextProtos: tt.downstream}
+			ds := startTestServer(t, func(c net.Conn) {
+				tC := tls.Server(c, dsCfg)
+				if tC.Handshake() != nil {
+					return
+				}
+				io.WriteString(tC, tC.ConnectionState().NegotiatedProtocol+"\n")
+				io.Copy(tC, tC)
+			})
+			l, err := net.Listen("tcp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal("failed to start listener for server", err)
+			}
+			s := NewProxyServer(tlsCfg{recordingCfg: &recordingCfg{downstream: ds}, crt: crt}, l)
+			go s.Serve(context.Background())
+			defer s.Shutdown(context.Background())
+
+			c, err := tls.Dial("tcp4", l.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: tt.offered})
+			if err != nil {
+				t.Fatal("failed to connect to proxy", err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+
+			if got := c.ConnectionState().NegotiatedProtocol; got != tt.want {
+				t.Errorf("victim negotiated %q, want %q", got, tt.want)
+			}
+			// the downstream reports the protocol it negotiated with the proxy
+			if got, want := roundTrip(t, c, "x", len(tt.want)+2), tt.want+"\nx"; got != want {
+				t.Errorf("downstream response = %q, want %q", got, want)
+			}
+			if conns := s.Conns(); len(conns) != 1 || conns[0].ALPN != tt.want {
+				t.Errorf("Conns() = %+v, want one connection with alpn %q", conns, tt.want)
+			}
+		})
+	}
+}
+
+// filterCfg applies action to every connection.
+type filterCfg struct {
+	*recordingCfg
+	action       ConnAction
+	noDownstream bool
+}
+
+func (c filterCfg) GetDownstreamAddr(_ Addr, _ Addr) (*Addr, error) {
+	if c.noDownstream {
+		return nil, nil
+	}
+	return &c.downstream, nil
+}
+
+func (c filterCfg) FilterConn(_ Addr, _ Addr, _ *Addr, _ *ClientHello) ConnAction {
+	return c.action
+}
+
+func TestProxyServer_FilterConn(t *testing.T) {
+	tests := []struct {
+		name         string
+		action       ConnAction
+		noDownstream bool
+		wantRejected string
+		wantCaptured string
+	}{
+		{name: "intercept", action: InterceptConn, wantCaptured: "abc"},
+		{name: "passthrough", action: PassthroughConn},
+		{name: "reject", action: RejectConn, wantRejected: RejectFilter},
+		{name: "passthrough without downstream", action: PassthroughConn, noDownstream: true,
+			wantRejected: RejectFilter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recordingCfg{downstream: startEchoServer(t)}
+			l, err := net.Listen("tcp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal("failed to start listener for server", err)
+			}
+			s := NewProxyServer(filterCfg{recordingCfg: rec, action: tt.action, noDownstream: tt.noDownstream}, l)
+			go s.Serve(context.Background())
+			defer s.Shutdown(context.Background())
+
+			c, err := net.Dial("tcp4", l.Addr().String())
+			if err != nil {
+				t.Fatal("failed to connect to proxy", err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			if tt.wantRejected == "" {
+				if got := roundTrip(t, c, "abc", 3); got != "abc" {
+					t.Errorf("response = %q, want abc", got)
+				}
+			} else if _, err = c.Write([]byte("abc")); err != nil {
+				t.Fatal("failed to write to proxy", err)
+			} else if _, err = c.Read(make([]byte, 1)); err == nil {
+				t.Error("rejected connection was not closed")
+			}
+			c.Close()
+
+			victim, _ := capturedData(rec, 1)
+			if victim != tt.wantCaptured {
+				t.Errorf("victim data = %q, want %q", victim, tt.wantCaptured)
+			}
+			rec.m.Lock()
+			defer rec.m.Unlock()
+			if len(rec.ended) != 1 || rec.ended[0].Rejected != tt.wantRejected {
+				t.Errorf("ended connections = %+v, want one rejected for %q", rec.ended, tt.wantRejected)
+			}
+		})
+	}
+}
+
+// timedRecv is a TimedDataReceiver that records capture times.
+type timedRecv struct {
+	m        sync.Mutex
+	captured []time.Time
+	untimed  int // calls to the DataReceiver methods
+}
+
+func (r *timedRecv) RecvVictimData(ConnInfo, []byte)     { r.untimed++ }
+func (r *timedRecv) RecvDownstreamData(ConnInfo, []byte) { r.untimed++ }
+
+func (r *timedRecv) RecvVictimDataAt(_ ConnInfo, captured time.Time, _ []byte) {
+	time.Sleep(10 * time.Millisecond) // delivery trails capture
+	r.m.Lock()
+	r.captured = append(r.captured, captured)
+	r.m.Unlock()
+}
+
+func (r *timedRecv) RecvDownstreamDataAt(cI ConnInfo, captured time.Time, b []byte) {
+	r.RecvVictimDataAt(cI, captured, b)
+}
+
+func TestDataQueue_TimedDataReceiver(t *testing.T) {
+	r := new(timedRecv)
+	q := newDataQueue(r)
+	start := time.Now()
+	for i := range 3 {
+		q.push(ConnInfo{ID: 1}, i%2 == 0, []byte("abc"))
+	}
+	pushed := time.Now()
+	q.close()
+
+	if r.untimed != 0 {
+		t.Errorf("DataReceiver methods were called %d times, want 0", r.untimed)
+	}
+	if len(r.captured) != 3 {
+		t.Fatalf("received %d events, want 3", len(r.captured))
+	}
+	for i, c := range r.captured {
+		if c.Before(start) || c.After(pushed) {
+			t.Errorf("event %d captured at %s, want the time it was pushed (%s to %s)", i, c, start, pushed)
+		}
+	}
+}
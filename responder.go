@@ -0,0 +1,224 @@
+package gosplit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"time"
+)
+
+const (
+	// defaultResponderIdleTimeout is used when ScriptedResponder.IdleTimeout
+	// is zero.
+	defaultResponderIdleTimeout = 30 * time.Second
+	// maxResponderMsgLen is the number of bytes buffered while waiting for
+	// a complete ScriptedResponder message before the buffer is treated as
+	// one.
+	maxResponderMsgLen = 64 << 10
+	// responderPeekTimeout is how long victims of connections handled by a
+	// Responder are given to initiate a TLS handshake before the Responder
+	// is started, allowing servers to speak first.
+	responderPeekTimeout = time.Second
+)
+
+type (
+	// Responder plays the role of a server for connections that have no
+	// downstream, allowing data sent by victims during multi-turn
+	// exchanges to be captured.
+	Responder interface {
+		// Respond converses with the victim until the exchange is complete.
+		//
+		// conn is the victim connection, after TLS has been terminated when
+		// the victim initiated a handshake. Data read from conn is sent to
+		// DataReceiver as victim data and data written to it is sent as
+		// downstream data. conn is closed after Respond returns.
+		//
+		// ctx is done when the proxy server is shutting down.
+		Respond(ctx context.Context, conn net.Conn) error
+	}
+
+	// ResponderGetter allows implementors to respond to victims of
+	// connections that have no downstream instead of capturing only the
+	// initial data they send.
+	ResponderGetter interface {
+		// GetResponder returns the Responder for a connection without a
+		// downstream, or nil to capture only the initial data.
+		GetResponder(victim Addr, proxy Addr) Responder
+	}
+
+	// ScriptedResponder is a Responder that sends canned responses to the
+	// messages sent by victims, e.g., to play an SMTP server that accepts
+	// any credentials.
+	ScriptedResponder struct {
+		// Greeting is sent upon connection, before any messages are read.
+		Greeting string
+		// Delimiter marks the end of each message sent by the victim,
+		// e.g., "\n" for line based protocols. Each read is treated as
+		// a message when empty.
+		Delimiter string
+		// MessageLen, when set, returns the length of a message given
+		// its data through the first Delimiter, allowing messages to
+		// continue past it, e.g., an HTTP request with a body of
+		// Content-Length bytes. Values shorter than head are ignored.
+		MessageLen func(head []byte) int
+		// Rules determine the response to each message. The first rule
+		// matching a message is applied.
+		Rules []ResponderRule
+		// Default is sent in response to messages that match no rule.
+		// Nothing is sent when it is empty.
+		Default string
+		// IdleTimeout is how long to wait for the victim to send a
+		// message before closing the connection. Defaults to 30 seconds.
+		IdleTimeout time.Duration
+		// MaxMessages is the number of messages to respond to before
+		// closing the connection. Zero allows an unlimited number.
+		MaxMessages int
+	}
+
+	// ResponderRule is a canned response sent by ScriptedResponder.
+	ResponderRule struct {
+		// State the responder must be in for the rule to apply. Responders
+		// begin in the empty state.
+		State string
+		// Match must match the message for the rule to apply. Rules with
+		// a nil Match match any message.
+		Match *regexp.Regexp
+		// Response sent to the victim. Submatches of Match can be
+		// referenced as described by regexp.Regexp.Expand, e.g., "$1".
+		Response string
+		// Next is the state the responder enters after responding.
+		Next string
+		// Close the connection after responding.
+		Close bool
+	}
+
+	// responderConn passes data to a dataQueue when cfg implements
+	// DataReceiver, allowing implementors to receive data exchanged
+	// between a victim and a Responder.
+	responderConn struct {
+		net.Conn
+		dq       *dataQueue // nil when cfg does not implement DataReceiver
+		connInfo ConnInfo
+		counters *connCounters
+	}
+)
+
+// Read from the connection.
+//
+// Note: This is the victim side of the connection.
+func (c *responderConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.dq.push(c.connInfo, true, b[:n])
+	c.counters.victim.Add(int64(n))
+	return
+}
+
+// Write to the connection.
+//
+// Note: This is the Responder side of the connection.
+func (c *responderConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	c.dq.push(c.connInfo, false, b[:n])
+	c.counters.downstream.Add(int64(n))
+	return
+}
+
+// Respond implements Responder.
+//
+// The connection is closed without error when the victim closes it or
+// is idle for IdleTimeout.
+func (r *ScriptedResponder) Respond(ctx context.Context, conn net.Conn) (err error) {
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	if r.Greeting != "" {
+		if _, err = io.WriteString(conn, r.Greeting); err != nil {
+			return fmt.Errorf("error sending greeting: %w", err)
+		}
+	}
+	idle := r.IdleTimeout
+	if idle <= 0 {
+		idle = defaultResponderIdleTimeout
+	}
+
+	var (
+		buf, msg []byte
+		state    string
+		count    int
+		b        = make([]byte, 4096)
+	)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idle))
+		n, rErr := conn.Read(b)
+		buf = append(buf, b[:n]...)
+		for {
+			if msg, buf = r.nextMsg(buf); msg == nil {
+				break
+			}
+			resp, rule := r.respond(state, msg)
+			if len(resp) > 0 {
+				if _, err = conn.Write(resp); err != nil {
+					return fmt.Errorf("error sending response: %w", err)
+				}
+			}
+			count++
+			if rule != nil {
+				state = rule.Next
+				if rule.Close {
+					return nil
+				}
+			}
+			if r.MaxMessages > 0 && count >= r.MaxMessages {
+				return nil
+			}
+		}
+		if rErr != nil {
+			var nErr net.Error
+			if errors.Is(rErr, io.EOF) || errors.Is(rErr, io.ErrClosedPipe) || errors.Is(rErr, net.ErrClosed) ||
+				(errors.As(rErr, &nErr) && nErr.Timeout()) {
+				return nil
+			}
+			return rErr
+		}
+	}
+}
+
+// nextMsg returns the first complete message in buf, along with the
+// remaining data. msg is nil when buf contains no complete message.
+func (r *ScriptedResponder) nextMsg(buf []byte) (msg, rest []byte) {
+	if len(buf) == 0 {
+		return nil, buf
+	} else if r.Delimiter == "" || len(buf) >= maxResponderMsgLen {
+		return buf, nil
+	} else if i := bytes.Index(buf, []byte(r.Delimiter)); i >= 0 {
+		i += len(r.Delimiter)
+		if r.MessageLen != nil {
+			if i = max(i, r.MessageLen(buf[:i:i])); i > len(buf) {
+				// the remainder of the message has yet to be received
+				return nil, buf
+			}
+		}
+		return buf[:i:i], buf[i:]
+	}
+	return nil, buf
+}
+
+// respond returns the response to msg, along with the rule that
+// produced it. rule is nil when Default was used.
+func (r *ScriptedResponder) respond(state string, msg []byte) (resp []byte, rule *ResponderRule) {
+	for i := range r.Rules {
+		rule = &r.Rules[i]
+		if rule.State != state {
+			continue
+		} else if rule.Match == nil {
+			return []byte(rule.Response), rule
+		} else if m := rule.Match.FindSubmatchIndex(msg); m != nil {
+			return rule.Match.Expand(nil, []byte(rule.Response), msg, m), rule
+		}
+	}
+	return []byte(r.Default), nil
+}
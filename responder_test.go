@@ -0,0 +1,208 @@
+package gosplit
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"io"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// responderCfg is a recordingCfg without a downstream that converses
+// with victims using r, intercepting TLS connections using crt.
+type responderCfg struct {
+	*recordingCfg
+	r   Responder
+	crt *tls.Certificate
+}
+
+func (c responderCfg) GetProxyTLSConfig(_ Addr, _ Addr, _ *Addr) (*tls.Config, error) {
+	return &tls.Config{Certificates: []tls.Certificate{*c.crt}}, nil
+}
+
+func (c responderCfg) GetDownstreamAddr(_ Addr, _ Addr) (*Addr, error) {
+	return nil, nil
+}
+
+func (c responderCfg) GetResponder(_ Addr, _ Addr) Responder {
+	return c.r
+}
+
+func TestScriptedResponder_Respond(t *testing.T) {
+	smtp := &ScriptedResponder{
+		Greeting:  "220 ready\r\n",
+		Delimiter: "\n",
+		Rules: []ResponderRule{
+			{Match: regexp.MustCompile(`^AUTH LOGIN`), Response: "334 user\r\n", Next: "user"},
+			{State: "user", Response: "334 pass\r\n", Next: "pass"},
+			{State: "pass", Response: "235 ok\r\n"},
+			{Match: regexp.MustCompile(`^QUIT`), Response: "221 bye\r\n", Close: true},
+		},
+		Default: "250 ok\r\n",
+	}
+	tests := []struct {
+		name       string
+		r          *ScriptedResponder
+		greeting   string
+		exchanges  [][2]string // sent by the victim, expected response
+		wantClosed bool        // responder closes the connection
+	}{
+		{name: "stateful", r: smtp, greeting: "220 ready\r\n", exchanges: [][2]string{
+			{"EHLO x\r\n", "250 ok\r\n"},
+			{"AUTH LOGIN\r\n", "334 user\r\n"},
+			{"dXNlcg==\r\n", "334 pass\r\n"},
+			{"cGFzcw==\r\n", "235 ok\r\n"},
+			{"NOOP\r\n", "250 ok\r\n"},
+		}},
+		{name: "pipelined", r: smtp, greeting: "220 ready\r\n", exchanges: [][2]string{
+			{"EHLO x\r\nNOOP\r\n", "250 ok\r\n250 ok\r\n"},
+		}},
+		{name: "partial message", r: smtp, greeting: "220 ready\r\n", exchanges: [][2]string{
+			{"EH", ""},
+			{"LO x\r\n", "250 ok\r\n"},
+		}},
+		{name: "close", r: smtp, greeting: "220 ready\r\n", wantClosed: true, exchanges: [][2]string{
+			{"QUIT\r\n", "221 bye\r\n"},
+		}},
+		{name: "submatch", r: &ScriptedResponder{Delimiter: "\n", Rules: []ResponderRule{
+			{Match: regexp.MustCompile(`^(\S+) LOGIN`), Response: "${1} OK\r\n"},
+		}}, exchanges: [][2]string{
+			{"a1 LOGIN user pass\r\n", "a1 OK\r\n"},
+		}},
+		{name: "message length", r: &ScriptedResponder{Delimiter: "\n\n", Default: "ok\n",
+			// the header is followed by as many bytes as its first line
+			MessageLen: func(head []byte) int { return 2 * len(head) }},
+			exchanges: [][2]string{
+				{"a\n\n", ""},
+				{"\n\n\n", "ok\n"},
+				{"b\n\nxyzc\n\n", "ok\n"},
+				{"xyz", "ok\n"},
+			}},
+		{name: "max messages", r: &ScriptedResponder{Default: "ok", MaxMessages: 1}, wantClosed: true,
+			exchanges: [][2]string{
+				{"hello", "ok"},
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			victim, server := net.Pipe()
+			defer victim.Close()
+			errC := make(chan error, 1)
+			go func() {
+				defer server.Close()
+				errC <- tt.r.Respond(context.Background(), server)
+			}()
+
+			victim.SetDeadline(time.Now().Add(5 * time.Second))
+			read := func(n int) string {
+				b := make([]byte, n)
+				if _, err := io.ReadFull(victim, b); err != nil {
+					t.Fatal("failed to read response", err)
+				}
+				return string(b)
+			}
+			if got := read(len(tt.greeting)); got != tt.greeting {
+				t.Errorf("greeting = %q, want %q", got, tt.greeting)
+			}
+			for _, e := range tt.exchanges {
+				if _, err := victim.Write([]byte(e[0])); err != nil {
+					t.Fatal("failed to write message", err)
+				}
+				if got := read(len(e[1])); got != e[1] {
+					t.Errorf("response to %q = %q, want %q", e[0], got, e[1])
+				}
+			}
+			if !tt.wantClosed {
+				victim.Close()
+			} else if _, err := victim.Read(make([]byte, 1)); err == nil {
+				t.Error("connection remained open")
+			}
+			if err := <-errC; err != nil {
+				t.Errorf("Respond() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestProxyServer_Responder(t *testing.T) {
+	crt, err := GenSelfSignedCert(pkix.Name{Organization: []string{"Test Org"}},
+		[]net.IP{net.ParseIP("127.0.0.1")}, []string{"localhost"}, nil)
+	if err != nil {
+		t.Fatal("failed to generate certificate", err)
+	}
+	r := &ScriptedResponder{
+		Greeting:  "220 ready\r\n",
+		Delimiter: "\n",
+		Rules: []ResponderRule{
+			{Match: regexp.MustCompile(`^USER`), Response: "331 password\r\n"},
+			{Match: regexp.MustCompile(`^PASS`), Response: "230 ok\r\n", Close: true},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		tls      bool
+		greeting string // expected before the victim sends anything
+	}{
+		{name: "server first", greeting: "220 ready\r\n"},
+		// the victim sends the first message, so the greeting is read
+		// along with the first response
+		{name: "tls", tls: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recordingCfg{}
+			l, err := net.Listen("tcp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal("failed to start listener for server", err)
+			}
+			s := NewProxyServer(responderCfg{recordingCfg: rec, r: r, crt: crt}, l)
+			go s.Serve(context.Background())
+			defer s.Shutdown(context.Background())
+
+			var c net.Conn
+			if c, err = net.Dial("tcp4", l.Addr().String()); err != nil {
+				t.Fatal("failed to connect to proxy", err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+
+			if tt.tls {
+				c = tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+			} else if got := roundTrip(t, c, "", len(tt.greeting)); got != tt.greeting {
+				t.Errorf("greeting = %q, want %q", got, tt.greeting)
+			}
+			want := "220 ready\r\n331 password\r\n"[len(tt.greeting):]
+			if got := roundTrip(t, c, "USER a\r\n", len(want)); got != want {
+				t.Errorf("response to USER = %q, want %q", got, want)
+			}
+			if got := roundTrip(t, c, "PASS b\r\n", 8); got != "230 ok\r\n" {
+				t.Errorf("response to PASS = %q, want %q", got, "230 ok\r\n")
+			}
+			if _, err = c.Read(make([]byte, 1)); err == nil {
+				t.Error("connection remained open")
+			}
+
+			// data is delivered before the connection ends
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				rec.m.Lock()
+				ends := rec.ends
+				rec.m.Unlock()
+				if ends == 1 {
+					break
+				}
+			}
+			rec.m.Lock()
+			defer rec.m.Unlock()
+			if got, want := string(rec.victimData), "USER a\r\nPASS b\r\n"; got != want {
+				t.Errorf("victim data = %q, want %q", got, want)
+			}
+			if got, want := string(rec.dsData), "220 ready\r\n331 password\r\n230 ok\r\n"; got != want {
+				t.Errorf("downstream data = %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package gosplit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// upgradePeekTimeout is how long victims of connections handled by an
+	// Upgrader are given to initiate a TLS handshake before the Upgrader
+	// is started, allowing servers to speak first.
+	upgradePeekTimeout = time.Second
+	// maxPatternBuffer bounds the data matched by PatternStartTLS.
+	maxPatternBuffer = 4096
+)
+
+type (
+	// Upgrader negotiates an upgrade to TLS in cleartext on behalf of the
+	// victim and downstream, e.g., LDAP's StartTLS extended operation,
+	// after which the proxy intercepts the TLS handshakes.
+	Upgrader interface {
+		// Upgrade relays the cleartext exchange between the victim and
+		// downstream until both have agreed to upgrade to TLS, returning
+		// true when the TLS handshakes should begin. The remainder of the
+		// connection is relayed in cleartext when false is returned.
+		//
+		// Data written to victim is sent to DataReceiver as downstream
+		// data and data written to downstream is sent as victim data.
+		// Upgrade must not read data sent after the negotiation, e.g.,
+		// the victim's ClientHello, so reads must not be buffered beyond
+		// the messages being relayed. The connections are buffered,
+		// making small reads inexpensive, and implement Peek and Buffered
+		// as bufio.Reader does, allowing data to be inspected before it
+		// is read.
+		//
+		// Deadlines set on the connections are reset after Upgrade
+		// returns, and ctx is done when the proxy server is shutting
+		// down.
+		Upgrade(ctx context.Context, victim, downstream net.Conn) (bool, error)
+	}
+
+	// UpgraderGetter allows implementors to intercept connections that
+	// negotiate TLS after exchanging cleartext, which would otherwise be
+	// relayed without interception.
+	UpgraderGetter interface {
+		// GetUpgrader returns the Upgrader for a connection that did not
+		// begin with a TLS handshake, or nil to relay it as is.
+		GetUpgrader(victim Addr, proxy Addr, downstream Addr) Upgrader
+	}
+
+	// RelayWrapper may be implemented by Upgraders that take part in
+	// connections after negotiating upgrades, e.g., to rewrite the
+	// addresses of data connections announced over FTP control
+	// connections.
+	RelayWrapper interface {
+		// WrapDownstream returns the reader that data sent by the
+		// downstream is relayed to the victim from. r returns the data
+		// as sent by the downstream, after it has been captured.
+		//
+		// WrapDownstream is called once for each connection relayed to a
+		// downstream returned by GetUpgrader, including those that began
+		// with a TLS handshake or that weren't upgraded. l opens
+		// listeners for connections related to the connection.
+		WrapDownstream(cI ConnInfo, l ConnLinker, r io.Reader) io.Reader
+	}
+
+	// PatternStartTLS is an Upgrader for text protocols that upgrade to
+	// TLS when the victim sends a command that the downstream accepts,
+	// allowing such protocols to be intercepted without implementing an
+	// Upgrader, e.g., for NNTP:
+	//
+	//	PatternStartTLS{
+	//		Trigger:     regexp.MustCompile(`(?mi)^STARTTLS\r?\n`),
+	//		Accept:      regexp.MustCompile(`(?m)^382`),
+	//		ServerFirst: true,
+	//	}
+	PatternStartTLS struct {
+		// Trigger matches the data sent by the victim to request the
+		// upgrade.
+		Trigger *regexp.Regexp
+		// Accept matches the downstream's reply accepting the upgrade.
+		// Replies ending with a line break or the end of an XML element,
+		// e.g., XMPP's <failure/>, that don't match are treated as
+		// refusals, after which the connection is relayed in cleartext.
+		Accept *regexp.Regexp
+		// ServerFirst indicates that the downstream speaks first, e.g.,
+		// by sending a greeting, delaying reads from the victim until it
+		// has.
+		ServerFirst bool
+	}
+
+	// upgradeReader reads from a connection in a routine, one read at a
+	// time as requested, so that reads are never made beyond the
+	// negotiation of an upgrade.
+	upgradeReader struct {
+		conn net.Conn
+		req  chan struct{}
+		c    chan upgradeRead
+	}
+
+	// upgradeRead is the result of a read made by an upgradeReader.
+	upgradeRead struct {
+		b   []byte
+		err error
+	}
+
+	// upgradeConn passes data written to it to a dataQueue when cfg
+	// implements DataReceiver, allowing implementors to receive data
+	// exchanged while an Upgrader negotiates TLS.
+	upgradeConn struct {
+		net.Conn
+		dq       *dataQueue // nil when cfg does not implement DataReceiver
+		connInfo ConnInfo
+		counter  *atomic.Int64
+		victim   bool // data written was sent by the victim
+	}
+)
+
+// Write to the connection.
+func (c *upgradeConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	c.dq.push(c.connInfo, c.victim, b[:n])
+	c.counter.Add(int64(n))
+	return
+}
+
+// Peek returns the next n bytes without reading them.
+func (c *upgradeConn) Peek(n int) ([]byte, error) {
+	return c.Conn.(*peekConn).Peek(n)
+}
+
+// Buffered returns the number of bytes that can be peeked at without
+// reading from the connection.
+func (c *upgradeConn) Buffered() int {
+	return c.Conn.(*peekConn).Buffered()
+}
+
+// upgrade passes the victim and downstream connections to an Upgrader,
+// then intercepts the TLS handshakes it negotiated. False is returned
+// when the connection should be closed.
+func (c *proxyConn) upgrade(connTime time.Time, u Upgrader) bool {
+	cI := ConnInfo{Time: connTime}
+	cI.fill(c)
+	dPeek := &peekConn{Conn: c.downstream, buf: bufio.NewReader(c.downstream)}
+	c.downstream = dPeek
+	vC := &upgradeConn{Conn: c.Conn, dq: c.dq, connInfo: cI, counter: &c.counters.downstream}
+	dC := &upgradeConn{Conn: dPeek, dq: c.dq, connInfo: cI, counter: &c.counters.victim, victim: true}
+
+	c.log(DebugLogLvl, "negotiating tls upgrade")
+	stop := context.AfterFunc(c.ctx, func() {
+		c.Conn.SetDeadline(time.Now())
+		dPeek.SetDeadline(time.Now())
+	})
+	ok, err := u.Upgrade(c.ctx, vC, dC)
+	stop()
+	if c.ctx.Err() != nil {
+		c.log(DebugLogLvl, "proxy server is shutting down; abandoning connection")
+		return false
+	} else if err != nil {
+		c.log(ErrorLogLvl, fmt.Sprintf("failed to negotiate tls upgrade: %s", err))
+		return false
+	}
+	c.Conn.SetDeadline(time.Time{})
+	dPeek.SetDeadline(time.Time{})
+	if !ok {
+		c.log(DebugLogLvl, "tls upgrade not negotiated; relaying cleartext")
+		return true
+	}
+
+	// the victim's hello determines the protocols offered to the
+	// downstream
+	c.Conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // TODO deadline configurable
+	if peek, err := c.Conn.(*peekConn).Peek(tlsRecordHeaderLen); err != nil {
+		c.log(ErrorLogLvl, fmt.Sprintf("failure checking upgraded victim connection for tls: %s", err))
+		return false
+	} else if !isHandshake(peek) {
+		c.log(ErrorLogLvl, "victim did not initiate a tls handshake after upgrading")
+		return false
+	} else if c.hello, err = c.peekHello(); err != nil {
+		c.log(DebugLogLvl, fmt.Sprintf("failed to parse client hello: %s", err))
+	}
+	c.publish()
+
+	var alpn []string
+	if c.hello != nil {
+		alpn = c.hello.ALPN
+	}
+	tC, err := c.handshakeDownstream(dPeek, alpn)
+	if err != nil {
+		c.log(ErrorLogLvl, err.Error())
+		return false
+	}
+	c.downstream = tC
+	if err = c.handshakeVictim(true, tC.ConnectionState().NegotiatedProtocol); err != nil {
+		c.log(ErrorLogLvl, err.Error())
+		return false
+	}
+	c.Conn.SetReadDeadline(time.Time{})
+	c.log(DebugLogLvl, "upgraded connection to tls")
+	return true
+}
+
+// Upgrade implements Upgrader.
+func (u PatternStartTLS) Upgrade(_ context.Context, victim, downstream net.Conn) (bool, error) {
+	if u.Trigger == nil || u.Accept == nil {
+		return false, errors.New("trigger and accept patterns are required")
+	}
+	vR, dR := newUpgradeReader(victim), newUpgradeReader(downstream)
+	defer vR.stop()
+	defer dR.stop()
+	dR.next()
+	if !u.ServerFirst {
+		vR.next()
+	}
+
+	var (
+		sent, reply []byte // retained for matching
+		triggered   bool   // the victim requested the upgrade
+		greeted     bool   // the downstream has spoken
+	)
+	for {
+		select {
+		case r := <-vR.c:
+			if len(r.b) > 0 {
+				sent = appendTail(sent, r.b, maxPatternBuffer)
+				triggered = u.Trigger.Match(sent)
+				if _, err := downstream.Write(r.b); err != nil {
+					return false, fmt.Errorf("error relaying victim data: %w", err)
+				}
+			}
+			if r.err != nil {
+				return false, fmt.Errorf("error reading victim data: %w", r.err)
+			} else if !triggered {
+				vR.next()
+			}
+		case r := <-dR.c:
+			if len(r.b) > 0 {
+				if _, err := victim.Write(r.b); err != nil {
+					return false, fmt.Errorf("error relaying downstream data: %w", err)
+				}
+			}
+			if r.err != nil {
+				return false, fmt.Errorf("error reading downstream data: %w", r.err)
+			} else if u.ServerFirst && !greeted {
+				greeted = true
+				vR.next()
+			}
+			if triggered {
+				reply = appendTail(reply, r.b, maxPatternBuffer)
+				if u.Accept.Match(reply) {
+					return true, nil
+				} else if end := bytes.TrimRight(reply, " \t"); bytes.HasSuffix(end, []byte("\n")) ||
+					bytes.HasSuffix(end, []byte(">")) {
+					return false, nil
+				}
+			}
+			dR.next()
+		}
+	}
+}
+
+// appendTail appends b to buf, discarding the beginning of buf when it
+// exceeds n bytes.
+func appendTail(buf, b []byte, n int) []byte {
+	buf = append(buf, b...)
+	if len(buf) > n {
+		buf = append([]byte(nil), buf[len(buf)-n:]...)
+	}
+	return buf
+}
+
+func newUpgradeReader(conn net.Conn) *upgradeReader {
+	r := &upgradeReader{conn: conn, req: make(chan struct{}), c: make(chan upgradeRead, 1)}
+	go func() {
+		for range r.req {
+			b := make([]byte, maxPatternBuffer)
+			n, err := r.conn.Read(b)
+			r.c <- upgradeRead{b: b[:n], err: err}
+		}
+	}()
+	return r
+}
+
+// next requests a read, the result of which is sent to r.c.
+//
+// Note: the result of the previous read must have been received.
+func (r *upgradeReader) next() {
+	r.req <- struct{}{}
+}
+
+// stop the routine once any pending read completes.
+func (r *upgradeReader) stop() {
+	close(r.req)
+}
@@ -0,0 +1,328 @@
+package gosplit
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// upgradeCfg is a tlsCfg that negotiates upgrades to TLS using u.
+type upgradeCfg struct {
+	tlsCfg
+	u Upgrader
+}
+
+func (c upgradeCfg) GetUpgrader(_ Addr, _ Addr, _ Addr) Upgrader {
+	return c.u
+}
+
+// startUpgradeProxy starts a proxy server that negotiates upgrades using
+// u with a downstream that passes connections to handle, returning a
+// connection to the proxy and the cfg recording the data it captures.
+func startUpgradeProxy(t *testing.T, crt *tls.Certificate, u Upgrader, handle func(net.Conn)) (net.Conn, *recordingCfg) {
+	rec := &recordingCfg{downstream: startTestServer(t, handle)}
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to start listener for server", err)
+	}
+	s := NewProxyServer(upgradeCfg{tlsCfg: tlsCfg{recordingCfg: rec, crt: crt}, u: u}, l)
+	go s.Serve(context.Background())
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+
+	c, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal("failed to connect to proxy", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c, rec
+}
+
+// capturedData waits for n connections recorded by rec to end, then
+// returns the data captured from each side.
+func capturedData(rec *recordingCfg, n int) (victim string, downstream string) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		rec.m.Lock()
+		ends := rec.ends
+		rec.m.Unlock()
+		if ends == n {
+			break
+		}
+	}
+	rec.m.Lock()
+	defer rec.m.Unlock()
+	return string(rec.victimData), string(rec.dsData)
+}
+
+// upgradeTestCert generates the certificate presented by the proxy and
+// downstreams.
+func upgradeTestCert(t *testing.T) *tls.Certificate {
+	crt, err := GenSelfSignedCert(pkix.Name{Organization: []string{"Test Org"}},
+		[]net.IP{net.ParseIP("127.0.0.1")}, []string{"localhost"}, nil)
+	if err != nil {
+		t.Fatal("failed to generate certificate", err)
+	}
+	return crt
+}
+
+// upgradeTestHandshake upgrades the victim's connection to the proxy.
+func upgradeTestHandshake(t *testing.T, c net.Conn) net.Conn {
+	tC := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	if err := tC.Handshake(); err != nil {
+		t.Fatal("tls handshake with proxy failed", err)
+	}
+	return tC
+}
+
+// prefixConn sends prefix along with the first write, e.g., so that
+// cleartext and a ClientHello are read together.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Write(b []byte) (int, error) {
+	if p := c.prefix; p != nil {
+		c.prefix = nil
+		n, err := c.Conn.Write(append(p, b...))
+		return max(n-len(p), 0), err
+	}
+	return c.Conn.Write(b)
+}
+
+// upgradeStep is data exchanged by a victim and downstream.
+type upgradeStep struct {
+	victim  bool // sent by the victim rather than the downstream
+	data    string
+	relayed string // received by the peer when it differs from data
+	tls     bool   // both legs are upgraded to tls after the step
+	hello   bool   // victim data is sent along with the ClientHello
+}
+
+func TestUpgraders(t *testing.T) {
+	crt := upgradeTestCert(t)
+
+	pgRequest := func(code uint32) string {
+		return string(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, postgresRequestLen), code))
+	}
+	pgStartup := string(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 23), 196608)) +
+		"user\x00postgres\x00\x00"
+	pgAuth := "R\x00\x00\x00\x08\x00\x00\x00\x00"
+
+	myGreeting := func(caps uint16) string {
+		b := append([]byte("\x0a8.0.36\x00"), 1, 0, 0, 0)
+		b = append(b, "abcdefgh\x00"...)
+		b = binary.LittleEndian.AppendUint16(b, caps)
+		return mysqlTestPacket(0, string(append(b, "\xff\x02\x00\xff\xdf\x15\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00ijklmnopqrst\x00"...)))
+	}
+	mySSLRequest := mysqlTestPacket(1, string(binary.LittleEndian.AppendUint32(nil, 0x8aa08|mysqlClientSSL))+
+		"\x00\x00\x00\x01\xff"+string(make([]byte, 23)))
+	myLogin := func(seq byte) string {
+		return mysqlTestPacket(seq, string(binary.LittleEndian.AppendUint32(nil, 0x8aa08))+
+			"\x00\x00\x00\x01\xff"+string(make([]byte, 23))+"root\x00\x00")
+	}
+	myOK := mysqlTestPacket(2, "\x00\x00\x00\x02\x00\x00\x00")
+
+	nntp := PatternStartTLS{Trigger: regexp.MustCompile(`(?mi)^STARTTLS\r?\n`), Accept: regexp.MustCompile(`(?m)^382`),
+		ServerFirst: true}
+	xmpp := PatternStartTLS{Trigger: regexp.MustCompile(`<starttls\s+xmlns=['"]urn:ietf:params:xml:ns:xmpp-tls['"]\s*/>`),
+		Accept: regexp.MustCompile(`<proceed\s+xmlns=['"]urn:ietf:params:xml:ns:xmpp-tls['"]\s*/>`)}
+
+	rdpCookie := "Cookie: mstshash=alice\r\n"
+
+	tests := []struct {
+		name  string
+		u     Upgrader
+		steps []upgradeStep // exchanged before ping and pong
+	}{
+		{name: "postgres accepted", u: PostgresStartTLS{}, steps: []upgradeStep{
+			{victim: true, data: pgRequest(postgresSSLRequest)},
+			{data: "S", tls: true},
+			{victim: true, data: pgStartup},
+			{data: pgAuth},
+		}},
+		{name: "postgres gssenc declined", u: PostgresStartTLS{}, steps: []upgradeStep{
+			{victim: true, data: pgRequest(postgresGSSENCRequest)},
+			{data: "N"},
+			{victim: true, data: pgRequest(postgresSSLRequest)},
+			{data: "S", tls: true},
+			{victim: true, data: pgStartup},
+			{data: pgAuth},
+		}},
+		{name: "postgres refused", u: PostgresStartTLS{}, steps: []upgradeStep{
+			{victim: true, data: pgRequest(postgresSSLRequest)},
+			{data: "N"},
+			{victim: true, data: pgStartup},
+			{data: pgAuth},
+		}},
+		{name: "postgres cleartext", u: PostgresStartTLS{}, steps: []upgradeStep{
+			{victim: true, data: pgStartup},
+			{data: pgAuth},
+		}},
+		{name: "mysql accepted", u: MySQLStartTLS{}, steps: []upgradeStep{
+			{data: myGreeting(0xffff)},
+			{victim: true, data: mySSLRequest, tls: true},
+			{victim: true, data: myLogin(2)},
+			{data: myOK},
+		}},
+		{name: "mysql declined by victim", u: MySQLStartTLS{}, steps: []upgradeStep{
+			{data: myGreeting(0xffff)},
+			{victim: true, data: myLogin(1)},
+			{data: myOK},
+		}},
+		{name: "mysql unsupported by downstream", u: MySQLStartTLS{}, steps: []upgradeStep{
+			{data: myGreeting(0xffff &^ mysqlClientSSL)},
+			{victim: true, data: myLogin(1)},
+			{data: myOK},
+		}},
+		{name: "ftp auth tls", u: FTPStartTLS{}, steps: []upgradeStep{
+			{data: "220-welcome\r\n220 ready\r\n"},
+			{victim: true, data: "FEAT\r\n"},
+			{data: "211-features\r\n AUTH TLS\r\n211 end\r\n"},
+			{victim: true, data: "AUTH TLS\r\n"},
+			{data: "234 proceed\r\n", tls: true},
+		}},
+		{name: "ftp cleartext", u: FTPStartTLS{}, steps: []upgradeStep{
+			{data: "220 ready\r\n"},
+			{victim: true, data: "USER a\r\n"},
+			{data: "331 password required\r\n"},
+		}},
+		{name: "nntp", u: nntp, steps: []upgradeStep{
+			{data: "200 news ready\r\n"},
+			{victim: true, data: "CAPABILITIES\r\n"},
+			{data: "101 capabilities\r\nVERSION 2\r\nSTARTTLS\r\n.\r\n"},
+			{victim: true, data: "STARTTLS\r\n"},
+			{data: "382 continue with tls negotiation\r\n", tls: true},
+		}},
+		{name: "nntp refused", u: nntp, steps: []upgradeStep{
+			{data: "200 news ready\r\n"},
+			{victim: true, data: "STARTTLS\r\n"},
+			{data: "580 can not initiate tls negotiation\r\n"},
+		}},
+		{name: "xmpp", u: xmpp, steps: []upgradeStep{
+			{victim: true, data: "<stream:stream to='a.test' version='1.0'>"},
+			{data: "<stream:stream from='a.test' version='1.0'><stream:features>" +
+				"<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'><required/></starttls></stream:features>"},
+			{victim: true, data: "<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>"},
+			{data: "<proceed xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>", tls: true},
+		}},
+		{name: "rdp tls", u: RDPStartTLS{}, steps: []upgradeStep{
+			{victim: true, data: rdpTestTPDU(x224ConnectionRequest, rdpCookie, rdpTestNeg(rdpNegReq, 0x03))},
+			{data: rdpTestTPDU(x224ConnectionConfirm, rdpTestNeg(rdpNegRsp, 0x02)), tls: true},
+		}},
+		// requests are captured as sent to the downstream
+		{name: "rdp strip nla", u: RDPStartTLS{StripNLA: true}, steps: []upgradeStep{
+			{victim: true, data: rdpTestTPDU(x224ConnectionRequest, rdpCookie, rdpTestNeg(rdpNegReq, 0x0b)),
+				relayed: rdpTestTPDU(x224ConnectionRequest, rdpCookie, rdpTestNeg(rdpNegReq, 0x01))},
+			{data: rdpTestTPDU(x224ConnectionConfirm, rdpTestNeg(rdpNegRsp, 0x01)), tls: true},
+		}},
+		{name: "rdp standard security", u: RDPStartTLS{StripNLA: true}, steps: []upgradeStep{
+			{victim: true, data: rdpTestTPDU(x224ConnectionRequest, rdpCookie)},
+			{data: rdpTestTPDU(x224ConnectionConfirm)},
+		}},
+		{name: "midstream hello after preamble", u: MidStreamTLS{}, steps: []upgradeStep{
+			{data: "READY\n"},
+			{victim: true, data: "AUTH guest\n"},
+			{victim: true, data: "UPGRADE\n", tls: true, hello: true},
+		}},
+		{name: "midstream hello after reply", u: MidStreamTLS{}, steps: []upgradeStep{
+			{victim: true, data: "UPGRADE\n"},
+			{data: "OK\n", tls: true},
+		}},
+		{name: "midstream cleartext resembling a record", u: MidStreamTLS{}, steps: []upgradeStep{
+			{victim: true, data: "abc\x16\x03"},
+			{data: "OK\n"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps := append(tt.steps, upgradeStep{victim: true, data: "ping\r\n"}, upgradeStep{data: "pong\r\n"})
+			var wantVictim, wantDownstream string
+			for i, s := range steps {
+				if s.relayed == "" {
+					s.relayed = s.data
+					steps[i] = s
+				}
+				if s.victim {
+					wantVictim += s.relayed
+				} else {
+					wantDownstream += s.relayed
+				}
+			}
+
+			dsCfg := &tls.Config{Certificates: []tls.Certificate{*crt}}
+			c, rec := startUpgradeProxy(t, crt, tt.u, func(c net.Conn) {
+				for _, s := range steps {
+					if !s.victim {
+						c.Write([]byte(s.data))
+					} else {
+						b := make([]byte, len(s.relayed))
+						if _, err := io.ReadFull(c, b); err != nil || string(b) != s.relayed {
+							t.Errorf("downstream received %q, %v, want %q", b, err, s.relayed)
+							return
+						}
+					}
+					if s.tls {
+						c = tls.Server(c, dsCfg)
+					}
+				}
+			})
+
+			for _, s := range steps {
+				switch {
+				case s.victim && s.hello:
+					c = upgradeTestHandshake(t, &prefixConn{Conn: c, prefix: []byte(s.data)})
+					continue
+				case s.victim:
+					if _, err := c.Write([]byte(s.data)); err != nil {
+						t.Fatal("failed to write to proxy", err)
+					}
+				default:
+					b := make([]byte, len(s.data))
+					if _, err := io.ReadFull(c, b); err != nil || string(b) != s.data {
+						t.Fatalf("victim received %q, %v, want %q", b, err, s.data)
+					}
+				}
+				if s.tls {
+					c = upgradeTestHandshake(t, c)
+				}
+			}
+			c.Close()
+
+			victim, downstream := capturedData(rec, 1)
+			if victim != wantVictim {
+				t.Errorf("victim data = %q, want %q", victim, wantVictim)
+			}
+			if downstream != wantDownstream {
+				t.Errorf("downstream data = %q, want %q", downstream, wantDownstream)
+			}
+		})
+	}
+}
+
+func TestAppendTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		buf, b string
+		n      int
+		want   string
+	}{
+		{name: "under limit", buf: "ab", b: "cd", n: 8, want: "abcd"},
+		{name: "at limit", buf: "ab", b: "cd", n: 4, want: "abcd"},
+		{name: "beginning discarded", buf: "abc", b: "def", n: 4, want: "cdef"},
+		{name: "longer than limit", b: "abcdef", n: 2, want: "ef"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := appendTail([]byte(tt.buf), []byte(tt.b), tt.n); string(got) != tt.want {
+				t.Errorf("appendTail() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package gosplit
+
+import (
+	"errors"
+	"io"
+	"maps"
+	"net"
+	"strings"
+)
+
+// Reasons used as keys of ServerStats.HandshakeFailures when a failed
+// handshake can't be attributed to a TLS alert.
+const (
+	HandshakeEOF     = "eof"     // the victim closed the connection
+	HandshakeTimeout = "timeout" // the handshake did not complete in time
+	HandshakeOther   = "other"   // any other failure
+)
+
+// ServerStats contains cumulative counters describing the connections
+// handled by a ProxyServer.
+//
+// Use ProxyServer.Stats to obtain a snapshot.
+type ServerStats struct {
+	// Accepted is the number of connections accepted from the listener,
+	// including those that were later rejected.
+	Accepted uint64 `json:"accepted"`
+	// Active is the number of connections currently being handled.
+	Active int `json:"active"`
+	// Closed is the number of handled connections that have ended.
+	Closed uint64 `json:"closed"`
+	// Rejected is the number of connections rejected by ConnLimiter
+	// or ConnFilter.
+	Rejected uint64 `json:"rejected"`
+	// Intercepted is the number of victim TLS handshakes that completed
+	// with the proxy.
+	Intercepted uint64 `json:"intercepted"`
+	// HandshakeFailures counts failed victim TLS handshakes by reason.
+	//
+	// The reason is the description of the TLS alert sent by the victim,
+	// e.g., "bad certificate", the description of the alert sent to the
+	// victim prefixed with "local: ", or one of HandshakeEOF,
+	// HandshakeTimeout, and HandshakeOther.
+	HandshakeFailures map[string]uint64 `json:"handshake_failures"`
+	// DialFailures is the number of failed connection attempts to
+	// downstreams.
+	DialFailures uint64 `json:"dial_failures"`
+	// VictimBytes is the number of bytes sent by victims to downstreams.
+	VictimBytes uint64 `json:"victim_bytes"`
+	// DownstreamBytes is the number of bytes sent by downstreams to
+	// victims.
+	DownstreamBytes uint64 `json:"downstream_bytes"`
+	// QueuedData is the number of data events waiting to be delivered
+	// to the DataReceiver.
+	QueuedData int `json:"queued_data"`
+}
+
+// Stats returns a snapshot of the server's counters.
+func (s *ProxyServer) Stats() (st ServerStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st = s.stats
+	st.HandshakeFailures = maps.Clone(s.stats.HandshakeFailures)
+	if st.HandshakeFailures == nil {
+		st.HandshakeFailures = make(map[string]uint64)
+	}
+	st.Active = int(s.connCount.Load())
+	// include bytes from active connections, which are added to the
+	// totals when the connections end
+	for c := range s.conns {
+		st.VictimBytes += uint64(c.counters.victim.Load())
+		st.DownstreamBytes += uint64(c.counters.downstream.Load())
+		st.QueuedData += c.dq.len()
+	}
+	return
+}
+
+// updateStats calls f with the server's counters while holding s.mu.
+func (s *ProxyServer) updateStats(f func(*ServerStats)) {
+	s.mu.Lock()
+	f(&s.stats)
+	s.mu.Unlock()
+}
+
+// recordHandshake records the outcome of a victim TLS handshake.
+func (s *ProxyServer) recordHandshake(err error) {
+	s.updateStats(func(st *ServerStats) {
+		if err == nil {
+			st.Intercepted++
+			return
+		}
+		if st.HandshakeFailures == nil {
+			st.HandshakeFailures = make(map[string]uint64)
+		}
+		st.HandshakeFailures[handshakeFailureReason(err)]++
+	})
+}
+
+// handshakeFailureReason determines the key of ServerStats.HandshakeFailures
+// for a handshake error.
+func handshakeFailureReason(err error) string {
+	var oE *net.OpError
+	var nE net.Error
+	if errors.As(err, &oE) && oE.Op == "remote error" {
+		// alerts received from the victim, e.g., "tls: bad certificate"
+		return strings.TrimPrefix(oE.Err.Error(), "tls: ")
+	} else if oE != nil && oE.Op == "local error" {
+		// alerts sent to the victim
+		return "local: " + strings.TrimPrefix(oE.Err.Error(), "tls: ")
+	} else if errors.Is(err, io.EOF) {
+		return HandshakeEOF
+	} else if errors.As(err, &nE) && nE.Timeout() {
+		return HandshakeTimeout
+	}
+	return HandshakeOther
+}
@@ -0,0 +1,178 @@
+package gosplit
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tlsCfg is a recordingCfg that intercepts TLS connections using crt.
+type tlsCfg struct {
+	*recordingCfg
+	crt *tls.Certificate
+}
+
+func (c tlsCfg) GetProxyTLSConfig(_ Addr, _ Addr, _ *Addr) (*tls.Config, error) {
+	return &tls.Config{Certificates: []tls.Certificate{*c.crt}}, nil
+}
+
+func (c tlsCfg) GetDownstreamTLSConfig(_ Addr, _ Addr, _ Addr) (*tls.Config, error) {
+	return &tls.Config{InsecureSkipVerify: true}, nil
+}
+
+func TestProxyServer_Stats(t *testing.T) {
+	crt, err := GenSelfSignedCert(pkix.Name{Organization: []string{"test"}}, nil, []string{"test.local"}, NewRSAPrivKey(2048))
+	if err != nil {
+		t.Fatal("failed to generate certificate", err)
+	}
+	dsCfg := &tls.Config{Certificates: []tls.Certificate{*crt}}
+	ds := startTestServer(t, func(c net.Conn) {
+		tC := tls.Server(c, dsCfg)
+		io.Copy(tC, tC)
+	})
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to start listener for server", err)
+	}
+	s := NewProxyServer(tlsCfg{recordingCfg: &recordingCfg{downstream: ds}, crt: crt}, l)
+	go s.Serve(context.Background())
+
+	// a victim that trusts the certificate
+	c, err := tls.Dial("tcp4", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal("failed to connect to proxy", err)
+	}
+	c.Write([]byte("hello"))
+	io.ReadFull(c, make([]byte, 5))
+	c.Close()
+
+	// a victim that rejects the certificate
+	if _, err = tls.Dial("tcp4", l.Addr().String(), &tls.Config{ServerName: "test.local"}); err == nil {
+		t.Fatal("expected victim handshake to fail")
+	}
+
+	// the failure is recorded once the proxy receives the victim's alert
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if len(s.Stats().HandshakeFailures) > 0 {
+			break
+		}
+	}
+
+	if err = s.Shutdown(context.Background()); err != nil {
+		t.Fatal("failed to shut down server", err)
+	}
+
+	st := s.Stats()
+	if st.Accepted != 2 || st.Closed != 2 || st.Active != 0 {
+		t.Errorf("Stats() accepted, closed, active = %d, %d, %d, want 2, 2, 0", st.Accepted, st.Closed, st.Active)
+	}
+	if st.Intercepted != 1 {
+		t.Errorf("Stats().Intercepted = %d, want 1", st.Intercepted)
+	}
+	if n := st.HandshakeFailures["bad certificate"]; n != 1 {
+		t.Errorf("Stats().HandshakeFailures = %v, want 1 bad certificate", st.HandshakeFailures)
+	}
+	if st.VictimBytes != 5 || st.DownstreamBytes != 5 {
+		t.Errorf("Stats() victim, downstream bytes = %d, %d, want 5, 5", st.VictimBytes, st.DownstreamBytes)
+	}
+}
+
+func TestHandshakeFailureReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "alert", err: &net.OpError{Op: "remote error", Err: errors.New("tls: unknown certificate authority")}, want: "unknown certificate authority"},
+		{name: "local alert", err: &net.OpError{Op: "local error", Err: errors.New("tls: bad record MAC")}, want: "local: bad record MAC"},
+		{name: "eof", err: fmt.Errorf("handshake: %w", io.EOF), want: HandshakeEOF},
+		{name: "timeout", err: &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, want: HandshakeTimeout},
+		{name: "other", err: errors.New("tls: client offered only unsupported versions"), want: HandshakeOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := handshakeFailureReason(tt.err); got != tt.want {
+				t.Errorf("handshakeFailureReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyServer_DownstreamFailures(t *testing.T) {
+	crt, err := GenSelfSignedCert(pkix.Name{Organization: []string{"test"}}, nil, []string{"test.local"}, nil)
+	if err != nil {
+		t.Fatal("failed to generate certificate", err)
+	}
+	// a port nothing listens on
+	closed, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := Addr{IP: "127.0.0.1", Port: fmt.Sprint(closed.Addr().(*net.TCPAddr).Port)}
+	closed.Close()
+
+	tests := []struct {
+		name             string
+		alpn             []string // offered by the victim
+		reachable        bool     // the downstream accepts connections, but not tls
+		wantHandshake    bool     // the victim's handshake succeeds
+		wantDialFailures uint64
+		wantDials        int
+	}{
+		{name: "unreachable", wantHandshake: true, wantDialFailures: 1},
+		{name: "unreachable while mirroring alpn", alpn: []string{"h2"}, wantHandshake: true, wantDialFailures: 1},
+		{name: "tls failure while mirroring alpn", alpn: []string{"h2"}, reachable: true, wantDials: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := unreachable
+			var (
+				m     sync.Mutex
+				dials int
+			)
+			if tt.reachable {
+				ds = startTestServer(t, func(c net.Conn) {
+					m.Lock()
+					dials++
+					m.Unlock()
+				})
+			}
+			l, err := net.Listen("tcp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal("failed to start listener for server", err)
+			}
+			s := NewProxyServer(tlsCfg{recordingCfg: &recordingCfg{downstream: ds}, crt: crt}, l)
+			go s.Serve(context.Background())
+
+			c, err := tls.Dial("tcp4", l.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: tt.alpn})
+			if (err == nil) != tt.wantHandshake {
+				t.Errorf("victim handshake error = %v, want success %v", err, tt.wantHandshake)
+			}
+			if err == nil {
+				c.Write([]byte("hello"))
+				c.Close()
+			}
+			if err = s.Shutdown(context.Background()); err != nil {
+				t.Fatal("failed to shut down server", err)
+			}
+
+			if st := s.Stats(); st.DialFailures != tt.wantDialFailures {
+				t.Errorf("Stats().DialFailures = %d, want %d", st.DialFailures, tt.wantDialFailures)
+			}
+			m.Lock()
+			defer m.Unlock()
+			if dials != tt.wantDials {
+				t.Errorf("downstream accepted %d connections, want %d", dials, tt.wantDials)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package gosplit
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	WebSocketContinuation WebSocketOpcode = 0x0
+	WebSocketText         WebSocketOpcode = 0x1
+	WebSocketBinary       WebSocketOpcode = 0x2
+	WebSocketClose        WebSocketOpcode = 0x8
+	WebSocketPing         WebSocketOpcode = 0x9
+	WebSocketPong         WebSocketOpcode = 0xa
+
+	// webSocketWindow is the largest window used by permessage-deflate.
+	webSocketWindow = 32 << 10
+)
+
+var errWebSocketFrame = errors.New("malformed websocket frame")
+
+type (
+	// WebSocketOpcode identifies the type of a WebSocket message.
+	WebSocketOpcode byte
+
+	// WebSocketMessage is a message sent over a WebSocket, after
+	// reassembling fragmented messages.
+	WebSocketMessage struct {
+		// Victim indicates that the message was sent by the victim.
+		Victim bool            `json:"victim"`
+		Opcode WebSocketOpcode `json:"opcode"`
+		// Data is the unmasked payload of the message, decompressed when
+		// the message was compressed using permessage-deflate. Data is
+		// left compressed when it can't be decompressed.
+		Data []byte `json:"data,omitempty"`
+		// Compressed indicates that the message was compressed.
+		Compressed bool `json:"compressed,omitempty"`
+		// Time the first frame of the message was captured.
+		Time     time.Time `json:"time"`
+		ConnInfo `json:"conn_info"`
+	}
+
+	// webSocketConn is the WebSocket state of a connection observed by
+	// an HTTPParser.
+	webSocketConn struct {
+		cI         ConnInfo
+		at         time.Time // capture time of the data being added
+		deflate    bool      // permessage-deflate was negotiated
+		victim     webSocketSide
+		downstream webSocketSide
+	}
+
+	// webSocketSide is the state of the frames sent by one side of a
+	// WebSocket.
+	webSocketSide struct {
+		b []byte // unparsed frames
+		// msg is the fragmented message in progress, if any
+		msg     *WebSocketMessage
+		payload []byte
+		// window holds the most recent decompressed data, which later
+		// messages may refer to unless context takeover is disabled
+		window    []byte
+		noContext bool
+	}
+)
+
+func (o WebSocketOpcode) String() string {
+	switch o {
+	case WebSocketContinuation:
+		return "continuation"
+	case WebSocketText:
+		return "text"
+	case WebSocketBinary:
+		return "binary"
+	case WebSocketClose:
+		return "close"
+	case WebSocketPing:
+		return "ping"
+	case WebSocketPong:
+		return "pong"
+	}
+	return "opcode " + strconv.Itoa(int(o))
+}
+
+// isWebSocketUpgrade determines if resp accepted an upgrade to a
+// WebSocket.
+func isWebSocketUpgrade(resp *HTTPResponse) bool {
+	return resp.StatusCode == http.StatusSwitchingProtocols &&
+		strings.EqualFold(strings.TrimSpace(resp.Header.Get("Upgrade")), "websocket")
+}
+
+// newWebSocketConn initializes the state of a WebSocket using the
+// extensions accepted by the downstream's handshake response.
+func newWebSocketConn(cI ConnInfo, h http.Header) *webSocketConn {
+	c := &webSocketConn{cI: cI}
+	for _, v := range h.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(v, ",") {
+			params := strings.Split(ext, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), "permessage-deflate") {
+				continue
+			}
+			c.deflate = true
+			for _, p := range params[1:] {
+				switch strings.ToLower(strings.TrimSpace(p)) {
+				case "client_no_context_takeover":
+					c.victim.noContext = true
+				case "server_no_context_takeover":
+					c.downstream.noContext = true
+				}
+			}
+		}
+	}
+	return c
+}
+
+// add frames sent by the victim or downstream, returning the messages
+// they complete.
+func (c *webSocketConn) add(victim bool, at time.Time, b []byte) (msgs []WebSocketMessage, err error) {
+	c.at = at
+	side := &c.downstream
+	if victim {
+		side = &c.victim
+	}
+	side.b = append(side.b, b...)
+	for {
+		var n int
+		if n, msgs, err = c.frame(msgs, victim, side.b); err != nil || n == 0 {
+			break
+		}
+		side.b = side.b[n:]
+	}
+	if err == nil && len(side.b)+len(side.payload) > maxHTTPBuffer {
+		err = errors.New("websocket message exceeds buffer")
+	}
+	return
+}
+
+// buffered returns the number of bytes held by the connection's state.
+func (c *webSocketConn) buffered() int {
+	return len(c.victim.b) + len(c.victim.payload) + len(c.victim.window) +
+		len(c.downstream.b) + len(c.downstream.payload) + len(c.downstream.window)
+}
+
+// frame parses the frame at the start of b, returning its length, or
+// zero when it is incomplete.
+func (c *webSocketConn) frame(msgs []WebSocketMessage, victim bool, b []byte) (int, []WebSocketMessage, error) {
+	if len(b) < 2 {
+		return 0, msgs, nil
+	}
+	fin, rsv1, opcode := b[0]&0x80 != 0, b[0]&0x40 != 0, WebSocketOpcode(b[0]&0xf)
+	masked, l, n := b[1]&0x80 != 0, uint64(b[1]&0x7f), 2
+	switch l {
+	case 126:
+		if len(b) < n+2 {
+			return 0, msgs, nil
+		}
+		l, n = uint64(binary.BigEndian.Uint16(b[n:])), n+2
+	case 127:
+		if len(b) < n+8 {
+			return 0, msgs, nil
+		}
+		l, n = binary.BigEndian.Uint64(b[n:]), n+8
+	}
+	var mask []byte
+	if masked {
+		if len(b) < n+4 {
+			return 0, msgs, nil
+		}
+		mask, n = b[n:n+4], n+4
+	}
+	if l > maxHTTPBuffer {
+		return 0, msgs, errors.New("websocket frame exceeds buffer")
+	} else if uint64(len(b)-n) < l {
+		return 0, msgs, nil
+	}
+	payload := append([]byte(nil), b[n:n+int(l)]...)
+	if mask != nil {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	n += int(l)
+
+	side := &c.downstream
+	if victim {
+		side = &c.victim
+	}
+	switch {
+	case opcode > WebSocketBinary && opcode < WebSocketClose || opcode > WebSocketPong:
+		return 0, msgs, errWebSocketFrame
+	case opcode >= WebSocketClose:
+		// control frames may be interleaved with fragments
+		if !fin {
+			return 0, msgs, errWebSocketFrame
+		}
+		return n, append(msgs, WebSocketMessage{Victim: victim, Opcode: opcode, Data: payload,
+			Time: c.at, ConnInfo: c.cI}), nil
+	case opcode == WebSocketContinuation:
+		if side.msg == nil {
+			return 0, msgs, errWebSocketFrame
+		}
+	default:
+		if side.msg != nil {
+			return 0, msgs, errWebSocketFrame
+		}
+		side.msg = &WebSocketMessage{Victim: victim, Opcode: opcode, Compressed: c.deflate && rsv1,
+			Time: c.at, ConnInfo: c.cI}
+	}
+	side.payload = append(side.payload, payload...)
+	if fin {
+		m := *side.msg
+		m.Data = side.payload
+		if m.Compressed {
+			m.Data = side.inflate(side.payload)
+		}
+		msgs = append(msgs, m)
+		side.msg, side.payload = nil, nil
+	}
+	return n, msgs, nil
+}
+
+// inflate decompresses a message compressed using permessage-deflate,
+// returning b when it can't be decompressed.
+func (s *webSocketSide) inflate(b []byte) []byte {
+	if s.noContext {
+		s.window = nil
+	}
+	// messages are flushed, omitting the trailer of the empty stored
+	// block that ends the flush
+	r := flate.NewReaderDict(io.MultiReader(bytes.NewReader(b), bytes.NewReader([]byte{0, 0, 0xff, 0xff})), s.window)
+	var out bytes.Buffer
+	_, err := io.Copy(&out, io.LimitReader(r, maxHTTPBuffer))
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		// the window no longer reflects the compressor's
+		s.window = nil
+		return b
+	}
+	s.window = append(s.window, out.Bytes()...)
+	if len(s.window) > webSocketWindow {
+		s.window = append([]byte(nil), s.window[len(s.window)-webSocketWindow:]...)
+	}
+	return out.Bytes()
+}
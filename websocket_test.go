@@ -0,0 +1,133 @@
+package gosplit
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// webSocketTestFrame encodes a frame, masking the payload when mask is
+// set as clients must.
+func webSocketTestFrame(fin, rsv1 bool, opcode WebSocketOpcode, mask []byte, payload []byte) string {
+	b := []byte{byte(opcode), 0}
+	if fin {
+		b[0] |= 0x80
+	}
+	if rsv1 {
+		b[0] |= 0x40
+	}
+	switch {
+	case len(payload) < 126:
+		b[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		b[1] = 126
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	default:
+		b[1] = 127
+		b = binary.BigEndian.AppendUint64(b, uint64(len(payload)))
+	}
+	if mask != nil {
+		b[1] |= 0x80
+		b = append(b, mask...)
+	}
+	for i, c := range payload {
+		if mask != nil {
+			c ^= mask[i%4]
+		}
+		b = append(b, c)
+	}
+	return string(b)
+}
+
+// webSocketTestDeflate compresses a message using w, which retains its
+// window between messages, as permessage-deflate does.
+func webSocketTestDeflate(t *testing.T, w *flate.Writer, buf *bytes.Buffer, s string) []byte {
+	buf.Reset()
+	if _, err := w.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	} else if err = w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), bytes.TrimSuffix(buf.Bytes(), []byte{0, 0, 0xff, 0xff})...)
+}
+
+func TestHTTPParser_WebSocket(t *testing.T) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second message refers to the first
+	deflated1 := webSocketTestDeflate(t, fw, &buf, "hello compressed world")
+	deflated2 := webSocketTestDeflate(t, fw, &buf, "hello compressed world")
+	mask := []byte{1, 2, 3, 4}
+	long := bytes.Repeat([]byte("a"), 300)
+
+	type msg struct {
+		victim     bool
+		opcode     WebSocketOpcode
+		data       string
+		compressed bool
+	}
+	chunks := []struct {
+		victim bool
+		data   string
+	}{
+		{true, "GET /ws HTTP/1.1\r\nHost: a.test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n\r\n"},
+		// frames sent along with the handshake response
+		{false, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Extensions: permessage-deflate; client_no_context_takeover\r\n\r\n" +
+			webSocketTestFrame(true, false, WebSocketText, nil, []byte("hi"))},
+		{true, webSocketTestFrame(true, false, WebSocketText, mask, []byte("masked"))[:5]},
+		{true, webSocketTestFrame(true, false, WebSocketText, mask, []byte("masked"))[5:]},
+		// fragments with an interleaved control frame
+		{true, webSocketTestFrame(false, false, WebSocketBinary, mask, long[:200]) +
+			webSocketTestFrame(true, false, WebSocketPing, mask, []byte("p")) +
+			webSocketTestFrame(true, false, WebSocketContinuation, mask, long[200:])},
+		{false, webSocketTestFrame(true, true, WebSocketText, nil, deflated1) +
+			webSocketTestFrame(true, true, WebSocketText, nil, deflated2)},
+		{false, webSocketTestFrame(true, false, WebSocketClose, nil, []byte{3, 0xe8})},
+	}
+	want := []msg{
+		{opcode: WebSocketText, data: "hi"},
+		{victim: true, opcode: WebSocketText, data: "masked"},
+		{victim: true, opcode: WebSocketPing, data: "p"},
+		{victim: true, opcode: WebSocketBinary, data: string(long)},
+		{opcode: WebSocketText, data: "hello compressed world", compressed: true},
+		{opcode: WebSocketText, data: "hello compressed world", compressed: true},
+		{opcode: WebSocketClose, data: "\x03\xe8"},
+	}
+
+	var (
+		got       []msg
+		exchanges int
+	)
+	p := NewHTTPParser(func(x HTTPExchange) {
+		if len(got) > 0 {
+			t.Error("exchange received after websocket messages")
+		}
+		exchanges++
+	})
+	p.RecvWebSocket = func(m WebSocketMessage) {
+		got = append(got, msg{victim: m.Victim, opcode: m.Opcode, data: string(m.Data), compressed: m.Compressed})
+	}
+	cI := ConnInfo{ID: 1}
+	for _, c := range chunks {
+		if c.victim {
+			p.RecvVictimData(cI, []byte(c.data))
+		} else {
+			p.RecvDownstreamData(cI, []byte(c.data))
+		}
+	}
+	p.RecvConnEnd(cI)
+
+	if exchanges != 1 {
+		t.Errorf("received %d exchanges, want 1", exchanges)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+}